@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aiDescriptorVersion is part of every cache key. Bump it when the
+// descriptor's fields or their meaning change, which invalidates all
+// cached results.
+const aiDescriptorVersion = 2
+
+// AIRequestDescriptor is the canonical form of an AI call: everything that
+// can change the provider's answer. Providers are called with the AIRequest
+// built from it (see Request), and its hash is the cache key, so a parameter
+// cannot reach a provider without also keying the cache. New AIRequest
+// fields must be added here.
+type AIRequestDescriptor struct {
+	Version   int    `json:"v"`
+	Operation string `json:"op"`
+	// PromptVersion identifies the operation's prompt template. Bump it when
+	// the template changes in a way the rendered prompt does not show, e.g.
+	// the meaning of a system prompt.
+	PromptVersion int `json:"prompt_version"`
+	// Model is the first model of the chain. Results from fallback models
+	// are cached under it too.
+	Model     string      `json:"model"`
+	System    string      `json:"system,omitempty"`
+	Messages  []AIMessage `json:"messages"`
+	MaxTokens int         `json:"max_tokens,omitempty"`
+}
+
+// Request builds the provider request for model, which may be a fallback
+// model rather than d.Model
+func (d *AIRequestDescriptor) Request(model string) AIRequest {
+	return AIRequest{
+		Model:     model,
+		System:    d.System,
+		Messages:  append([]AIMessage(nil), d.Messages...),
+		MaxTokens: d.MaxTokens,
+	}
+}
+
+// cacheKeyNames holds the name an operation's cache keys use where it is not
+// the operation name. Summaries were cached under "ai:summary:" before
+// operations existed; keeping the prefix keeps prefix invalidation and
+// existing tooling working for them.
+var cacheKeyNames = map[string]string{"summarize": "summary"}
+
+// CacheKey returns "ai:<name>:" and the SHA-256 of the descriptor's JSON
+// encoding, where name is the operation name unless cacheKeyNames renames
+// it. Struct fields encode in a fixed order, so equal descriptors always
+// produce the same key.
+func (d *AIRequestDescriptor) CacheKey() string {
+	data, err := json.Marshal(d)
+	if err != nil {
+		// Strings, ints and slices of them always encode
+		panic(fmt.Sprintf("encode AI request descriptor: %v", err))
+	}
+	hash := sha256.Sum256(data)
+	return cacheKeyForHash(d.Operation, hex.EncodeToString(hash[:]))
+}
+
+// cacheKeyForHash returns the cache key of operation's descriptor hash
+func cacheKeyForHash(operation, hash string) string {
+	if renamed, ok := cacheKeyNames[operation]; ok {
+		operation = renamed
+	}
+	return cacheKeyPrefix + operation + ":" + hash
+}
+
+// AIOperation is an AI task served by a paid route
+type AIOperation struct {
+	Name string
+	// Describe validates a request body and builds its descriptor. Errors
+	// are *invalidAIRequestError and answered with 400.
+	Describe func(body []byte) (*AIRequestDescriptor, error)
+}
+
+// invalidAIRequestError rejects a request body an operation cannot serve
+type invalidAIRequestError struct {
+	title   string
+	message string
+}
+
+func (e *invalidAIRequestError) Error() string { return e.title + ": " + e.message }
+
+// respondInvalidAIRequest sends the 400 for a Describe error
+func respondInvalidAIRequest(c *gin.Context, err error) {
+	if invalid, ok := err.(*invalidAIRequestError); ok {
+		c.JSON(400, gin.H{"error": invalid.title, "message": invalid.message})
+		return
+	}
+	c.JSON(400, gin.H{"error": "Invalid request", "message": err.Error()})
+}
+
+// aiOperations maps AI routes to their operation. CacheMiddleware caches
+// only routes listed here.
+var aiOperations = map[string]*AIOperation{
+	routeKey("POST", "/api/ai/summarize"): summarizeOperation,
+}
+
+// lookupAIOperation returns the operation of the matched route, or nil
+func lookupAIOperation(c *gin.Context) *AIOperation {
+	return aiOperations[routeKey(c.Request.Method, c.FullPath())]
+}
+
+// describeAIRequest returns the descriptor CacheMiddleware built for this
+// request, or builds it from body, so the handler calls the provider with
+// exactly what the cache key covers
+func describeAIRequest(c *gin.Context, op *AIOperation, body []byte) (*AIRequestDescriptor, error) {
+	if desc, ok := c.Get("ai_descriptor"); ok {
+		return desc.(*AIRequestDescriptor), nil
+	}
+	desc, err := op.Describe(body)
+	if err != nil {
+		return nil, err
+	}
+	c.Set("ai_descriptor", desc)
+	return desc, nil
+}
+
+// summarizeOperation asks for a two-sentence summary of the body's text
+var summarizeOperation = &AIOperation{Name: "summarize", Describe: describeSummarizeBody}
+
+// summarizePromptVersion is the version of the summary prompt template
+const summarizePromptVersion = 1
+
+func describeSummarizeBody(body []byte) (*AIRequestDescriptor, error) {
+	var req SummarizeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, &invalidAIRequestError{"Invalid request body", "Request must be valid JSON"}
+	}
+	if req.Text == "" {
+		return nil, &invalidAIRequestError{"Invalid request", "text field cannot be empty"}
+	}
+	return describeSummary(getOpenRouterModel(), req.Text), nil
+}
+
+// describeSummary builds the two-sentence summary prompt for text
+func describeSummary(model, text string) *AIRequestDescriptor {
+	return &AIRequestDescriptor{
+		Version:       aiDescriptorVersion,
+		Operation:     "summarize",
+		PromptVersion: summarizePromptVersion,
+		Model:         model,
+		Messages: []AIMessage{
+			{Role: "user", Content: fmt.Sprintf("Summarize this text in 2 sentences: %s", text)},
+		},
+	}
+}
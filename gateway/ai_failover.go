@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrEmptyCompletion is returned when a provider answers 200 without any
+// choices. It is retryable: the same prompt usually succeeds on a retry or
+// on another model.
+var ErrEmptyCompletion = errors.New("invalid response from AI provider: no choices")
+
+// RetryPolicy controls retries and failover for AI calls
+type RetryPolicy struct {
+	// MaxRetries is the number of retries per model after the first attempt
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry; it doubles each retry
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff
+	MaxDelay time.Duration
+	// AttemptTimeout bounds a single provider call. Attempts never outlive
+	// the request deadline set by AI_REQUEST_TIMEOUT_SECONDS.
+	AttemptTimeout time.Duration
+}
+
+// getRetryPolicy reads the retry policy from the environment
+func getRetryPolicy() RetryPolicy {
+	maxRetries := getEnvAsInt("AI_MAX_RETRIES", 2)
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	return RetryPolicy{
+		MaxRetries:     maxRetries,
+		BaseDelay:      time.Duration(getEnvAsInt("AI_RETRY_BASE_DELAY_MS", 250)) * time.Millisecond,
+		MaxDelay:       time.Duration(getEnvAsInt("AI_RETRY_MAX_DELAY_MS", 2000)) * time.Millisecond,
+		AttemptTimeout: getAIAttemptTimeout(),
+	}
+}
+
+// backoff returns the delay before the given retry (1-based): exponential
+// with "equal jitter", i.e. uniformly random in [d/2, d].
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// getModelChain returns OPENROUTER_MODEL followed by the comma-separated
+// AI_FALLBACK_MODELS, in order and without duplicates. Each model is served
+// by the provider AI_PROVIDERS_CONFIG assigns to it.
+func getModelChain() []string {
+	chain := []string{getOpenRouterModel()}
+	seen := map[string]bool{chain[0]: true}
+	for _, model := range strings.Split(os.Getenv("AI_FALLBACK_MODELS"), ",") {
+		model = strings.TrimSpace(model)
+		if model != "" && !seen[model] {
+			chain = append(chain, model)
+			seen[model] = true
+		}
+	}
+	return chain
+}
+
+// nonRetryableError marks an error that must not be retried, e.g. a stream
+// that already sent content to the client
+type nonRetryableError struct{ err error }
+
+func (e *nonRetryableError) Error() string { return e.err.Error() }
+func (e *nonRetryableError) Unwrap() error { return e.err }
+
+// isRetryableAIError reports whether err is worth retrying or failing over:
+// 429 and 5xx responses, empty completions, per-attempt timeouts and
+// transport errors. Other 4xx responses are the request's fault and are not.
+func isRetryableAIError(err error) bool {
+	var permanent *nonRetryableError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		return perr.StatusCode == http.StatusTooManyRequests || perr.StatusCode >= 500
+	}
+	return true
+}
+
+// aiCallOutcome classifies a failed attempt for the provider's circuit
+// breaker. Errors that are the request's fault say nothing about the
+// provider's health.
+func aiCallOutcome(err error) callOutcome {
+	var perr *ProviderError
+	if errors.As(err, &perr) && perr.StatusCode < 500 && perr.StatusCode != http.StatusTooManyRequests {
+		return callIgnored
+	}
+	return callFailed
+}
+
+// aiAttempt performs one provider call for req
+type aiAttempt func(ctx context.Context, provider AIProvider, req AIRequest) (*AIResponse, error)
+
+// callWithFailover runs attempt along the model chain. Each model is tried up
+// to 1+MaxRetries times with backoff before moving to the next one. All
+// attempts share ctx's deadline; a retry is skipped when its backoff would
+// overrun it. Models whose provider's circuit breaker is open or whose
+// concurrency limit is reached are skipped.
+func callWithFailover(ctx context.Context, desc *AIRequestDescriptor, attempt aiAttempt) (resp *AIResponse, err error) {
+	ctx, span := startSpan(ctx, "callAI")
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.String("ai.model", resp.Model), attribute.String("ai.provider", resp.Provider))
+		}
+		endSpan(span, err)
+	}()
+
+	policy := getRetryPolicy()
+	var lastErr error
+
+	for _, model := range getModelChain() {
+		provider, err := aiProviders.ForModel(model)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for try := 0; try <= policy.MaxRetries; try++ {
+			if try > 0 && !sleepWithinDeadline(ctx, policy.backoff(try)) {
+				return nil, lastErr
+			}
+
+			var resp *AIResponse
+			err := aiGuard(provider).run(func() error {
+				var err error
+				resp, err = callAttempt(ctx, policy.AttemptTimeout, provider, desc.Request(model), attempt)
+				return err
+			}, func(err error) callOutcome {
+				if ctx.Err() != nil {
+					return callIgnored
+				}
+				return aiCallOutcome(err)
+			})
+			if err == nil {
+				if model != getOpenRouterModel() {
+					log.Printf("AI request served by fallback model %s via %s", model, provider.Name())
+				}
+				return resp, nil
+			}
+			lastErr = err
+
+			if ctx.Err() != nil {
+				// The overall AI budget is spent or the client went away
+				return nil, ctx.Err()
+			}
+			var unavailable *DependencyUnavailableError
+			if errors.As(err, &unavailable) {
+				// Fail over without waiting on a provider that is known to be down
+				log.Printf("Skipping model %s: %v", model, err)
+				break
+			}
+			if !isRetryableAIError(err) {
+				return nil, err
+			}
+			log.Printf("AI attempt %d for model %s via %s failed: %v", try+1, model, provider.Name(), err)
+		}
+	}
+	return nil, lastErr
+}
+
+// callAttempt runs one attempt under its own timeout
+func callAttempt(ctx context.Context, timeout time.Duration, provider AIProvider, req AIRequest, attempt aiAttempt) (*AIResponse, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, span := startSpan(ctx, "aiAttempt", attribute.String("ai.provider", provider.Name()), attribute.String("ai.model", req.Model))
+	start := time.Now()
+	resp, err := attempt(ctx, provider, req)
+	aiRequestDuration.WithLabelValues(provider.Name(), req.Model, upstreamOutcome(err)).Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	return resp, err
+}
+
+// sleepWithinDeadline waits for d unless that would pass ctx's deadline or
+// ctx is cancelled first. It reports whether the wait completed.
+func sleepWithinDeadline(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
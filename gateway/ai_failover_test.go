@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeAIServer answers chat completions by model using handlers[model], which
+// receives the 1-based call count for that model
+type fakeAIServer struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	handlers map[string]func(w http.ResponseWriter, call int)
+}
+
+func newFakeAIServer(t *testing.T, handlers map[string]func(w http.ResponseWriter, call int)) (*fakeAIServer, *httptest.Server) {
+	f := &fakeAIServer{calls: map[string]int{}, handlers: handlers}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body openAIChatRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.calls[body.Model]++
+		call := f.calls[body.Model]
+		f.mu.Unlock()
+		handler, ok := f.handlers[body.Model]
+		if !ok {
+			t.Errorf("unexpected model %s", body.Model)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler(w, call)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OPENROUTER_URL", server.URL)
+	t.Setenv("OPENROUTER_API_KEY", "test")
+	t.Setenv("AI_RETRY_BASE_DELAY_MS", "1")
+	t.Setenv("AI_RETRY_MAX_DELAY_MS", "5")
+	return f, server
+}
+
+func (f *fakeAIServer) count(model string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[model]
+}
+
+func reply(content string) func(w http.ResponseWriter, call int) {
+	return func(w http.ResponseWriter, call int) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"` + content + `"}}]}`))
+	}
+}
+
+func status(code int) func(w http.ResponseWriter, call int) {
+	return func(w http.ResponseWriter, call int) { w.WriteHeader(code) }
+}
+
+func TestCallAI_RetriesRetryableErrors(t *testing.T) {
+	fake, _ := newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary": func(w http.ResponseWriter, call int) {
+			switch call {
+			case 1:
+				w.WriteHeader(http.StatusTooManyRequests)
+			case 2:
+				w.Write([]byte(`{"choices":[]}`))
+			default:
+				reply("ok")(w, call)
+			}
+		},
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+
+	resp, err := callAI(context.Background(), describeSummary(getOpenRouterModel(), "text"))
+	if err != nil {
+		t.Fatalf("callAI failed: %v", err)
+	}
+	if resp.Content != "ok" || fake.count("primary") != 3 {
+		t.Errorf("expected success on third attempt, got %+v after %d calls", resp, fake.count("primary"))
+	}
+}
+
+func TestCallAI_FailsOverToNextModel(t *testing.T) {
+	fake, _ := newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary":  status(http.StatusServiceUnavailable),
+		"fallback": reply("from fallback"),
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("AI_FALLBACK_MODELS", "fallback")
+	t.Setenv("AI_MAX_RETRIES", "1")
+
+	resp, err := callAI(context.Background(), describeSummary(getOpenRouterModel(), "text"))
+	if err != nil {
+		t.Fatalf("callAI failed: %v", err)
+	}
+	if resp.Model != "fallback" || resp.Content != "from fallback" {
+		t.Errorf("expected fallback model to serve, got %+v", resp)
+	}
+	if fake.count("primary") != 2 {
+		t.Errorf("expected primary to be tried 1+AI_MAX_RETRIES times, got %d", fake.count("primary"))
+	}
+}
+
+func TestCallAI_DoesNotRetryClientErrors(t *testing.T) {
+	fake, _ := newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary":  status(http.StatusBadRequest),
+		"fallback": reply("unused"),
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("AI_FALLBACK_MODELS", "fallback")
+
+	_, err := callAI(context.Background(), describeSummary(getOpenRouterModel(), "text"))
+	var perr *ProviderError
+	if !errors.As(err, &perr) || perr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the 400 to be returned, got %v", err)
+	}
+	if fake.count("primary") != 1 || fake.count("fallback") != 0 {
+		t.Errorf("400 should neither retry nor fail over (primary=%d fallback=%d)", fake.count("primary"), fake.count("fallback"))
+	}
+}
+
+func TestCallAI_PerAttemptTimeoutStaysWithinBudget(t *testing.T) {
+	fake, _ := newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary": func(w http.ResponseWriter, call int) {
+			if call == 1 {
+				time.Sleep(3 * time.Second)
+			}
+			reply("second try")(w, call)
+		},
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("AI_ATTEMPT_TIMEOUT_SECONDS", "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resp, err := callAI(ctx, describeSummary(getOpenRouterModel(), "text"))
+	if err != nil {
+		t.Fatalf("callAI failed: %v", err)
+	}
+	if resp.Content != "second try" || fake.count("primary") != 2 {
+		t.Errorf("expected the hung attempt to be abandoned and retried, got %+v", resp)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("attempt timeout not applied, took %v", elapsed)
+	}
+}
+
+func TestCallAI_BudgetExhaustedReturnsDeadline(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary": func(w http.ResponseWriter, call int) {
+			time.Sleep(2 * time.Second)
+			reply("late")(w, call)
+		},
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := callAI(ctx, describeSummary(getOpenRouterModel(), "text")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestCallAIStream_NoRetryAfterContentSent(t *testing.T) {
+	fake, _ := newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary": func(w http.ResponseWriter, call int) {
+			w.Write([]byte(`data: {"choices":[{"delta":{"content":"partial"}}]}` + "\n\ndata: {not json\n\n"))
+		},
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+
+	var deltas []string
+	_, err := callAIStream(context.Background(), describeSummary(getOpenRouterModel(), "text"), func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected stream error")
+	}
+	if fake.count("primary") != 1 || len(deltas) != 1 {
+		t.Errorf("stream must not be retried after content was sent (calls=%d deltas=%v)", fake.count("primary"), deltas)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	bounds := map[int][2]time.Duration{
+		1: {50 * time.Millisecond, 100 * time.Millisecond},
+		2: {100 * time.Millisecond, 200 * time.Millisecond},
+		5: {150 * time.Millisecond, 300 * time.Millisecond},
+	}
+	for retry, b := range bounds {
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(retry); d < b[0] || d > b[1] {
+				t.Errorf("backoff(%d) = %v, want within %v", retry, d, b)
+			}
+		}
+	}
+}
+
+func TestGetModelChain(t *testing.T) {
+	t.Setenv("OPENROUTER_MODEL", "a")
+	t.Setenv("AI_FALLBACK_MODELS", " b, a ,,c ")
+	if got := strings.Join(getModelChain(), ","); got != "a,b,c" {
+		t.Errorf("getModelChain() = %s, want a,b,c", got)
+	}
+}
+
+func TestHandleSummarize_RecordsServingModel(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary":  status(http.StatusBadGateway),
+		"fallback": reply("summary"),
+	})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("AI_FALLBACK_MODELS", "fallback")
+	t.Setenv("AI_MAX_RETRIES", "0")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"0xabc","error":""}`))
+	}))
+	defer verifier.Close()
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	nonce := "nonce-failover-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := nonceStore.Issue(context.Background(), nonce, time.Minute); err != nil {
+		t.Fatalf("failed to issue nonce: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"hello"}`))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 after failover, got %d body=%s", w.Code, w.Body.String())
+	}
+	var body struct{ Result, Model string }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Model != "fallback" {
+		t.Errorf("expected response to name the fallback model, got %+v", body)
+	}
+
+	receiptJSON, _ := base64.StdEncoding.DecodeString(w.Header().Get("X-402-Receipt"))
+	var receipt SignedReceipt
+	json.Unmarshal(receiptJSON, &receipt)
+	if receipt.Receipt.Service.Model != "fallback" {
+		t.Errorf("expected receipt to record the fallback model, got %q", receipt.Receipt.Service.Model)
+	}
+	if receipt.Receipt.Service.ResponseHash != hashData(w.Body.Bytes()) {
+		t.Error("response_hash should still cover the body including the model field")
+	}
+}
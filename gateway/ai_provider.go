@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AIMessage is a single chat message sent to a provider
+type AIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// AIRequest is a provider-neutral completion request
+type AIRequest struct {
+	Model     string
+	System    string
+	Messages  []AIMessage
+	MaxTokens int
+}
+
+// AIUsage reports token consumption as returned by the provider
+type AIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// AIResponse is a provider-neutral completion result
+type AIResponse struct {
+	Content  string
+	Model    string
+	Provider string
+	Usage    AIUsage
+}
+
+// AIProvider is implemented by every AI backend the gateway can call
+type AIProvider interface {
+	// Name identifies the provider in logs and errors
+	Name() string
+	// Complete runs a single chat completion. Implementations must honor ctx
+	// cancellation and return context.DeadlineExceeded on timeout.
+	Complete(ctx context.Context, req AIRequest) (*AIResponse, error)
+}
+
+// StreamingAIProvider is implemented by providers that can stream a
+// completion as it is generated
+type StreamingAIProvider interface {
+	AIProvider
+	// Stream runs a completion, calling onDelta with each content chunk as it
+	// arrives. The returned response carries the full concatenated content.
+	// An error from onDelta aborts the stream and is returned as is.
+	Stream(ctx context.Context, req AIRequest, onDelta func(string) error) (*AIResponse, error)
+}
+
+// ProviderError is returned when a provider answers with a non-2xx status
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// defaultMaxTokens is used when a request does not set MaxTokens but the
+// provider API requires it (Anthropic)
+const defaultMaxTokens = 1024
+
+// maxProviderErrorBody caps how much of an error body is kept in ProviderError
+const maxProviderErrorBody = 512
+
+// postJSON sends body as JSON to url and decodes a 2xx JSON response into out.
+// Timeouts are normalized to context.DeadlineExceeded and non-2xx responses
+// become a *ProviderError.
+func postJSON(ctx context.Context, client *http.Client, provider, url string, headers map[string]string, body, out interface{}) error {
+	resp, err := openPost(ctx, client, provider, url, headers, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+			return context.DeadlineExceeded
+		}
+		return fmt.Errorf("failed to decode AI response: %w", err)
+	}
+	return nil
+}
+
+// openPost sends body as JSON to url and returns the open 2xx response for
+// the caller to read (and close). Errors are normalized like postJSON.
+func openPost(ctx context.Context, client *http.Client, provider, url string, headers map[string]string, body interface{}) (*http.Response, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s request: %w", provider, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %w", provider, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if cid, ok := ctx.Value(correlationIDKey).(string); ok {
+		req.Header.Set("X-Correlation-ID", cid)
+	}
+	injectTraceContext(ctx, req.Header)
+
+	if client == nil {
+		client = aiHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxProviderErrorBody))
+		return nil, &ProviderError{Provider: provider, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// streamError normalizes an error hit while reading a streamed response
+func streamError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		return context.DeadlineExceeded
+	}
+	return fmt.Errorf("failed to read AI stream: %w", err)
+}
+
+// maxStreamLine bounds a single line of a streamed provider response
+const maxStreamLine = 1024 * 1024
+
+// ErrStreamTruncated is returned when a provider's stream ends before the
+// provider marked the response finished, e.g. because the connection dropped
+var ErrStreamTruncated = errors.New("AI stream ended before the response was finished")
+
+// readStreamLines calls fn for every non-empty line of r. With sse set, only
+// the payload of "data:" lines is passed and "[DONE]" ends the stream.
+// Reaching the end of r otherwise returns ErrStreamTruncated; providers
+// whose streams end with a final message of their own accept it once they
+// have seen that message.
+func readStreamLines(ctx context.Context, r io.Reader, sse bool, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if sse {
+			data, ok := bytes.CutPrefix(line, []byte("data:"))
+			if !ok {
+				continue // event names, ids and ":" keep-alive comments
+			}
+			line = bytes.TrimSpace(data)
+			if string(line) == "[DONE]" {
+				return nil
+			}
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return streamError(ctx, err)
+	}
+	return ErrStreamTruncated
+}
+
+// ProviderConfig configures one named provider in AI_PROVIDERS_CONFIG
+type ProviderConfig struct {
+	// Type is one of "openrouter", "openai", "anthropic" or "ollama"
+	Type    string `json:"type"`
+	BaseURL string `json:"baseUrl,omitempty"`
+	// APIKeyEnv names the environment variable holding the API key, so
+	// secrets stay out of the config file
+	APIKeyEnv string            `json:"apiKeyEnv,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// providersFile is the on-disk format of AI_PROVIDERS_CONFIG
+type providersFile struct {
+	Default   string                    `json:"default"`
+	Providers map[string]ProviderConfig `json:"providers"`
+	Models    map[string]string         `json:"models"`
+}
+
+// AIProviderRegistry resolves which provider serves a given model
+type AIProviderRegistry struct {
+	providers       map[string]AIProvider
+	models          map[string]string
+	defaultProvider string
+}
+
+// aiProviders is the process-wide registry, replaced by initAIProviders at startup
+var aiProviders = defaultAIProviderRegistry()
+
+// defaultAIProviderRegistry routes every model to OpenRouter
+func defaultAIProviderRegistry() *AIProviderRegistry {
+	return &AIProviderRegistry{
+		providers:       map[string]AIProvider{"openrouter": &OpenRouterProvider{}},
+		models:          map[string]string{},
+		defaultProvider: "openrouter",
+	}
+}
+
+// LoadAIProviderRegistry reads a JSON provider config from path. The built-in
+// "openrouter" provider is always available unless overridden by name.
+func LoadAIProviderRegistry(path string) (*AIProviderRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read AI providers config: %w", err)
+	}
+
+	var file providersFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse AI providers config: %w", err)
+	}
+
+	registry := defaultAIProviderRegistry()
+	for name, cfg := range file.Providers {
+		provider, err := newAIProvider(name, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", name, err)
+		}
+		registry.providers[name] = provider
+	}
+	for model, name := range file.Models {
+		if _, ok := registry.providers[name]; !ok {
+			return nil, fmt.Errorf("model %s references unknown provider %s", model, name)
+		}
+		registry.models[model] = name
+	}
+	if file.Default != "" {
+		if _, ok := registry.providers[file.Default]; !ok {
+			return nil, fmt.Errorf("default references unknown provider %s", file.Default)
+		}
+		registry.defaultProvider = file.Default
+	}
+	return registry, nil
+}
+
+// newAIProvider builds a provider from its config
+func newAIProvider(name string, cfg ProviderConfig) (AIProvider, error) {
+	var apiKey string
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+		if apiKey == "" {
+			return nil, fmt.Errorf("%s is not set", cfg.APIKeyEnv)
+		}
+	}
+
+	switch strings.ToLower(cfg.Type) {
+	case "openrouter":
+		return &OpenRouterProvider{URL: cfg.BaseURL, APIKey: apiKey}, nil
+	case "openai":
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("baseUrl is required for openai providers")
+		}
+		return &OpenAICompatibleProvider{ProviderName: name, BaseURL: cfg.BaseURL, APIKey: apiKey, Headers: cfg.Headers}, nil
+	case "anthropic":
+		if apiKey == "" {
+			return nil, fmt.Errorf("apiKeyEnv is required for anthropic providers")
+		}
+		return &AnthropicProvider{BaseURL: cfg.BaseURL, APIKey: apiKey}, nil
+	case "ollama":
+		return &OllamaProvider{BaseURL: cfg.BaseURL}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", cfg.Type)
+	}
+}
+
+// initAIProviders loads AI_PROVIDERS_CONFIG if set
+func initAIProviders() error {
+	path := os.Getenv("AI_PROVIDERS_CONFIG")
+	if path == "" {
+		return nil
+	}
+	registry, err := LoadAIProviderRegistry(path)
+	if err != nil {
+		return err
+	}
+	aiProviders = registry
+	log.Printf("Loaded %d AI providers from %s (default: %s)", len(registry.providers), path, registry.defaultProvider)
+	return nil
+}
+
+// ForModel returns the provider configured for model, or the default provider
+func (r *AIProviderRegistry) ForModel(model string) (AIProvider, error) {
+	name, ok := r.models[model]
+	if !ok {
+		name = r.defaultProvider
+	}
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("no AI provider configured for model %s", model)
+	}
+	return provider, nil
+}
+
+// usesOpenRouter reports whether any model can be routed to OpenRouter, which
+// decides whether OpenRouter availability counts towards readiness
+func (r *AIProviderRegistry) usesOpenRouter() bool {
+	if _, ok := r.providers[r.defaultProvider].(*OpenRouterProvider); ok {
+		return true
+	}
+	for _, name := range r.models {
+		if _, ok := r.providers[name].(*OpenRouterProvider); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// callAI sends desc to the configured model chain. Retryable failures are
+// retried and then failed over to the next model (see callWithFailover); the
+// response names the model that served it.
+func callAI(ctx context.Context, desc *AIRequestDescriptor) (*AIResponse, error) {
+	return callWithFailover(ctx, desc, func(ctx context.Context, provider AIProvider, req AIRequest) (*AIResponse, error) {
+		return provider.Complete(ctx, req)
+	})
+}
+
+// callAIStream is callAI with streaming. Providers that cannot stream deliver
+// the whole completion as a single delta. Once a delta has reached the client
+// the call can no longer be retried or failed over.
+func callAIStream(ctx context.Context, desc *AIRequestDescriptor, onDelta func(string) error) (*AIResponse, error) {
+	return callWithFailover(ctx, desc, func(ctx context.Context, provider AIProvider, req AIRequest) (*AIResponse, error) {
+		delivered := false
+		deliver := func(delta string) error {
+			delivered = true
+			return onDelta(delta)
+		}
+
+		var resp *AIResponse
+		var err error
+		if streamer, ok := provider.(StreamingAIProvider); ok {
+			resp, err = streamer.Stream(ctx, req, deliver)
+		} else if resp, err = provider.Complete(ctx, req); err == nil {
+			err = deliver(resp.Content)
+		}
+		if err != nil && delivered {
+			return nil, &nonRetryableError{err}
+		}
+		return resp, err
+	})
+}
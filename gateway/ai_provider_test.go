@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenRouterProvider_Complete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer or-key" {
+			t.Errorf("expected bearer auth, got %q", got)
+		}
+		var body openAIChatRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Model != "test/model" || len(body.Messages) != 1 {
+			t.Errorf("unexpected request: %+v", body)
+		}
+		w.Write([]byte(`{"model":"test/model","choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("OPENROUTER_URL", server.URL)
+	t.Setenv("OPENROUTER_API_KEY", "or-key")
+
+	resp, err := (&OpenRouterProvider{}).Complete(context.Background(), AIRequest{
+		Model:    "test/model",
+		Messages: []AIMessage{{Role: "user", Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if resp.Content != "hi" || resp.Provider != "openrouter" || resp.Usage.TotalTokens != 4 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestOpenAICompatibleProvider_Complete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("X-Org"); got != "acme" {
+			t.Errorf("expected custom header, got %q", got)
+		}
+		var body openAIChatRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		if len(body.Messages) != 2 || body.Messages[0].Role != "system" {
+			t.Errorf("expected system prompt to be sent as first message, got %+v", body.Messages)
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"done"}}]}`))
+	}))
+	defer server.Close()
+
+	p := &OpenAICompatibleProvider{ProviderName: "vllm", BaseURL: server.URL + "/v1/", Headers: map[string]string{"X-Org": "acme"}}
+	resp, err := p.Complete(context.Background(), AIRequest{
+		Model:    "llama",
+		System:   "be brief",
+		Messages: []AIMessage{{Role: "user", Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if resp.Content != "done" || resp.Model != "llama" || resp.Provider != "vllm" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestOpenAICompatibleProvider_NoChoices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer server.Close()
+
+	_, err := (&OpenAICompatibleProvider{BaseURL: server.URL}).Complete(context.Background(), AIRequest{Model: "m"})
+	if err == nil || err.Error() != "invalid response from AI provider: no choices" {
+		t.Errorf("expected no choices error, got %v", err)
+	}
+}
+
+func TestAnthropicProvider_Complete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "ak" || r.Header.Get("anthropic-version") != anthropicVersion {
+			t.Errorf("missing Anthropic headers: %v", r.Header)
+		}
+		var body anthropicRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.MaxTokens != defaultMaxTokens || body.System != "be brief" {
+			t.Errorf("unexpected request: %+v", body)
+		}
+		w.Write([]byte(`{"model":"claude-x","content":[{"type":"text","text":"a"},{"type":"text","text":"b"}],"usage":{"input_tokens":5,"output_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	resp, err := (&AnthropicProvider{BaseURL: server.URL, APIKey: "ak"}).Complete(context.Background(), AIRequest{
+		Model:    "claude-x",
+		System:   "be brief",
+		Messages: []AIMessage{{Role: "user", Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if resp.Content != "ab" || resp.Usage.PromptTokens != 5 || resp.Usage.TotalTokens != 7 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestOllamaProvider_Complete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var body ollamaRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Stream {
+			t.Error("expected stream=false")
+		}
+		w.Write([]byte(`{"model":"llama3","message":{"role":"assistant","content":"local"},"prompt_eval_count":4,"eval_count":6}`))
+	}))
+	defer server.Close()
+
+	resp, err := (&OllamaProvider{BaseURL: server.URL}).Complete(context.Background(), AIRequest{
+		Model:    "llama3",
+		Messages: []AIMessage{{Role: "user", Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if resp.Content != "local" || resp.Provider != "ollama" || resp.Usage.TotalTokens != 10 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestProvider_Non2xxReturnsProviderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"slow down"}`))
+	}))
+	defer server.Close()
+
+	_, err := (&OllamaProvider{BaseURL: server.URL}).Complete(context.Background(), AIRequest{Model: "m"})
+	var perr *ProviderError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected ProviderError, got %v", err)
+	}
+	if perr.StatusCode != http.StatusTooManyRequests || perr.Provider != "ollama" {
+		t.Errorf("unexpected ProviderError: %+v", perr)
+	}
+}
+
+func TestLoadAIProviderRegistry(t *testing.T) {
+	t.Setenv("TEST_ANTHROPIC_KEY", "ak")
+	path := filepath.Join(t.TempDir(), "providers.json")
+	os.WriteFile(path, []byte(`{
+		"default": "local",
+		"providers": {
+			"local": {"type": "ollama"},
+			"claude": {"type": "anthropic", "apiKeyEnv": "TEST_ANTHROPIC_KEY"}
+		},
+		"models": {"claude-x": "claude", "or/model": "openrouter"}
+	}`), 0o600)
+
+	registry, err := LoadAIProviderRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadAIProviderRegistry failed: %v", err)
+	}
+
+	tests := map[string]string{"claude-x": "anthropic", "or/model": "openrouter", "llama3": "ollama"}
+	for model, want := range tests {
+		provider, err := registry.ForModel(model)
+		if err != nil {
+			t.Fatalf("ForModel(%s) failed: %v", model, err)
+		}
+		if provider.Name() != want {
+			t.Errorf("ForModel(%s) = %s, want %s", model, provider.Name(), want)
+		}
+	}
+	if !registry.usesOpenRouter() {
+		t.Error("expected usesOpenRouter when a model is routed to OpenRouter")
+	}
+}
+
+func TestLoadAIProviderRegistry_Invalid(t *testing.T) {
+	configs := map[string]string{
+		"unknown type":     `{"providers": {"x": {"type": "bogus"}}}`,
+		"missing base url": `{"providers": {"x": {"type": "openai"}}}`,
+		"missing api key":  `{"providers": {"x": {"type": "anthropic", "apiKeyEnv": "TEST_UNSET_KEY_FOR_PROVIDERS"}}}`,
+		"unknown model":    `{"models": {"m": "nope"}}`,
+		"unknown default":  `{"default": "nope"}`,
+	}
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "providers.json")
+			os.WriteFile(path, []byte(cfg), 0o600)
+			if _, err := LoadAIProviderRegistry(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestCallAI_UsesConfiguredProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":"from ollama"}}`))
+	}))
+	defer server.Close()
+
+	orig := aiProviders
+	defer func() { aiProviders = orig }()
+	aiProviders = &AIProviderRegistry{
+		providers:       map[string]AIProvider{"local": &OllamaProvider{BaseURL: server.URL}},
+		models:          map[string]string{},
+		defaultProvider: "local",
+	}
+	if aiProviders.usesOpenRouter() {
+		t.Error("expected usesOpenRouter to be false for an Ollama-only registry")
+	}
+
+	t.Setenv("OPENROUTER_MODEL", "llama3")
+	resp, err := callAI(context.Background(), describeSummary(getOpenRouterModel(), "some text"))
+	if err != nil {
+		t.Fatalf("callAI failed: %v", err)
+	}
+	if resp.Content != "from ollama" || resp.Model != "llama3" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestAnthropicProvider_Stream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body anthropicRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		if !body.Stream {
+			t.Error("expected stream=true")
+		}
+		w.Write([]byte("event: message_start\n" +
+			`data: {"type":"message_start","message":{"model":"claude-x","usage":{"input_tokens":5}}}` + "\n\n" +
+			"event: content_block_delta\n" +
+			`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"Hel"}}` + "\n\n" +
+			"event: content_block_delta\n" +
+			`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"lo"}}` + "\n\n" +
+			"event: message_delta\n" +
+			`data: {"type":"message_delta","usage":{"output_tokens":2}}` + "\n\n" +
+			"event: message_stop\n" +
+			`data: {"type":"message_stop"}` + "\n\n"))
+	}))
+	defer server.Close()
+
+	var deltas []string
+	resp, err := (&AnthropicProvider{BaseURL: server.URL, APIKey: "ak"}).Stream(context.Background(), AIRequest{Model: "claude-x"}, func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if len(deltas) != 2 || resp.Content != "Hello" || resp.Usage.TotalTokens != 7 {
+		t.Errorf("unexpected stream result: deltas=%v resp=%+v", deltas, resp)
+	}
+}
+
+func TestStreamOpenAIChat_EndOfStream(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		wantErr bool
+	}{
+		"done":          {`data: {"choices":[{"delta":{"content":"a"}}]}` + "\n\ndata: [DONE]\n\n", false},
+		"finish reason": {`data: {"choices":[{"delta":{"content":"a"},"finish_reason":"stop"}]}` + "\n\n", false},
+		"closed midway": {`data: {"choices":[{"delta":{"content":"a"},"finish_reason":null}]}` + "\n\n", true},
+	}
+	for name, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tt.body))
+		}))
+		_, err := streamOpenAIChat(context.Background(), server.Client(), "openai", server.URL, nil, AIRequest{Model: "m"}, func(string) error { return nil })
+		server.Close()
+		if tt.wantErr && !errors.Is(err, ErrStreamTruncated) {
+			t.Errorf("%s: expected ErrStreamTruncated, got %v", name, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestAnthropicProvider_StreamTruncated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("event: content_block_delta\n" +
+			`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"Hel"}}` + "\n\n"))
+	}))
+	defer server.Close()
+
+	_, err := (&AnthropicProvider{BaseURL: server.URL, APIKey: "ak"}).Stream(context.Background(), AIRequest{Model: "claude-x"}, func(string) error { return nil })
+	if !errors.Is(err, ErrStreamTruncated) {
+		t.Errorf("expected ErrStreamTruncated without message_stop, got %v", err)
+	}
+}
+
+func TestOllamaProvider_Stream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"model":"llama3","message":{"content":"a"},"done":false}` + "\n" +
+			`{"model":"llama3","message":{"content":"b"},"done":false}` + "\n" +
+			`{"model":"llama3","message":{"content":""},"done":true,"prompt_eval_count":3,"eval_count":2}` + "\n"))
+	}))
+	defer server.Close()
+
+	var deltas []string
+	resp, err := (&OllamaProvider{BaseURL: server.URL}).Stream(context.Background(), AIRequest{Model: "llama3"}, func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if len(deltas) != 2 || resp.Content != "ab" || resp.Usage.TotalTokens != 5 {
+		t.Errorf("unexpected stream result: deltas=%v resp=%+v", deltas, resp)
+	}
+}
+
+func TestCallAIStream_NonStreamingProviderSendsSingleDelta(t *testing.T) {
+	orig := aiProviders
+	defer func() { aiProviders = orig }()
+	aiProviders = &AIProviderRegistry{
+		providers:       map[string]AIProvider{"stub": stubProvider{content: "whole"}},
+		models:          map[string]string{},
+		defaultProvider: "stub",
+	}
+
+	var deltas []string
+	resp, err := callAIStream(context.Background(), describeSummary(getOpenRouterModel(), "text"), func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("callAIStream failed: %v", err)
+	}
+	if len(deltas) != 1 || deltas[0] != "whole" || resp.Content != "whole" {
+		t.Errorf("expected a single delta with the full content, got %v", deltas)
+	}
+}
+
+// stubProvider is an AIProvider without streaming support
+type stubProvider struct{ content string }
+
+func (s stubProvider) Name() string { return "stub" }
+
+func (s stubProvider) Complete(ctx context.Context, req AIRequest) (*AIResponse, error) {
+	return &AIResponse{Content: s.content, Model: req.Model, Provider: "stub"}, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// balanceTokenHeader carries the bearer token returned by a top-up. Paid
+// routes called with it and without a signature are debited from the balance.
+const balanceTokenHeader = "X-402-Balance-Token"
+
+// maxTopUpBodySize bounds POST /api/balance/topup bodies
+const maxTopUpBodySize = 64 * 1024
+
+// TopUpRequest is the body of POST /api/balance/topup
+type TopUpRequest struct {
+	Amount string `json:"amount"`
+}
+
+// prepaidRequested reports whether the request asks to be paid from a balance
+func prepaidRequested(c *gin.Context) bool {
+	return ledger != nil && c.GetHeader(balanceTokenHeader) != ""
+}
+
+// authenticateBalanceToken resolves the wallet behind the balance token
+// header. If the token is missing or unknown it sends a 401 and returns false.
+func authenticateBalanceToken(c *gin.Context) (string, bool) {
+	token := c.GetHeader(balanceTokenHeader)
+	if token == "" {
+		c.JSON(401, gin.H{"error": "Unauthorized", "message": "Missing " + balanceTokenHeader + " header"})
+		return "", false
+	}
+	wallet, err := ledger.WalletForToken(c.Request.Context(), balanceTokenHash(token))
+	if err != nil {
+		log.Printf("Balance token lookup failed: %v", err)
+		c.JSON(500, gin.H{"error": "Ledger unavailable", "message": "An internal error occurred"})
+		return "", false
+	}
+	if wallet == "" {
+		c.JSON(401, gin.H{"error": "Unauthorized", "message": "Invalid balance token"})
+		return "", false
+	}
+	return wallet, true
+}
+
+// handleGetBalance handles GET /api/balance, returning the balance of the
+// wallet that owns the balance token
+func handleGetBalance(c *gin.Context) {
+	wallet, ok := authenticateBalanceToken(c)
+	if !ok {
+		return
+	}
+	units, err := ledger.Balance(c.Request.Context(), wallet)
+	if err != nil {
+		log.Printf("Balance lookup failed for %s: %v", wallet, err)
+		c.JSON(500, gin.H{"error": "Ledger unavailable", "message": "An internal error occurred"})
+		return
+	}
+	c.JSON(200, gin.H{"wallet": wallet, "balance": formatLedgerAmount(units)})
+}
+
+// handleTopUp handles POST /api/balance/topup. Without payment headers it
+// answers 402 with a payment context for the requested amount, whose nonce
+// is bound to the body. Once that context is signed the amount is credited
+// to the signer's balance and a new balance token is returned, replacing
+// any earlier token of that wallet.
+func handleTopUp(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTopUpBodySize)
+	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(413, gin.H{"error": "Payload too large"})
+		return
+	}
+	var req TopUpRequest
+	if err := json.Unmarshal(requestBody, &req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	units, err := parseLedgerAmount(req.Amount)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid amount", "details": err.Error()})
+		return
+	}
+
+	// The deposit is priced by the body rather than the route, and the nonce
+	// is bound to the body digest like a usage quote
+	deposit := *lookupPaidRoute(c)
+	deposit.Amount = formatLedgerAmount(units)
+	deposit.Usage = false
+	binding := &Quote{RequestHash: "sha256:" + bodyDigest(requestBody), Amount: deposit.Amount}
+
+	signature := c.GetHeader("X-402-Signature")
+	nonce := c.GetHeader("X-402-Nonce")
+	if signature == "" || nonce == "" {
+		paymentCtx := deposit.paymentContext(quotedNonce(uuid.New().String(), binding), uint64(time.Now().Unix()))
+		if err := nonceStore.Issue(c.Request.Context(), paymentCtx.Nonce, getNonceTTL()); err != nil {
+			log.Printf("Failed to issue payment nonce: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to create payment context", "message": "An internal error occurred"})
+			return
+		}
+		paymentChallengesTotal.WithLabelValues(routeLabel(c)).Inc()
+		c.JSON(402, gin.H{
+			"error":          "Payment Required",
+			"message":        "Please sign the deposit payment context",
+			"paymentContext": paymentCtx,
+		})
+		return
+	}
+
+	timestamp, err := strconv.ParseUint(c.GetHeader("X-402-Timestamp"), 10, 64)
+	if err != nil || timestamp == 0 {
+		c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Missing or invalid X-402-Timestamp header"})
+		return
+	}
+	if !nonceMatchesQuote(nonce, binding) {
+		c.JSON(403, gin.H{"error": "Invalid Signature", "details": ErrQuoteMismatch.Error()})
+		return
+	}
+
+	verifyResp, _, err := verifyPayment(c.Request.Context(), &deposit, signature, nonce, timestamp, requestBody)
+	if err != nil {
+		log.Printf("Verification error: %v", err)
+		respondVerificationError(c, err)
+		return
+	}
+	if !verifyResp.IsValid {
+		if strings.HasPrefix(verifyResp.Error, "E007") ||
+			strings.HasPrefix(verifyResp.Error, "E008") ||
+			strings.HasPrefix(verifyResp.Error, "E009") {
+			c.JSON(400, gin.H{"error": "Invalid timestamp", "details": verifyResp.Error})
+		} else {
+			c.JSON(403, gin.H{"error": "Invalid Signature", "details": verifyResp.Error})
+		}
+		return
+	}
+
+	if !checkWalletRateLimit(c, verifyResp.RecoveredAddress) {
+		return
+	}
+	// Redeeming the nonce first makes each signed deposit credit exactly once
+	if !redeemNonce(c, nonce) {
+		return
+	}
+
+	wallet := strings.ToLower(verifyResp.RecoveredAddress)
+	// Finish the deposit even if the client disconnects: the nonce is spent
+	ctx := context.WithoutCancel(c.Request.Context())
+	balance, err := ledger.Credit(ctx, wallet, units)
+	if errors.Is(err, ErrBalanceOverflow) {
+		log.Printf("Refused deposit of %s to %s (nonce %s): %v", deposit.Amount, wallet, nonce, err)
+		c.JSON(409, gin.H{"error": "Balance limit exceeded", "details": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("CRITICAL: failed to credit %s of %s (nonce %s): %v", deposit.Amount, wallet, nonce, err)
+		c.JSON(500, gin.H{"error": "Failed to credit balance", "message": "An internal error occurred"})
+		return
+	}
+	token, err := newBalanceToken()
+	if err == nil {
+		err = ledger.SetToken(ctx, wallet, balanceTokenHash(token))
+	}
+	if err != nil {
+		// The deposit is credited; a later top-up issues a new token
+		log.Printf("Failed to issue balance token for %s: %v", wallet, err)
+		c.JSON(500, gin.H{"error": "Failed to issue balance token", "message": "Balance was credited; top up again to get a token"})
+		return
+	}
+
+	log.Printf("Credited %s to %s (balance %s)", deposit.Amount, wallet, formatLedgerAmount(balance))
+	c.JSON(200, gin.H{
+		"wallet":       wallet,
+		"credited":     deposit.Amount,
+		"balance":      formatLedgerAmount(balance),
+		"balanceToken": token,
+	})
+}
+
+// unsignedFundingRequested reports whether the request is paid from a
+// prepaid balance or a refund credit instead of a signature
+func unsignedFundingRequested(c *gin.Context) bool {
+	return prepaidRequested(c) || refundRequested(c)
+}
+
+// chargeUnsigned pays for a request without a signature, from the refund
+// credit if one is named and otherwise from the prepaid balance
+func chargeUnsigned(c *gin.Context, route *PaidRoute, requestBody []byte) (*PaymentContext, string, bool) {
+	if refundRequested(c) {
+		return spendRefund(c, route, requestBody)
+	}
+	return chargePrepaid(c, route, requestBody)
+}
+
+// priceUnsignedRequest builds the payment context of a request that is not
+// paid by signature and returns its price in base units. On failure it has
+// already sent a 500 and returns false.
+func priceUnsignedRequest(c *gin.Context, route *PaidRoute, requestBody []byte, nonce string) (*PaymentContext, int64, bool) {
+	quote, err := route.quote(requestBody)
+	if err != nil {
+		log.Printf("Failed to quote request: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to price request", "message": "An internal error occurred"})
+		return nil, 0, false
+	}
+	paymentCtx := route.paymentContext(nonce, uint64(time.Now().Unix()))
+	if quote != nil {
+		paymentCtx.Amount = quote.Amount
+		paymentCtx.Quote = quote
+	}
+
+	units, err := parseLedgerAmount(paymentCtx.Amount)
+	if err != nil {
+		log.Printf("Route price cannot be debited: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to price request", "message": "An internal error occurred"})
+		return nil, 0, false
+	}
+	return &paymentCtx, units, true
+}
+
+// chargePrepaid debits the price of the request from the balance of the
+// wallet owning the balance token. It returns the payment context to record
+// in the receipt and the payer; on failure it has already sent the response
+// (401, 402 with E014, 429 or 500) and returns false.
+func chargePrepaid(c *gin.Context, route *PaidRoute, requestBody []byte) (*PaymentContext, string, bool) {
+	wallet, ok := authenticateBalanceToken(c)
+	if !ok {
+		return nil, "", false
+	}
+
+	paymentCtx, units, ok := priceUnsignedRequest(c, route, requestBody, "prepaid_"+uuid.New().String())
+	if !ok {
+		return nil, "", false
+	}
+	paymentCtx.Funding = fundingPrepaid
+
+	if !checkWalletRateLimit(c, wallet) {
+		return nil, "", false
+	}
+
+	balance, err := ledger.Debit(c.Request.Context(), wallet, units)
+	if errors.Is(err, ErrInsufficientBalance) {
+		c.JSON(402, gin.H{
+			"error":   "Payment Required",
+			"message": "Top up via POST /api/balance/topup or sign the payment context",
+			"details": err.Error(),
+			"balance": formatLedgerAmount(balance),
+			"amount":  paymentCtx.Amount,
+		})
+		return nil, "", false
+	}
+	if err != nil {
+		log.Printf("Debit failed for %s: %v", wallet, err)
+		c.JSON(500, gin.H{"error": "Ledger unavailable", "message": "An internal error occurred"})
+		return nil, "", false
+	}
+
+	c.Header("X-402-Balance", formatLedgerAmount(balance))
+	return paymentCtx, wallet, true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newBalanceRouter serves the balance and summarize routes with a fresh
+// in-memory ledger and a verifier that accepts every signature from testWallet
+func newBalanceRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	t.Cleanup(verifier.Close)
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	ledger = NewMemoryLedger()
+	t.Cleanup(func() { ledger = nil })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/balance", handleGetBalance)
+	r.POST("/api/balance/topup", handleTopUp)
+	r.POST("/api/ai/summarize", handleSummarize)
+	return r
+}
+
+// topUp runs the deposit flow for amount and returns the balance token
+func topUp(t *testing.T, r http.Handler, amount string) string {
+	t.Helper()
+	body := `{"amount":"` + amount + `"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/balance/topup", strings.NewReader(body)))
+	if w.Code != 402 {
+		t.Fatalf("expected 402 deposit challenge, got %d body=%s", w.Code, w.Body.String())
+	}
+	var challenge struct{ PaymentContext PaymentContext }
+	json.Unmarshal(w.Body.Bytes(), &challenge)
+	if challenge.PaymentContext.Amount != amount {
+		t.Fatalf("expected the challenge to ask for %s, got %+v", amount, challenge.PaymentContext)
+	}
+
+	req := httptest.NewRequest("POST", "/api/balance/topup", strings.NewReader(body))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", challenge.PaymentContext.Nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected deposit to succeed, got %d body=%s", w.Code, w.Body.String())
+	}
+	var resp struct{ BalanceToken string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	// The signed deposit cannot be replayed
+	req = httptest.NewRequest("POST", "/api/balance/topup", strings.NewReader(body))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", challenge.PaymentContext.Nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "E011") {
+		t.Fatalf("expected a replayed deposit to be rejected with E011, got %d body=%s", w.Code, w.Body.String())
+	}
+	return resp.BalanceToken
+}
+
+func prepaidRequest(r http.Handler, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(body))
+	req.Header.Set(balanceTokenHeader, token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPrepaid_TopUpAndDebit(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": reply("summary")})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	t.Setenv("PAYMENT_AMOUNT", "0.004")
+	r := newBalanceRouter(t)
+
+	token := topUp(t, r, "0.01")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/balance", nil)
+	req.Header.Set(balanceTokenHeader, token)
+	r.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"balance":"0.01"`) {
+		t.Fatalf("expected balance 0.01, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	if w := prepaidRequest(r, token, `{"text":""}`); w.Code != 400 {
+		t.Fatalf("expected 400 for an empty text, got %d", w.Code)
+	}
+
+	for _, want := range []string{"0.006", "0.002"} {
+		w := prepaidRequest(r, token, `{"text":"hello"}`)
+		if w.Code != 200 {
+			t.Fatalf("expected prepaid request to succeed, got %d body=%s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-402-Balance"); got != want {
+			t.Errorf("expected remaining balance %s, got %s", want, got)
+		}
+		receiptJSON, _ := base64.StdEncoding.DecodeString(w.Header().Get("X-402-Receipt"))
+		var receipt SignedReceipt
+		json.Unmarshal(receiptJSON, &receipt)
+		if p := receipt.Receipt.Payment; p.Funding != fundingPrepaid || p.Amount != "0.004" || p.Payer != strings.ToLower(testWallet) {
+			t.Errorf("expected a prepaid receipt for 0.004 from the depositor, got %+v", p)
+		}
+	}
+
+	w = prepaidRequest(r, token, `{"text":"hello"}`)
+	if w.Code != 402 || !strings.Contains(w.Body.String(), "E014") {
+		t.Fatalf("expected 402 E014 once the balance runs out, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	if w := prepaidRequest(r, "pgb_unknown", `{"text":"hello"}`); w.Code != 401 {
+		t.Errorf("expected 401 for an unknown balance token, got %d", w.Code)
+	}
+}
+
+func TestPrepaid_TopUpRotatesToken(t *testing.T) {
+	r := newBalanceRouter(t)
+	first := topUp(t, r, "1")
+	second := topUp(t, r, "0.5")
+
+	for token, want := range map[string]int{first: 401, second: 200} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/balance", nil)
+		req.Header.Set(balanceTokenHeader, token)
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("expected %d, got %d body=%s", want, w.Code, w.Body.String())
+		}
+		if want == 200 && !strings.Contains(w.Body.String(), `"balance":"1.5"`) {
+			t.Errorf("expected both deposits to be credited, got %s", w.Body.String())
+		}
+	}
+}
+
+func TestPrepaid_TopUpValidation(t *testing.T) {
+	r := newBalanceRouter(t)
+	for _, body := range []string{`{"amount":"0"}`, `{"amount":"0.0000001"}`, `{}`, `[`} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/balance/topup", strings.NewReader(body)))
+		if w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+
+	// A nonce issued for one amount cannot fund another
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/balance/topup", strings.NewReader(`{"amount":"0.01"}`)))
+	var challenge struct{ PaymentContext PaymentContext }
+	json.Unmarshal(w.Body.Bytes(), &challenge)
+	req := httptest.NewRequest("POST", "/api/balance/topup", strings.NewReader(`{"amount":"100"}`))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", challenge.PaymentContext.Nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "E013") {
+		t.Errorf("expected 403 E013 for a swapped amount, got %d body=%s", w.Code, w.Body.String())
+	}
+}
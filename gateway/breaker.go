@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors wrapped by DependencyUnavailableError
+var (
+	ErrCircuitOpen  = errors.New("circuit breaker open")
+	ErrBulkheadFull = errors.New("too many concurrent calls")
+)
+
+// DependencyUnavailableError is returned without calling a dependency whose
+// circuit breaker is open or whose concurrency limit is reached. Handlers
+// answer it with 503 and Retry-After.
+type DependencyUnavailableError struct {
+	Dependency string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *DependencyUnavailableError) Error() string {
+	return fmt.Sprintf("%s unavailable: %v", e.Dependency, e.Err)
+}
+
+func (e *DependencyUnavailableError) Unwrap() error { return e.Err }
+
+// retryAfterSeconds is the Retry-After value, rounded up to a whole second
+func (e *DependencyUnavailableError) retryAfterSeconds() int {
+	return max(1, int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// respondUnavailable sends the 503 for a dependency that was not called
+func respondUnavailable(c *gin.Context, err *DependencyUnavailableError) {
+	retryAfter := err.retryAfterSeconds()
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(503, gin.H{"error": "Service Unavailable", "message": err.Error(), "retry_after": retryAfter})
+}
+
+// respondPaidUnavailable is respondUnavailable for a request that was
+// already paid for, which records the failure as refundable
+func respondPaidUnavailable(c *gin.Context, err *DependencyUnavailableError) {
+	retryAfter := err.retryAfterSeconds()
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	respondServiceFailure(c, 503, gin.H{"error": "Service Unavailable", "message": err.Error(), "retry_after": retryAfter}, err.Error())
+}
+
+// Circuit breaker states
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// callOutcome is how a guarded call ended, as far as the breaker is concerned
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	// callIgnored says nothing about the dependency, e.g. the client went away
+	callIgnored
+)
+
+// CircuitBreaker opens after threshold consecutive failures and rejects
+// calls for openFor. It then lets a single probe through (half-open): a
+// success closes it, a failure opens it again.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	openFor   time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a closed breaker. A threshold <= 0 disables it.
+func NewCircuitBreaker(name string, threshold int, openFor time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{name: name, threshold: threshold, openFor: openFor, now: time.Now}
+	circuitBreakerState.WithLabelValues(name).Set(float64(breakerClosed))
+	return b
+}
+
+// allow reports whether a call may proceed. If not, it returns how long
+// until the breaker will let a probe through.
+func (b *CircuitBreaker) allow() (time.Duration, bool) {
+	if b.threshold <= 0 {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(b.openFor).Sub(b.now()); wait > 0 {
+			return wait, false
+		}
+		b.setStateLocked(breakerHalfOpen)
+		b.probing = true
+		return 0, true
+	case breakerHalfOpen:
+		if b.probing {
+			// Another request is probing; it decides within its own timeout
+			return time.Second, false
+		}
+		b.probing = true
+		return 0, true
+	}
+	return 0, true
+}
+
+// record reports the outcome of a call that allow let through
+func (b *CircuitBreaker) record(outcome callOutcome) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = false
+		switch outcome {
+		case callSucceeded:
+			b.failures = 0
+			b.setStateLocked(breakerClosed)
+		case callFailed:
+			b.openLocked()
+		}
+	case breakerClosed:
+		switch outcome {
+		case callSucceeded:
+			b.failures = 0
+		case callFailed:
+			b.failures++
+			if b.failures >= b.threshold {
+				b.openLocked()
+			}
+		}
+	}
+	// An open breaker ignores calls that started before it opened
+}
+
+func (b *CircuitBreaker) openLocked() {
+	b.openedAt = b.now()
+	b.setStateLocked(breakerOpen)
+}
+
+func (b *CircuitBreaker) setStateLocked(state breakerState) {
+	if b.state != state {
+		b.state = state
+		circuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+	}
+}
+
+// State returns the current state. An open breaker whose wait has passed
+// reports half-open, since the next call will probe.
+func (b *CircuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && !b.now().Before(b.openedAt.Add(b.openFor)) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// retryAfter returns how long an open breaker keeps rejecting calls, or 0
+func (b *CircuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.state != breakerOpen {
+		return 0
+	}
+	return max(0, b.openedAt.Add(b.openFor).Sub(b.now()))
+}
+
+// Bulkhead caps the number of concurrent calls to a dependency. Calls over
+// the limit are rejected at once instead of queueing goroutines.
+type Bulkhead struct {
+	slots chan struct{}
+}
+
+// NewBulkhead creates a bulkhead admitting limit concurrent calls. A limit
+// <= 0 returns nil, which admits everything.
+func NewBulkhead(limit int) *Bulkhead {
+	if limit <= 0 {
+		return nil
+	}
+	return &Bulkhead{slots: make(chan struct{}, limit)}
+}
+
+func (b *Bulkhead) tryAcquire() bool {
+	if b == nil {
+		return true
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Bulkhead) release() {
+	if b != nil {
+		<-b.slots
+	}
+}
+
+// inFlight returns the number of calls holding a slot
+func (b *Bulkhead) inFlight() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.slots)
+}
+
+// dependencyGuard combines the circuit breaker and bulkhead of one dependency
+type dependencyGuard struct {
+	name     string
+	breaker  *CircuitBreaker
+	bulkhead *Bulkhead
+}
+
+// run calls fn unless the breaker is open or the bulkhead is full, in which
+// case it returns a *DependencyUnavailableError. classify maps fn's error to
+// the outcome recorded by the breaker.
+func (g *dependencyGuard) run(fn func() error, classify func(error) callOutcome) error {
+	if wait, ok := g.breaker.allow(); !ok {
+		dependencyRejectionsTotal.WithLabelValues(g.name, "circuit_open").Inc()
+		return &DependencyUnavailableError{Dependency: g.name, RetryAfter: wait, Err: ErrCircuitOpen}
+	}
+	if !g.bulkhead.tryAcquire() {
+		// The call never happened; free a half-open probe slot
+		g.breaker.record(callIgnored)
+		dependencyRejectionsTotal.WithLabelValues(g.name, "bulkhead_full").Inc()
+		return &DependencyUnavailableError{Dependency: g.name, RetryAfter: time.Second, Err: ErrBulkheadFull}
+	}
+	defer g.bulkhead.release()
+
+	err := fn()
+	if err == nil {
+		g.breaker.record(callSucceeded)
+	} else {
+		g.breaker.record(classify(err))
+	}
+	return err
+}
+
+// getBreakerFailureThreshold returns CIRCUIT_BREAKER_FAILURE_THRESHOLD, the
+// consecutive failures that open a breaker (default 5, 0 disables breakers)
+func getBreakerFailureThreshold() int {
+	return getEnvAsInt("CIRCUIT_BREAKER_FAILURE_THRESHOLD", 5)
+}
+
+// getBreakerOpenDuration returns how long an open breaker rejects calls
+// before probing (CIRCUIT_BREAKER_OPEN_SECONDS, default 30)
+func getBreakerOpenDuration() time.Duration {
+	return getPositiveTimeout("CIRCUIT_BREAKER_OPEN_SECONDS", 30)
+}
+
+// getDependencyConcurrency returns the concurrency limit of a dependency
+// kind: VERIFIER_MAX_CONCURRENCY (default 64) or AI_MAX_CONCURRENCY per
+// provider (default 32). 0 removes the limit.
+func getDependencyConcurrency(kind string) int {
+	if kind == "verifier" {
+		return getEnvAsInt("VERIFIER_MAX_CONCURRENCY", 64)
+	}
+	return getEnvAsInt("AI_MAX_CONCURRENCY", 32)
+}
+
+// dependencyGuards holds a guard per dependency ("verifier", "ai:<provider>"),
+// created on first use from the environment
+var dependencyGuards = struct {
+	sync.Mutex
+	byName map[string]*dependencyGuard
+}{byName: make(map[string]*dependencyGuard)}
+
+// guardFor returns the guard of the named dependency; kind selects its
+// concurrency limit
+func guardFor(kind, name string) *dependencyGuard {
+	dependencyGuards.Lock()
+	defer dependencyGuards.Unlock()
+	g, ok := dependencyGuards.byName[name]
+	if !ok {
+		g = &dependencyGuard{
+			name:     name,
+			breaker:  NewCircuitBreaker(name, getBreakerFailureThreshold(), getBreakerOpenDuration()),
+			bulkhead: NewBulkhead(getDependencyConcurrency(kind)),
+		}
+		dependencyGuards.byName[name] = g
+	}
+	return g
+}
+
+func verifierGuard() *dependencyGuard { return guardFor("verifier", "verifier") }
+
+func aiGuard(provider AIProvider) *dependencyGuard {
+	return guardFor("ai", "ai:"+provider.Name())
+}
+
+// resetDependencyGuards drops all guards so they are recreated from the
+// environment
+func resetDependencyGuards() {
+	dependencyGuards.Lock()
+	defer dependencyGuards.Unlock()
+	for name := range dependencyGuards.byName {
+		circuitBreakerState.DeleteLabelValues(name)
+	}
+	dependencyGuards.byName = make(map[string]*dependencyGuard)
+}
+
+// breakerStates reports each dependency's breaker state and in-flight calls
+// for /readyz
+func breakerStates() gin.H {
+	dependencyGuards.Lock()
+	names := make([]string, 0, len(dependencyGuards.byName))
+	guards := make(map[string]*dependencyGuard, len(dependencyGuards.byName))
+	for name, g := range dependencyGuards.byName {
+		names = append(names, name)
+		guards[name] = g
+	}
+	dependencyGuards.Unlock()
+
+	sort.Strings(names)
+	states := gin.H{}
+	for _, name := range names {
+		g := guards[name]
+		state := gin.H{"state": g.breaker.State().String(), "in_flight": g.bulkhead.inFlight()}
+		if wait := g.breaker.retryAfter(); wait > 0 {
+			state["retry_after_seconds"] = int(math.Ceil(wait.Seconds()))
+		}
+		states[name] = state
+	}
+	return states
+}
+
+// aiUnavailable returns an error when every model in the chain is served by
+// a provider whose breaker is open, so a paid request can be refused before
+// the payment is taken. It returns nil if any provider may be called.
+func aiUnavailable() *DependencyUnavailableError {
+	var soonest time.Duration
+	for _, model := range getModelChain() {
+		provider, err := aiProviders.ForModel(model)
+		if err != nil {
+			continue
+		}
+		wait := aiGuard(provider).breaker.retryAfter()
+		if wait <= 0 {
+			return nil
+		}
+		if soonest == 0 || wait < soonest {
+			soonest = wait
+		}
+	}
+	if soonest == 0 {
+		return nil
+	}
+	return &DependencyUnavailableError{Dependency: "AI providers", RetryAfter: soonest, Err: ErrCircuitOpen}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useFreshBreakers recreates the dependency guards with the given failure
+// threshold, and again after the test
+func useFreshBreakers(t *testing.T, threshold int) {
+	t.Helper()
+	t.Setenv("CIRCUIT_BREAKER_FAILURE_THRESHOLD", strconv.Itoa(threshold))
+	t.Setenv("CIRCUIT_BREAKER_OPEN_SECONDS", "30")
+	resetDependencyGuards()
+	t.Cleanup(resetDependencyGuards)
+}
+
+func TestCircuitBreaker_Transitions(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker("test", 3, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	call := func(outcome callOutcome) bool {
+		if _, ok := b.allow(); !ok {
+			return false
+		}
+		b.record(outcome)
+		return true
+	}
+
+	// A success resets the consecutive failure count
+	call(callFailed)
+	call(callFailed)
+	call(callSucceeded)
+	call(callFailed)
+	call(callIgnored)
+	call(callFailed)
+	if b.State() != breakerClosed {
+		t.Fatalf("expected closed after non-consecutive failures, got %s", b.State())
+	}
+	call(callFailed)
+	if b.State() != breakerOpen {
+		t.Fatalf("expected open after 3 consecutive failures, got %s", b.State())
+	}
+	if wait, ok := b.allow(); ok || wait != 10*time.Second {
+		t.Fatalf("expected rejection with 10s wait, got %v %v", wait, ok)
+	}
+
+	// After the wait a single probe is let through
+	now = now.Add(10 * time.Second)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("expected a half-open probe")
+	}
+	if _, ok := b.allow(); ok {
+		t.Fatal("expected a second concurrent probe to be rejected")
+	}
+	b.record(callFailed)
+	if b.State() != breakerOpen {
+		t.Fatalf("expected a failed probe to reopen, got %s", b.State())
+	}
+
+	now = now.Add(10 * time.Second)
+	if !call(callSucceeded) || b.State() != breakerClosed {
+		t.Fatalf("expected a successful probe to close, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	b := NewCircuitBreaker("disabled", 0, time.Second)
+	for i := 0; i < 10; i++ {
+		b.allow()
+		b.record(callFailed)
+	}
+	if _, ok := b.allow(); !ok || b.State() != breakerClosed {
+		t.Error("a breaker with threshold 0 must never open")
+	}
+}
+
+func TestDependencyGuard_BulkheadRejectsOverLimit(t *testing.T) {
+	g := &dependencyGuard{name: "test", breaker: NewCircuitBreaker("test", 5, time.Second), bulkhead: NewBulkhead(1)}
+	entered, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- g.run(func() error {
+			close(entered)
+			<-release
+			return nil
+		}, nil)
+	}()
+	<-entered
+
+	err := g.run(func() error { t.Error("call over the limit must not run"); return nil }, nil)
+	var unavailable *DependencyUnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, ErrBulkheadFull) {
+		t.Fatalf("expected ErrBulkheadFull, got %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("first call failed: %v", err)
+	}
+	if err := g.run(func() error { return nil }, nil); err != nil {
+		t.Errorf("expected the slot to be released, got %v", err)
+	}
+}
+
+func TestHandleSummarize_VerifierBreakerFailsFast(t *testing.T) {
+	useFreshBreakers(t, 2)
+	var calls atomic.Int32
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer verifier.Close()
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	for i := 0; i < 2; i++ {
+		if w := paidRequest(t, r, `{"text":"hello"}`); w.Code != 500 {
+			t.Fatalf("expected 500 while the verifier fails, got %d", w.Code)
+		}
+	}
+	w := paidRequest(t, r, `{"text":"hello"}`)
+	if w.Code != 503 {
+		t.Fatalf("expected 503 once the breaker opened, got %d body=%s", w.Code, w.Body.String())
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 30 {
+		t.Errorf("expected Retry-After within the open period, got %q", w.Header().Get("Retry-After"))
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected the open breaker to skip the verifier, got %d calls", calls.Load())
+	}
+}
+
+func TestHandleSummarize_AIBreakerRefusesBeforePayment(t *testing.T) {
+	useFreshBreakers(t, 1)
+	useRefundTestEnv(t)
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": status(http.StatusBadGateway)})
+	t.Setenv("AI_MAX_RETRIES", "0")
+	r := newBalanceRouter(t)
+
+	// The first paid request fails and is refunded, opening the breaker
+	w := paidRequest(t, r, `{"text":"hello"}`)
+	if w.Code != 500 {
+		t.Fatalf("expected 500 from the failing provider, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// The next one is refused before its nonce is redeemed
+	before := refundCount(t)
+	w = paidRequest(t, r, `{"text":"hello"}`)
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d body=%s", w.Code, w.Body.String())
+	}
+	if refundCount(t) != before {
+		t.Error("a request refused by the breaker must not be recorded as a failed paid service")
+	}
+
+	gin.SetMode(gin.TestMode)
+	ready := gin.New()
+	ready.GET("/readyz", handleReadyz)
+	origVerifier, origOpenRouter := checkVerifierHealth, checkOpenRouterHealth
+	checkVerifierHealth = func() string { return "ok" }
+	checkOpenRouterHealth = func() string { return "ok" }
+	defer func() { checkVerifierHealth, checkOpenRouterHealth = origVerifier, origOpenRouter }()
+
+	w = httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var resp struct {
+		Checks struct {
+			Breakers map[string]struct {
+				State string `json:"state"`
+			} `json:"breakers"`
+		} `json:"checks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if got := resp.Checks.Breakers["ai:openrouter"].State; got != "open" {
+		t.Errorf("expected /readyz to report the open AI breaker, got %q in %s", got, w.Body.String())
+	}
+	if got := resp.Checks.Breakers["verifier"].State; got != "closed" {
+		t.Errorf("expected a closed verifier breaker, got %q", got)
+	}
+}
+
+func refundCount(t *testing.T) int {
+	t.Helper()
+	entries, err := refundStore.List(t.Context(), testWallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
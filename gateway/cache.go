@@ -3,33 +3,45 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// CachedResponse represents the data stored in Redis
+// CachedResponse is a cached AI result
 type CachedResponse struct {
-	Result   string `json:"result"`
+	Result string `json:"result"`
+	// Model is the model that produced Result (empty for entries written
+	// before failover existed, which were always served by the primary model)
+	Model    string `json:"model,omitempty"`
 	CachedAt int64  `json:"cached_at"`
+	// Version is the descriptor version of the request (0 before versioned
+	// descriptors), so outdated entries can be invalidated together
+	Version int `json:"version,omitempty"`
+	// SoftExpiresAt and ExpiresAt are the Unix times at which the entry
+	// turns stale and at which it is dropped (0 for older entries)
+	SoftExpiresAt int64 `json:"soft_expires_at,omitempty"`
+	ExpiresAt     int64 `json:"expires_at,omitempty"`
+	// Error marks a negative entry: the provider rejected the request and
+	// Result is empty
+	Error *CachedAIError `json:"error,omitempty"`
 }
 
 func CacheMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Only cache if Redis is available
-		if redisClient == nil {
+		// Only cache if a cache is configured and the route is an AI operation
+		op := lookupAIOperation(c)
+		if responseCache == nil || op == nil {
 			c.Next()
 			return
 		}
@@ -38,9 +50,12 @@ func CacheMiddleware() gin.HandlerFunc {
 		signature := c.GetHeader("X-402-Signature")
 		nonce := c.GetHeader("X-402-Nonce")
 
+		// Prepaid and refund-funded requests are charged instead of verified
+		unsigned := signature == "" && unsignedFundingRequested(c)
+
 		// If no signature, we can't verify payment, so bypass cache
 		// (Handler will reject it anyway)
-		if signature == "" || nonce == "" {
+		if !unsigned && (signature == "" || nonce == "") {
 			c.Next()
 			return
 		}
@@ -82,180 +97,282 @@ func CacheMiddleware() gin.HandlerFunc {
 			c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
 		}
 
-		// Parse body to get text for cache key
-		// Note: Cache key is based on text+model at request time. If model env var changes
-		// between cache key generation and AI call, there could be a mismatch, but this
-		// is acceptable since the model should not change during normal operation.
-		var req SummarizeRequest
-		if err := json.Unmarshal(requestBody, &req); err != nil {
-			// Invalid JSON - reject immediately to prevent cache bypass attacks
-			log.Printf("[DEBUG] Invalid JSON in request: %v", err)
-			c.JSON(400, gin.H{"error": "Invalid request body", "message": "Request must be valid JSON"})
+		// The descriptor covers everything sent to the provider, so the key
+		// changes whenever the request would. The handler reuses it.
+		desc, err := op.Describe(requestBody)
+		if err != nil {
+			// Reject immediately to prevent cache bypass attacks
+			respondInvalidAIRequest(c, err)
 			c.Abort()
 			return
 		}
+		c.Set("ai_descriptor", desc)
+		cacheKey := desc.CacheKey()
 
-		// Validate text is not empty
-		if req.Text == "" {
-			c.JSON(400, gin.H{"error": "Invalid request", "message": "text field cannot be empty"})
-			c.Abort()
+		// Check Cache
+		_, span := startSpan(c.Request.Context(), "cacheLookup")
+		cached, err := getFromCache(c.Request.Context(), cacheKey)
+		span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+		span.End()
+		if err == nil {
+			stale := false
+			switch {
+			case cached.Error != nil:
+				log.Printf("Cache NEGATIVE HIT: %s", cacheKey)
+				recordCacheLookup("negative")
+			case cached.isStale(time.Now()):
+				log.Printf("Cache STALE HIT: %s", cacheKey)
+				recordCacheLookup("stale")
+				stale = true
+			default:
+				log.Printf("Cache HIT: %s", cacheKey)
+				recordCacheLookup("hit")
+			}
+			// Serve the stale result now and, once this request has paid for
+			// it, refresh it for later callers
+			if serveCacheEntry(c, cached, desc.Model, unsigned, requestBody) && stale {
+				cacheWrites.Add(1)
+				go func() {
+					defer cacheWrites.Done()
+					refreshCacheEntry(desc, cacheKey)
+				}()
+			}
 			return
 		}
 
-		// Generate Cache Key (include model to prevent cache collisions)
-		model := os.Getenv("OPENROUTER_MODEL")
-		if model == "" {
-			model = "z-ai/glm-4.5-air:free"
+		// Cache MISS
+		log.Printf("Cache MISS: %s", cacheKey)
+		recordCacheLookup("miss")
+
+		if !getCacheCoalesceEnabled() {
+			fillCache(c, cacheKey, func() {})
+			return
 		}
-		cacheKey := getCacheKey(req.Text, model)
 
-		// Check Cache
-		if cached, err := getFromCache(c.Request.Context(), cacheKey); err == nil {
-			log.Printf("Cache HIT: %s", cacheKey)
-
-			// Cache HIT! -> Verify Payment *BEFORE* serving
-			// verifyPayment creates its own timeout context, so pass request context directly
-			timestampStr := c.GetHeader("X-402-Timestamp")
-			if timestampStr == "" {
-				c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Missing X-402-Timestamp header"})
-				c.Abort()
+		// Identical concurrent misses share one upstream call: within this
+		// process through singleflight, across replicas through a Redis lock
+		// when the cache is shared.
+		// Waiters still pay for the shared result like a cache hit.
+		for {
+			shared, ran, filled, err := coalesceCacheFill(c, cacheKey)
+			if filled {
 				return
 			}
-			timestamp, err := strconv.ParseUint(timestampStr, 10, 64)
-			if err != nil || timestamp == 0 {
-				c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Invalid X-402-Timestamp header"})
-				c.Abort()
-				return
+			if errors.Is(err, errCacheFillFailed) || errors.Is(err, errCacheFillAbandoned) {
+				// The shared call failed, e.g. its payment was rejected or
+				// the provider errored; coalesce again, so one waiter tries
+				// on its own account while the others keep waiting
+				continue
 			}
-			verifyResp, paymentCtx, err := verifyPayment(c.Request.Context(), signature, nonce, timestamp)
 			if err != nil {
-				log.Printf("Verification error on cache hit: %v", err)
-				if errors.Is(err, context.DeadlineExceeded) {
-					c.JSON(504, gin.H{"error": "Gateway Timeout", "message": "Verifier request timed out"})
-				} else {
-					c.JSON(500, gin.H{"error": "Verification Service Failed", "message": "An internal error occurred"})
-				}
-				c.Abort()
+				// The request ended while waiting; it has not been charged
+				c.AbortWithStatusJSON(504, gin.H{"error": "Gateway Timeout", "message": "Request exceeded maximum allowed time"})
 				return
 			}
-
-			if !verifyResp.IsValid {
-				// Check for timestamp-related errors (E007, E008, E009)
-				if strings.HasPrefix(verifyResp.Error, "E007") ||
-					strings.HasPrefix(verifyResp.Error, "E008") ||
-					strings.HasPrefix(verifyResp.Error, "E009") {
-					c.JSON(400, gin.H{"error": "Invalid timestamp", "details": verifyResp.Error})
-				} else {
-					c.JSON(403, gin.H{"error": "Invalid Signature", "details": verifyResp.Error})
-				}
-				c.Abort()
-				return
+			if !ran {
+				cacheCoalescedTotal.WithLabelValues("process").Inc()
 			}
-
-			// Payment Verified. Store verification for downstream if needed (though we abort)
-			c.Set("payment_verification", verifyResp)
-			c.Set("payment_context", paymentCtx)
-
-			// Generate Receipt and Respond
-			// We treat the cached result as the AI result
-			// Generate receipt for cache hit using current request and cached result.
-			// Note: request_hash matches current request, response is from cache,
-			// but both are cryptographically valid since cache key ensures identical text.
-			if err := generateAndSendReceipt(c, *paymentCtx, verifyResp.RecoveredAddress, requestBody, cached.Result); err != nil {
-				log.Printf("Failed to send cached response receipt: %v", err)
-				// generateAndSendReceipt already sent an error response (500)
-			}
-			c.Abort()
+			serveCacheEntry(c, shared, desc.Model, unsigned, requestBody)
 			return
 		}
+	}
+}
 
-		// Cache MISS
-		log.Printf("Cache MISS: %s", cacheKey)
+// serveCacheEntry answers from a cache entry, negative or not, and reports
+// whether the request was charged for it
+func serveCacheEntry(c *gin.Context, cached *CachedResponse, model string, unsigned bool, requestBody []byte) bool {
+	if cached.Error != nil {
+		respondNegativeCacheHit(c, cached.Error)
+		return false
+	}
+	return serveCachedResponse(c, cached, model, unsigned, requestBody)
+}
 
-		// Prepare to capture response
-		writer := &cachedWriter{
-			ResponseWriter: c.Writer,
-			body:           &bytes.Buffer{},
-			cacheKey:       cacheKey,
+// serveCachedResponse charges the request like any paid request and serves
+// cached with a receipt of its own, then aborts the chain. It reports whether
+// the payment was accepted.
+func serveCachedResponse(c *gin.Context, cached *CachedResponse, model string, unsigned bool, requestBody []byte) bool {
+	defer c.Abort()
+
+	// Charge the balance or verify payment *BEFORE* serving
+	var paymentCtx *PaymentContext
+	var payer string
+	if unsigned {
+		var ok bool
+		if paymentCtx, payer, ok = chargeUnsigned(c, lookupPaidRoute(c), requestBody); !ok {
+			return false
 		}
-		c.Writer = writer
-
-		c.Next()
-
-		// Handler finished. Check status and extract result with proper locking
-		writer.mu.RLock()
-		statusCode := writer.ResponseWriter.Status()
-		bodyBytes := writer.body.Bytes()
-		writer.mu.RUnlock()
-
-		if statusCode == 200 {
-			// Response format: {"result": "...", "receipt": ...}
-			var resp map[string]interface{}
-			if err := json.Unmarshal(bodyBytes, &resp); err == nil {
-				if result, ok := resp["result"].(string); ok {
-					// Store asynchronously with a deadline to prevent indefinite goroutines
-					go func(k, v string) {
-						ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-						defer cancel()
-						storeInCache(ctx, k, v)
-					}(cacheKey, result)
-				}
+	} else {
+		// verifyPayment creates its own timeout context, so pass request context directly
+		timestampStr := c.GetHeader("X-402-Timestamp")
+		if timestampStr == "" {
+			c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Missing X-402-Timestamp header"})
+			return false
+		}
+		timestamp, err := strconv.ParseUint(timestampStr, 10, 64)
+		if err != nil || timestamp == 0 {
+			c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Invalid X-402-Timestamp header"})
+			return false
+		}
+		nonce := c.GetHeader("X-402-Nonce")
+		verifyResp, verifiedCtx, err := verifyPayment(c.Request.Context(), lookupPaidRoute(c), c.GetHeader("X-402-Signature"), nonce, timestamp, requestBody)
+		if err != nil {
+			log.Printf("Verification error on cache hit: %v", err)
+			respondVerificationError(c, err)
+			return false
+		}
+
+		if !verifyResp.IsValid {
+			// Check for timestamp-related errors (E007, E008, E009)
+			if strings.HasPrefix(verifyResp.Error, "E007") ||
+				strings.HasPrefix(verifyResp.Error, "E008") ||
+				strings.HasPrefix(verifyResp.Error, "E009") {
+				c.JSON(400, gin.H{"error": "Invalid timestamp", "details": verifyResp.Error})
+			} else {
+				c.JSON(403, gin.H{"error": "Invalid Signature", "details": verifyResp.Error})
 			}
+			return false
 		}
-	}
-}
 
-func getCacheKey(text string, model string) string {
-	// IMPORTANT: This cache key ONLY includes text and model.
-	// Cache version v1 - if parameters change, increment version to invalidate old caches
-	// If callOpenRouter() is modified to accept additional parameters
-	// (temperature, max_tokens, top_p, etc.), those MUST be added to
-	// this cache key to prevent incorrect cache hits.
-	// TODO: Consider accepting a struct with all OpenRouter parameters
-	const cacheVersion = "v1"
-	combined := cacheVersion + ":" + text + ":" + model
-	hash := sha256.Sum256([]byte(combined))
-	return "ai:summary:" + hex.EncodeToString(hash[:])
-}
+		if !checkWalletRateLimit(c, verifyResp.RecoveredAddress) {
+			return false
+		}
 
-func getFromCache(ctx context.Context, key string) (*CachedResponse, error) {
-	if redisClient == nil {
-		return nil, fmt.Errorf("redis not available")
+		// Signature is valid: redeem the nonce so a cached result cannot be replayed
+		if !redeemNonce(c, nonce) {
+			return false
+		}
+
+		// Payment Verified. Store verification for downstream if needed (though we abort)
+		c.Set("payment_verification", verifyResp)
+		paymentCtx, payer = verifiedCtx, verifyResp.RecoveredAddress
+	}
+	c.Set("payment_context", paymentCtx)
+
+	// Generate Receipt and Respond
+	// We treat the cached result as the AI result
+	// Generate receipt for cache hit using current request and cached result.
+	// Note: request_hash matches current request, response is from cache,
+	// but both are cryptographically valid since cache key ensures identical text.
+	servedBy := cached.Model
+	if servedBy == "" {
+		servedBy = model
 	}
+	if wantsEventStream(c) {
+		streamCachedResult(c, *paymentCtx, payer, requestBody, cached.Result, servedBy)
+	} else if err := generateAndSendReceipt(c, *paymentCtx, payer, requestBody, cached.Result, servedBy); err != nil {
+		log.Printf("Failed to send cached response receipt: %v", err)
+		// generateAndSendReceipt already sent an error response (500)
+	}
+	return true
+}
 
-	val, err := redisClient.Get(ctx, key).Result()
-	if err != nil {
-		return nil, err
+// fillCache runs the handler on a cache miss and stores its result. release
+// is called once the result is stored, or at once if there is none. The
+// result, negative or not, is returned so concurrent waiters can share it.
+func fillCache(c *gin.Context, cacheKey string, release func()) (*CachedResponse, bool) {
+	// Prepare to capture response
+	writer := &cachedWriter{
+		ResponseWriter: c.Writer,
+		body:           &bytes.Buffer{},
+		cacheKey:       cacheKey,
+	}
+	c.Writer = writer
+
+	c.Next()
+
+	// Handler finished. Check status and extract result with proper locking
+	writer.mu.RLock()
+	statusCode := writer.ResponseWriter.Status()
+	bodyBytes := writer.body.Bytes()
+	writer.mu.RUnlock()
+
+	if statusCode != 200 {
+		if failure, ok := c.Get("ai_error"); ok {
+			// Keep the rejection so the same input is not sent again
+			cached := CachedResponse{Error: failure.(*CachedAIError), CachedAt: time.Now().Unix()}
+			cacheWrites.Add(1)
+			go func() {
+				defer cacheWrites.Done()
+				defer release()
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				storeInCache(ctx, cacheKey, &cached)
+			}()
+			return &cached, true
+		}
+		release()
+		return nil, false
+	}
+	// Response format: {"result": "...", "receipt": ...}. Streamed
+	// responses are SSE, so the handler hands the full result over in
+	// the context instead.
+	result, ok := c.Get("streamed_result")
+	servedBy := c.GetString("streamed_model")
+	if !ok {
+		var resp map[string]interface{}
+		if err := json.Unmarshal(bodyBytes, &resp); err == nil {
+			result, ok = resp["result"].(string)
+			servedBy, _ = resp["model"].(string)
+		}
+	}
+	if !ok {
+		release()
+		return nil, false
 	}
 
-	var cached CachedResponse
-	if err := json.Unmarshal([]byte(val), &cached); err != nil {
-		return nil, err
+	cached := &CachedResponse{Result: result.(string), Model: servedBy, CachedAt: time.Now().Unix()}
+	if desc, ok := c.Get("ai_descriptor"); ok {
+		cached.Version = desc.(*AIRequestDescriptor).Version
 	}
 
-	return &cached, nil
+	// Store asynchronously with a deadline to prevent indefinite goroutines.
+	// The fill lock is held until then so other replicas find the entry.
+	cacheWrites.Add(1)
+	go func(k string, v CachedResponse) {
+		defer cacheWrites.Done()
+		defer release()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		storeInCache(ctx, k, &v)
+	}(cacheKey, *cached)
+	return cached, true
 }
 
-func storeInCache(ctx context.Context, key string, data string) {
-	if redisClient == nil {
-		return
+// getFromCache looks key up in the response cache
+func getFromCache(ctx context.Context, key string) (*CachedResponse, error) {
+	if responseCache == nil {
+		return nil, fmt.Errorf("response cache not enabled")
 	}
+	return responseCache.Get(ctx, key)
+}
 
-	ttl := time.Duration(getEnvAsInt("CACHE_TTL_SECONDS", 3600)) * time.Second
-
-	cached := CachedResponse{
-		Result:   data,
-		CachedAt: time.Now().Unix(),
+// storeInCache caches a result, fresh for CACHE_SOFT_TTL_SECONDS and kept
+// for CACHE_TTL_SECONDS, or a negative entry for CACHE_NEGATIVE_TTL_SECONDS.
+// Results over CACHE_MAX_ENTRY_BYTES are skipped. It sets the expiry times
+// of cached and logs failures.
+func storeInCache(ctx context.Context, key string, cached *CachedResponse) {
+	if responseCache == nil {
+		return
 	}
-
-	jsonData, err := json.Marshal(cached)
-	if err != nil {
-		log.Printf("[WARNING] Failed to marshal cache data for key %s: %v", safeKeyPrefix(key), err)
+	ttl, softTTL := getCacheTTL(), getCacheSoftTTL()
+	if cached.Error != nil {
+		ttl, softTTL = getCacheNegativeTTL(), getCacheNegativeTTL()
+	}
+	if maxBytes := getCacheMaxEntryBytes(); maxBytes > 0 && len(cached.Result) > maxBytes {
+		// Served to this caller but not kept
+		log.Printf("Not caching %d-byte result for key %s (CACHE_MAX_ENTRY_BYTES=%d)", len(cached.Result), safeKeyPrefix(key), maxBytes)
+		cacheOversizedTotal.Inc()
 		return
 	}
+	if cached.CachedAt == 0 {
+		cached.CachedAt = time.Now().Unix()
+	}
+	cached.SoftExpiresAt = cached.CachedAt + int64(softTTL/time.Second)
+	cached.ExpiresAt = cached.CachedAt + int64(ttl/time.Second)
 
 	// Use the context provided by caller (already has 5s timeout from async goroutine)
-	if err := redisClient.Set(ctx, key, jsonData, ttl).Err(); err != nil {
+	if err := responseCache.Set(ctx, key, cached, ttl); err != nil {
 		log.Printf("[WARNING] Failed to store in cache for key %s: %v", safeKeyPrefix(key), err)
 	}
 }
@@ -288,3 +405,11 @@ func (w *cachedWriter) WriteString(s string) (int, error) {
 	w.body.WriteString(s)
 	return w.ResponseWriter.WriteString(s)
 }
+
+// StartStreaming forwards to the wrapped writer so streamed responses are
+// not held back by a timeout middleware's buffer
+func (w *cachedWriter) StartStreaming() {
+	if s, ok := w.ResponseWriter.(streamingWriter); ok {
+		s.StartStreaming()
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cacheLookups counts CacheMiddleware lookups since start by result (hit,
+// stale, negative, miss) for the admin hit ratio; Prometheus keeps the same
+// counts in paygate_cache_requests_total
+var cacheLookups sync.Map
+
+// recordCacheLookup counts a cache lookup
+func recordCacheLookup(result string) {
+	counter, _ := cacheLookups.LoadOrStore(result, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(1)
+	cacheRequestsTotal.WithLabelValues(result).Inc()
+}
+
+func cacheLookupCount(result string) int64 {
+	if counter, ok := cacheLookups.Load(result); ok {
+		return counter.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// getAdminAPIToken returns ADMIN_API_TOKEN. Admin routes are only served
+// when it is set.
+func getAdminAPIToken() string {
+	return os.Getenv("ADMIN_API_TOKEN")
+}
+
+// registerCacheAdminRoutes adds the cache admin endpoints to an
+// authenticated group
+func registerCacheAdminRoutes(g *gin.RouterGroup) {
+	g.GET("/stats", handleCacheStats)
+	g.GET("/entries/:key", handleGetCacheEntry)
+	g.DELETE("/entries/:key", handleDeleteCacheEntry)
+	g.POST("/lookup", handleCacheLookup)
+	g.POST("/invalidate", handleInvalidateCache)
+}
+
+// cacheBackendName names the backend actually in use, which differs from
+// CACHE_BACKEND after a fallback to memory
+func cacheBackendName(cache ResponseCache) string {
+	switch cache.(type) {
+	case *RedisResponseCache:
+		return "redis"
+	case *MemoryResponseCache:
+		return "memory"
+	case *TieredResponseCache:
+		return "tiered"
+	}
+	return "custom"
+}
+
+// adminCacheKey validates a key from a request. Only cache keys are
+// accepted so admin calls cannot touch nonces, receipts or balances stored
+// in the same Redis.
+func adminCacheKey(c *gin.Context, key string) (string, bool) {
+	if !strings.HasPrefix(key, cacheKeyPrefix) {
+		c.JSON(400, gin.H{"error": "Invalid cache key", "message": "Cache keys start with " + cacheKeyPrefix})
+		return "", false
+	}
+	return key, true
+}
+
+// handleCacheStats handles GET /admin/cache/stats
+func handleCacheStats(c *gin.Context) {
+	stats, err := responseCache.Stats(c.Request.Context())
+	if err != nil {
+		log.Printf("Cache stats failed: %v", err)
+		c.JSON(500, gin.H{"error": "Cache unavailable", "message": "An internal error occurred"})
+		return
+	}
+	// Stale and negative hits spare a provider call too
+	stale, negative := cacheLookupCount("stale"), cacheLookupCount("negative")
+	hits, misses := cacheLookupCount("hit")+stale+negative, cacheLookupCount("miss")
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+	c.JSON(200, gin.H{
+		"backend":       cacheBackendName(responseCache),
+		"shared":        responseCache.Shared(),
+		"entries":       stats.Entries,
+		"bytes":         stats.Bytes,
+		"hits":          hits,
+		"stale_hits":    stale,
+		"negative_hits": negative,
+		"misses":        misses,
+		"hit_ratio":     hitRatio,
+	})
+}
+
+// handleGetCacheEntry handles GET /admin/cache/entries/:key
+func handleGetCacheEntry(c *gin.Context) {
+	key, ok := adminCacheKey(c, c.Param("key"))
+	if !ok {
+		return
+	}
+	respondCacheEntry(c, key)
+}
+
+// handleCacheLookup handles POST /admin/cache/lookup. The body carries an
+// operation and either the hash of a cache key or the request body a client
+// would send for it, which is hashed exactly as CacheMiddleware does.
+func handleCacheLookup(c *gin.Context) {
+	var req struct {
+		Operation string          `json:"operation"`
+		Hash      string          `json:"hash"`
+		Request   json.RawMessage `json:"request"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Hash == "" && len(req.Request) == 0) {
+		c.JSON(400, gin.H{"error": "Invalid request", "message": "hash or request is required"})
+		return
+	}
+	if req.Operation == "" {
+		req.Operation = summarizeOperation.Name
+	}
+	op := findAIOperation(req.Operation)
+	if op == nil {
+		c.JSON(400, gin.H{"error": "Invalid request", "message": "Unknown operation " + req.Operation})
+		return
+	}
+	if req.Hash != "" {
+		hash := strings.ToLower(req.Hash)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			c.JSON(400, gin.H{"error": "Invalid request", "message": "hash must be a hex SHA-256"})
+			return
+		}
+		respondCacheEntry(c, cacheKeyForHash(op.Name, hash))
+		return
+	}
+	desc, err := op.Describe(req.Request)
+	if err != nil {
+		respondInvalidAIRequest(c, err)
+		return
+	}
+	respondCacheEntry(c, desc.CacheKey())
+}
+
+// findAIOperation returns the operation called name, or nil
+func findAIOperation(name string) *AIOperation {
+	for _, op := range aiOperations {
+		if op.Name == name {
+			return op
+		}
+	}
+	return nil
+}
+
+func respondCacheEntry(c *gin.Context, key string) {
+	cached, err := responseCache.Get(c.Request.Context(), key)
+	if errors.Is(err, ErrCacheMiss) {
+		c.JSON(404, gin.H{"error": "Cache entry not found", "key": key})
+		return
+	}
+	if err != nil {
+		log.Printf("Cache lookup failed for key %s: %v", safeKeyPrefix(key), err)
+		c.JSON(500, gin.H{"error": "Cache unavailable", "message": "An internal error occurred"})
+		return
+	}
+	c.JSON(200, gin.H{"key": key, "entry": cached})
+}
+
+// handleDeleteCacheEntry handles DELETE /admin/cache/entries/:key
+func handleDeleteCacheEntry(c *gin.Context) {
+	key, ok := adminCacheKey(c, c.Param("key"))
+	if !ok {
+		return
+	}
+	deleted, err := responseCache.Delete(c.Request.Context(), key)
+	if err != nil {
+		log.Printf("Cache delete failed for key %s: %v", safeKeyPrefix(key), err)
+		c.JSON(500, gin.H{"error": "Cache unavailable", "message": "An internal error occurred"})
+		return
+	}
+	recordAudit(c, "cache.delete", map[string]interface{}{"key": key}, map[string]interface{}{"deleted": deleted})
+	if !deleted {
+		c.JSON(404, gin.H{"error": "Cache entry not found", "key": key})
+		return
+	}
+	c.JSON(200, gin.H{"key": key, "deleted": true})
+}
+
+// cacheInvalidation selects the entries POST /admin/cache/invalidate
+// deletes. Every given filter must match.
+type cacheInvalidation struct {
+	// Prefix matches the start of the key, e.g. "ai:summary:" for one
+	// operation or "ai:" for every entry
+	Prefix string `json:"prefix,omitempty"`
+	// Model matches the model that produced the result
+	Model string `json:"model,omitempty"`
+	// Version matches the descriptor version; 0 selects entries written
+	// before versions were recorded
+	Version *int `json:"version,omitempty"`
+}
+
+func (f cacheInvalidation) matches(key string, cached *CachedResponse) bool {
+	if f.Prefix != "" && !strings.HasPrefix(key, f.Prefix) {
+		return false
+	}
+	if f.Model != "" {
+		model := cached.Model
+		if model == "" {
+			// Entries from before failover were served by the primary model
+			model = getOpenRouterModel()
+		}
+		if model != f.Model {
+			return false
+		}
+	}
+	return f.Version == nil || cached.Version == *f.Version
+}
+
+// handleInvalidateCache handles POST /admin/cache/invalidate. At least one
+// filter is required so an empty body cannot flush the cache by accident.
+func handleInvalidateCache(c *gin.Context) {
+	var filter cacheInvalidation
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+	if filter.Prefix == "" && filter.Model == "" && filter.Version == nil {
+		c.JSON(400, gin.H{"error": "Invalid request", "message": "At least one of prefix, model or version is required"})
+		return
+	}
+	if filter.Prefix != "" && !strings.HasPrefix(filter.Prefix, cacheKeyPrefix) {
+		c.JSON(400, gin.H{"error": "Invalid cache key", "message": "Cache keys start with " + cacheKeyPrefix})
+		return
+	}
+	deleted, err := responseCache.DeleteWhere(c.Request.Context(), filter.matches)
+	target := map[string]interface{}{"prefix": filter.Prefix, "model": filter.Model, "version": filter.Version}
+	if err != nil {
+		// Some entries may be gone already, so the attempt is audited too
+		recordAudit(c, "cache.invalidate", target, map[string]interface{}{"deleted": deleted, "error": err.Error()})
+		log.Printf("Cache invalidation failed after %d entries: %v", deleted, err)
+		c.JSON(500, gin.H{"error": "Cache unavailable", "message": "An internal error occurred", "deleted": deleted})
+		return
+	}
+	recordAudit(c, "cache.invalidate", target, map[string]interface{}{"deleted": deleted})
+	c.JSON(200, gin.H{"deleted": deleted})
+}
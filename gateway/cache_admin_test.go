@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// recordingAuditTrail keeps audit events in memory
+type recordingAuditTrail struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (r *recordingAuditTrail) Record(ctx context.Context, event AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+// newCacheAdminRouter serves the admin API over cache with token "secret"
+// and returns the audit trail it records to
+func newCacheAdminRouter(t *testing.T, cache ResponseCache) (*gin.Engine, *recordingAuditTrail) {
+	t.Helper()
+	responseCache = cache
+	trail := &recordingAuditTrail{}
+	origTrail := auditTrail
+	auditTrail = trail
+	t.Cleanup(func() { responseCache, auditTrail = nil, origTrail })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CorrelationIDMiddleware())
+	registerCacheAdminRoutes(r.Group("/admin/cache", AdminAuthMiddleware("secret")))
+	return r, trail
+}
+
+func adminRequest(r *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	r, _ := newCacheAdminRouter(t, NewMemoryResponseCache(10, 0))
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Bearer secret2"} {
+		req := httptest.NewRequest("GET", "/admin/cache/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("Authorization %q: expected 401, got %d", auth, w.Code)
+		}
+	}
+	if w := adminRequest(r, "GET", "/admin/cache/stats", ""); w.Code != 200 {
+		t.Errorf("expected the token to be accepted, got %d", w.Code)
+	}
+}
+
+func TestCacheAdmin_StatsAndLookup(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryResponseCache(10, 0)
+	r, _ := newCacheAdminRouter(t, cache)
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	key := describeSummary("primary", "hello").CacheKey()
+	cache.Set(ctx, key, cachedResult("cached hello"), time.Minute)
+
+	hits, misses := cacheLookupCount("hit")+cacheLookupCount("stale")+cacheLookupCount("negative"), cacheLookupCount("miss")
+	recordCacheLookup("hit")
+	recordCacheLookup("miss")
+	w := adminRequest(r, "GET", "/admin/cache/stats", "")
+	var stats struct {
+		Backend      string
+		Entries      int
+		Bytes        int64
+		Hits, Misses int64
+	}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if w.Code != 200 || stats.Backend != "memory" || stats.Entries != 1 || stats.Bytes == 0 {
+		t.Errorf("unexpected stats %d %s", w.Code, w.Body.String())
+	}
+	if stats.Hits != hits+1 || stats.Misses != misses+1 {
+		t.Errorf("expected the lookups to be counted, got %s", w.Body.String())
+	}
+
+	if w := adminRequest(r, "GET", "/admin/cache/entries/"+key, ""); w.Code != 200 || !strings.Contains(w.Body.String(), "cached hello") {
+		t.Errorf("expected the entry by key, got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, "POST", "/admin/cache/lookup", `{"request":{"text":"hello"}}`); w.Code != 200 || !strings.Contains(w.Body.String(), key) {
+		t.Errorf("expected the entry for the request body, got %d %s", w.Code, w.Body.String())
+	}
+	hash := strings.TrimPrefix(key, "ai:summary:")
+	if w := adminRequest(r, "POST", "/admin/cache/lookup", `{"hash":"`+hash+`"}`); w.Code != 200 || !strings.Contains(w.Body.String(), "cached hello") {
+		t.Errorf("expected the entry for the key hash, got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, "POST", "/admin/cache/lookup", `{"hash":"not-a-hash"}`); w.Code != 400 {
+		t.Errorf("expected 400 for a malformed hash, got %d", w.Code)
+	}
+	if w := adminRequest(r, "POST", "/admin/cache/lookup", `{"request":{"text":"other"}}`); w.Code != 404 {
+		t.Errorf("expected 404 for an uncached request, got %d", w.Code)
+	}
+	if w := adminRequest(r, "POST", "/admin/cache/lookup", `{"operation":"nope","request":{}}`); w.Code != 400 {
+		t.Errorf("expected 400 for an unknown operation, got %d", w.Code)
+	}
+	if w := adminRequest(r, "GET", "/admin/cache/entries/nonce:abc", ""); w.Code != 400 {
+		t.Errorf("expected keys outside the cache to be rejected, got %d", w.Code)
+	}
+}
+
+func TestCacheAdmin_DeleteIsAudited(t *testing.T) {
+	cache := NewMemoryResponseCache(10, 0)
+	r, trail := newCacheAdminRouter(t, cache)
+	cache.Set(context.Background(), "ai:summary:abc", cachedResult("x"), time.Minute)
+
+	if w := adminRequest(r, "DELETE", "/admin/cache/entries/ai:summary:abc", ""); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if cache.Len() != 0 {
+		t.Error("expected the entry to be deleted")
+	}
+	if w := adminRequest(r, "DELETE", "/admin/cache/entries/ai:summary:abc", ""); w.Code != 404 {
+		t.Errorf("expected 404 for a missing entry, got %d", w.Code)
+	}
+	if len(trail.events) != 2 {
+		t.Fatalf("expected both deletes to be audited, got %d events", len(trail.events))
+	}
+	event := trail.events[0]
+	if event.Action != "cache.delete" || event.Target["key"] != "ai:summary:abc" || event.Result["deleted"] != true || event.RequestID == "" || event.Actor == "" {
+		t.Errorf("unexpected audit event %+v", event)
+	}
+}
+
+func TestCacheAdmin_Invalidate(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryResponseCache(10, 0)
+	r, trail := newCacheAdminRouter(t, cache)
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	entries := map[string]*CachedResponse{
+		"ai:summary:1":   {Result: "a", Model: "primary", Version: 2},
+		"ai:summary:2":   {Result: "b", Model: "fallback", Version: 2},
+		"ai:summary:3":   {Result: "c", Version: 0}, // Written before failover by the primary
+		"ai:translate:1": {Result: "d", Model: "primary", Version: 2},
+	}
+	for key, value := range entries {
+		cache.Set(ctx, key, value, time.Minute)
+	}
+
+	if w := adminRequest(r, "POST", "/admin/cache/invalidate", `{}`); w.Code != 400 {
+		t.Errorf("expected an empty filter to be rejected, got %d", w.Code)
+	}
+	if w := adminRequest(r, "POST", "/admin/cache/invalidate", `{"prefix":"lock:"}`); w.Code != 400 {
+		t.Errorf("expected a prefix outside the cache to be rejected, got %d", w.Code)
+	}
+
+	remaining := func(keys ...string) {
+		t.Helper()
+		for key := range entries {
+			_, err := cache.Get(ctx, key)
+			want := false
+			for _, k := range keys {
+				want = want || k == key
+			}
+			if (err == nil) != want {
+				t.Errorf("%s: expected present=%v, got %v", key, want, err)
+			}
+		}
+	}
+	w := adminRequest(r, "POST", "/admin/cache/invalidate", `{"model":"primary","prefix":"ai:summary:"}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"deleted":2`) {
+		t.Fatalf("expected 2 primary summaries to be deleted, got %d %s", w.Code, w.Body.String())
+	}
+	remaining("ai:summary:2", "ai:translate:1")
+
+	if w := adminRequest(r, "POST", "/admin/cache/invalidate", `{"version":2}`); w.Code != 200 || !strings.Contains(w.Body.String(), `"deleted":2`) {
+		t.Fatalf("expected the version 2 entries to be deleted, got %d %s", w.Code, w.Body.String())
+	}
+	remaining()
+
+	if len(trail.events) != 2 || trail.events[0].Action != "cache.invalidate" || trail.events[0].Target["model"] != "primary" || trail.events[0].Result["deleted"] != 2 {
+		t.Errorf("expected the invalidations to be audited, got %+v", trail.events)
+	}
+}
+
+func TestRedisResponseCache_Admin(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skipf("Redis unavailable, skipping integration test: %v", err)
+	}
+	cache := NewRedisResponseCache(client)
+	prefix := "ai:admintest" + time.Now().Format("150405.000000") + ":"
+	for i, model := range []string{"m1", "m1", "m2"} {
+		cache.Set(ctx, prefix+string(rune('a'+i)), &CachedResponse{Result: "x", Model: model}, time.Minute)
+	}
+	client.Set(ctx, "lock:"+prefix+"a", "token", time.Minute) // Not a cache entry
+	defer client.Del(ctx, prefix+"a", prefix+"b", prefix+"c", "lock:"+prefix+"a")
+
+	stats, err := cache.Stats(ctx)
+	if err != nil || stats.Entries < 3 || stats.Bytes == 0 {
+		t.Errorf("unexpected stats %+v %v", stats, err)
+	}
+	n, err := cache.DeleteWhere(ctx, cacheInvalidation{Prefix: prefix, Model: "m1"}.matches)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 deletions, got %d %v", n, err)
+	}
+	if _, err := cache.Get(ctx, prefix+"c"); err != nil {
+		t.Errorf("expected the other model's entry to stay, got %v", err)
+	}
+	if deleted, err := cache.Delete(ctx, prefix+"c"); !deleted || err != nil {
+		t.Errorf("expected Delete to report the entry, got %v %v", deleted, err)
+	}
+	if _, err := cache.Get(ctx, prefix+"c"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected a miss after Delete, got %v", err)
+	}
+	if client.Exists(ctx, "lock:"+prefix+"a").Val() != 1 {
+		t.Error("expected keys outside the cache prefix to be left alone")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Stored cache entries start with a format marker. Plain JSON needs none:
+// it starts with '{', which is how entries from before compression are
+// stored.
+const cacheFormatGzip byte = 0x01
+
+// getCacheCompressMinBytes returns the encoded size from which entries are
+// gzip-compressed in Redis (CACHE_COMPRESS_MIN_BYTES, default 1024). 0
+// disables compression.
+func getCacheCompressMinBytes() int {
+	return getEnvAsInt("CACHE_COMPRESS_MIN_BYTES", 1024)
+}
+
+// getCacheMaxEntryBytes returns the largest result that is cached
+// (CACHE_MAX_ENTRY_BYTES, default 1 MiB). Larger results are served but not
+// stored. 0 removes the limit.
+func getCacheMaxEntryBytes() int {
+	return getEnvAsInt("CACHE_MAX_ENTRY_BYTES", 1<<20)
+}
+
+// encodeCacheEntry serializes value for a byte-oriented backend, gzipping
+// it when it is at least CACHE_COMPRESS_MIN_BYTES and compression helps.
+// Bytes saved are counted in paygate_cache_compression_saved_bytes_total.
+func encodeCacheEntry(value *CachedResponse) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("marshal cache entry: %w", err)
+	}
+	minBytes := getCacheCompressMinBytes()
+	if minBytes <= 0 || len(data) < minBytes {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(cacheFormatGzip)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("compress cache entry: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress cache entry: %w", err)
+	}
+	if buf.Len() >= len(data) {
+		// Incompressible, e.g. already dense text
+		return data, nil
+	}
+	cacheCompressionSavedBytes.Add(float64(len(data) - buf.Len()))
+	return buf.Bytes(), nil
+}
+
+// decodeCacheEntry reverses encodeCacheEntry, reading either format
+func decodeCacheEntry(data []byte) (*CachedResponse, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty cache entry")
+	}
+	switch data[0] {
+	case '{':
+	case cacheFormatGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("decompress cache entry: %w", err)
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("decompress cache entry: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown cache entry format 0x%02x", data[0])
+	}
+
+	var cached CachedResponse
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestCacheCodec_CompressesAboveThreshold(t *testing.T) {
+	t.Setenv("CACHE_COMPRESS_MIN_BYTES", "256")
+	small := cachedResult("short")
+	large := cachedResult(strings.Repeat("a repetitive summary ", 100))
+
+	data, err := encodeCacheEntry(small)
+	if err != nil || data[0] != '{' {
+		t.Fatalf("expected a small entry to stay plain JSON, got %q %v", data, err)
+	}
+
+	saved := testutil.ToFloat64(cacheCompressionSavedBytes)
+	data, err = encodeCacheEntry(large)
+	if err != nil || data[0] != cacheFormatGzip {
+		t.Fatalf("expected a large entry to be compressed, got %v", err)
+	}
+	plain, _ := json.Marshal(large)
+	if got := testutil.ToFloat64(cacheCompressionSavedBytes) - saved; got != float64(len(plain)-len(data)) || got <= 0 {
+		t.Errorf("expected %d saved bytes to be counted, got %v", len(plain)-len(data), got)
+	}
+	decoded, err := decodeCacheEntry(data)
+	if err != nil || decoded.Result != large.Result || decoded.Model != large.Model {
+		t.Errorf("round trip failed: %+v %v", decoded, err)
+	}
+
+	t.Setenv("CACHE_COMPRESS_MIN_BYTES", "0")
+	if data, _ := encodeCacheEntry(large); data[0] != '{' {
+		t.Error("expected CACHE_COMPRESS_MIN_BYTES=0 to disable compression")
+	}
+}
+
+func TestCacheCodec_DecodesLegacyEntries(t *testing.T) {
+	// Written by earlier versions as plain JSON
+	cached, err := decodeCacheEntry([]byte(`{"result":"old","cached_at":1700000000}`))
+	if err != nil || cached.Result != "old" {
+		t.Errorf("expected a plain JSON entry to decode, got %+v %v", cached, err)
+	}
+	for _, data := range []string{"", "\x07junk", "\x01not gzip"} {
+		if _, err := decodeCacheEntry([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestRedisResponseCache_Compression(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skipf("Redis unavailable, skipping integration test: %v", err)
+	}
+	t.Setenv("CACHE_COMPRESS_MIN_BYTES", "256")
+	cache := NewRedisResponseCache(client)
+	key := "ai:codectest:" + time.Now().Format("150405.000000")
+	defer client.Del(ctx, key)
+
+	value := cachedResult(strings.Repeat("compress me ", 500))
+	if err := cache.Set(ctx, key, value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if stored := client.StrLen(ctx, key).Val(); stored >= int64(len(value.Result)) {
+		t.Errorf("expected the stored entry to be compressed, got %d bytes for a %d-byte result", stored, len(value.Result))
+	}
+	got, err := cache.Get(ctx, key)
+	if err != nil || got.Result != value.Result {
+		t.Errorf("expected the entry back, got %v", err)
+	}
+}
+
+func TestStoreInCache_SkipsOversizedResults(t *testing.T) {
+	responseCache = NewMemoryResponseCache(10, 0)
+	defer func() { responseCache = nil }()
+	t.Setenv("CACHE_MAX_ENTRY_BYTES", "100")
+	ctx := context.Background()
+	oversized := testutil.ToFloat64(cacheOversizedTotal)
+
+	storeInCache(ctx, "ai:summary:big", cachedResult(strings.Repeat("x", 101)))
+	if _, err := getFromCache(ctx, "ai:summary:big"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected an oversized result not to be cached, got %v", err)
+	}
+	if testutil.ToFloat64(cacheOversizedTotal)-oversized != 1 {
+		t.Error("expected the skipped result to be counted")
+	}
+	storeInCache(ctx, "ai:summary:ok", cachedResult(strings.Repeat("x", 100)))
+	if _, err := getFromCache(ctx, "ai:summary:ok"); err != nil {
+		t.Errorf("expected a result at the limit to be cached, got %v", err)
+	}
+}
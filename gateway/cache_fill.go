@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheFills collapses concurrent misses on the same cache key in this
+// process into one handler run
+var cacheFills singleflight.Group
+
+// cacheWrites tracks the background writes of fetched and refreshed results,
+// so they can be waited for before the response cache is replaced
+var cacheWrites sync.WaitGroup
+
+// errCacheFillFailed means the request filling the cache produced no
+// cacheable result, so its waiters must coalesce again
+var errCacheFillFailed = errors.New("cache fill produced no result")
+
+// errCacheFillAbandoned means the request that would have filled the cache
+// ended before its fill started, so its waiters must coalesce again
+var errCacheFillAbandoned = errors.New("cache fill abandoned")
+
+// States of a request's own fill. A request whose context ends may only walk
+// away while its fill has not started, since a running fill uses its context.
+const (
+	cacheFillPending int32 = iota
+	cacheFillRunning
+	cacheFillAbandoned
+)
+
+// coalesceCacheFill joins the in-process fill of cacheKey, running it on this
+// request's account if there is none. ran reports whether this request led
+// the fill and filled whether it called the handler, in which case the
+// response is already written. Waiting ends early if the request context
+// ends, with the context's error.
+func coalesceCacheFill(c *gin.Context, cacheKey string) (shared *CachedResponse, ran, filled bool, err error) {
+	var state atomic.Int32
+	var panicked interface{}
+	ch := cacheFills.DoChan(cacheKey, func() (v interface{}, err error) {
+		if !state.CompareAndSwap(cacheFillPending, cacheFillRunning) {
+			return nil, errCacheFillAbandoned
+		}
+		// The fill runs on its own goroutine; a handler panic is raised
+		// again on the request's goroutine, where recovery can handle it
+		defer func() {
+			if p := recover(); p != nil {
+				panicked, err = p, errCacheFillFailed
+			}
+		}()
+		ran = true
+		release, held := acquireCacheFillLock(c.Request.Context(), cacheKey)
+		if !held {
+			// Another replica is calling the provider for this key
+			if cached := waitForCacheFill(c.Request.Context(), cacheKey); cached != nil {
+				cacheCoalescedTotal.WithLabelValues("cluster").Inc()
+				return cached, nil
+			}
+		}
+		filled = true
+		if cached, ok := fillCache(c, cacheKey, release); ok {
+			return cached, nil
+		}
+		return nil, errCacheFillFailed
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-c.Request.Context().Done():
+		if state.CompareAndSwap(cacheFillPending, cacheFillAbandoned) {
+			return nil, false, false, c.Request.Context().Err()
+		}
+		// This request's own fill is running and still uses c
+		res = <-ch
+	}
+	if panicked != nil {
+		panic(panicked)
+	}
+	if res.Err != nil {
+		return nil, ran, filled, res.Err
+	}
+	return res.Val.(*CachedResponse), ran, filled, nil
+}
+
+// cacheFillPollInterval is how often a replica waiting on another replica's
+// fill checks the cache
+const cacheFillPollInterval = 100 * time.Millisecond
+
+// getCacheCoalesceEnabled reports whether concurrent misses are coalesced
+// (CACHE_COALESCE_MISSES, default true)
+func getCacheCoalesceEnabled() bool {
+	enabled := strings.ToLower(os.Getenv("CACHE_COALESCE_MISSES"))
+	return enabled != "false" && enabled != "0"
+}
+
+// getCacheFillLockTTL returns how long a replica may hold the fill lock of a
+// key before others stop waiting for it (CACHE_FILL_LOCK_SECONDS, default 30)
+func getCacheFillLockTTL() time.Duration {
+	return getPositiveTimeout("CACHE_FILL_LOCK_SECONDS", 30)
+}
+
+func cacheFillLockKey(cacheKey string) string {
+	return "lock:" + cacheKey
+}
+
+// releaseCacheFillLockScript deletes the lock only if it is still ours, so
+// a fill that outlived its TTL cannot drop another replica's lock
+var releaseCacheFillLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// acquireCacheFillLock takes the Redis lock for filling cacheKey. held is
+// false when another replica holds it. A cache other replicas cannot read
+// needs no lock. If Redis fails the fill goes ahead unlocked, as a cache
+// without coalescing would.
+func acquireCacheFillLock(ctx context.Context, cacheKey string) (release func(), held bool) {
+	noop := func() {}
+	client := redisClient
+	if client == nil || responseCache == nil || !responseCache.Shared() {
+		return noop, true
+	}
+	key, token := cacheFillLockKey(cacheKey), uuid.NewString()
+	ok, err := client.SetNX(ctx, key, token, getCacheFillLockTTL()).Result()
+	if err != nil {
+		log.Printf("[WARNING] Failed to take cache fill lock for key %s: %v", safeKeyPrefix(cacheKey), err)
+		return noop, true
+	}
+	if !ok {
+		return noop, false
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := releaseCacheFillLockScript.Run(ctx, client, []string{key}, token).Err(); err != nil {
+			log.Printf("[WARNING] Failed to release cache fill lock for key %s: %v", safeKeyPrefix(cacheKey), err)
+		}
+	}, true
+}
+
+// waitForCacheFill polls the cache while another replica holds the fill
+// lock. It returns nil if the lock goes away without an entry (that fill
+// failed or expired) or ctx ends.
+func waitForCacheFill(ctx context.Context, cacheKey string) *CachedResponse {
+	ticker := time.NewTicker(cacheFillPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if cached, err := getFromCache(ctx, cacheKey); err == nil {
+			return cached
+		}
+		client := redisClient
+		if client == nil {
+			return nil
+		}
+		exists, err := client.Exists(ctx, cacheFillLockKey(cacheKey)).Result()
+		if err != nil || exists == 0 {
+			// The entry may have been stored just before the lock was released
+			if cached, err := getFromCache(ctx, cacheKey); err == nil {
+				return cached
+			}
+			return nil
+		}
+	}
+}
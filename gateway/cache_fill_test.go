@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newCoalescingRouter serves summarize behind the cache with Redis, a
+// verifier accepting any signature and an AI provider that answers after
+// delay. It returns the router, the AI call counter and a unique text.
+func newCoalescingRouter(t *testing.T, delay time.Duration) (*gin.Engine, *atomic.Int32, string) {
+	t.Helper()
+	t.Setenv("CACHE_ENABLED", "true")
+	t.Setenv("REDIS_URL", "127.0.0.1:6379")
+	initRedis()
+	if redisClient == nil {
+		t.Skip("Redis unavailable, skipping cache coalescing test")
+	}
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = nil
+	})
+	if err := initResponseCache(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeResponseCache)
+
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	t.Cleanup(verifier.Close)
+	var aiCalls atomic.Int32
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aiCalls.Add(1)
+		time.Sleep(delay)
+		w.Write([]byte(`{"choices":[{"message":{"content":"shared summary"}}]}`))
+	}))
+	t.Cleanup(ai.Close)
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	t.Setenv("OPENROUTER_URL", ai.URL)
+	t.Setenv("OPENROUTER_API_KEY", "test")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	origStore := nonceStore
+	nonceStore = NewMemoryNonceStore()
+	t.Cleanup(func() { nonceStore = origStore })
+
+	text := t.Name() + " " + time.Now().String()
+	key := describeSummary(getOpenRouterModel(), text).CacheKey()
+	redisClient.Del(context.Background(), key, cacheFillLockKey(key))
+	t.Cleanup(func() { redisClient.Del(context.Background(), key, cacheFillLockKey(key)) })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", CacheMiddleware(), handleSummarize)
+	return r, &aiCalls, text
+}
+
+// summarizeWithNonce sends a signed summarize request with a fresh nonce
+func summarizeWithNonce(t *testing.T, r http.Handler, text string, i int) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	return signedPost(t, r, "/api/ai/summarize", string(body), i)
+}
+
+// signedPost sends a signed POST to path with a fresh nonce
+func signedPost(t *testing.T, r http.Handler, path, body string, i int) *httptest.ResponseRecorder {
+	nonce := fmt.Sprintf("nonce-coalesce-%d-%d", time.Now().UnixNano(), i)
+	if err := nonceStore.Issue(context.Background(), nonce, time.Minute); err != nil {
+		t.Errorf("failed to issue nonce: %v", err)
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCacheMiddleware_CoalescesConcurrentMisses(t *testing.T) {
+	r, aiCalls, text := newCoalescingRouter(t, 300*time.Millisecond)
+	coalesced := testutil.ToFloat64(cacheCoalescedTotal.WithLabelValues("process"))
+
+	const clients = 5
+	responses := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = summarizeWithNonce(t, r, text, i)
+		}()
+	}
+	wg.Wait()
+
+	if got := aiCalls.Load(); got != 1 {
+		t.Errorf("expected one AI call for %d identical misses, got %d", clients, got)
+	}
+	receipts := map[string]bool{}
+	for i, w := range responses {
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "shared summary") {
+			t.Fatalf("request %d: expected the shared result, got %d body=%s", i, w.Code, w.Body.String())
+		}
+		receipts[w.Header().Get("X-402-Receipt")] = true
+	}
+	if len(receipts) != clients {
+		t.Errorf("expected every request to get its own receipt, got %d distinct", len(receipts))
+	}
+	if got := testutil.ToFloat64(cacheCoalescedTotal.WithLabelValues("process")) - coalesced; got != clients-1 {
+		t.Errorf("expected %d coalesced requests, got %v", clients-1, got)
+	}
+}
+
+func TestCacheMiddleware_WaitsForAnotherReplica(t *testing.T) {
+	r, aiCalls, text := newCoalescingRouter(t, 0)
+	key := describeSummary(getOpenRouterModel(), text).CacheKey()
+	ctx := context.Background()
+	coalesced := testutil.ToFloat64(cacheCoalescedTotal.WithLabelValues("cluster"))
+
+	// Another replica holds the fill lock and stores its result shortly
+	redisClient.Set(ctx, cacheFillLockKey(key), "other-replica", time.Minute)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		storeInCache(ctx, key, &CachedResponse{Result: "from another replica", Model: "primary", CachedAt: time.Now().Unix()})
+		redisClient.Del(ctx, cacheFillLockKey(key))
+	}()
+
+	w := summarizeWithNonce(t, r, text, 0)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "from another replica") {
+		t.Fatalf("expected the other replica's result, got %d body=%s", w.Code, w.Body.String())
+	}
+	if aiCalls.Load() != 0 {
+		t.Errorf("expected no AI call while another replica fills, got %d", aiCalls.Load())
+	}
+	if got := testutil.ToFloat64(cacheCoalescedTotal.WithLabelValues("cluster")) - coalesced; got != 1 {
+		t.Errorf("expected one cluster-coalesced request, got %v", got)
+	}
+}
+
+func TestCacheMiddleware_CallsProviderWhenOtherFillFails(t *testing.T) {
+	r, aiCalls, text := newCoalescingRouter(t, 0)
+	key := describeSummary(getOpenRouterModel(), text).CacheKey()
+	ctx := context.Background()
+
+	// The other replica gives up without storing anything
+	redisClient.Set(ctx, cacheFillLockKey(key), "other-replica", time.Minute)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		redisClient.Del(ctx, cacheFillLockKey(key))
+	}()
+
+	w := summarizeWithNonce(t, r, text, 0)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "shared summary") {
+		t.Fatalf("expected the provider's result, got %d body=%s", w.Code, w.Body.String())
+	}
+	if aiCalls.Load() != 1 {
+		t.Errorf("expected the request to call the provider itself, got %d calls", aiCalls.Load())
+	}
+}
+
+// missConcurrently sends clients identical summarize misses, the first one
+// alone so it leads the fill
+func missConcurrently(t *testing.T, r http.Handler, text string, clients int) []*httptest.ResponseRecorder {
+	t.Helper()
+	responses := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = summarizeWithNonce(t, r, text, i)
+		}()
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	return responses
+}
+
+func TestCacheMiddleware_RecoalescesAfterFailedFill(t *testing.T) {
+	r, ai := newMemoryCacheRouter(t, map[string]func(http.ResponseWriter, int){"primary": func(w http.ResponseWriter, call int) {
+		time.Sleep(100 * time.Millisecond)
+		reply("shared summary")(w, call)
+	}})
+	// The first payment, the leader's, is rejected after the others joined
+	var verifications atomic.Int32
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verifications.Add(1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"is_valid":false,"error":"E003: bad signature"}`))
+			return
+		}
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	t.Cleanup(verifier.Close)
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	const clients = 5
+	responses := missConcurrently(t, r, "recoalesce", clients)
+	if responses[0].Code != 403 {
+		t.Errorf("expected the leader's payment to be rejected, got %d", responses[0].Code)
+	}
+	for i, w := range responses[1:] {
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "shared summary") {
+			t.Errorf("request %d: expected the shared result, got %d body=%s", i+1, w.Code, w.Body.String())
+		}
+	}
+	if got := ai.count("primary"); got != 1 {
+		t.Errorf("expected the waiters to share one new AI call, got %d", got)
+	}
+}
+
+func TestCacheMiddleware_SharesNegativeResult(t *testing.T) {
+	r, ai := newMemoryCacheRouter(t, map[string]func(http.ResponseWriter, int){"primary": func(w http.ResponseWriter, call int) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusForbidden)
+	}})
+
+	const clients = 4
+	responses := missConcurrently(t, r, "rejected together", clients)
+	if responses[0].Code != 500 {
+		t.Errorf("expected the leader's paid failure, got %d", responses[0].Code)
+	}
+	for i, w := range responses[1:] {
+		if w.Code != 422 || w.Header().Get("X-402-Receipt") != "" {
+			t.Errorf("request %d: expected an uncharged rejection, got %d body=%s", i+1, w.Code, w.Body.String())
+		}
+	}
+	if got := ai.count("primary"); got != 1 {
+		t.Errorf("expected the rejection to be shared, got %d AI calls", got)
+	}
+}
+
+func TestCacheMiddleware_WaiterGivesUpWithItsRequest(t *testing.T) {
+	release := make(chan struct{})
+	r, _ := newMemoryCacheRouter(t, map[string]func(http.ResponseWriter, int){"primary": func(w http.ResponseWriter, call int) {
+		<-release
+		reply("late summary")(w, call)
+	}})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		summarizeWithNonce(t, r, "slow fill", 0)
+	}()
+	t.Cleanup(func() {
+		close(release)
+		<-done
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	nonce := "nonce-waiter-gives-up"
+	if err := nonceStore.Issue(context.Background(), nonce, time.Minute); err != nil {
+		t.Fatalf("failed to issue nonce: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"slow fill"}`)).WithContext(ctx)
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	r.ServeHTTP(w, req)
+
+	if dur := time.Since(start); dur > time.Second {
+		t.Errorf("expected the waiter to stop with its request, waited %v", dur)
+	}
+	if w.Code != 504 || w.Header().Get("X-402-Receipt") != "" {
+		t.Errorf("expected an uncharged 504, got %d body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestCacheMiddleware_CachesAnyAIOperation(t *testing.T) {
+	r, _, text := newCoalescingRouter(t, 0)
+
+	// A second AI route with its own request format
+	translate := &AIOperation{Name: "translate", Describe: func(body []byte) (*AIRequestDescriptor, error) {
+		var req struct{ Text, Lang string }
+		if err := json.Unmarshal(body, &req); err != nil || req.Lang == "" {
+			return nil, &invalidAIRequestError{"Invalid request", "lang is required"}
+		}
+		return &AIRequestDescriptor{
+			Version: aiDescriptorVersion, Operation: "translate", PromptVersion: 1, Model: "primary",
+			System:   "Translate to " + req.Lang,
+			Messages: []AIMessage{{Role: "user", Content: req.Text}},
+		}, nil
+	}}
+	aiOperations[routeKey("POST", "/api/ai/translate")] = translate
+	defer delete(aiOperations, routeKey("POST", "/api/ai/translate"))
+
+	var calls atomic.Int32
+	r.POST("/api/ai/translate", CacheMiddleware(), func(c *gin.Context) {
+		calls.Add(1)
+		desc, _ := c.Get("ai_descriptor")
+		c.JSON(200, gin.H{"result": desc.(*AIRequestDescriptor).System, "model": "primary"})
+	})
+	keys := []string{}
+	for _, lang := range []string{"fr", "de"} {
+		desc, _ := translate.Describe([]byte(`{"text":"` + text + `","lang":"` + lang + `"}`))
+		keys = append(keys, desc.CacheKey())
+	}
+	defer redisClient.Del(context.Background(), keys...)
+
+	body := `{"text":"` + text + `","lang":"fr"}`
+	for i := range 2 {
+		if w := signedPost(t, r, "/api/ai/translate", body, i); w.Code != 200 || !strings.Contains(w.Body.String(), "Translate to fr") {
+			t.Fatalf("request %d: got %d body=%s", i, w.Code, w.Body.String())
+		}
+		if i == 0 {
+			waitForCacheEntry(t, keys[0])
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the second request to be served from the cache, got %d handler calls", calls.Load())
+	}
+
+	// A different parameter is a different entry
+	if w := signedPost(t, r, "/api/ai/translate", `{"text":"`+text+`","lang":"de"}`, 2); w.Code != 200 || calls.Load() != 2 {
+		t.Errorf("expected another language to miss the cache, got %d with %d calls", w.Code, calls.Load())
+	}
+	if w := signedPost(t, r, "/api/ai/translate", `{"text":"x"}`, 3); w.Code != 400 {
+		t.Errorf("expected the operation's validation to reject the body, got %d", w.Code)
+	}
+}
+
+// closeResponseCache waits for background cache writes, then disables the
+// response cache
+func closeResponseCache() {
+	cacheWrites.Wait()
+	responseCache = nil
+}
+
+// waitForCacheEntry waits for the asynchronous cache store of key
+func waitForCacheEntry(t *testing.T, key string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := getFromCache(context.Background(), key); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("cache entry %s not stored", safeKeyPrefix(key))
+}
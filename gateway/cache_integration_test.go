@@ -79,6 +79,10 @@ func TestCacheIntegration_FullFlow(t *testing.T) {
 			redisClient = nil
 		}
 	}()
+	if err := initResponseCache(); err != nil {
+		t.Fatalf("Failed to initialize response cache: %v", err)
+	}
+	defer closeResponseCache()
 
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
@@ -88,10 +92,23 @@ func TestCacheIntegration_FullFlow(t *testing.T) {
 	// 5. Test execution
 	textToSummarize := "This is a unique text for cache integration test " + time.Now().String()
 	model := "z-ai/glm-4.5-air:free" // Default model
-	cacheKey := getCacheKey(textToSummarize, model)
+	cacheKey := describeSummary(model, textToSummarize).CacheKey()
+
+	// Each paid request needs a nonce issued by the gateway
+	origStore := nonceStore
+	nonceStore = NewMemoryNonceStore()
+	defer func() { nonceStore = origStore }()
+	issueNonce := func() string {
+		t.Helper()
+		paymentCtx, err := createPaymentContext(ctx, defaultPaidRoute, nil)
+		if err != nil {
+			t.Fatalf("Failed to issue nonce: %v", err)
+		}
+		return paymentCtx.Nonce
+	}
 
 	// Helper to make request
-	makeRequest := func(sig string) *httptest.ResponseRecorder {
+	makeRequestWithNonce := func(sig, nonce string) *httptest.ResponseRecorder {
 		t.Helper()
 		reqBody := map[string]string{"text": textToSummarize}
 		jsonBody, err := json.Marshal(reqBody)
@@ -104,13 +121,17 @@ func TestCacheIntegration_FullFlow(t *testing.T) {
 		}
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("X-402-Signature", sig)
-		req.Header.Set("X-402-Nonce", "nonce-123")
+		req.Header.Set("X-402-Nonce", nonce)
 		req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
 
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, req)
 		return w
 	}
+	makeRequest := func(sig string) *httptest.ResponseRecorder {
+		t.Helper()
+		return makeRequestWithNonce(sig, issueNonce())
+	}
 
 	// Clean up cache key before starting
 	rdb.Del(ctx, cacheKey)
@@ -146,8 +167,9 @@ func TestCacheIntegration_FullFlow(t *testing.T) {
 	assertCachePopulated()
 
 	// Request 2: Cache Hit (Valid Sig)
+	hitNonce := issueNonce()
 	start = time.Now()
-	w2 := makeRequest("0xValidSig")
+	w2 := makeRequestWithNonce("0xValidSig", hitNonce)
 	duration2 := time.Since(start)
 
 	if w2.Code != 200 {
@@ -167,6 +189,12 @@ func TestCacheIntegration_FullFlow(t *testing.T) {
 		t.Errorf("Expected status 403 for invalid signature on cache hit, got %d", w3.Code)
 	}
 
+	// Security Check: Cache HIT but REPLAYED Nonce
+	wReplay := makeRequestWithNonce("0xValidSig", hitNonce)
+	if wReplay.Code != 403 {
+		t.Errorf("Expected status 403 for replayed nonce on cache hit, got %d", wReplay.Code)
+	}
+
 	// Security Check: Cache HIT but MISSING Signature
 	reqBody := map[string]string{"text": textToSummarize}
 	jsonBody, err := json.Marshal(reqBody)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CachedAIError is a deterministic provider rejection kept as a negative
+// cache entry, so the same input is not sent again until it expires
+type CachedAIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// getCacheSoftTTL returns how long a result is fresh
+// (CACHE_SOFT_TTL_SECONDS). Between it and CACHE_TTL_SECONDS the result is
+// stale: still served, but refreshed in the background. It defaults to, and
+// is capped at, CACHE_TTL_SECONDS, which disables stale serving.
+func getCacheSoftTTL() time.Duration {
+	hard := getCacheTTL()
+	soft := time.Duration(getEnvAsInt("CACHE_SOFT_TTL_SECONDS", int(hard/time.Second))) * time.Second
+	if soft <= 0 || soft > hard {
+		return hard
+	}
+	return soft
+}
+
+// getCacheNegativeTTL returns how long provider rejections are cached
+// (CACHE_NEGATIVE_TTL_SECONDS, default 60). 0 disables negative caching.
+func getCacheNegativeTTL() time.Duration {
+	return time.Duration(max(getEnvAsInt("CACHE_NEGATIVE_TTL_SECONDS", 60), 0)) * time.Second
+}
+
+// getCacheNegativeStatuses returns the provider statuses that reject an
+// input whatever the retry (CACHE_NEGATIVE_STATUSES, default
+// "400,403,413,422"). 401, 404 and 429 depend on the gateway's account or
+// configuration rather than the input and should not be listed.
+func getCacheNegativeStatuses() map[int]bool {
+	statuses := map[int]bool{}
+	for _, part := range strings.Split(getEnv("CACHE_NEGATIVE_STATUSES", "400,403,413,422"), ",") {
+		if status, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			statuses[status] = true
+		}
+	}
+	return statuses
+}
+
+// negativeCacheError returns the entry to cache for err, or nil if err is
+// not a deterministic rejection or negative caching is disabled
+func negativeCacheError(err error) *CachedAIError {
+	var perr *ProviderError
+	if getCacheNegativeTTL() <= 0 || !errors.As(err, &perr) || !getCacheNegativeStatuses()[perr.StatusCode] {
+		return nil
+	}
+	return &CachedAIError{Status: perr.StatusCode, Message: err.Error()}
+}
+
+// noteAIFailure hands a cacheable provider rejection to CacheMiddleware,
+// which stores it as a negative entry once the handler has answered
+func noteAIFailure(c *gin.Context, err error) {
+	if cached := negativeCacheError(err); cached != nil {
+		c.Set("ai_error", cached)
+	}
+}
+
+// respondNegativeCacheHit answers a request whose input the provider
+// rejected recently. Nothing is served, so nothing is charged.
+func respondNegativeCacheHit(c *gin.Context, cached *CachedAIError) {
+	c.AbortWithStatusJSON(422, gin.H{
+		"error":   "AI request rejected",
+		"message": "The AI provider recently rejected this request; it was not charged",
+		"details": cached.Message,
+	})
+}
+
+// isStale reports whether a result is past its soft expiry. Entries written
+// before soft expiry existed are fresh until they expire.
+func (c *CachedResponse) isStale(now time.Time) bool {
+	return c.SoftExpiresAt != 0 && now.Unix() >= c.SoftExpiresAt
+}
+
+// cacheRefreshes holds the keys this process is refreshing
+var cacheRefreshes sync.Map
+
+// refreshCacheEntry calls the provider for desc and replaces the stale
+// entry under cacheKey. One refresh runs per key: within this process
+// through cacheRefreshes, across replicas through the fill lock. Nobody
+// pays for the refresh itself: it only starts once the stale hit that
+// triggers it has been charged, so unpaid requests cannot drive provider
+// calls.
+func refreshCacheEntry(desc *AIRequestDescriptor, cacheKey string) {
+	if _, running := cacheRefreshes.LoadOrStore(cacheKey, struct{}{}); running {
+		return
+	}
+	defer cacheRefreshes.Delete(cacheKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), getAITimeout())
+	defer cancel()
+	release, held := acquireCacheFillLock(ctx, cacheKey)
+	if !held {
+		cacheRefreshesTotal.WithLabelValues("skipped").Inc()
+		return
+	}
+	defer release()
+
+	resp, err := callAI(ctx, desc)
+	if err != nil {
+		// The stale entry stays until its hard expiry
+		log.Printf("[WARNING] Background refresh failed for key %s: %v", safeKeyPrefix(cacheKey), err)
+		cacheRefreshesTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	storeInCache(ctx, cacheKey, &CachedResponse{Result: resp.Content, Model: resp.Model, Version: desc.Version})
+	cacheRefreshesTotal.WithLabelValues("refreshed").Inc()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newMemoryCacheRouter serves summarize behind an in-process cache with a
+// verifier accepting any signature and the given fake AI models
+func newMemoryCacheRouter(t *testing.T, models map[string]func(http.ResponseWriter, int)) (*gin.Engine, *fakeAIServer) {
+	t.Helper()
+	origClient := redisClient
+	redisClient = nil
+	responseCache = NewMemoryResponseCache(100, 1<<20)
+	t.Cleanup(func() {
+		closeResponseCache()
+		redisClient = origClient
+	})
+
+	ai, _ := newFakeAIServer(t, models)
+	useRefundTestEnv(t)
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	t.Cleanup(verifier.Close)
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	origStore := nonceStore
+	nonceStore = NewMemoryNonceStore()
+	t.Cleanup(func() { nonceStore = origStore })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", CacheMiddleware(), handleSummarize)
+	return r, ai
+}
+
+func TestStoreInCache_Expiry(t *testing.T) {
+	responseCache = NewMemoryResponseCache(10, 0)
+	defer func() { responseCache = nil }()
+	t.Setenv("CACHE_TTL_SECONDS", "100")
+	t.Setenv("CACHE_SOFT_TTL_SECONDS", "40")
+	t.Setenv("CACHE_NEGATIVE_TTL_SECONDS", "10")
+	ctx := context.Background()
+
+	storeInCache(ctx, "ai:summary:ok", &CachedResponse{Result: "r", CachedAt: 1000})
+	got, _ := getFromCache(ctx, "ai:summary:ok")
+	if got == nil || got.SoftExpiresAt != 1040 || got.ExpiresAt != 1100 {
+		t.Errorf("expected soft and hard expiry at +40s and +100s, got %+v", got)
+	}
+
+	storeInCache(ctx, "ai:summary:rejected", &CachedResponse{Error: &CachedAIError{Status: 400}, CachedAt: 1000})
+	got, _ = getFromCache(ctx, "ai:summary:rejected")
+	if got == nil || got.SoftExpiresAt != 1010 || got.ExpiresAt != 1010 {
+		t.Errorf("expected a negative entry to expire after 10s, got %+v", got)
+	}
+
+	// A soft TTL above the hard TTL is capped
+	t.Setenv("CACHE_SOFT_TTL_SECONDS", "500")
+	if got := getCacheSoftTTL(); got != 100*time.Second {
+		t.Errorf("expected the soft TTL to be capped at 100s, got %v", got)
+	}
+}
+
+func TestNegativeCacheError(t *testing.T) {
+	for status, cached := range map[int]bool{400: true, 403: true, 422: true, 401: false, 429: false, 500: false} {
+		err := &ProviderError{Provider: "openrouter", StatusCode: status, Message: "flagged"}
+		if got := negativeCacheError(err); (got != nil) != cached {
+			t.Errorf("status %d: expected cached=%v, got %+v", status, cached, got)
+		}
+	}
+	if negativeCacheError(context.DeadlineExceeded) != nil {
+		t.Error("expected timeouts not to be cached")
+	}
+	t.Setenv("CACHE_NEGATIVE_TTL_SECONDS", "0")
+	if negativeCacheError(&ProviderError{StatusCode: 400}) != nil {
+		t.Error("expected CACHE_NEGATIVE_TTL_SECONDS=0 to disable negative caching")
+	}
+}
+
+func TestCacheMiddleware_ServesStaleAndRefreshes(t *testing.T) {
+	r, ai := newMemoryCacheRouter(t, map[string]func(http.ResponseWriter, int){"primary": reply("fresh summary")})
+	ctx := context.Background()
+	key := describeSummary("primary", "stale me").CacheKey()
+	past := time.Now().Add(-time.Minute).Unix()
+	responseCache.Set(ctx, key, &CachedResponse{Result: "old summary", Model: "primary", CachedAt: past, SoftExpiresAt: past}, time.Hour)
+
+	w := summarizeWithNonce(t, r, "stale me", 0)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "old summary") || w.Header().Get("X-402-Receipt") == "" {
+		t.Fatalf("expected the stale result to be served and paid for, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if cached, _ := getFromCache(ctx, key); cached != nil && cached.Result == "fresh summary" {
+			if cached.isStale(time.Now()) {
+				t.Error("expected the refreshed entry to be fresh")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ai.count("primary") != 1 {
+		t.Errorf("expected one background AI call, got %d", ai.count("primary"))
+	}
+
+	if w := summarizeWithNonce(t, r, "stale me", 1); !strings.Contains(w.Body.String(), "fresh summary") {
+		t.Errorf("expected the refreshed result, got %s", w.Body.String())
+	}
+}
+
+func TestCacheMiddleware_UnpaidStaleHitDoesNotRefresh(t *testing.T) {
+	r, ai := newMemoryCacheRouter(t, map[string]func(http.ResponseWriter, int){"primary": reply("fresh summary")})
+	ctx := context.Background()
+	key := describeSummary("primary", "stale me").CacheKey()
+	past := time.Now().Add(-time.Minute).Unix()
+	responseCache.Set(ctx, key, &CachedResponse{Result: "old summary", Model: "primary", CachedAt: past, SoftExpiresAt: past}, time.Hour)
+
+	// The signature checks out but the nonce was never issued, so the
+	// request is not charged
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"stale me"}`))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", "nonce-never-issued")
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code == 200 || w.Header().Get("X-402-Receipt") != "" {
+		t.Fatalf("expected the unpaid request to be rejected, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if ai.count("primary") != 0 {
+		t.Errorf("expected no AI call for an unpaid stale hit, got %d", ai.count("primary"))
+	}
+	if cached, _ := getFromCache(ctx, key); cached == nil || cached.Result != "old summary" {
+		t.Errorf("expected the stale entry to be left alone, got %+v", cached)
+	}
+}
+
+func TestCacheMiddleware_NegativeCaching(t *testing.T) {
+	r, ai := newMemoryCacheRouter(t, map[string]func(http.ResponseWriter, int){"primary": status(http.StatusForbidden)})
+	key := describeSummary("primary", "doomed").CacheKey()
+
+	if w := summarizeWithNonce(t, r, "doomed", 0); w.Code != 500 || w.Header().Get("X-402-Refund") == "" {
+		t.Fatalf("expected the paid failure to be refundable, got %d body=%s", w.Code, w.Body.String())
+	}
+	waitForCacheEntry(t, key)
+
+	w := summarizeWithNonce(t, r, "doomed", 1)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "403") {
+		t.Fatalf("expected the cached rejection, got %d body=%s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-402-Receipt") != "" || w.Header().Get("X-402-Refund") != "" {
+		t.Error("expected a negative hit to be neither charged nor refunded")
+	}
+	if ai.count("primary") != 1 {
+		t.Errorf("expected the rejected input not to be sent again, got %d AI calls", ai.count("primary"))
+	}
+}
@@ -20,12 +20,12 @@ func TestCacheKey(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			model := "z-ai/glm-4.5-air:free"
-			key1 := getCacheKey(tt.text, model)
-			key2 := getCacheKey(tt.text, model)
+			key1 := describeSummary(model, tt.text).CacheKey()
+			key2 := describeSummary(model, tt.text).CacheKey()
 
 			// 1. Deterministic
 			if key1 != key2 {
-				t.Errorf("getCacheKey not deterministic: %s != %s", key1, key2)
+				t.Errorf("CacheKey not deterministic: %s != %s", key1, key2)
 			}
 
 			// 2. Format
@@ -45,8 +45,8 @@ func TestCacheKey(t *testing.T) {
 func TestCacheKeyUniqueForDifferentInputs(t *testing.T) {
 	// Verify that different inputs produce different cache keys
 	model := "z-ai/glm-4.5-air:free"
-	k1 := getCacheKey("abc", model)
-	k2 := getCacheKey("abd", model)
+	k1 := describeSummary(model, "abc").CacheKey()
+	k2 := describeSummary(model, "abd").CacheKey()
 	if k1 == k2 {
 		t.Error("Different inputs produced same cache key")
 	}
@@ -56,12 +56,67 @@ func TestCacheKeyUniqueForDifferentInputs(t *testing.T) {
 func TestCacheKeySpec(t *testing.T) {
 	text := "test"
 	model := "z-ai/glm-4.5-air:free"
-	const cacheVersion = "v1"
-	combined := cacheVersion + ":" + text + ":" + model
-	hash := sha256.Sum256([]byte(combined))
+	canonical := `{"v":2,"op":"summarize","prompt_version":1,"model":"z-ai/glm-4.5-air:free",` +
+		`"messages":[{"role":"user","content":"Summarize this text in 2 sentences: test"}]}`
+	hash := sha256.Sum256([]byte(canonical))
 	expected := "ai:summary:" + hex.EncodeToString(hash[:])
-	actual := getCacheKey(text, model)
+	actual := describeSummary(model, text).CacheKey()
 	if actual != expected {
 		t.Errorf("Spec mismatch: got %s want %s", actual, expected)
 	}
 }
+
+func TestCacheKeyCoversRequestParameters(t *testing.T) {
+	base := describeSummary("model-a", "text")
+	variants := map[string]func(d *AIRequestDescriptor){
+		"model":          func(d *AIRequestDescriptor) { d.Model = "model-b" },
+		"system prompt":  func(d *AIRequestDescriptor) { d.System = "Answer in French." },
+		"max tokens":     func(d *AIRequestDescriptor) { d.MaxTokens = 64 },
+		"operation":      func(d *AIRequestDescriptor) { d.Operation = "translate" },
+		"prompt version": func(d *AIRequestDescriptor) { d.PromptVersion++ },
+		"version":        func(d *AIRequestDescriptor) { d.Version++ },
+		"messages": func(d *AIRequestDescriptor) {
+			d.Messages = append(d.Messages, AIMessage{Role: "user", Content: "more"})
+		},
+	}
+	for name, change := range variants {
+		d := describeSummary("model-a", "text")
+		change(d)
+		if d.CacheKey() == base.CacheKey() {
+			t.Errorf("changing the %s did not change the cache key", name)
+		}
+	}
+}
+
+func TestAIRequestDescriptor_Request(t *testing.T) {
+	d := describeSummary("primary", "hello")
+	d.System, d.MaxTokens = "Be brief.", 128
+	req := d.Request("fallback")
+	if req.Model != "fallback" || req.System != "Be brief." || req.MaxTokens != 128 {
+		t.Errorf("request does not match the descriptor: %+v", req)
+	}
+	if len(req.Messages) != 1 || req.Messages[0].Content != "Summarize this text in 2 sentences: hello" {
+		t.Errorf("unexpected messages %+v", req.Messages)
+	}
+	// The request must not share the descriptor's message slice
+	req.Messages[0].Content = "changed"
+	if d.Messages[0].Content == "changed" {
+		t.Error("Request aliased the descriptor's messages")
+	}
+}
+
+func TestDescribeSummarizeBody(t *testing.T) {
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	desc, err := describeSummarizeBody([]byte(`{"text":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.CacheKey() != describeSummary("primary", "hello").CacheKey() {
+		t.Errorf("expected the body to describe a summary of its text with the primary model, got %+v", desc)
+	}
+	for _, body := range []string{`not json`, `{"text":""}`, `{}`} {
+		if _, err := describeSummarizeBody([]byte(body)); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
@@ -19,3 +19,9 @@ func getVerifierTimeout() time.Duration { return getPositiveTimeout("VERIFIER_TI
 func getHealthCheckTimeout() time.Duration {
 	return getPositiveTimeout("HEALTH_CHECK_TIMEOUT_SECONDS", 2)
 }
+
+// getAIAttemptTimeout bounds a single AI provider call; retries and failover
+// attempts all share the AI_REQUEST_TIMEOUT_SECONDS budget
+func getAIAttemptTimeout() time.Duration {
+	return getPositiveTimeout("AI_ATTEMPT_TIMEOUT_SECONDS", 10)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound HTTP clients, one per upstream dependency so they do not share a
+// connection pool. They are http.DefaultClient until initHTTPClients runs.
+var (
+	verifierHTTPClient = http.DefaultClient
+	aiHTTPClient       = http.DefaultClient
+)
+
+// HTTPClientConfig tunes the transport of an outbound client. It is read
+// from environment variables sharing a prefix, e.g. VERIFIER_HTTP_ or AI_HTTP_.
+type HTTPClientConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int // 0 means unlimited
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration // 0 means no limit besides the request context
+	HTTP2                 bool
+	// ProxyURL routes requests through an HTTP(S) proxy. Empty uses
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY; "direct" disables proxying.
+	ProxyURL string
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate for mTLS
+	CertFile string
+	KeyFile  string
+}
+
+// defaultHTTPClientConfig returns the defaults shared by all upstreams
+func defaultHTTPClientConfig() HTTPClientConfig {
+	return HTTPClientConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         5 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+		HTTP2:               true,
+	}
+}
+
+// loadHTTPClientConfig overrides the defaults with <prefix>* variables
+func loadHTTPClientConfig(prefix string) HTTPClientConfig {
+	cfg := defaultHTTPClientConfig()
+	seconds := func(key string, def time.Duration) time.Duration {
+		return time.Duration(getEnvAsInt(prefix+key, int(def/time.Second))) * time.Second
+	}
+	cfg.MaxIdleConns = getEnvAsInt(prefix+"MAX_IDLE_CONNS", cfg.MaxIdleConns)
+	cfg.MaxIdleConnsPerHost = getEnvAsInt(prefix+"MAX_IDLE_CONNS_PER_HOST", cfg.MaxIdleConnsPerHost)
+	cfg.MaxConnsPerHost = getEnvAsInt(prefix+"MAX_CONNS_PER_HOST", cfg.MaxConnsPerHost)
+	cfg.IdleConnTimeout = seconds("IDLE_CONN_TIMEOUT_SECONDS", cfg.IdleConnTimeout)
+	cfg.DialTimeout = seconds("DIAL_TIMEOUT_SECONDS", cfg.DialTimeout)
+	cfg.KeepAlive = seconds("KEEP_ALIVE_SECONDS", cfg.KeepAlive)
+	cfg.TLSHandshakeTimeout = seconds("TLS_HANDSHAKE_TIMEOUT_SECONDS", cfg.TLSHandshakeTimeout)
+	cfg.ResponseHeaderTimeout = seconds("RESPONSE_HEADER_TIMEOUT_SECONDS", cfg.ResponseHeaderTimeout)
+	if v, err := strconv.ParseBool(os.Getenv(prefix + "HTTP2")); err == nil {
+		cfg.HTTP2 = v
+	}
+	cfg.ProxyURL = os.Getenv(prefix + "PROXY_URL")
+	cfg.CAFile = os.Getenv(prefix + "CA_FILE")
+	cfg.CertFile = os.Getenv(prefix + "CLIENT_CERT_FILE")
+	cfg.KeyFile = os.Getenv(prefix + "CLIENT_KEY_FILE")
+	return cfg
+}
+
+// initHTTPClients builds the verifier and AI provider clients from
+// VERIFIER_HTTP_* and AI_HTTP_*
+func initHTTPClients() error {
+	verifier, err := newHTTPClient("verifier", loadHTTPClientConfig("VERIFIER_HTTP_"))
+	if err != nil {
+		return fmt.Errorf("verifier client: %w", err)
+	}
+	ai, err := newHTTPClient("ai", loadHTTPClientConfig("AI_HTTP_"))
+	if err != nil {
+		return fmt.Errorf("AI client: %w", err)
+	}
+	verifierHTTPClient, aiHTTPClient = verifier, ai
+	return nil
+}
+
+// newHTTPClient builds an instrumented client. name labels its transport
+// metrics. Timeouts are left to the request context, as with the default
+// client.
+func newHTTPClient(name string, cfg HTTPClientConfig) (*http.Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := cfg.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           countingDialer(name, dialer.DialContext),
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if !cfg.HTTP2 {
+		// A non-nil empty map is how net/http is told not to negotiate h2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if cfg.CertFile != "" {
+		log.Printf("HTTP client %s: using client certificate %s", name, cfg.CertFile)
+	}
+	return &http.Client{Transport: &instrumentedTransport{name: name, base: transport}}, nil
+}
+
+func (cfg HTTPClientConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (cfg HTTPClientConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	switch strings.ToLower(cfg.ProxyURL) {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(cfg.ProxyURL)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", cfg.ProxyURL)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// countingDialer wraps dial to track the client's open connections
+func countingDialer(name string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		httpClientOpenConnections.WithLabelValues(name).Inc()
+		return &countedConn{Conn: conn, name: name}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	name string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { httpClientOpenConnections.WithLabelValues(c.name).Dec() })
+	return c.Conn.Close()
+}
+
+// instrumentedTransport records in-flight requests, connection reuse and
+// the time spent obtaining a connection. A rising wait with in-flight
+// requests at MaxConnsPerHost means the pool is exhausted.
+type instrumentedTransport struct {
+	name string
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			httpClientConnWait.WithLabelValues(t.name).Observe(time.Since(start).Seconds())
+			httpClientConnectionsTotal.WithLabelValues(t.name, strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	inFlight := httpClientInFlight.WithLabelValues(t.name)
+	inFlight.Inc()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		inFlight.Dec()
+		return nil, err
+	}
+	// The connection stays busy until the body is closed
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: inFlight.Dec}
+	return resp, nil
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the pool
+func (t *instrumentedTransport) CloseIdleConnections() {
+	if ci, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
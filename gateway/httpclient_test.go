@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadHTTPClientConfig(t *testing.T) {
+	cfg := loadHTTPClientConfig("TEST_HTTP_")
+	if cfg != defaultHTTPClientConfig() {
+		t.Fatalf("expected defaults, got %+v", cfg)
+	}
+
+	t.Setenv("TEST_HTTP_MAX_IDLE_CONNS_PER_HOST", "8")
+	t.Setenv("TEST_HTTP_MAX_CONNS_PER_HOST", "16")
+	t.Setenv("TEST_HTTP_DIAL_TIMEOUT_SECONDS", "1")
+	t.Setenv("TEST_HTTP_HTTP2", "false")
+	t.Setenv("TEST_HTTP_PROXY_URL", "http://proxy:3128")
+	cfg = loadHTTPClientConfig("TEST_HTTP_")
+	if cfg.MaxIdleConnsPerHost != 8 || cfg.MaxConnsPerHost != 16 || cfg.DialTimeout != time.Second || cfg.HTTP2 || cfg.ProxyURL != "http://proxy:3128" {
+		t.Errorf("overrides not applied: %+v", cfg)
+	}
+}
+
+func TestNewHTTPClient_InvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]HTTPClientConfig{
+		"missing CA file":    {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"cert without key":   {CertFile: "client.pem"},
+		"unparseable proxy":  {ProxyURL: "://proxy"},
+		"proxy without host": {ProxyURL: "proxy:3128"},
+	} {
+		if _, err := newHTTPClient("test", cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// writePEM writes a PEM block to a file in dir and returns its path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewHTTPClient_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	// A self-signed client certificate, trusted by the server as its own CA
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	clientCert, _ := x509.ParseCertificate(certDER)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := defaultHTTPClientConfig()
+	cfg.CAFile = writePEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	// Trusting the server is not enough without a client certificate
+	client, err := newHTTPClient("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	cfg.CertFile = writePEM(t, dir, "client.pem", "CERTIFICATE", certDER)
+	cfg.KeyFile = writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+	client, err = newHTTPClient("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("mTLS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "gateway" {
+		t.Errorf("expected the server to see the client certificate, got %q", body)
+	}
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute target URL
+		if strings.HasPrefix(r.RequestURI, "http://verifier.internal/") {
+			proxied.Add(1)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer proxy.Close()
+
+	cfg := defaultHTTPClientConfig()
+	cfg.ProxyURL = proxy.URL
+	client, err := newHTTPClient("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://verifier.internal/health")
+	if err != nil {
+		t.Fatalf("proxied request failed: %v", err)
+	}
+	resp.Body.Close()
+	if proxied.Load() != 1 {
+		t.Error("expected the request to go through the proxy")
+	}
+}
+
+func TestNewHTTPClient_TransportStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	client, err := newHTTPClient("stats-test", defaultHTTPClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBefore := testutil.ToFloat64(httpClientConnectionsTotal.WithLabelValues("stats-test", "false"))
+	reusedBefore := testutil.ToFloat64(httpClientConnectionsTotal.WithLabelValues("stats-test", "true"))
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(httpClientInFlight.WithLabelValues("stats-test")); got != 1 {
+			t.Errorf("expected 1 in-flight request before the body is closed, got %v", got)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(httpClientInFlight.WithLabelValues("stats-test")); got != 0 {
+		t.Errorf("expected no in-flight requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(httpClientOpenConnections.WithLabelValues("stats-test")); got != 1 {
+		t.Errorf("expected one pooled connection, got %v", got)
+	}
+	newConns := testutil.ToFloat64(httpClientConnectionsTotal.WithLabelValues("stats-test", "false")) - newBefore
+	reused := testutil.ToFloat64(httpClientConnectionsTotal.WithLabelValues("stats-test", "true")) - reusedBefore
+	if newConns != 1 || reused != 2 {
+		t.Errorf("expected 1 new and 2 reused connections, got %v and %v", newConns, reused)
+	}
+
+	// The transport closes idle connections from its read loop goroutine
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(httpClientOpenConnections.WithLabelValues("stats-test")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected closed idle connections to be uncounted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
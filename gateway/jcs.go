@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// JSON Canonicalization Scheme (RFC 8785). The canonical form of a JSON
+// value has object members sorted by the UTF-16 code units of their names,
+// no whitespace, strings escaped only where JSON requires it, and numbers
+// formatted like ECMAScript's Number.prototype.toString. It is what
+// JSON.stringify produces once object keys are sorted, so any language can
+// reproduce the bytes a receipt signature covers.
+
+// marshalCanonical returns the RFC 8785 canonical JSON of v
+func marshalCanonical(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalizeJSON(data)
+}
+
+// canonicalizeJSON rewrites a JSON document in its RFC 8785 canonical form.
+// Duplicate object names, numbers outside the float64 range and trailing
+// data are rejected, as I-JSON requires.
+func canonicalizeJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := writeCanonicalValue(&buf, dec); err != nil {
+		return nil, fmt.Errorf("canonicalize JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("canonicalize JSON: unexpected data after the top-level value")
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCanonicalValue reads the next JSON value from dec and writes it in
+// canonical form
+func writeCanonicalValue(buf *bytes.Buffer, dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			return writeCanonicalObject(buf, dec)
+		}
+		buf.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalValue(buf, dec); err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token() // ]
+		buf.WriteByte(']')
+		return err
+	case string:
+		writeCanonicalString(buf, v)
+	case json.Number:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return fmt.Errorf("number %s: %w", v, err)
+		}
+		buf.WriteString(formatCanonicalNumber(f))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case nil:
+		buf.WriteString("null")
+	}
+	return nil
+}
+
+// writeCanonicalObject writes the members of an object whose '{' has been
+// read, sorted by name
+func writeCanonicalObject(buf *bytes.Buffer, dec *json.Decoder) error {
+	type member struct {
+		name  string
+		key   []uint16
+		value []byte
+	}
+	var members []member
+	seen := map[string]bool{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := tok.(string)
+		if seen[name] {
+			return fmt.Errorf("duplicate object name %q", name)
+		}
+		seen[name] = true
+
+		var value bytes.Buffer
+		if err := writeCanonicalValue(&value, dec); err != nil {
+			return err
+		}
+		members = append(members, member{name: name, key: utf16.Encode([]rune(name)), value: value.Bytes()})
+	}
+	if _, err := dec.Token(); err != nil { // }
+		return err
+	}
+
+	sort.Slice(members, func(i, j int) bool { return compareUTF16(members[i].key, members[j].key) < 0 })
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeCanonicalString(buf, m.name)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// compareUTF16 orders strings by their UTF-16 code units, which differs
+// from byte order for characters beyond U+FFFF
+func compareUTF16(a, b []uint16) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// writeCanonicalString writes s as a JSON string, escaping only the quote,
+// the backslash and control characters
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// formatCanonicalNumber formats f like ECMAScript's Number.prototype.toString:
+// the shortest digits that round-trip, in plain notation for exponents from
+// -7 to 20 and in exponent notation otherwise
+func formatCanonicalNumber(f float64) string {
+	if f == 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		// -0 is written as 0; NaN and Infinity cannot come from JSON
+		return "0"
+	}
+	sign := ""
+	if f < 0 {
+		sign, f = "-", -f
+	}
+
+	// Shortest round-trip digits and decimal exponent: d.ddde±x
+	mantissa, exp, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+	k, n := len(digits), e+1
+
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits
+	}
+	exponent := strconv.Itoa(n - 1)
+	if n-1 >= 0 {
+		exponent = "+" + exponent
+	}
+	if k > 1 {
+		digits = digits[:1] + "." + digits[1:]
+	}
+	return sign + digits + "e" + exponent
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The vectors in testdata/jcs are meant for other implementations too:
+// input/<name>.json canonicalizes to output/<name>.json, and each line of
+// numbers.txt is an IEEE 754 double in hex and its canonical form.
+
+func TestCanonicalizeJSON_Vectors(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/jcs/input/*.json")
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("no JCS vectors found: %v", err)
+	}
+	for _, input := range inputs {
+		name := filepath.Base(input)
+		data, _ := os.ReadFile(input)
+		want, err := os.ReadFile(filepath.Join("testdata/jcs/output", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := canonicalizeJSON(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s:\n got  %s\n want %s", name, got, want)
+		}
+
+		// Canonical JSON is a fixed point
+		if again, err := canonicalizeJSON(got); err != nil || string(again) != string(got) {
+			t.Errorf("%s: canonical form changed when canonicalized again: %s %v", name, again, err)
+		}
+	}
+}
+
+func TestFormatCanonicalNumber_Vectors(t *testing.T) {
+	f, err := os.Open("testdata/jcs/numbers.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		bits, want, _ := strings.Cut(scanner.Text(), ",")
+		n, err := strconv.ParseUint(bits, 16, 64)
+		if err != nil {
+			t.Fatalf("bad vector %q", scanner.Text())
+		}
+		value := math.Float64frombits(n)
+		if got := formatCanonicalNumber(value); got != want {
+			t.Errorf("%s: expected %s, got %s", bits, want, got)
+		}
+		// The canonical form reads back as the same double
+		if back, _ := strconv.ParseFloat(want, 64); back != value && !(back == 0 && value == 0) {
+			t.Errorf("%s: %s does not round-trip", bits, want)
+		}
+	}
+}
+
+func TestCanonicalizeJSON_Rejects(t *testing.T) {
+	for _, data := range []string{
+		`{"a":1,"a":2}`,
+		`[1e400]`,
+		`{"a":1} {"b":2}`,
+		`{"a":`,
+		``,
+	} {
+		if got, err := canonicalizeJSON([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error, got %s", data, got)
+		}
+	}
+}
+
+// receiptVector is testdata/receipt_v3.json: a v3 receipt signed with a
+// published test key, its canonical JSON and the digest that was signed
+type receiptVector struct {
+	PrivateKey    string        `json:"private_key"`
+	SignedReceipt SignedReceipt `json:"signed_receipt"`
+	Canonical     string        `json:"canonical"`
+	Keccak256     string        `json:"keccak256"`
+}
+
+func TestReceiptV3_Vector(t *testing.T) {
+	data, err := os.ReadFile("testdata/receipt_v3.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vector receiptVector
+	if err := json.Unmarshal(data, &vector); err != nil {
+		t.Fatal(err)
+	}
+	receipt := vector.SignedReceipt.Receipt
+
+	canonical, err := marshalCanonical(receipt)
+	if err != nil || string(canonical) != vector.Canonical {
+		t.Fatalf("canonical receipt:\n got  %s\n want %s (%v)", canonical, vector.Canonical, err)
+	}
+	digest, err := receiptDigest(receipt)
+	if err != nil || "0x"+hex.EncodeToString(digest) != vector.Keccak256 {
+		t.Fatalf("expected digest %s, got %x (%v)", vector.Keccak256, digest, err)
+	}
+
+	// Signing is deterministic (RFC 6979), so the published signature is
+	// reproduced exactly
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", vector.PrivateKey)
+	key, err := parsePrivateKeyHex(vector.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptKeyring = newSingleKeyring(key)
+	t.Cleanup(func() { receiptKeyring = nil })
+	signed, err := signReceipt(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Signature != vector.SignedReceipt.Signature || signed.ServerPublicKey != vector.SignedReceipt.ServerPublicKey {
+		t.Errorf("expected signature %s by %s, got %s by %s", vector.SignedReceipt.Signature, vector.SignedReceipt.ServerPublicKey, signed.Signature, signed.ServerPublicKey)
+	}
+	if err := verifyReceipt(&vector.SignedReceipt); err != nil {
+		t.Errorf("expected the published receipt to verify, got %v", err)
+	}
+	if err := validateReceipt(&vector.SignedReceipt); err != nil {
+		t.Errorf("expected the published receipt to be valid, got %v", err)
+	}
+}
+
+func TestReceiptV3_IndependentOfFieldOrder(t *testing.T) {
+	useTestReceiptKey(t)
+	receipt := testTypedReceipt()
+	receipt.Version = receiptVersionV3
+	signed, err := signReceipt(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A verifier that decodes the receipt generically and re-encodes it with
+	// its own member order and escaping gets the same digest
+	receiptJSON, _ := json.Marshal(signed.Receipt)
+	var generic map[string]interface{}
+	if err := json.Unmarshal(receiptJSON, &generic); err != nil {
+		t.Fatal(err)
+	}
+	reencoded, _ := json.MarshalIndent(generic, "", "  ")
+	canonical, err := canonicalizeJSON(reencoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := receiptDigest(signed.Receipt)
+	if got := crypto.Keccak256(canonical); hex.EncodeToString(got) != hex.EncodeToString(digest) {
+		t.Errorf("expected the re-encoded receipt to hash to the signed digest")
+	}
+	if err := verifyReceipt(signed); err != nil {
+		t.Errorf("expected the v3 receipt to verify, got %v", err)
+	}
+
+	tampered := *signed
+	tampered.Receipt.Payment.Amount = "1000"
+	if err := verifyReceipt(&tampered); err == nil {
+		t.Error("expected a tampered v3 receipt to fail verification")
+	}
+}
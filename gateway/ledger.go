@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrInsufficientBalance is returned by Debit when the wallet's prepaid
+// balance does not cover the amount
+var ErrInsufficientBalance = errors.New("E014: insufficient prepaid balance")
+
+// ErrBalanceOverflow is returned by Credit when the new balance would not
+// fit in an int64 of base units
+var ErrBalanceOverflow = errors.New("E017: prepaid balance limit exceeded")
+
+// ledgerDecimals is the precision balances are kept in. Amounts are stored
+// as integer base units (1 = 0.000001 USDC) so debits never lose precision.
+const ledgerDecimals = defaultQuoteDecimals
+
+// Ledger holds prepaid balances in base units, keyed by lowercase wallet
+// address, plus the bearer token each wallet uses to spend its balance.
+// Debit must be atomic: concurrent debits can never overdraw a balance.
+type Ledger interface {
+	// Balance returns the wallet's balance (0 for unknown wallets)
+	Balance(ctx context.Context, wallet string) (int64, error)
+	// Credit adds units to the wallet's balance and returns the new balance.
+	// If that would overflow it returns ErrBalanceOverflow and changes nothing.
+	Credit(ctx context.Context, wallet string, units int64) (int64, error)
+	// Debit subtracts units and returns the new balance. If the balance is
+	// too low it returns the unchanged balance and ErrInsufficientBalance.
+	Debit(ctx context.Context, wallet string, units int64) (int64, error)
+	// SetToken makes tokenHash the wallet's only valid balance token
+	SetToken(ctx context.Context, wallet, tokenHash string) error
+	// WalletForToken returns the wallet owning tokenHash, or "" if none does
+	WalletForToken(ctx context.Context, tokenHash string) (string, error)
+}
+
+// ledger is nil, and prepaid funding disabled, unless LEDGER_ENABLED is set
+var ledger Ledger
+
+func getLedgerEnabled() bool {
+	enabled := strings.ToLower(os.Getenv("LEDGER_ENABLED"))
+	return enabled == "true" || enabled == "1"
+}
+
+// getLedgerBackend returns LEDGER_STORE: "memory" (default), "redis" or "file"
+func getLedgerBackend() string {
+	return strings.ToLower(getEnv("LEDGER_STORE", "memory"))
+}
+
+// initLedger selects the ledger backend from LEDGER_STORE when prepaid
+// balances are enabled. Redis being unavailable is an error: a memory ledger
+// would lose deposits on restart and split balances across replicas.
+func initLedger() error {
+	if !getLedgerEnabled() {
+		return nil
+	}
+	switch backend := getLedgerBackend(); backend {
+	case "memory", "":
+		ledger = NewMemoryLedger()
+	case "redis":
+		if redisClient == nil {
+			return fmt.Errorf("LEDGER_STORE=redis but Redis is unavailable")
+		}
+		ledger = NewRedisLedger(redisClient)
+	case "file":
+		store, err := NewFileLedger(getEnv("LEDGER_FILE", "data/ledger.json"))
+		if err != nil {
+			return err
+		}
+		ledger = store
+	default:
+		return fmt.Errorf("unknown LEDGER_STORE %q (expected memory, redis or file)", backend)
+	}
+	log.Printf("Prepaid ledger: %s", getLedgerBackend())
+	return nil
+}
+
+// parseLedgerAmount converts a decimal amount such as "1.5" to base units.
+// It rejects non-positive amounts and amounts finer than ledgerDecimals.
+func parseLedgerAmount(amount string) (int64, error) {
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok || r.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	r.Mul(r, new(big.Rat).SetInt(ledgerScale()))
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return 0, fmt.Errorf("amount %q must have at most %d decimals", amount, ledgerDecimals)
+	}
+	return r.Num().Int64(), nil
+}
+
+// formatLedgerAmount converts base units back to a decimal string
+func formatLedgerAmount(units int64) string {
+	return formatAmountCeil(new(big.Rat).SetFrac(big.NewInt(units), ledgerScale()), ledgerDecimals)
+}
+
+// ledgerScale is the number of base units in one token
+func ledgerScale() *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(ledgerDecimals), nil)
+}
+
+// newBalanceToken returns a random bearer token for spending a balance
+func newBalanceToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate balance token: %w", err)
+	}
+	return "pgb_" + hex.EncodeToString(b), nil
+}
+
+// balanceTokenHash is what ledgers store, so a leaked ledger cannot be spent from
+func balanceTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// ledgerAccount is one wallet's entry, also the on-disk format of FileLedger
+type ledgerAccount struct {
+	Balance   int64  `json:"balance"`
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+// ledgerState is the account table shared by the memory and file ledgers.
+// Callers hold the owning ledger's lock.
+type ledgerState struct {
+	accounts map[string]*ledgerAccount
+	tokens   map[string]string // token hash -> wallet
+}
+
+func newLedgerState(accounts map[string]*ledgerAccount) *ledgerState {
+	s := &ledgerState{accounts: accounts, tokens: make(map[string]string)}
+	for wallet, account := range accounts {
+		if account.TokenHash != "" {
+			s.tokens[account.TokenHash] = wallet
+		}
+	}
+	return s
+}
+
+func (s *ledgerState) account(wallet string) *ledgerAccount {
+	wallet = strings.ToLower(wallet)
+	account, ok := s.accounts[wallet]
+	if !ok {
+		account = &ledgerAccount{}
+		s.accounts[wallet] = account
+	}
+	return account
+}
+
+func (s *ledgerState) balance(wallet string) int64 {
+	if account, ok := s.accounts[strings.ToLower(wallet)]; ok {
+		return account.Balance
+	}
+	return 0
+}
+
+func (s *ledgerState) credit(wallet string, units int64) (int64, error) {
+	if balance := s.balance(wallet); units > math.MaxInt64-balance {
+		return balance, ErrBalanceOverflow
+	}
+	account := s.account(wallet)
+	account.Balance += units
+	return account.Balance, nil
+}
+
+func (s *ledgerState) debit(wallet string, units int64) (int64, error) {
+	if balance := s.balance(wallet); balance < units {
+		return balance, ErrInsufficientBalance
+	}
+	account := s.account(wallet)
+	account.Balance -= units
+	return account.Balance, nil
+}
+
+// setToken replaces the wallet's token and returns the previous hash
+func (s *ledgerState) setToken(wallet, tokenHash string) string {
+	account := s.account(wallet)
+	previous := account.TokenHash
+	if previous != "" {
+		delete(s.tokens, previous)
+	}
+	if tokenHash != "" {
+		s.tokens[tokenHash] = strings.ToLower(wallet)
+	}
+	account.TokenHash = tokenHash
+	return previous
+}
+
+// MemoryLedger keeps balances in a process-local map.
+// Balances are lost on restart and not shared across replicas.
+type MemoryLedger struct {
+	mu    sync.Mutex
+	state *ledgerState
+}
+
+// NewMemoryLedger creates an empty in-memory ledger
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{state: newLedgerState(make(map[string]*ledgerAccount))}
+}
+
+func (l *MemoryLedger) Balance(ctx context.Context, wallet string) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.balance(wallet), nil
+}
+
+func (l *MemoryLedger) Credit(ctx context.Context, wallet string, units int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.credit(wallet, units)
+}
+
+func (l *MemoryLedger) Debit(ctx context.Context, wallet string, units int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.debit(wallet, units)
+}
+
+func (l *MemoryLedger) SetToken(ctx context.Context, wallet, tokenHash string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state.setToken(wallet, tokenHash)
+	return nil
+}
+
+func (l *MemoryLedger) WalletForToken(ctx context.Context, tokenHash string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.tokens[tokenHash], nil
+}
+
+const (
+	ledgerBalancesKey     = "x402:ledger:balances"      // wallet -> base units
+	ledgerTokensKey       = "x402:ledger:tokens"        // token hash -> wallet
+	ledgerWalletTokensKey = "x402:ledger:wallet-tokens" // wallet -> token hash
+)
+
+// The ledger scripts compare balances as decimal strings and return them as
+// strings: Lua numbers are doubles, exact only up to 2^53. Balances are never
+// negative, so their strings order by length, then by digits.
+
+// debitScript subtracts ARGV[2] from the wallet ARGV[1] only if the balance
+// covers it. Returns {1, new balance} or {0, current balance}.
+var debitScript = redis.NewScript(`
+local balance = redis.call('HGET', KEYS[1], ARGV[1]) or '0'
+local units = ARGV[2]
+if #balance < #units or (#balance == #units and balance < units) then
+	return {0, balance}
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], '-' .. units)
+return {1, redis.call('HGET', KEYS[1], ARGV[1])}
+`)
+
+// creditScript adds ARGV[2] to the wallet ARGV[1] only if its balance is at
+// most ARGV[3], the largest balance that cannot overflow.
+// Returns {1, new balance} or {0}.
+var creditScript = redis.NewScript(`
+local balance = redis.call('HGET', KEYS[1], ARGV[1]) or '0'
+local limit = ARGV[3]
+if #balance > #limit or (#balance == #limit and balance > limit) then
+	return {0}
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[2])
+return {1, redis.call('HGET', KEYS[1], ARGV[1])}
+`)
+
+// setTokenScript swaps the wallet ARGV[1] to token hash ARGV[2], revoking
+// its previous token in the same step
+var setTokenScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[2], ARGV[1])
+if previous then
+	redis.call('HDEL', KEYS[1], previous)
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// RedisLedger keeps balances in Redis hashes so every replica debits the
+// same balance. Debits run as a Lua script to stay atomic.
+type RedisLedger struct {
+	client *redis.Client
+}
+
+// NewRedisLedger creates a ledger backed by the given Redis client
+func NewRedisLedger(client *redis.Client) *RedisLedger {
+	return &RedisLedger{client: client}
+}
+
+func (l *RedisLedger) Balance(ctx context.Context, wallet string) (int64, error) {
+	units, err := l.client.HGet(ctx, ledgerBalancesKey, strings.ToLower(wallet)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("load balance: %w", err)
+	}
+	return units, nil
+}
+
+func (l *RedisLedger) Credit(ctx context.Context, wallet string, units int64) (int64, error) {
+	limit := strconv.FormatInt(math.MaxInt64-units, 10)
+	res, err := creditScript.Run(ctx, l.client, []string{ledgerBalancesKey}, strings.ToLower(wallet), units, limit).Int64Slice()
+	if err != nil {
+		return 0, fmt.Errorf("credit balance: %w", err)
+	}
+	if len(res) == 1 && res[0] == 0 {
+		return 0, ErrBalanceOverflow
+	}
+	if len(res) != 2 {
+		return 0, fmt.Errorf("credit balance: unexpected script result %v", res)
+	}
+	return res[1], nil
+}
+
+func (l *RedisLedger) Debit(ctx context.Context, wallet string, units int64) (int64, error) {
+	res, err := debitScript.Run(ctx, l.client, []string{ledgerBalancesKey}, strings.ToLower(wallet), units).Int64Slice()
+	if err != nil {
+		return 0, fmt.Errorf("debit balance: %w", err)
+	}
+	if len(res) != 2 {
+		return 0, fmt.Errorf("debit balance: unexpected script result %v", res)
+	}
+	if res[0] == 0 {
+		return res[1], ErrInsufficientBalance
+	}
+	return res[1], nil
+}
+
+func (l *RedisLedger) SetToken(ctx context.Context, wallet, tokenHash string) error {
+	keys := []string{ledgerTokensKey, ledgerWalletTokensKey}
+	if err := setTokenScript.Run(ctx, l.client, keys, strings.ToLower(wallet), tokenHash).Err(); err != nil {
+		return fmt.Errorf("store balance token: %w", err)
+	}
+	return nil
+}
+
+func (l *RedisLedger) WalletForToken(ctx context.Context, tokenHash string) (string, error) {
+	wallet, err := l.client.HGet(ctx, ledgerTokensKey, tokenHash).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("load balance token: %w", err)
+	}
+	return wallet, nil
+}
+
+// FileLedger keeps all accounts in one JSON file, rewritten atomically after
+// every change. It suits a single gateway instance without Redis.
+type FileLedger struct {
+	mu    sync.Mutex
+	path  string
+	state *ledgerState
+}
+
+// NewFileLedger loads the ledger at path, starting empty if it does not exist
+func NewFileLedger(path string) (*FileLedger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create ledger directory: %w", err)
+	}
+	accounts := make(map[string]*ledgerAccount)
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("read ledger: %w", err)
+	default:
+		if err := json.Unmarshal(data, &accounts); err != nil {
+			return nil, fmt.Errorf("decode ledger: %w", err)
+		}
+	}
+	return &FileLedger{path: path, state: newLedgerState(accounts)}, nil
+}
+
+// save writes the accounts via a temp file and rename
+func (l *FileLedger) save() error {
+	data, err := json.Marshal(l.state.accounts)
+	if err != nil {
+		return fmt.Errorf("marshal ledger: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".ledger-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write ledger: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close ledger file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("commit ledger file: %w", err)
+	}
+	return nil
+}
+
+func (l *FileLedger) Balance(ctx context.Context, wallet string) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.balance(wallet), nil
+}
+
+// Credit, Debit and SetToken undo the in-memory change if the file cannot
+// be written, so memory never runs ahead of disk
+
+func (l *FileLedger) Credit(ctx context.Context, wallet string, units int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	balance, err := l.state.credit(wallet, units)
+	if err != nil {
+		return balance, err
+	}
+	if err := l.save(); err != nil {
+		l.state.account(wallet).Balance -= units
+		return balance - units, err
+	}
+	return balance, nil
+}
+
+func (l *FileLedger) Debit(ctx context.Context, wallet string, units int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	balance, err := l.state.debit(wallet, units)
+	if err != nil {
+		return balance, err
+	}
+	if err := l.save(); err != nil {
+		l.state.account(wallet).Balance += units
+		return balance + units, err
+	}
+	return balance, nil
+}
+
+func (l *FileLedger) SetToken(ctx context.Context, wallet, tokenHash string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous := l.state.setToken(wallet, tokenHash)
+	if err := l.save(); err != nil {
+		l.state.setToken(wallet, previous)
+		return err
+	}
+	return nil
+}
+
+func (l *FileLedger) WalletForToken(ctx context.Context, tokenHash string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.tokens[tokenHash], nil
+}
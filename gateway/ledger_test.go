@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLedgerAmount(t *testing.T) {
+	for amount, want := range map[string]int64{"1": 1_000_000, "0.001": 1_000, "2.5": 2_500_000, "0.000001": 1} {
+		got, err := parseLedgerAmount(amount)
+		if err != nil || got != want {
+			t.Errorf("parseLedgerAmount(%q) = %d, %v; want %d", amount, got, err, want)
+		}
+		if back := formatLedgerAmount(got); back != amount {
+			t.Errorf("formatLedgerAmount(%d) = %q, want %q", got, back, amount)
+		}
+	}
+	for _, amount := range []string{"", "0", "-1", "abc", "0.0000001", "1e30"} {
+		if _, err := parseLedgerAmount(amount); err == nil {
+			t.Errorf("parseLedgerAmount(%q): expected an error", amount)
+		}
+	}
+}
+
+// testLedger runs the behavior every Ledger backend must share
+func testLedger(t *testing.T, l Ledger, wallet string) {
+	t.Helper()
+	ctx := context.Background()
+
+	if balance, err := l.Debit(ctx, wallet, 1); !errors.Is(err, ErrInsufficientBalance) || balance != 0 {
+		t.Fatalf("expected an empty balance to refuse debits, got %d, %v", balance, err)
+	}
+	if balance, err := l.Credit(ctx, wallet, 10); err != nil || balance != 10 {
+		t.Fatalf("Credit = %d, %v; want 10", balance, err)
+	}
+
+	// Concurrent debits must never overdraw: exactly 10 of 20 succeed
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := l.Debit(ctx, wallet, 1); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded != 10 {
+		t.Errorf("expected 10 debits to succeed, got %d", succeeded)
+	}
+	if balance, err := l.Balance(ctx, "0x"+strings.ToUpper(wallet[2:])); err != nil || balance != 0 {
+		t.Errorf("Balance = %d, %v; want 0", balance, err)
+	}
+
+	if err := l.SetToken(ctx, wallet, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetToken(ctx, wallet, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := l.WalletForToken(ctx, "first"); got != "" {
+		t.Errorf("expected the replaced token to be revoked, got %q", got)
+	}
+	if got, _ := l.WalletForToken(ctx, "second"); got != wallet {
+		t.Errorf("WalletForToken = %q, want %q", got, wallet)
+	}
+
+	// A credit past the int64 range is refused and changes nothing
+	if balance, err := l.Credit(ctx, wallet, math.MaxInt64); err != nil || balance != math.MaxInt64 {
+		t.Fatalf("Credit = %d, %v; want the maximum balance", balance, err)
+	}
+	if _, err := l.Credit(ctx, wallet, 1); !errors.Is(err, ErrBalanceOverflow) {
+		t.Errorf("expected ErrBalanceOverflow, got %v", err)
+	}
+	if balance, err := l.Debit(ctx, wallet, math.MaxInt64); err != nil || balance != 0 {
+		t.Errorf("expected the overflowing credit to leave the balance alone, got %d, %v", balance, err)
+	}
+}
+
+func TestMemoryLedger(t *testing.T) {
+	testLedger(t, NewMemoryLedger(), "0xabc0000000000000000000000000000000000001")
+}
+
+func TestFileLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger", "ledger.json")
+	l, err := NewFileLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := "0xabc0000000000000000000000000000000000002"
+	testLedger(t, l, wallet)
+	if _, err := l.Credit(context.Background(), wallet, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewFileLedger(path)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if balance, _ := reloaded.Balance(context.Background(), wallet); balance != 42 {
+		t.Errorf("expected the balance to survive a restart, got %d", balance)
+	}
+	if got, _ := reloaded.WalletForToken(context.Background(), "second"); got != wallet {
+		t.Errorf("expected the token to survive a restart, got %q", got)
+	}
+}
+
+func TestRedisLedger(t *testing.T) {
+	client := newTestRedisClient(t)
+	wallet := "0x" + strconv.FormatInt(time.Now().UnixNano(), 16)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		client.HDel(ctx, ledgerBalancesKey, wallet)
+		client.HDel(ctx, ledgerWalletTokensKey, wallet)
+		client.HDel(ctx, ledgerTokensKey, "first", "second")
+	})
+	testLedger(t, NewRedisLedger(client), wallet)
+}
+
+func TestInitLedger_RedisRequired(t *testing.T) {
+	orig, origClient := ledger, redisClient
+	redisClient = nil
+	defer func() { ledger, redisClient = orig, origClient }()
+
+	t.Setenv("LEDGER_ENABLED", "true")
+	t.Setenv("LEDGER_STORE", "redis")
+	if !getRedisRequired() {
+		t.Error("expected LEDGER_STORE=redis to require Redis")
+	}
+	if err := initLedger(); err == nil {
+		t.Error("expected a startup error when the Redis ledger is unavailable")
+	}
+}
@@ -4,10 +4,8 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/ecdsa"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -30,6 +28,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
 )
 
 type PaymentContext struct {
@@ -39,6 +39,13 @@ type PaymentContext struct {
 	Nonce     string `json:"nonce"`
 	ChainID   int    `json:"chainId"`
 	Timestamp uint64 `json:"timestamp"`
+	// Quote is set for usage-priced routes. It is informational for the
+	// client; the signed fields above already carry its amount and body binding.
+	Quote *Quote `json:"quote,omitempty"`
+	// Funding is how the request was paid for (fundingSignature,
+	// fundingPrepaid or fundingRefund). It is recorded in the receipt, never
+	// signed by clients.
+	Funding string `json:"-"`
 }
 
 type VerifyRequest struct {
@@ -57,16 +64,27 @@ type SummarizeRequest struct {
 }
 
 // validateConfig validates all required environment variables at startup.
-// It checks for OPENROUTER_API_KEY, SERVER_WALLET_PRIVATE_KEY, and conditionally REDIS_URL.
+// It checks for SERVER_WALLET_PRIVATE_KEY (unless RECEIPT_KEYS_CONFIG names
+// the signing keys), OPENROUTER_API_KEY (unless AI_PROVIDERS_CONFIG
+// configures the providers), and conditionally REDIS_URL (when caching or a Redis-backed
+// store is enabled).
 // Returns an error listing all missing variables if any are not set.
 func validateConfig() error {
 	required := []string{
-		"OPENROUTER_API_KEY",
 		"SERVER_WALLET_PRIVATE_KEY", // Critical for signing receipts
 	}
+	// A receipt keyring names its own key variables, checked when it is loaded
+	if os.Getenv("RECEIPT_KEYS_CONFIG") != "" {
+		required = nil
+	}
 
-	// Add REDIS_URL to required if caching is enabled
-	if getCacheEnabled() {
+	// Provider API keys are checked when AI_PROVIDERS_CONFIG is loaded
+	if os.Getenv("AI_PROVIDERS_CONFIG") == "" {
+		required = append([]string{"OPENROUTER_API_KEY"}, required...)
+	}
+
+	// Add REDIS_URL to required if caching or another Redis-backed store is enabled
+	if getRedisRequired() {
 		required = append(required, "REDIS_URL")
 	}
 
@@ -83,12 +101,18 @@ func validateConfig() error {
 	}
 
 	// Validate SERVER_WALLET_PRIVATE_KEY format early (before server starts accepting traffic)
-	if err := validateServerPrivateKey(); err != nil {
-		return fmt.Errorf("SERVER_WALLET_PRIVATE_KEY validation failed: %w", err)
+	if os.Getenv("RECEIPT_KEYS_CONFIG") == "" {
+		if err := validateServerPrivateKey(); err != nil {
+			return fmt.Errorf("SERVER_WALLET_PRIVATE_KEY validation failed: %w", err)
+		}
 	}
 
-	// Validate REDIS_URL format if caching is enabled
-	if getCacheEnabled() {
+	if err := validateReceiptConfig(); err != nil {
+		return err
+	}
+
+	// Validate REDIS_URL format if Redis is needed
+	if getRedisRequired() {
 		if err := validateRedisURL(); err != nil {
 			return fmt.Errorf("REDIS_URL validation failed: %w", err)
 		}
@@ -128,7 +152,7 @@ func validateServerPrivateKey() error {
 
 // validateRedisURL validates the Redis URL format without connecting.
 // It supports both redis:// URLs and host:port format.
-// Only called when CACHE_ENABLED=true to ensure Redis is properly configured.
+// Only called when Redis is required to ensure it is properly configured.
 func validateRedisURL() error {
 	redisURL := os.Getenv("REDIS_URL")
 	if redisURL == "" {
@@ -183,8 +207,10 @@ func main() {
 	if model := os.Getenv("MODEL"); model != "" {
 		fmt.Printf("    - Model: %s\n", model)
 	}
-	if verifier := os.Getenv("VERIFIER_URL"); verifier != "" {
-		fmt.Printf("    - Verifier: %s\n", verifier)
+	if mode := getVerifierMode(); mode == verifierModeLocal {
+		fmt.Println("    - Verifier: local (in-process EIP-712)")
+	} else if verifier := os.Getenv("VERIFIER_URL"); verifier != "" {
+		fmt.Printf("    - Verifier: %s (%s)\n", verifier, mode)
 	}
 	if chainID := os.Getenv("CHAIN_ID"); chainID != "" {
 		fmt.Printf("    - Chain ID: %s\n", chainID)
@@ -195,7 +221,7 @@ func main() {
 	if os.Getenv("MODEL") == "" {
 		fmt.Println("[WARN] MODEL not set, using default model")
 	}
-	if os.Getenv("VERIFIER_URL") == "" {
+	if os.Getenv("VERIFIER_URL") == "" && getVerifierMode() != verifierModeLocal {
 		fmt.Println("[WARN] VERIFIER_URL not set, using default verifier")
 	}
 	if os.Getenv("CHAIN_ID") == "" {
@@ -207,6 +233,9 @@ func main() {
 	// VIBE FIX: Register the Correlation ID Middleware immediately
 	// This ensures every single request gets an ID before anything else happens.
 	r.Use(CorrelationIDMiddleware())
+	// Tracing runs next so every later middleware and the handler share one
+	// server span carrying the correlation ID
+	r.Use(TracingMiddleware())
 
 	// Configure GZIP compression for API responses
 	// - Uses DefaultCompression for balance between speed and size
@@ -216,9 +245,54 @@ func main() {
 
 	// Initialize Redis early to fail-fast if Redis required but unavailable
 	initRedis()
+	if err := initNonceStore(); err != nil {
+		log.Fatalf("Failed to initialize nonce store: %v", err)
+	}
+	if err := initReceiptStore(); err != nil {
+		log.Fatalf("Failed to initialize receipt store: %v", err)
+	}
+	if err := initLedger(); err != nil {
+		log.Fatalf("Failed to initialize prepaid ledger: %v", err)
+	}
+	if err := initRefundStore(); err != nil {
+		log.Fatalf("Failed to initialize refund store: %v", err)
+	}
+	if err := initResponseCache(); err != nil {
+		log.Fatalf("Failed to initialize response cache: %v", err)
+	}
+	if err := initAuditTrail(); err != nil {
+		log.Fatalf("Failed to initialize audit trail: %v", err)
+	}
+	if err := initPaidRoutes(); err != nil {
+		log.Fatalf("Failed to load pricing config: %v", err)
+	}
+	if err := initModelPricing(); err != nil {
+		log.Fatalf("Failed to load model pricing config: %v", err)
+	}
+	if err := initHTTPClients(); err != nil {
+		log.Fatalf("Failed to configure HTTP clients: %v", err)
+	}
+	if err := initReceiptKeyring(); err != nil {
+		log.Fatalf("Failed to load receipt keys: %v", err)
+	}
+	if err := initPaymentVerifier(); err != nil {
+		log.Fatalf("Failed to initialize payment verifier: %v", err)
+	}
+	if err := initAIProviders(); err != nil {
+		log.Fatalf("Failed to load AI providers config: %v", err)
+	}
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	r.StaticFile("/openapi.yaml", "openapi.yaml")
 
+	// Prometheus metrics, registered before CORS and rate limiting so scrapes
+	// are never throttled
+	r.GET("/metrics", handleMetrics())
+
 	r.GET("/docs", func(c *gin.Context) {
 		c.Header("Content-Type", "text/html")
 		c.String(200, `
@@ -251,7 +325,10 @@ func main() {
 			"X-402-Signature",
 			"X-402-Nonce",
 			"X-402-Timestamp",
+			"X-402-Balance-Token",
+			"X-402-Refund-ID",
 			"X-Correlation-ID",
+			"Accept-Receipt-Version",
 		},
 		ExposeHeaders: []string{
 			"Content-Length",
@@ -260,6 +337,8 @@ func main() {
 			"X-RateLimit-Reset",
 			"Retry-After",
 			"X-402-Receipt",
+			"X-402-Balance",
+			"X-402-Refund",
 			"X-Correlation-ID",
 		},
 		AllowCredentials: true,
@@ -269,6 +348,9 @@ func main() {
 	if getRateLimitEnabled() {
 		limiters := initRateLimiters()
 		r.Use(RateLimitMiddleware(limiters))
+		if err := initWalletRateLimit(limiters); err != nil {
+			log.Fatalf("Failed to load wallet rate limit tiers: %v", err)
+		}
 		log.Println("Rate limiting enabled")
 	}
 
@@ -293,11 +375,37 @@ func main() {
 		aiGroup.POST("/summarize", handleSummarize)
 	}
 
+	// Prepaid balances: one signed deposit funds many requests
+	if ledger != nil {
+		balanceGroup := r.Group("/api/balance")
+		balanceGroup.GET("", handleGetBalance)
+		balanceGroup.POST("/topup", handleTopUp)
+	}
+
+	// Refund credits for paid requests that failed. Listing and claiming to
+	// a balance need the prepaid ledger.
+	r.GET("/api/refunds/:id", handleGetRefund)
+	if ledger != nil {
+		r.GET("/api/refunds", handleListRefunds)
+		r.POST("/api/refunds/:id/claim", handleClaimRefund)
+	}
+
 	// Receipt lookup endpoint
 	// Note: Rate limiting applies only if enabled globally via RATE_LIMIT_ENABLED=true
 	// Random 12-char receipt IDs (2^48 space) make brute-force enumeration impractical
 	r.GET("/api/receipts/:id", handleGetReceipt)
 
+	// Receipt signing keys, for verifiers that pin keys by kid
+	r.GET("/.well-known/paygate-keys", handleReceiptKeys)
+
+	// Cache administration, served only with ADMIN_API_TOKEN set.
+	// Invalidations are recorded in the audit trail.
+	if token := getAdminAPIToken(); token != "" && responseCache != nil {
+		registerCacheAdminRoutes(r.Group("/admin/cache", AdminAuthMiddleware(token)))
+	} else if token == "" {
+		log.Println("Admin API disabled (ADMIN_API_TOKEN not set)")
+	}
+
 	// Initialize receipt cleanup goroutine
 	cleanupCtx, cleanupCancel := context.WithCancel(context.Background())
 	defer func() {
@@ -337,101 +445,156 @@ func handleSummarize(c *gin.Context) {
 	signature := c.GetHeader("X-402-Signature")
 	nonce := c.GetHeader("X-402-Nonce")
 	timestampHeader := c.GetHeader("X-402-Timestamp")
+	route := lookupPaidRoute(c)
+
+	// Check if body already read by middleware
+	if body, exists := c.Get("request_body"); exists {
+		// Cache middleware always sets this as []byte, safe to assert
+		requestBody = body.([]byte)
+	}
+
+	// Read body if not already available
+	if requestBody == nil {
+		// Read body with limit (only if middleware didn't process it)
+		const maxBodySize = 10 * 1024 * 1024
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(maxBodySize))
+			requestBody, err = io.ReadAll(c.Request.Body)
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					c.JSON(413, gin.H{"error": "Payload too large", "max_size": "10MB"})
+				} else {
+					c.JSON(500, gin.H{"error": "Failed to read request body"})
+				}
+				return
+			}
+		}
+	}
+
+	// Clients paying from a prepaid balance or a refund credit instead of a
+	// signature are charged after the request is validated, so malformed
+	// requests are not charged
+	unsigned := signature == "" && unsignedFundingRequested(c)
 
 	// Basic check
-	if signature == "" || nonce == "" {
+	if !unsigned && (signature == "" || nonce == "") {
+		quote, err := route.quote(requestBody)
+		if err != nil {
+			log.Printf("Failed to quote request: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to create payment context", "message": "An internal error occurred"})
+			return
+		}
+		paymentCtx, err := createPaymentContext(c.Request.Context(), route, quote)
+		if err != nil {
+			log.Printf("Failed to issue payment nonce: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to create payment context", "message": "An internal error occurred"})
+			return
+		}
+		paymentChallengesTotal.WithLabelValues(routeLabel(c)).Inc()
 		c.JSON(402, gin.H{
 			"error":          "Payment Required",
 			"message":        "Please sign the payment context",
-			"paymentContext": createPaymentContext(),
+			"paymentContext": paymentCtx,
 		})
 		return
 	}
 
-	if timestampHeader == "" {
-		c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Missing X-402-Timestamp header"})
+	// Refuse before taking payment when no AI provider can be called
+	if unavailable := aiUnavailable(); unavailable != nil {
+		respondUnavailable(c, unavailable)
 		return
 	}
 
-	timestampValue, err := strconv.ParseUint(timestampHeader, 10, 64)
-	if err != nil || timestampValue == 0 {
-		c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Invalid X-402-Timestamp header"})
+	// 2. Parse Request (already done by the cache middleware when it ran).
+	// Validated before the signature is checked, so a malformed request does
+	// not spend its nonce
+	desc, err := describeAIRequest(c, summarizeOperation, requestBody)
+	if err != nil {
+		respondInvalidAIRequest(c, err)
 		return
 	}
 
-	// Check if body already read by middleware
-	if body, exists := c.Get("request_body"); exists {
-		// Cache middleware always sets this as []byte, safe to assert
-		requestBody = body.([]byte)
-	}
+	var paymentCtx *PaymentContext
+	var payer string
+	if !unsigned {
+		if timestampHeader == "" {
+			c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Missing X-402-Timestamp header"})
+			return
+		}
 
-	// Read body if not already available
-	if requestBody == nil {
-		// Read body with limit (only if middleware didn't process it)
-		const maxBodySize = 10 * 1024 * 1024
-		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(maxBodySize))
-		requestBody, err = io.ReadAll(c.Request.Body)
+		timestampValue, err := strconv.ParseUint(timestampHeader, 10, 64)
+		if err != nil || timestampValue == 0 {
+			c.JSON(400, gin.H{"error": "Invalid timestamp", "details": "Invalid X-402-Timestamp header"})
+			return
+		}
+
+		// Verify
+		verifyResp, verifiedCtx, err := verifyPayment(c.Request.Context(), route, signature, nonce, uint64(timestampValue), requestBody)
 		if err != nil {
-			var maxBytesErr *http.MaxBytesError
-			if errors.As(err, &maxBytesErr) {
-				c.JSON(413, gin.H{"error": "Payload too large", "max_size": "10MB"})
+			log.Printf("Verification error: %v", err)
+			respondVerificationError(c, err)
+			return
+		}
+
+		if !verifyResp.IsValid {
+			// Check for timestamp-related errors (E007, E008, E009)
+			if strings.HasPrefix(verifyResp.Error, "E007") ||
+				strings.HasPrefix(verifyResp.Error, "E008") ||
+				strings.HasPrefix(verifyResp.Error, "E009") {
+				c.JSON(400, gin.H{"error": "Invalid timestamp", "details": verifyResp.Error})
 			} else {
-				c.JSON(500, gin.H{"error": "Failed to read request body"})
+				c.JSON(403, gin.H{"error": "Invalid Signature", "details": verifyResp.Error})
 			}
 			return
 		}
-	}
 
-	// Verify
-	verifyResp, paymentCtx, err := verifyPayment(c.Request.Context(), signature, nonce, uint64(timestampValue))
-	if err != nil {
-		log.Printf("Verification error: %v", err)
-		if errors.Is(err, context.DeadlineExceeded) {
-			c.JSON(504, gin.H{"error": "Gateway Timeout", "message": "Verifier request timed out"})
-		} else {
-			c.JSON(500, gin.H{"error": "Verification Service Failed", "message": "An internal error occurred"})
+		// Limit per payer wallet before redeeming, so a 429 does not spend the nonce
+		if !checkWalletRateLimit(c, verifyResp.RecoveredAddress) {
+			return
 		}
-		return
-	}
 
-	if !verifyResp.IsValid {
-		// Check for timestamp-related errors (E007, E008, E009)
-		if strings.HasPrefix(verifyResp.Error, "E007") ||
-			strings.HasPrefix(verifyResp.Error, "E008") ||
-			strings.HasPrefix(verifyResp.Error, "E009") {
-			c.JSON(400, gin.H{"error": "Invalid timestamp", "details": verifyResp.Error})
-		} else {
-			c.JSON(403, gin.H{"error": "Invalid Signature", "details": verifyResp.Error})
+		// Signature is valid: redeem the nonce so it cannot be replayed
+		if !redeemNonce(c, nonce) {
+			return
 		}
-		return
+
+		paymentCtx, payer = verifiedCtx, verifyResp.RecoveredAddress
 	}
 
-	// 2. Parse Request
-	var req SummarizeRequest
-	if err := json.Unmarshal(requestBody, &req); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid request body"})
-		return
+	if unsigned {
+		var ok bool
+		if paymentCtx, payer, ok = chargeUnsigned(c, route, requestBody); !ok {
+			return
+		}
 	}
+	// From here on a failure is recorded as refundable
+	trackPaidService(c, *paymentCtx, payer, requestBody)
 
-	// Validate text is not empty (also validated in cache middleware, but needed here for non-cached requests)
-	if req.Text == "" {
-		c.JSON(400, gin.H{"error": "Invalid request", "message": "text field cannot be empty"})
+	// 3. Call AI Service (streamed as SSE when the client asks for it)
+	if wantsEventStream(c) {
+		streamCompletion(c, *paymentCtx, payer, requestBody, desc)
 		return
 	}
-
-	// 3. Call AI Service
-	summary, err := callOpenRouter(c.Request.Context(), req.Text)
+	aiResp, err := callAI(c.Request.Context(), desc)
 	if err != nil {
+		var unavailable *DependencyUnavailableError
+		if errors.As(err, &unavailable) {
+			respondPaidUnavailable(c, unavailable)
+			return
+		}
 		if errors.Is(err, context.DeadlineExceeded) || c.Request.Context().Err() == context.DeadlineExceeded {
-			c.JSON(504, gin.H{"error": "Gateway Timeout", "message": "AI request timed out"})
+			respondServiceFailure(c, 504, gin.H{"error": "Gateway Timeout", "message": "AI request timed out"}, "AI request timed out")
 			return
 		}
-		c.JSON(500, gin.H{"error": "AI Service Failed", "details": err.Error()})
+		noteAIFailure(c, err)
+		respondServiceFailure(c, 500, gin.H{"error": "AI Service Failed", "details": err.Error()}, "AI service failed")
 		return
 	}
+	markServiceDelivered(c)
 
 	// 4. Generate & Send Receipt
-	if err := generateAndSendReceipt(c, *paymentCtx, verifyResp.RecoveredAddress, requestBody, summary); err != nil {
+	if err := generateAndSendReceipt(c, *paymentCtx, payer, requestBody, aiResp.Content, aiResp.Model); err != nil {
 		log.Printf("Failed to generate receipt: %v", err)
 		// generateAndSendReceipt sends error response if it fails?
 		// No, it returns error, we might have already written status if we aren't careful.
@@ -441,75 +604,73 @@ func handleSummarize(c *gin.Context) {
 }
 
 // verifyPayment calls the verification service.
+// The payment context is rebuilt from the matched route's pricing, so a
+// signature is only valid for the route it was issued for. For usage-priced
+// routes the quote is recomputed from requestBody, and the nonce must carry
+// that body's digest; otherwise an E013 result is returned without calling the verifier.
+func verifyPayment(ctx context.Context, route *PaidRoute, signature, nonce string, timestamp uint64, requestBody []byte) (*VerifyResponse, *PaymentContext, error) {
+	ctx, span := startSpan(ctx, "verifyPayment", semconv.HTTPRoute(route.Path))
+	verifyResp, paymentCtx, err := requestVerification(ctx, route, signature, nonce, timestamp, requestBody)
+	outcome := verificationOutcome(verifyResp, err)
+	paymentVerificationsTotal.WithLabelValues(outcome).Inc()
+	span.SetAttributes(attribute.String("payment.outcome", outcome))
+	endSpan(span, err)
+	return verifyResp, paymentCtx, err
+}
 
-func verifyPayment(ctx context.Context, signature, nonce string, timestamp uint64) (*VerifyResponse, *PaymentContext, error) {
-	paymentCtx := PaymentContext{
-		Recipient: getRecipientAddress(),
-		Token:     "USDC",
-		Amount:    getPaymentAmount(),
-		Nonce:     nonce,
-		ChainID:   getChainID(),
-		Timestamp: timestamp,
-	}
-
-	verifyReq := VerifyRequest{
-		Context:   paymentCtx,
-		Signature: signature,
-	}
-
-	verifyBody, err := json.Marshal(verifyReq)
-	if err != nil {
-		return nil, nil, fmt.Errorf("marshal verification request: %w", err)
-	}
-
-	verifierURL := os.Getenv("VERIFIER_URL")
-	if verifierURL == "" {
-		verifierURL = "http://127.0.0.1:3002"
+// respondVerificationError answers a verifyPayment error: 503 when the
+// verifier's circuit breaker or bulkhead refused the call, 504 when it timed
+// out, and 500 otherwise
+func respondVerificationError(c *gin.Context, err error) {
+	var unavailable *DependencyUnavailableError
+	switch {
+	case errors.As(err, &unavailable):
+		respondUnavailable(c, unavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(504, gin.H{"error": "Gateway Timeout", "message": "Verifier request timed out"})
+	default:
+		c.JSON(500, gin.H{"error": "Verification Service Failed", "message": "An internal error occurred"})
 	}
+}
 
-	// Use a separate context for verifier timeout to avoid hanging
-	verifierCtx, verifierCancel := context.WithTimeout(ctx, getVerifierTimeout())
-	defer verifierCancel()
+// requestVerification does the work of verifyPayment
+func requestVerification(ctx context.Context, route *PaidRoute, signature, nonce string, timestamp uint64, requestBody []byte) (*VerifyResponse, *PaymentContext, error) {
+	paymentCtx := route.paymentContext(nonce, timestamp)
 
-	vreq, err := http.NewRequestWithContext(verifierCtx, "POST", verifierURL+"/verify", bytes.NewBuffer(verifyBody))
+	quote, err := route.quote(requestBody)
 	if err != nil {
-		return nil, nil, fmt.Errorf("create verifier request: %w", err)
+		return nil, nil, fmt.Errorf("reconstruct quote: %w", err)
 	}
-	vreq.Header.Set("Content-Type", "application/json")
-
-	// VIBE FIX: Pass Correlation ID to the Verifier Service
-	// CORRECT: Use the constant 'correlationIDKey' to retrieve the value
-	if cid, ok := ctx.Value(correlationIDKey).(string); ok {
-		vreq.Header.Set("X-Correlation-ID", cid)
+	if quote != nil {
+		if !nonceMatchesQuote(nonce, quote) {
+			return &VerifyResponse{IsValid: false, Error: ErrQuoteMismatch.Error()}, &paymentCtx, nil
+		}
+		paymentCtx.Amount = quote.Amount
+		paymentCtx.Quote = quote
 	}
 
-	// Use http.DefaultClient and rely on verifierCtx for timeouts/cancellation.
-	resp, err := http.DefaultClient.Do(vreq)
+	verifyResp, err := paymentVerifier.Verify(ctx, VerifyRequest{
+		Context:   paymentCtx,
+		Signature: signature,
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("verifier request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("verifier returned status %d", resp.StatusCode)
+		return nil, nil, err
 	}
 
-	var verifyResp VerifyResponse
-	if err := json.NewDecoder(resp.Body).Decode(&verifyResp); err != nil {
-		return nil, nil, fmt.Errorf("decode verification response: %w", err)
-	}
-
-	return &verifyResp, &paymentCtx, nil
+	return verifyResp, &paymentCtx, nil
 }
 
 // generateAndSendReceipt handles receipt generation, storage, and sending the final JSON response.
 // The receipt is sent ONLY in the X-402-Receipt header, not in the response body,
 // to ensure the ResponseHash in the receipt matches the actual JSON body clients receive.
-func generateAndSendReceipt(c *gin.Context, paymentCtx PaymentContext, recoveredAddr string, requestBody []byte, aiResult string) error {
+func generateAndSendReceipt(c *gin.Context, paymentCtx PaymentContext, recoveredAddr string, requestBody []byte, aiResult string, model string) error {
 	// Construct the response body that will be sent to client (without receipt)
 	responseMap := map[string]interface{}{
 		"result": aiResult,
 	}
+	if model != "" {
+		responseMap["model"] = model
+	}
 	responseBody, err := json.Marshal(responseMap)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to encode response"})
@@ -517,13 +678,15 @@ func generateAndSendReceipt(c *gin.Context, paymentCtx PaymentContext, recovered
 	}
 
 	// Generate receipt with the actual response body hash
-	receipt, err := GenerateReceipt(paymentCtx, recoveredAddr, c.Request.URL.Path, requestBody, responseBody)
+	_, span := startSpan(c.Request.Context(), "generateReceipt")
+	receipt, err := GenerateReceipt(paymentCtx, recoveredAddr, c.Request.URL.Path, model, negotiateReceiptVersion(c), requestBody, responseBody)
+	endSpan(span, err)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to generate receipt", "details": err.Error()})
 		return err
 	}
 
-	if err := storeReceipt(receipt, getReceiptTTL()); err != nil {
+	if err := storeReceipt(c.Request.Context(), receipt, getReceiptTTL()); err != nil {
 		c.JSON(500, gin.H{"error": "Failed to store receipt"})
 		return err
 	}
@@ -541,16 +704,20 @@ func generateAndSendReceipt(c *gin.Context, paymentCtx PaymentContext, recovered
 	return nil
 }
 
-// createPaymentContext constructs a PaymentContext prefilled with the recipient address (from RECIPIENT_ADDRESS or a fallback), the USDC token, amount "0.001", a newly generated UUID nonce, and chain ID 8453.
-func createPaymentContext() PaymentContext {
-	return PaymentContext{
-		Recipient: getRecipientAddress(),
-		Token:     "USDC",
-		Amount:    getPaymentAmount(),
-		Nonce:     uuid.New().String(),
-		ChainID:   getChainID(),
-		Timestamp: uint64(time.Now().Unix()),
+// createPaymentContext constructs a PaymentContext from the route's pricing (falling back to RECIPIENT_ADDRESS, the USDC token, PAYMENT_AMOUNT and CHAIN_ID), with a newly generated UUID nonce.
+// If quote is non-nil its amount replaces the flat price and the nonce is bound to the quoted body.
+// The nonce is recorded in the nonce store so it can later be redeemed exactly once.
+func createPaymentContext(ctx context.Context, route *PaidRoute, quote *Quote) (PaymentContext, error) {
+	paymentCtx := route.paymentContext(uuid.New().String(), uint64(time.Now().Unix()))
+	if quote != nil {
+		paymentCtx.Amount = quote.Amount
+		paymentCtx.Nonce = quotedNonce(paymentCtx.Nonce, quote)
+		paymentCtx.Quote = quote
+	}
+	if err := nonceStore.Issue(ctx, paymentCtx.Nonce, getNonceTTL()); err != nil {
+		return PaymentContext{}, err
 	}
+	return paymentCtx, nil
 }
 
 // getRecipientAddress retrieves the recipient address from the RECIPIENT_ADDRESS environment variable.
@@ -589,154 +756,98 @@ func getChainID() int {
 	return chainID
 }
 
-// callOpenRouter sends the given text to the OpenRouter chat completions API
-// requesting a two-sentence summary and returns the generated summary.
-// It reads OPENROUTER_API_KEY for authorization and OPENROUTER_MODEL to select
-// the model (defaults to "z-ai/glm-4.5-air:free" if unset).
-func callOpenRouter(ctx context.Context, text string) (string, error) {
-	apiKey := os.Getenv("OPENROUTER_API_KEY")
+// getOpenRouterModel returns the model from OPENROUTER_MODEL, defaulting to "z-ai/glm-4.5-air:free"
+func getOpenRouterModel() string {
 	model := os.Getenv("OPENROUTER_MODEL")
 	if model == "" {
 		model = "z-ai/glm-4.5-air:free"
 	}
-
-	prompt := fmt.Sprintf("Summarize this text in 2 sentences: %s", text)
-
-	reqBody, _ := json.Marshal(map[string]interface{}{
-		"model": model,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-	})
-
-	openRouterURL := os.Getenv("OPENROUTER_URL")
-	if openRouterURL == "" {
-		openRouterURL = "https://openrouter.ai/api/v1/chat/completions"
-	}
-	req, err := http.NewRequestWithContext(ctx, "POST", openRouterURL, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return "", fmt.Errorf("failed to create OpenRouter request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	// VIBE FIX: Pass Correlation ID to AI Service
-	// (Assuming the context has it, though OpenRouter might not use it, it's good practice)
-	if cid, ok := ctx.Value(correlationIDKey).(string); ok { // Changed to use correlationIDKey
-		req.Header.Set("X-Correlation-ID", cid)
-	}
-
-	// Use http.DefaultClient and rely on ctx for cancellation/timeouts.
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
-			return "", context.DeadlineExceeded
-		}
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode AI response: %w", err)
-	}
-
-	choices, ok := result["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		log.Printf("OpenRouter response: %+v", result)
-		return "", fmt.Errorf("invalid response from AI provider: no choices")
-	}
-
-	choice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid response from AI provider: malformed choice")
-	}
-
-	message, ok := choice["message"].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid response from AI provider: malformed message")
-	}
-
-	content, ok := message["content"].(string)
-	if !ok {
-		return "", fmt.Errorf("invalid response from AI provider: missing content")
-	}
-
-	return content, nil
+	return model
 }
 
 // Rate Limiting Functions
 
 // initRateLimiters creates rate limiters for each tier
+// With RATE_LIMIT_BACKEND=redis the buckets live in Redis and are shared by
+// all replicas; each tier keeps a local TokenBucket as its fallback.
 func initRateLimiters() map[string]RateLimiter {
 	cleanupInterval := getEnvAsInt("RATE_LIMIT_CLEANUP_INTERVAL", 300)
 	cleanupTTL := time.Duration(cleanupInterval) * time.Second
+	useRedis := getRateLimitBackend() == "redis"
+	if useRedis && redisClient == nil {
+		log.Println("WARNING: RATE_LIMIT_BACKEND=redis but Redis is unavailable, rate limits are per replica")
+	}
+	redisTimeout := getRateLimitRedisTimeout()
 
-	return map[string]RateLimiter{
-		"anonymous": NewTokenBucket(
-			getEnvAsInt("RATE_LIMIT_ANONYMOUS_RPM", 10),
-			getEnvAsInt("RATE_LIMIT_ANONYMOUS_BURST", 5),
-			cleanupTTL,
-		),
-		"standard": NewTokenBucket(
-			getEnvAsInt("RATE_LIMIT_STANDARD_RPM", 60),
-			getEnvAsInt("RATE_LIMIT_STANDARD_BURST", 20),
-			cleanupTTL,
-		),
-		"verified": NewTokenBucket(
-			getEnvAsInt("RATE_LIMIT_VERIFIED_RPM", 120),
-			getEnvAsInt("RATE_LIMIT_VERIFIED_BURST", 50),
-			cleanupTTL,
-		),
+	tiers := map[string][2]int{
+		"anonymous": {getEnvAsInt("RATE_LIMIT_ANONYMOUS_RPM", 10), getEnvAsInt("RATE_LIMIT_ANONYMOUS_BURST", 5)},
+		"standard":  {getEnvAsInt("RATE_LIMIT_STANDARD_RPM", 60), getEnvAsInt("RATE_LIMIT_STANDARD_BURST", 20)},
+		"verified":  {getEnvAsInt("RATE_LIMIT_VERIFIED_RPM", 120), getEnvAsInt("RATE_LIMIT_VERIFIED_BURST", 50)},
+		"precheck":  {getEnvAsInt("RATE_LIMIT_PRECHECK_RPM", 300), getEnvAsInt("RATE_LIMIT_PRECHECK_BURST", 100)},
 	}
+
+	limiters := make(map[string]RateLimiter, len(tiers))
+	for tier, limit := range tiers {
+		local := NewTokenBucket(limit[0], limit[1], cleanupTTL)
+		if useRedis {
+			limiters[tier] = NewRedisTokenBucket(redisClient, tier, limit[0], limit[1], redisTimeout, local)
+		} else {
+			limiters[tier] = local
+		}
+	}
+	return limiters
 }
 
-// RateLimitMiddleware applies rate limiting to requests
+// RateLimitMiddleware applies the IP-based pre-check to every request.
+// Signed requests are limited again per payer wallet after verification
+// (see WalletRateLimit).
 func RateLimitMiddleware(limiters map[string]RateLimiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Determine rate limit key and tier
 		key := getRateLimitKey(c)
 		tier := selectRateLimitTier(c)
-		limiter := limiters[tier]
-
-		// Check if request is allowed
-		if !limiter.Allow(key) {
-			retryAfter := calculateRetryAfter(limiter, key)
-			c.Header("Retry-After", strconv.Itoa(retryAfter))
-			c.Header("X-RateLimit-Limit", strconv.Itoa(getLimitForTier(tier)))
-			c.Header("X-RateLimit-Remaining", "0")
-			c.Header("X-RateLimit-Reset", strconv.FormatInt(limiter.GetResetTime(key), 10))
-			c.JSON(429, gin.H{
-				"error":       "Too Many Requests",
-				"message":     "Rate limit exceeded. Please retry later.",
-				"retry_after": retryAfter,
-			})
-			c.Abort()
+		if !applyRateLimit(c, limiters[tier], key, tier) {
 			return
 		}
+		c.Next()
+	}
+}
 
-		// Add rate limit headers to successful responses
+// applyRateLimit takes a token for key from limiter and sets the
+// X-RateLimit-* headers. When the bucket is empty it sends a 429, aborts
+// the request and returns false.
+func applyRateLimit(c *gin.Context, limiter RateLimiter, key, tier string) bool {
+	_, span := startSpan(c.Request.Context(), "rateLimit", attribute.String("ratelimit.tier", tier))
+	allowed := limiter.Allow(key)
+	span.SetAttributes(attribute.Bool("ratelimit.allowed", allowed))
+	span.End()
+	if !allowed {
+		rateLimitedTotal.WithLabelValues(tier).Inc()
+		retryAfter := calculateRetryAfter(limiter, key)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
 		c.Header("X-RateLimit-Limit", strconv.Itoa(getLimitForTier(tier)))
-		c.Header("X-RateLimit-Remaining", strconv.Itoa(limiter.GetRemaining(key)))
+		c.Header("X-RateLimit-Remaining", "0")
 		c.Header("X-RateLimit-Reset", strconv.FormatInt(limiter.GetResetTime(key), 10))
-
-		c.Next()
+		c.JSON(429, gin.H{
+			"error":       "Too Many Requests",
+			"message":     "Rate limit exceeded. Please retry later.",
+			"retry_after": retryAfter,
+		})
+		c.Abort()
+		return false
 	}
+
+	// Add rate limit headers to successful responses
+	c.Header("X-RateLimit-Limit", strconv.Itoa(getLimitForTier(tier)))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(limiter.GetRemaining(key)))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(limiter.GetResetTime(key), 10))
+	return true
 }
 
-// getRateLimitKey determines the key for rate limiting (nonce/wallet > IP)
+// getRateLimitKey determines the key for the pre-verification check.
+// Nonces are fresh on every request, so they cannot identify a client; the
+// wallet is only known after verification, where WalletRateLimit keys on it.
 func getRateLimitKey(c *gin.Context) string {
-	signature := c.GetHeader("X-402-Signature")
-	nonce := c.GetHeader("X-402-Nonce")
-
-	// Only use nonce-based key if BOTH signature and nonce are present
-	// This prevents attackers from bypassing IP rate limits with fake nonces
-	if signature != "" && nonce != "" {
-		hash := sha256.Sum256([]byte(nonce))
-		// Use 32 hex chars (128 bits) for better collision resistance
-		return "nonce:" + hex.EncodeToString(hash[:])[:32]
-	}
-
 	return "ip:" + c.ClientIP()
 }
 
@@ -746,10 +857,11 @@ func selectRateLimitTier(c *gin.Context) string {
 	signature := c.GetHeader("X-402-Signature")
 	nonce := c.GetHeader("X-402-Nonce")
 
-	if signature != "" && nonce != "" {
-		// Future: Check if user is verified/premium
-		// For now, all signed requests get standard tier
-		return "standard"
+	if (signature != "" && nonce != "") || c.GetHeader(balanceTokenHeader) != "" || refundRequested(c) {
+		// Signed, prepaid and refund-funded requests get a looser per-IP
+		// pre-check; their real limit is the wallet tier applied once the
+		// payer is known
+		return "precheck"
 	}
 
 	// Unsigned requests get anonymous tier
@@ -776,6 +888,8 @@ func getLimitForTier(tier string) int {
 		return getEnvAsInt("RATE_LIMIT_STANDARD_RPM", 60)
 	case "verified":
 		return getEnvAsInt("RATE_LIMIT_VERIFIED_RPM", 120)
+	case "precheck":
+		return getEnvAsInt("RATE_LIMIT_PRECHECK_RPM", 300)
 	default:
 		return 10
 	}
@@ -803,21 +917,21 @@ func getEnvAsInt(key string, defaultValue int) int {
 
 // Receipt Management Functions
 
-var (
-	receiptStoreMu         sync.RWMutex
-	receiptStore           = make(map[string]*receiptEntry)
-	receiptCleanupInterval = 5 * time.Minute
-)
+var receiptCleanupInterval = 5 * time.Minute
 
-type receiptEntry struct {
-	receipt   *SignedReceipt
-	expiresAt time.Time
-}
+// receiptStoreTimeout bounds each receipt store operation
+const receiptStoreTimeout = 5 * time.Second
 
 // startReceiptCleanup runs periodic cleanup in a single goroutine
 // This prevents goroutine leaks by using a single background worker
-// instead of spawning one goroutine per receipt
+// instead of spawning one goroutine per receipt.
+// It returns immediately for backends that expire entries themselves.
 func startReceiptCleanup(ctx context.Context) {
+	if receiptStore.ExpiresNatively() {
+		log.Println("Receipt store expires entries natively, cleanup goroutine not needed")
+		return
+	}
+
 	ticker := time.NewTicker(receiptCleanupInterval)
 	defer ticker.Stop()
 
@@ -834,39 +948,41 @@ func startReceiptCleanup(ctx context.Context) {
 
 // cleanupExpiredReceipts removes expired receipts from the store
 func cleanupExpiredReceipts() {
-	now := time.Now()
-	receiptStoreMu.Lock()
-	defer receiptStoreMu.Unlock()
-
-	count := 0
-	for id, entry := range receiptStore {
-		if now.After(entry.expiresAt) {
-			delete(receiptStore, id)
-			count++
-		}
+	if receiptStore.ExpiresNatively() {
+		return
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), receiptStoreTimeout)
+	defer cancel()
+
+	count, err := receiptStore.Cleanup(ctx)
+	if err != nil {
+		log.Printf("[WARNING] Receipt cleanup failed: %v", err)
+	}
 	if count > 0 {
 		log.Printf("Cleaned up %d expired receipts", count)
 	}
 }
 
-// storeReceipt stores a receipt with TTL
-// Returns error for future extensibility (Redis/Postgres implementations)
-func storeReceipt(receipt *SignedReceipt, ttl time.Duration) error {
+// storeReceipt stores a receipt with TTL in the configured receipt store.
+// ctx only parents the trace span: the write is bounded by
+// receiptStoreTimeout and is not cancelled with the request.
+func storeReceipt(ctx context.Context, receipt *SignedReceipt, ttl time.Duration) (err error) {
+	ctx, span := startSpan(context.WithoutCancel(ctx), "storeReceipt")
+	defer func() { endSpan(span, err) }()
+
 	// Validate receipt format before storage
 	if err := validateReceipt(receipt); err != nil {
 		return fmt.Errorf("invalid receipt format: %w", err)
 	}
 
-	receiptStoreMu.Lock()
-	defer receiptStoreMu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, receiptStoreTimeout)
+	defer cancel()
 
-	receiptStore[receipt.Receipt.ID] = &receiptEntry{
-		receipt:   receipt,
-		expiresAt: time.Now().Add(ttl),
+	if err := receiptStore.Put(ctx, receipt, ttl); err != nil {
+		return err
 	}
-
+	receiptsIssuedTotal.Inc()
 	return nil
 }
 
@@ -886,6 +1002,15 @@ func validateReceipt(receipt *SignedReceipt) error {
 	if receipt.Receipt.Version == "" {
 		return fmt.Errorf("receipt version is empty")
 	}
+	switch receipt.Receipt.Version {
+	case receiptVersionV1, receiptVersionV3:
+	case receiptVersionV2:
+		if err := validateTypedReceipt(receipt.Receipt); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported receipt version %q", receipt.Receipt.Version)
+	}
 	if receipt.Receipt.Timestamp.IsZero() {
 		return fmt.Errorf("receipt timestamp is zero")
 	}
@@ -939,20 +1064,15 @@ func validateReceipt(receipt *SignedReceipt) error {
 
 // getReceipt retrieves a receipt by ID
 func getReceipt(id string) (*SignedReceipt, bool) {
-	receiptStoreMu.RLock()
-	defer receiptStoreMu.RUnlock()
-
-	entry, exists := receiptStore[id]
-	if !exists {
-		return nil, false
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), receiptStoreTimeout)
+	defer cancel()
 
-	// Check if expired
-	if time.Now().After(entry.expiresAt) {
+	receipt, exists, err := receiptStore.Get(ctx, id)
+	if err != nil {
+		log.Printf("[WARNING] Receipt lookup failed for %s: %v", id, err)
 		return nil, false
 	}
-
-	return entry.receipt, true
+	return receipt, exists
 }
 
 // getReceiptTTL returns configured TTL or default 24h
@@ -974,11 +1094,22 @@ func handleGetReceipt(c *gin.Context) {
 		return
 	}
 
+	// Receipts signed with a key since removed from the keyring can no
+	// longer be vouched for
+	status := "valid"
+	if err := verifyReceipt(receipt); errors.Is(err, ErrUnknownReceiptKey) {
+		status = "unknown_key"
+	} else if err != nil {
+		log.Printf("[WARNING] Stored receipt %s failed verification: %v", id, err)
+		status = "invalid"
+	}
+
 	c.JSON(200, gin.H{
 		"receipt":           receipt.Receipt,
 		"signature":         receipt.Signature,
 		"server_public_key": receipt.ServerPublicKey,
-		"status":            "valid",
+		"kid":               receipt.KeyID,
+		"status":            status,
 	})
 }
 
@@ -999,44 +1130,47 @@ func getServerPrivateKey() (*ecdsa.PrivateKey, error) {
 			return
 		}
 
-		// Remove 0x prefix if present
-		keyHex = strings.TrimPrefix(keyHex, "0x")
-
-		keyBytes, err := hex.DecodeString(keyHex)
-		if err != nil {
-			serverPrivateKeyErr = fmt.Errorf("invalid private key format: %w", err)
-			return
+		serverPrivateKey, serverPrivateKeyErr = parsePrivateKeyHex(keyHex)
+		if serverPrivateKeyErr == nil {
+			log.Println("Server private key loaded successfully")
 		}
+	})
 
-		// Validate minimum key length to prevent trivially weak keys
-		// Keys shorter than 31 bytes are cryptographically insecure or malformed
-		if len(keyBytes) < 31 {
-			serverPrivateKeyErr = fmt.Errorf("private key too short: got %d bytes, expected at least 31 bytes", len(keyBytes))
-			return
-		}
+	return serverPrivateKey, serverPrivateKeyErr
+}
 
-		// Left-pad to 32 bytes if necessary (handles keys with leading zeros like 0x0001...)
-		// Keys between 16-31 bytes are valid but need padding
-		if len(keyBytes) < 32 {
-			padded := make([]byte, 32)
-			copy(padded[32-len(keyBytes):], keyBytes)
-			keyBytes = padded
-		} else if len(keyBytes) > 32 {
-			serverPrivateKeyErr = fmt.Errorf("private key must be at most 32 bytes, got %d bytes", len(keyBytes))
-			return
-		}
+// parsePrivateKeyHex parses a hex secp256k1 private key, with or without
+// 0x prefix
+func parsePrivateKeyHex(keyHex string) (*ecdsa.PrivateKey, error) {
+	// Remove 0x prefix if present
+	keyHex = strings.TrimPrefix(keyHex, "0x")
 
-		privateKey, err := crypto.ToECDSA(keyBytes)
-		if err != nil {
-			serverPrivateKeyErr = fmt.Errorf("failed to parse private key: %w", err)
-			return
-		}
+	keyBytes, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key format: %w", err)
+	}
 
-		serverPrivateKey = privateKey
-		log.Println("Server private key loaded successfully")
-	})
+	// Validate minimum key length to prevent trivially weak keys
+	// Keys shorter than 31 bytes are cryptographically insecure or malformed
+	if len(keyBytes) < 31 {
+		return nil, fmt.Errorf("private key too short: got %d bytes, expected at least 31 bytes", len(keyBytes))
+	}
 
-	return serverPrivateKey, serverPrivateKeyErr
+	// Left-pad to 32 bytes if necessary (handles keys with leading zeros like 0x0001...)
+	// Keys between 16-31 bytes are valid but need padding
+	if len(keyBytes) < 32 {
+		padded := make([]byte, 32)
+		copy(padded[32-len(keyBytes):], keyBytes)
+		keyBytes = padded
+	} else if len(keyBytes) > 32 {
+		return nil, fmt.Errorf("private key must be at most 32 bytes, got %d bytes", len(keyBytes))
+	}
+
+	privateKey, err := crypto.ToECDSA(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return privateKey, nil
 }
 
 // handleHealthz implements the liveness probe for the gateway service.
@@ -1048,20 +1182,29 @@ func handleHealthz(c *gin.Context) {
 
 // handleReadyz implements the readiness probe for the gateway service.
 // It performs a comprehensive health check by verifying:
-// 1. Connectivity to the Verifier service
-// 2. Availability of the OpenRouter API
+// 1. Connectivity to the Verifier service, unless VERIFIER_MODE=local
+// 2. Availability of the OpenRouter API, when OpenRouter serves any model
 // 3. Self-health metrics (goroutine count, memory usage)
+// It also reports each dependency's circuit breaker state, which does not
+// affect readiness.
 // Returns 200 OK if all dependencies are healthy, otherwise 503 Service Unavailable.
 func handleReadyz(c *gin.Context) {
 	checks := make(map[string]interface{})
 
-	//1. check verifier connectivity
-	verifierStatus := checkVerifierHealth()
+	//1. check verifier connectivity (the local verifier has no service to reach)
+	verifierStatus := "ok"
+	if paymentVerifier.Mode() != verifierModeLocal {
+		verifierStatus = checkVerifierHealth()
+	}
 	checks["verifier"] = verifierStatus
+	checks["breakers"] = breakerStates()
 
-	//2. Check OpenRouter availability
-	openRouterStatus := checkOpenRouterHealth()
-	checks["openrouter"] = openRouterStatus
+	//2. Check OpenRouter availability (only when a model is routed to it)
+	openRouterStatus := "ok"
+	if aiProviders.usesOpenRouter() {
+		openRouterStatus = checkOpenRouterHealth()
+		checks["openrouter"] = openRouterStatus
+	}
 
 	//3. Self-health metrics
 	var memStats runtime.MemStats
@@ -1089,10 +1232,7 @@ func handleReadyz(c *gin.Context) {
 // - "degraded": Verifier is reachable but returned non-200 status
 // - "unreachable": Verifier could not be contacted
 var checkVerifierHealth = func() string {
-	verifierURL := os.Getenv("VERIFIER_URL")
-	if verifierURL == "" {
-		verifierURL = "http://127.0.0.1:3002"
-	}
+	verifierURL := getVerifierURL()
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
@@ -1101,7 +1241,7 @@ var checkVerifierHealth = func() string {
 		return "unreachable"
 	}
 	//req.Header.Set("Authorization", "Bearer "+apiKey)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := verifierHTTPClient.Do(req)
 
 	if err != nil {
 		return "unreachable"
@@ -1140,7 +1280,7 @@ var checkOpenRouterHealth = func() string {
 		return "unreachable"
 	}
 	req.Header.Set("Authorization", "Bearer "+apiKey)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := aiHTTPClient.Do(req)
 
 	if err != nil {
 		return "unreachable"
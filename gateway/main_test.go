@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
@@ -114,15 +115,15 @@ func TestRateLimitMiddleware_AnonymousUser(t *testing.T) {
 	}
 }
 
-func TestRateLimitMiddleware_StandardUser(t *testing.T) {
-	// Setup with higher limits for authenticated users
+func TestRateLimitMiddleware_SignedPrecheck(t *testing.T) {
+	// Signed requests are pre-checked per IP with the looser precheck tier
 	os.Setenv("RATE_LIMIT_ENABLED", "true")
-	os.Setenv("RATE_LIMIT_STANDARD_RPM", "120")
-	os.Setenv("RATE_LIMIT_STANDARD_BURST", "5")
+	os.Setenv("RATE_LIMIT_PRECHECK_RPM", "120")
+	os.Setenv("RATE_LIMIT_PRECHECK_BURST", "5")
 	defer func() {
 		os.Unsetenv("RATE_LIMIT_ENABLED")
-		os.Unsetenv("RATE_LIMIT_STANDARD_RPM")
-		os.Unsetenv("RATE_LIMIT_STANDARD_BURST")
+		os.Unsetenv("RATE_LIMIT_PRECHECK_RPM")
+		os.Unsetenv("RATE_LIMIT_PRECHECK_BURST")
 	}()
 
 	gin.SetMode(gin.TestMode)
@@ -134,28 +135,34 @@ func TestRateLimitMiddleware_StandardUser(t *testing.T) {
 		c.JSON(200, gin.H{"ok": true})
 	})
 
-	// Authenticated request with signature and nonce
-	for i := 0; i < 5; i++ {
+	// Signed requests with a fresh nonce each time still share the IP bucket
+	for i := 0; i < 6; i++ {
 		req, _ := http.NewRequest("GET", "/test", nil)
 		req.Header.Set("X-402-Signature", "0x1234567890abcdef")
-		req.Header.Set("X-402-Nonce", "test-nonce-123")
+		req.Header.Set("X-402-Nonce", "test-nonce-"+strconv.Itoa(i))
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, req)
 
+		if i == 5 {
+			if w.Code != 429 {
+				t.Errorf("Expected rotating nonces to be limited per IP, got %d", w.Code)
+			}
+			break
+		}
 		if w.Code != 200 {
 			t.Errorf("Request %d: Expected status 200, got %d", i+1, w.Code)
 		}
 
-		// Verify rate limit is higher for authenticated users
+		// Verify the precheck limit applies to signed requests
 		limit, _ := strconv.Atoi(w.Header().Get("X-RateLimit-Limit"))
 		if limit != 120 {
-			t.Errorf("Expected rate limit of 120 for authenticated user, got %d", limit)
+			t.Errorf("Expected rate limit of 120 for signed request, got %d", limit)
 		}
 	}
 }
 
 func TestRateLimitMiddleware_DifferentKeys(t *testing.T) {
-	// Verify that different users have separate rate limit buckets
+	// Verify that different wallets have separate rate limit buckets
 	os.Setenv("RATE_LIMIT_ENABLED", "true")
 	os.Setenv("RATE_LIMIT_STANDARD_RPM", "60")
 	os.Setenv("RATE_LIMIT_STANDARD_BURST", "2")
@@ -169,40 +176,40 @@ func TestRateLimitMiddleware_DifferentKeys(t *testing.T) {
 	r := gin.Default()
 
 	limiters := initRateLimiters()
+	wallets := &WalletRateLimit{limiters: limiters}
 	r.Use(RateLimitMiddleware(limiters))
 	r.GET("/test", func(c *gin.Context) {
+		// Stands in for the wallet recovered by verifyPayment
+		if !wallets.Check(c, c.GetHeader("X-Test-Wallet")) {
+			return
+		}
 		c.JSON(200, gin.H{"ok": true})
 	})
 
-	// User 1 exhausts their limit
-	for i := 0; i < 2; i++ {
+	send := func(wallet string) int {
 		req, _ := http.NewRequest("GET", "/test", nil)
-		req.Header.Set("X-402-Signature", "sig1")
-		req.Header.Set("X-402-Nonce", "user1-11111111") // Different first 8 chars
+		req.Header.Set("X-402-Signature", "sig")
+		req.Header.Set("X-402-Nonce", "nonce-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+		req.Header.Set("X-Test-Wallet", wallet)
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, req)
-		if w.Code != 200 {
-			t.Errorf("User 1 request %d should succeed", i+1)
+		return w.Code
+	}
+
+	// User 1 exhausts their limit
+	for i := 0; i < 2; i++ {
+		if code := send("0x1111111111111111111111111111111111111111"); code != 200 {
+			t.Errorf("User 1 request %d should succeed, got %d", i+1, code)
 		}
 	}
 
 	// User 1 should now be rate limited
-	req1, _ := http.NewRequest("GET", "/test", nil)
-	req1.Header.Set("X-402-Signature", "sig1")
-	req1.Header.Set("X-402-Nonce", "user1-11111111")
-	w1 := httptest.NewRecorder()
-	r.ServeHTTP(w1, req1)
-	if w1.Code != 429 {
+	if code := send("0x1111111111111111111111111111111111111111"); code != 429 {
 		t.Error("User 1 should be rate limited")
 	}
 
 	// User 2 should still be allowed (different bucket)
-	req2, _ := http.NewRequest("GET", "/test", nil)
-	req2.Header.Set("X-402-Signature", "sig2")
-	req2.Header.Set("X-402-Nonce", "user2-22222222") // Different first 8 chars
-	w2 := httptest.NewRecorder()
-	r.ServeHTTP(w2, req2)
-	if w2.Code != 200 {
+	if code := send("0x2222222222222222222222222222222222222222"); code != 200 {
 		t.Error("User 2 should not be rate limited (separate bucket)")
 	}
 }
@@ -246,7 +253,7 @@ func TestGetRateLimitKey(t *testing.T) {
 		nonce       string
 		expectedKey string
 	}{
-		{"With both signature and nonce", "sig123", "test-nonce", "nonce:"},
+		{"With both signature and nonce", "sig123", "test-nonce", "ip:"},
 		{"Only nonce (no signature)", "", "test-nonce", "ip:"},
 		{"Only signature (no nonce)", "sig123", "", "ip:"},
 		{"Neither", "", "", "ip:"},
@@ -258,18 +265,9 @@ func TestGetRateLimitKey(t *testing.T) {
 			r.GET("/test", func(c *gin.Context) {
 				key := getRateLimitKey(c)
 
-				if strings.HasPrefix(tt.expectedKey, "nonce:") {
-					if !strings.HasPrefix(key, "nonce:") {
-						t.Errorf("Expected nonce-based key, got '%s'", key)
-					}
-					hashPart := strings.TrimPrefix(key, "nonce:")
-					if len(hashPart) != 32 {
-						t.Errorf("Expected hash to be 32 chars, got %d", len(hashPart))
-					}
-				} else {
-					if !strings.HasPrefix(key, "ip:") {
-						t.Errorf("Expected IP-based key, got '%s'", key)
-					}
+				// Nonces change per request, so the pre-check is always per IP
+				if !strings.HasPrefix(key, tt.expectedKey) {
+					t.Errorf("Expected IP-based key, got '%s'", key)
 				}
 				c.JSON(200, gin.H{"key": key})
 			})
@@ -299,7 +297,7 @@ func TestSelectRateLimitTier(t *testing.T) {
 		{"Anonymous (no headers)", "", "", "anonymous"},
 		{"Anonymous (only signature)", "sig", "", "anonymous"},
 		{"Anonymous (only nonce)", "", "nonce", "anonymous"},
-		{"Standard (both headers)", "sig", "nonce", "standard"},
+		{"Precheck (both headers)", "sig", "nonce", "precheck"},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds every gateway metric. A dedicated registry (rather
+// than the global default) keeps /metrics limited to what we register here.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	paymentChallengesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_payment_challenges_total",
+		Help: "402 Payment Required challenges issued, by route.",
+	}, []string{"route"})
+
+	paymentVerificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_payment_verifications_total",
+		Help: "Payment verifications by outcome: valid, an E0xx error code, invalid (no code), error or timeout.",
+	}, []string{"outcome"})
+
+	nonceRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_nonce_rejections_total",
+		Help: "Verified payments rejected at nonce redemption, by error code.",
+	}, []string{"code"})
+
+	receiptsIssuedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "paygate_receipts_issued_total",
+		Help: "Signed receipts issued and stored.",
+	})
+
+	failedServicesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_failed_services_total",
+		Help: "Paid requests that failed after payment, by refund: refundable (credit issued) or reversed (prepaid debit credited back).",
+	}, []string{"refund"})
+
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_cache_requests_total",
+		Help: "AI response cache lookups by result (hit, stale, negative or miss).",
+	}, []string{"result"})
+
+	cacheCompressionSavedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "paygate_cache_compression_saved_bytes_total",
+		Help: "Bytes saved by compressing response cache entries before storing them in Redis.",
+	})
+
+	cacheOversizedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "paygate_cache_oversized_total",
+		Help: "AI results served but not cached because they exceed CACHE_MAX_ENTRY_BYTES.",
+	})
+
+	cacheRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_cache_refreshes_total",
+		Help: "Background refreshes of stale cache entries, by outcome (refreshed, failed, or skipped when another replica was refreshing).",
+	}, []string{"outcome"})
+
+	cacheCoalescedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_cache_coalesced_requests_total",
+		Help: "Cache misses served from another request's upstream call, by scope (process or cluster).",
+	}, []string{"scope"})
+
+	cacheMemoryBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "paygate_cache_memory_bytes",
+		Help: "Approximate size of the in-process response cache.",
+	})
+
+	cacheEvictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_cache_evictions_total",
+		Help: "Entries dropped from the in-process response cache, by reason (capacity or expired).",
+	}, []string{"reason"})
+
+	rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_rate_limited_total",
+		Help: "Requests rejected with 429 by rate limit tier.",
+	}, []string{"tier"})
+
+	rateLimitFallbackTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_rate_limit_fallback_total",
+		Help: "Redis rate limiter operations served by the local token bucket because Redis was unavailable, by tier.",
+	}, []string{"tier"})
+
+	rateLimitDegraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "paygate_rate_limit_degraded",
+		Help: "1 while the Redis rate limiter for a tier is using its local fallback, 0 otherwise.",
+	}, []string{"tier"})
+
+	requestTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_request_timeouts_total",
+		Help: "Requests aborted by RequestTimeoutMiddleware (504, or an SSE error event once streaming), by route.",
+	}, []string{"route"})
+
+	verifierRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "paygate_verifier_request_duration_seconds",
+		Help:    "Latency of calls to the verifier service, by outcome.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2, 5},
+	}, []string{"outcome"})
+
+	verifierMismatchesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "paygate_verifier_mismatches_total",
+		Help: "Payments on which the remote and local verifiers disagreed (VERIFIER_MODE=dual).",
+	})
+
+	circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "paygate_circuit_breaker_state",
+		Help: "Circuit breaker state by dependency: 0 closed, 1 half-open, 2 open.",
+	}, []string{"dependency"})
+
+	dependencyRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_dependency_rejections_total",
+		Help: "Calls refused without reaching a dependency, by dependency and reason (circuit_open or bulkhead_full).",
+	}, []string{"dependency", "reason"})
+
+	httpClientInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "paygate_http_client_in_flight_requests",
+		Help: "Outbound requests holding a connection (until their body is closed), by client.",
+	}, []string{"client"})
+
+	httpClientOpenConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "paygate_http_client_open_connections",
+		Help: "Open outbound connections, idle or busy, by client.",
+	}, []string{"client"})
+
+	httpClientConnectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "paygate_http_client_connections_total",
+		Help: "Connections obtained for outbound requests, by client and whether they were reused from the pool.",
+	}, []string{"client", "reused"})
+
+	httpClientConnWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "paygate_http_client_conn_wait_seconds",
+		Help:    "Time to obtain a connection (pool wait plus dial and TLS handshake), by client.",
+		Buckets: []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"client"})
+
+	aiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "paygate_ai_request_duration_seconds",
+		Help:    "Latency of individual AI provider attempts, by provider, model and outcome.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"provider", "model", "outcome"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		paymentChallengesTotal,
+		paymentVerificationsTotal,
+		nonceRejectionsTotal,
+		receiptsIssuedTotal,
+		failedServicesTotal,
+		cacheRequestsTotal,
+		cacheCoalescedTotal,
+		cacheMemoryBytes,
+		cacheEvictionsTotal,
+		cacheRefreshesTotal,
+		cacheCompressionSavedBytes,
+		cacheOversizedTotal,
+		rateLimitedTotal,
+		rateLimitFallbackTotal,
+		rateLimitDegraded,
+		requestTimeoutsTotal,
+		verifierRequestDuration,
+		verifierMismatchesTotal,
+		circuitBreakerState,
+		dependencyRejectionsTotal,
+		httpClientInFlight,
+		httpClientOpenConnections,
+		httpClientConnectionsTotal,
+		httpClientConnWait,
+		aiRequestDuration,
+	)
+}
+
+// handleMetrics serves GET /metrics in the Prometheus exposition format
+func handleMetrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// errorCodePattern extracts the leading E0xx code from verifier errors
+var errorCodePattern = regexp.MustCompile(`^(E\d{3})\b`)
+
+// verificationOutcome classifies a verifyPayment result for metrics
+func verificationOutcome(resp *VerifyResponse, err error) string {
+	switch {
+	case err != nil && errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case err != nil:
+		return "error"
+	case resp.IsValid:
+		return "valid"
+	}
+	if m := errorCodePattern.FindStringSubmatch(resp.Error); m != nil {
+		return m[1]
+	}
+	return "invalid"
+}
+
+// upstreamOutcome classifies an upstream call error for latency metrics
+func upstreamOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// routeLabel returns the matched route pattern, keeping label cardinality
+// bounded even for 404s and path parameters
+func routeLabel(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
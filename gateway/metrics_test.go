@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// paidRequest sends a signed summarize request with a freshly issued nonce
+// and any extra headers
+func paidRequest(t *testing.T, r http.Handler, body string, extra ...[2]string) *httptest.ResponseRecorder {
+	t.Helper()
+	nonce := "nonce-metrics-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := nonceStore.Issue(context.Background(), nonce, time.Minute); err != nil {
+		t.Fatalf("failed to issue nonce: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(body))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	for _, h := range extra {
+		req.Header.Set(h[0], h[1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMetrics_PaymentFlow(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": reply("summary")})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	verifierResponse := `{"is_valid":false,"recovered_address":"","error":"E007: timestamp too old"}`
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(verifierResponse))
+	}))
+	defer verifier.Close()
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	challenges := testutil.ToFloat64(paymentChallengesTotal.WithLabelValues("/api/ai/summarize"))
+	rejected := testutil.ToFloat64(paymentVerificationsTotal.WithLabelValues("E007"))
+	valid := testutil.ToFloat64(paymentVerificationsTotal.WithLabelValues("valid"))
+	receipts := testutil.ToFloat64(receiptsIssuedTotal)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"hello"}`)))
+	if w.Code != 402 {
+		t.Fatalf("expected 402, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(paymentChallengesTotal.WithLabelValues("/api/ai/summarize")); got != challenges+1 {
+		t.Errorf("expected challenge counter to increase by 1, got %v -> %v", challenges, got)
+	}
+
+	if w := paidRequest(t, r, `{"text":"hello"}`); w.Code != 400 {
+		t.Fatalf("expected 400 for E007, got %d body=%s", w.Code, w.Body.String())
+	}
+	if got := testutil.ToFloat64(paymentVerificationsTotal.WithLabelValues("E007")); got != rejected+1 {
+		t.Errorf("expected E007 outcome to be counted, got %v -> %v", rejected, got)
+	}
+
+	verifierResponse = `{"is_valid":true,"recovered_address":"0xabc","error":""}`
+	if w := paidRequest(t, r, `{"text":"hello"}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	if got := testutil.ToFloat64(paymentVerificationsTotal.WithLabelValues("valid")); got != valid+1 {
+		t.Errorf("expected valid outcome to be counted, got %v -> %v", valid, got)
+	}
+	if got := testutil.ToFloat64(receiptsIssuedTotal); got != receipts+1 {
+		t.Errorf("expected receipt counter to increase by 1, got %v -> %v", receipts, got)
+	}
+
+	if testutil.CollectAndCount(verifierRequestDuration, "paygate_verifier_request_duration_seconds") == 0 {
+		t.Error("expected verifier latency to be observed")
+	}
+	if testutil.CollectAndCount(aiRequestDuration, "paygate_ai_request_duration_seconds") == 0 {
+		t.Error("expected AI latency to be observed")
+	}
+}
+
+func TestMetrics_RateLimitedByTier(t *testing.T) {
+	t.Setenv("RATE_LIMIT_ANONYMOUS_RPM", "60")
+	t.Setenv("RATE_LIMIT_ANONYMOUS_BURST", "1")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RateLimitMiddleware(initRateLimiters()))
+	r.GET("/test", func(c *gin.Context) { c.JSON(200, gin.H{"ok": true}) })
+
+	before := testutil.ToFloat64(rateLimitedTotal.WithLabelValues("anonymous"))
+	for i := 0; i < 2; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	}
+	if got := testutil.ToFloat64(rateLimitedTotal.WithLabelValues("anonymous")); got != before+1 {
+		t.Errorf("expected one anonymous 429 to be counted, got %v -> %v", before, got)
+	}
+}
+
+func TestMetrics_RequestTimeouts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestTimeoutMiddleware(100 * time.Millisecond))
+	r.GET("/slow/:id", func(c *gin.Context) {
+		time.Sleep(300 * time.Millisecond)
+		c.JSON(200, gin.H{"ok": true})
+	})
+
+	before := testutil.ToFloat64(requestTimeoutsTotal.WithLabelValues("/slow/:id"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/slow/42", nil))
+	if w.Code != 504 {
+		t.Fatalf("expected 504, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(requestTimeoutsTotal.WithLabelValues("/slow/:id")); got != before+1 {
+		t.Errorf("expected timeout to be counted under the route pattern, got %v -> %v", before, got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	receiptsIssuedTotal.Add(0)
+	cacheRequestsTotal.WithLabelValues("hit")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/metrics", handleMetrics())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	for _, name := range []string{"paygate_receipts_issued_total", "paygate_cache_requests_total", "go_goroutines"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("expected /metrics to expose %s", name)
+		}
+	}
+}
+
+func TestVerificationOutcome(t *testing.T) {
+	tests := []struct {
+		resp *VerifyResponse
+		err  error
+		want string
+	}{
+		{nil, context.DeadlineExceeded, "timeout"},
+		{nil, errors.New("connection refused"), "error"},
+		{&VerifyResponse{IsValid: true}, nil, "valid"},
+		{&VerifyResponse{Error: "E003: signature mismatch"}, nil, "E003"},
+		{&VerifyResponse{Error: "something else"}, nil, "invalid"},
+	}
+	for _, tt := range tests {
+		if got := verificationOutcome(tt.resp, tt.err); got != tt.want {
+			t.Errorf("verificationOutcome(%+v, %v) = %s, want %s", tt.resp, tt.err, got, tt.want)
+		}
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -40,16 +43,34 @@ func CorrelationIDMiddleware() gin.HandlerFunc {
 	}
 }
 
+// AdminAuthMiddleware requires "Authorization: Bearer <token>". The token is
+// compared in constant time so response timing does not reveal it.
+func AdminAuthMiddleware(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		got := []byte(c.GetHeader("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(got, expected) != 1 {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
 // bufferedWriter captures response writes in-memory so the middleware can
 // decide whether to send the real response or a timeout response without
-// racing with handler writes.
+// racing with handler writes. Once a handler starts streaming, writes pass
+// straight through to out instead.
 type bufferedWriter struct {
-	buf    *bytes.Buffer
-	head   http.Header
-	status int
-	wrote  bool
-	closed bool
-	mu     sync.RWMutex
+	buf       *bytes.Buffer
+	head      http.Header
+	status    int
+	wrote     bool
+	closed    bool
+	streaming bool
+	sent      bool
+	out       gin.ResponseWriter
+	mu        sync.RWMutex
 }
 
 // newBufferedWriter returns an initialized bufferedWriter used to capture
@@ -78,6 +99,9 @@ func (b *bufferedWriter) Write(data []byte) (int, error) {
 		return 0, nil
 	}
 	b.wrote = true
+	if b.streaming {
+		return b.out.Write(data)
+	}
 	return b.buf.Write(data)
 }
 
@@ -88,9 +112,100 @@ func (b *bufferedWriter) WriteString(s string) (int, error) {
 		return 0, nil
 	}
 	b.wrote = true
+	if b.streaming {
+		return b.out.WriteString(s)
+	}
 	return b.buf.WriteString(s)
 }
 
+// startStreaming sends the buffered headers, status and body to out and
+// switches the writer to pass-through mode. If out is itself a buffering
+// writer (nested timeout middleware), it is switched to streaming as well.
+func (b *bufferedWriter) startStreaming(out gin.ResponseWriter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.streaming {
+		return
+	}
+	for k, vv := range b.head {
+		out.Header()[k] = vv
+	}
+	out.WriteHeader(b.Status())
+	if s, ok := out.(streamingWriter); ok {
+		s.StartStreaming()
+	} else {
+		out.WriteHeaderNow()
+	}
+	if b.buf.Len() > 0 {
+		_, _ = out.Write(b.buf.Bytes())
+		b.buf.Reset()
+	}
+	b.streaming = true
+	b.wrote = true
+	b.out = out
+}
+
+// flush flushes out while streaming. It holds the lock so it cannot race
+// with the timeout path closing the writer.
+func (b *bufferedWriter) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || !b.streaming {
+		return
+	}
+	if fl, ok := b.out.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// isStreaming reports whether startStreaming has been called
+func (b *bufferedWriter) isStreaming() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.streaming
+}
+
+// passedThrough reports whether the response already went to the client,
+// streamed or sent by an inner timeout middleware, so there is nothing
+// buffered to flush
+func (b *bufferedWriter) passedThrough() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.streaming || b.sent
+}
+
+// sendNow writes a complete response to out, bypassing the buffer, and
+// closes the writer. An inner timeout middleware uses it so its 504 is not
+// held back until the enclosing handler chain returns.
+func (b *bufferedWriter) sendNow(out gin.ResponseWriter, header http.Header, status int, body []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.streaming {
+		return
+	}
+	b.closed = true
+	b.sent = true
+	writeResponseNow(out, header, status, body)
+}
+
+// writeResponseNow writes a complete response and flushes it to the client,
+// passing it through any enclosing timeout middleware. Content-Length is set
+// so the client has the whole response even though the connection stays
+// busy until the handler returns.
+func writeResponseNow(w gin.ResponseWriter, header http.Header, status int, body []byte) {
+	if shim, ok := w.(*responseWriterShim); ok {
+		shim.bw.sendNow(shim.orig, header, status, body)
+		return
+	}
+	for k, vv := range header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	w.Flush()
+}
+
 // WriteHeader captures the status code but does not flush to the client.
 func (b *bufferedWriter) WriteHeader(statusCode int) {
 	b.mu.Lock()
@@ -136,7 +251,8 @@ func (b *bufferedWriter) flushTo(w http.ResponseWriter) {
 
 // RequestTimeoutMiddleware applies a context timeout to the request and
 // buffers handler output. If the context deadline is exceeded, the middleware
-// returns 504 and discards the handler response. This avoids concurrent
+// discards the handler response and answers 504 at once, then waits for the
+// handler to return before handing c back to Gin. This avoids concurrent
 // response writes and ensures safe behavior with Gin.
 func RequestTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -167,6 +283,9 @@ func RequestTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
 			defer cancel()
 		}
 		c.Request = c.Request.WithContext(ctx)
+		// Read before the handler starts; the timeout path must not touch c
+		// while the handler may still be using it
+		route := routeLabel(c)
 
 		origWriter := c.Writer
 		bw := newBufferedWriter()
@@ -189,7 +308,10 @@ func RequestTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
 		case <-finished:
 			// Handler finished before deadline: flush buffered response. Do not
 			// restore c.Writer here to avoid racing with handler goroutine.
-			bw.flushTo(origWriter)
+			// A streamed or already sent response has been written.
+			if !bw.passedThrough() {
+				bw.flushTo(origWriter)
+			}
 			return
 		case p := <-panicChan:
 			// Restore the original writer so upstream Recovery middleware writes
@@ -197,21 +319,77 @@ func RequestTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
 			c.Writer = origWriter
 			panic(p)
 		case <-ctx.Done():
-			// Timeout exceeded — mark buffer closed to prevent further handler
-			// writes. Do NOT restore c.Writer here, otherwise a concurrently
-			// running handler may write directly to the real writer after the
-			// timeout response was already sent (causing panics or corruption).
-			bw.mu.Lock()
-			bw.closed = true
-			bw.mu.Unlock()
-			origWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
-			origWriter.WriteHeader(504)
-			_, _ = origWriter.Write([]byte(`{"error":"Gateway Timeout","message":"Request exceeded maximum allowed time"}`))
+		}
+
+		// Timeout exceeded — mark buffer closed to prevent further handler
+		// writes. Do NOT restore c.Writer here, otherwise a concurrently
+		// running handler may write directly to the real writer after the
+		// timeout response was already sent (causing panics or corruption).
+		bw.mu.Lock()
+		bw.closed = true
+		streaming, sent := bw.streaming, bw.sent
+		bw.mu.Unlock()
+
+		// An inner timeout middleware already answered
+		if sent {
+			waitForHandler(c, origWriter, finished, panicChan)
 			return
 		}
+
+		// Answer now, without waiting for the handler: it may be blocked on
+		// something that ignores the deadline. The refund is recorded from
+		// the pending service, which is safe to read concurrently.
+		var pending *pendingService
+		if v, ok := c.Get(pendingServiceKey); ok {
+			pending = v.(*pendingService)
+		}
+		failService := func(status int) *RefundEntry {
+			if pending == nil {
+				return nil
+			}
+			return pending.fail(ctx, status, "request timed out")
+		}
+
+		requestTimeoutsTotal.WithLabelValues(route).Inc()
+		if streaming {
+			// Headers are already on the wire; end the stream with an SSE
+			// error event instead of a 504.
+			_ = writeSSEEvent(origWriter, "error", withStreamRefund(gin.H{"error": "Gateway Timeout", "message": "Request exceeded maximum allowed time"}, failService(200)))
+		} else {
+			body := gin.H{"error": "Gateway Timeout", "message": "Request exceeded maximum allowed time"}
+			header := http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+			// A paid request that times out is refundable; the handler can
+			// no longer answer, so the refund goes out with this response
+			if entry := failService(504); entry != nil {
+				setRefundHeader(header, entry)
+				body["refund"] = refundSummary(entry)
+			}
+			payload, _ := json.Marshal(body)
+			writeResponseNow(origWriter, header, 504, payload)
+		}
+
+		waitForHandler(c, origWriter, finished, panicChan)
 	}
 }
 
+// waitForHandler blocks until the handler goroutine of a timed out request
+// returns. It still owns c (its keys, request and handler index), and Gin
+// reuses c once the middleware returns. The client already has its answer.
+func waitForHandler(c *gin.Context, origWriter gin.ResponseWriter, finished <-chan struct{}, panicChan <-chan interface{}) {
+	select {
+	case <-finished:
+	case p := <-panicChan:
+		c.Writer = origWriter
+		panic(p)
+	}
+}
+
+// streamingWriter is implemented by response writers that buffer output
+// until told that the handler is streaming
+type streamingWriter interface {
+	StartStreaming()
+}
+
 // responseWriterShim adapts bufferedWriter to satisfy gin.ResponseWriter so
 // handlers that call c.Writer/SetHeader interact with the buffered headers
 // and body. It forwards writes to the underlying bufferedWriter instance.
@@ -230,13 +408,14 @@ func (rws *responseWriterShim) Written() bool                     { return rws.b
 func (rws *responseWriterShim) Size() int                         { return rws.bw.buf.Len() }
 func (rws *responseWriterShim) WriteHeaderNowWithoutLock()        {}
 
-// Flush flushes the response to the client if the underlying writer
-// supports http.Flusher. This is a no-op otherwise.
-func (rws *responseWriterShim) Flush() {
-	if fl, ok := rws.orig.(http.Flusher); ok {
-		fl.Flush()
-	}
-}
+// StartStreaming stops buffering so streamed writes reach the client as they
+// happen. The request timeout still applies.
+func (rws *responseWriterShim) StartStreaming() { rws.bw.startStreaming(rws.orig) }
+
+// Flush flushes the response to the client if the handler is streaming and
+// the underlying writer supports http.Flusher. This is a no-op otherwise, so
+// a buffered response cannot commit headers early.
+func (rws *responseWriterShim) Flush() { rws.bw.flush() }
 
 // Hijack delegates to the underlying writer if it supports http.Hijacker.
 func (rws *responseWriterShim) Hijack() (net.Conn, *bufio.ReadWriter, error) {
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Nonce redemption errors. The E0xx prefixes continue the verifier's error
+// code series (E007-E009) so clients can branch on a stable code.
+var (
+	ErrNonceUnknown = errors.New("E010: nonce was not issued by this gateway")
+	ErrNonceReused  = errors.New("E011: nonce has already been used")
+	ErrNonceExpired = errors.New("E012: nonce has expired")
+)
+
+// nonceRetention is how long a nonce is remembered after it stops being
+// redeemable, so late replays are reported as reused/expired rather than unknown.
+const nonceRetention = 10 * time.Minute
+
+// NonceStore tracks nonces issued in 402 responses so that each signed
+// payment can be redeemed exactly once.
+type NonceStore interface {
+	// Issue records a freshly minted nonce that stays redeemable for ttl
+	Issue(ctx context.Context, nonce string, ttl time.Duration) error
+	// Consume atomically marks an issued nonce as used. It returns
+	// ErrNonceUnknown, ErrNonceReused or ErrNonceExpired if the nonce cannot be redeemed.
+	Consume(ctx context.Context, nonce string) error
+}
+
+// nonceStore is the process-wide store. It defaults to the in-memory
+// implementation and is replaced by initNonceStore when Redis is available.
+var nonceStore NonceStore = NewMemoryNonceStore()
+
+// getNonceStoreBackend returns the configured nonce backend: "memory",
+// "redis" or "" (default), which uses Redis when it is connected
+func getNonceStoreBackend() string {
+	return strings.ToLower(getEnv("NONCE_STORE", ""))
+}
+
+// initNonceStore selects the nonce backend from NONCE_STORE. Replicas behind
+// a load balancer must share nonces, so NONCE_STORE=redis fails startup
+// rather than falling back to a per-replica store that would reject nonces
+// issued by other replicas with E010.
+func initNonceStore() error {
+	switch backend := getNonceStoreBackend(); backend {
+	case "memory":
+		nonceStore = NewMemoryNonceStore()
+	case "redis":
+		if redisClient == nil {
+			return fmt.Errorf("NONCE_STORE=redis but Redis is unavailable")
+		}
+		nonceStore = NewRedisNonceStore(redisClient)
+	case "":
+		if redisClient == nil {
+			nonceStore = NewMemoryNonceStore()
+			log.Println("Nonce store: memory")
+			return nil
+		}
+		nonceStore = NewRedisNonceStore(redisClient)
+		log.Println("Nonce store: redis")
+		return nil
+	default:
+		return fmt.Errorf("unknown NONCE_STORE %q (expected memory or redis)", backend)
+	}
+	log.Printf("Nonce store: %s", getNonceStoreBackend())
+	return nil
+}
+
+// getNonceTTL returns how long an issued nonce can be redeemed. It defaults to
+// the signature expiry window plus the allowed clock skew.
+func getNonceTTL() time.Duration {
+	defaultSeconds := getEnvAsInt("SIGNATURE_EXPIRY_SECONDS", 300) + getEnvAsInt("SIGNATURE_CLOCK_SKEW_SECONDS", 60)
+	return getPositiveTimeout("NONCE_TTL_SECONDS", defaultSeconds)
+}
+
+// redeemNonce consumes the payment nonce and writes the error response if it
+// cannot be redeemed. It returns false when the request must not proceed.
+func redeemNonce(c *gin.Context, nonce string) bool {
+	err := nonceStore.Consume(c.Request.Context(), nonce)
+	if err == nil {
+		return true
+	}
+
+	if errors.Is(err, ErrNonceUnknown) || errors.Is(err, ErrNonceReused) || errors.Is(err, ErrNonceExpired) {
+		nonceRejectionsTotal.WithLabelValues(nonceErrorCode(err)).Inc()
+		c.JSON(403, gin.H{"error": "Invalid Nonce", "details": err.Error()})
+		return false
+	}
+
+	log.Printf("Nonce redemption error: %v", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(504, gin.H{"error": "Gateway Timeout", "message": "Nonce store request timed out"})
+	} else {
+		c.JSON(500, gin.H{"error": "Nonce Verification Failed", "message": "An internal error occurred"})
+	}
+	return false
+}
+
+// nonceErrorCode returns the E0xx code of a nonce store rejection
+func nonceErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrNonceUnknown):
+		return "E010"
+	case errors.Is(err, ErrNonceReused):
+		return "E011"
+	default:
+		return "E012"
+	}
+}
+
+// nonceEntry is the in-memory record of an issued nonce
+type nonceEntry struct {
+	expiresAt time.Time
+	consumed  bool
+}
+
+// MemoryNonceStore keeps issued nonces in a process-local map.
+// Suitable for single-instance deployments and tests.
+type MemoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]*nonceEntry
+	lastSweep time.Time
+}
+
+// NewMemoryNonceStore creates an empty in-memory nonce store
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces:    make(map[string]*nonceEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Issue records the nonce as redeemable until now+ttl
+func (s *MemoryNonceStore) Issue(ctx context.Context, nonce string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweepLocked(now)
+
+	if _, exists := s.nonces[nonce]; exists {
+		return fmt.Errorf("nonce already issued")
+	}
+	s.nonces[nonce] = &nonceEntry{expiresAt: now.Add(ttl)}
+	return nil
+}
+
+// Consume marks the nonce as used if it is known, unused and unexpired
+func (s *MemoryNonceStore) Consume(ctx context.Context, nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.nonces[nonce]
+	if !exists {
+		return ErrNonceUnknown
+	}
+	if entry.consumed {
+		return ErrNonceReused
+	}
+	if time.Now().After(entry.expiresAt) {
+		return ErrNonceExpired
+	}
+	entry.consumed = true
+	return nil
+}
+
+// sweepLocked drops entries past their retention window. It runs at most
+// once per retention period so Issue stays O(1) amortized without needing a
+// background goroutine. Caller must hold s.mu.
+func (s *MemoryNonceStore) sweepLocked(now time.Time) {
+	if now.Sub(s.lastSweep) < nonceRetention {
+		return
+	}
+	s.lastSweep = now
+	for nonce, entry := range s.nonces {
+		if now.After(entry.expiresAt.Add(nonceRetention)) {
+			delete(s.nonces, nonce)
+		}
+	}
+}
+
+// consumeNonceScript atomically checks and marks a nonce as used.
+// The stored value is the expiry in Unix milliseconds, or "used" once redeemed.
+// Returns 0 = unknown, 1 = reused, 2 = expired, 3 = consumed.
+var consumeNonceScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return 0
+end
+if v == 'used' then
+	return 1
+end
+if tonumber(v) < tonumber(ARGV[1]) then
+	return 2
+end
+redis.call('SET', KEYS[1], 'used', 'KEEPTTL')
+return 3
+`)
+
+// RedisNonceStore keeps issued nonces in Redis so every replica sees the
+// same single-use state.
+type RedisNonceStore struct {
+	client *redis.Client
+}
+
+// NewRedisNonceStore creates a nonce store backed by the given Redis client
+func NewRedisNonceStore(client *redis.Client) *RedisNonceStore {
+	return &RedisNonceStore{client: client}
+}
+
+func nonceKey(nonce string) string {
+	return "x402:nonce:" + nonce
+}
+
+// Issue records the nonce with its expiry. The Redis key outlives the expiry
+// by nonceRetention so late replays get a precise error.
+func (s *RedisNonceStore) Issue(ctx context.Context, nonce string, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+	ok, err := s.client.SetNX(ctx, nonceKey(nonce), strconv.FormatInt(expiresAt, 10), ttl+nonceRetention).Result()
+	if err != nil {
+		return fmt.Errorf("store nonce: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("nonce already issued")
+	}
+	return nil
+}
+
+// Consume atomically marks the nonce as used via a Lua script
+func (s *RedisNonceStore) Consume(ctx context.Context, nonce string) error {
+	res, err := consumeNonceScript.Run(ctx, s.client, []string{nonceKey(nonce)}, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return fmt.Errorf("consume nonce: %w", err)
+	}
+
+	switch res {
+	case 0:
+		return ErrNonceUnknown
+	case 1:
+		return ErrNonceReused
+	case 2:
+		return ErrNonceExpired
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMemoryNonceStore_SingleUse(t *testing.T) {
+	store := NewMemoryNonceStore()
+	ctx := context.Background()
+
+	if err := store.Issue(ctx, "n1", time.Minute); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if err := store.Consume(ctx, "n1"); err != nil {
+		t.Fatalf("first Consume should succeed, got %v", err)
+	}
+	if err := store.Consume(ctx, "n1"); !errors.Is(err, ErrNonceReused) {
+		t.Errorf("second Consume should return ErrNonceReused, got %v", err)
+	}
+}
+
+func TestMemoryNonceStore_Unknown(t *testing.T) {
+	store := NewMemoryNonceStore()
+	if err := store.Consume(context.Background(), "never-issued"); !errors.Is(err, ErrNonceUnknown) {
+		t.Errorf("expected ErrNonceUnknown, got %v", err)
+	}
+}
+
+func TestMemoryNonceStore_Expired(t *testing.T) {
+	store := NewMemoryNonceStore()
+	ctx := context.Background()
+
+	if err := store.Issue(ctx, "short", 10*time.Millisecond); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := store.Consume(ctx, "short"); !errors.Is(err, ErrNonceExpired) {
+		t.Errorf("expected ErrNonceExpired, got %v", err)
+	}
+}
+
+func TestMemoryNonceStore_DuplicateIssue(t *testing.T) {
+	store := NewMemoryNonceStore()
+	ctx := context.Background()
+
+	if err := store.Issue(ctx, "dup", time.Minute); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if err := store.Issue(ctx, "dup", time.Minute); err == nil {
+		t.Error("expected error when issuing the same nonce twice")
+	}
+}
+
+func TestInitNonceStore(t *testing.T) {
+	origClient, origStore := redisClient, nonceStore
+	redisClient = nil
+	defer func() { redisClient, nonceStore = origClient, origStore }()
+
+	t.Setenv("NONCE_STORE", "redis")
+	if !getRedisRequired() {
+		t.Error("expected NONCE_STORE=redis to require Redis")
+	}
+	if err := initNonceStore(); err == nil {
+		t.Error("expected NONCE_STORE=redis to fail without Redis")
+	}
+
+	t.Setenv("NONCE_STORE", "memory")
+	if err := initNonceStore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nonceStore.(*MemoryNonceStore); !ok {
+		t.Errorf("expected the memory store, got %T", nonceStore)
+	}
+
+	t.Setenv("NONCE_STORE", "etcd")
+	if err := initNonceStore(); err == nil {
+		t.Error("expected an unknown backend to be rejected")
+	}
+}
+
+func TestRedisNonceStore(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer rdb.Close()
+	ctx := context.Background()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Skipf("Redis unavailable, skipping integration test: %v", err)
+	}
+
+	store := NewRedisNonceStore(rdb)
+	nonce := uuid.New().String()
+	defer rdb.Del(ctx, nonceKey(nonce))
+
+	if err := store.Consume(ctx, nonce); !errors.Is(err, ErrNonceUnknown) {
+		t.Errorf("expected ErrNonceUnknown before issue, got %v", err)
+	}
+	if err := store.Issue(ctx, nonce, time.Minute); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if err := store.Consume(ctx, nonce); err != nil {
+		t.Fatalf("first Consume should succeed, got %v", err)
+	}
+	if err := store.Consume(ctx, nonce); !errors.Is(err, ErrNonceReused) {
+		t.Errorf("expected ErrNonceReused, got %v", err)
+	}
+
+	expired := uuid.New().String()
+	defer rdb.Del(ctx, nonceKey(expired))
+	// Store an expiry in the past directly to avoid sleeping
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	if err := rdb.Set(ctx, nonceKey(expired), past, time.Minute).Err(); err != nil {
+		t.Fatalf("failed to seed expired nonce: %v", err)
+	}
+	if err := store.Consume(ctx, expired); !errors.Is(err, ErrNonceExpired) {
+		t.Errorf("expected ErrNonceExpired, got %v", err)
+	}
+}
+
+func TestHandleSummarize_NonceReplay(t *testing.T) {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(VerifyResponse{IsValid: true, RecoveredAddress: "0xTestUser"})
+	}))
+	defer verifier.Close()
+
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"summary"}}]}`))
+	}))
+	defer ai.Close()
+
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	t.Setenv("OPENROUTER_URL", ai.URL)
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	t.Setenv("RECIPIENT_ADDRESS", "0xTestRecipient")
+
+	origStore := nonceStore
+	nonceStore = NewMemoryNonceStore()
+	defer func() { nonceStore = origStore }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	// 1. Obtain a nonce from the 402 challenge
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/ai/summarize", nil))
+	if w.Code != 402 {
+		t.Fatalf("expected 402, got %d", w.Code)
+	}
+	var challenge struct {
+		PaymentContext PaymentContext `json:"paymentContext"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil {
+		t.Fatalf("failed to parse 402 response: %v", err)
+	}
+
+	sendBody := func(nonce, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/ai/summarize", bytes.NewBufferString(body))
+		req.Header.Set("X-402-Signature", "0xsig")
+		req.Header.Set("X-402-Nonce", nonce)
+		req.Header.Set("X-402-Timestamp", strconv.FormatUint(challenge.PaymentContext.Timestamp, 10))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	send := func(nonce string) *httptest.ResponseRecorder {
+		return sendBody(nonce, `{"text":"hello"}`)
+	}
+
+	// 2. A malformed request is rejected without spending the nonce
+	if w := sendBody(challenge.PaymentContext.Nonce, `{"text":""}`); w.Code != 400 {
+		t.Fatalf("expected 400 for an empty text, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// 3. First redemption succeeds
+	if w := send(challenge.PaymentContext.Nonce); w.Code != 200 {
+		t.Fatalf("expected 200 on first use, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// 4. Replaying the same signed nonce is rejected
+	w = send(challenge.PaymentContext.Nonce)
+	if w.Code != 403 {
+		t.Fatalf("expected 403 on replay, got %d", w.Code)
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["details"] != ErrNonceReused.Error() {
+		t.Errorf("expected reused nonce error, got %q", resp["details"])
+	}
+
+	// 5. A nonce that was never issued is rejected
+	w = send("client-made-up-nonce")
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 403 || resp["details"] != ErrNonceUnknown.Error() {
+		t.Errorf("expected 403 unknown nonce, got %d %q", w.Code, resp["details"])
+	}
+}
@@ -18,7 +18,18 @@ func TestOpenAPISpecMatchesRoutes(t *testing.T) {
 
 	expectedPaths := []string{
 		"/healthz",
+		"/metrics",
+		"/.well-known/paygate-keys",
 		"/api/ai/summarize",
+		"/api/balance",
+		"/api/balance/topup",
+		"/api/refunds",
+		"/api/refunds/{id}",
+		"/api/refunds/{id}/claim",
+		"/admin/cache/stats",
+		"/admin/cache/entries/{key}",
+		"/admin/cache/lookup",
+		"/admin/cache/invalidate",
 	}
 
 	for _, path := range expectedPaths {
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// anthropicVersion is the Messages API version header value
+const anthropicVersion = "2023-06-01"
+
+type anthropicRequest struct {
+	Model     string      `json:"model"`
+	System    string      `json:"system,omitempty"`
+	Messages  []AIMessage `json:"messages"`
+	MaxTokens int         `json:"max_tokens"`
+	Stream    bool        `json:"stream,omitempty"`
+}
+
+type anthropicResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// anthropicStreamEvent covers the Messages API stream events we read:
+// message_start, content_block_delta, message_delta and error
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Model string `json:"model"`
+		Usage struct {
+			InputTokens int `json:"input_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// AnthropicProvider calls an Anthropic Messages API endpoint.
+// BaseURL defaults to https://api.anthropic.com.
+type AnthropicProvider struct {
+	BaseURL string
+	APIKey  string
+	Client  *http.Client
+}
+
+func (p *AnthropicProvider) Name() string { return "anthropic" }
+
+// request builds the Messages API URL, headers and body for req
+func (p *AnthropicProvider) request(req AIRequest, stream bool) (string, map[string]string, anthropicRequest) {
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
+	}
+	maxTokens := req.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxTokens
+	}
+
+	headers := map[string]string{
+		"x-api-key":         p.APIKey,
+		"anthropic-version": anthropicVersion,
+	}
+	body := anthropicRequest{Model: req.Model, System: req.System, Messages: req.Messages, MaxTokens: maxTokens, Stream: stream}
+	return strings.TrimSuffix(baseURL, "/") + "/v1/messages", headers, body
+}
+
+func (p *AnthropicProvider) Complete(ctx context.Context, req AIRequest) (*AIResponse, error) {
+	url, headers, body := p.request(req, false)
+
+	var result anthropicResponse
+	if err := postJSON(ctx, p.Client, p.Name(), url, headers, body, &result); err != nil {
+		return nil, err
+	}
+
+	var text strings.Builder
+	for _, block := range result.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return nil, fmt.Errorf("invalid response from AI provider: missing content")
+	}
+
+	model := result.Model
+	if model == "" {
+		model = req.Model
+	}
+	return &AIResponse{
+		Content:  text.String(),
+		Model:    model,
+		Provider: p.Name(),
+		Usage: AIUsage{
+			PromptTokens:     result.Usage.InputTokens,
+			CompletionTokens: result.Usage.OutputTokens,
+			TotalTokens:      result.Usage.InputTokens + result.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (p *AnthropicProvider) Stream(ctx context.Context, req AIRequest, onDelta func(string) error) (*AIResponse, error) {
+	url, headers, body := p.request(req, true)
+	resp, err := openPost(ctx, p.Client, p.Name(), url, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &AIResponse{Model: req.Model, Provider: p.Name()}
+	var content strings.Builder
+	finished := false
+	err = readStreamLines(ctx, resp.Body, true, func(data []byte) error {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("invalid stream event from AI provider: %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message.Model != "" {
+				result.Model = event.Message.Model
+			}
+			result.Usage.PromptTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				content.WriteString(event.Delta.Text)
+				return onDelta(event.Delta.Text)
+			}
+		case "message_delta":
+			result.Usage.CompletionTokens = event.Usage.OutputTokens
+		case "message_stop":
+			finished = true
+		case "error":
+			return fmt.Errorf("anthropic stream error: %s", event.Error.Message)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrStreamTruncated) && finished {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Content = content.String()
+	result.Usage.TotalTokens = result.Usage.PromptTokens + result.Usage.CompletionTokens
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type ollamaRequest struct {
+	Model    string      `json:"model"`
+	Messages []AIMessage `json:"messages"`
+	Stream   bool        `json:"stream"`
+	Options  *struct {
+		NumPredict int `json:"num_predict,omitempty"`
+	} `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Model   string `json:"model"`
+	Done    bool   `json:"done"`
+	Error   string `json:"error"`
+	Message *struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// OllamaProvider calls a local Ollama server's /api/chat endpoint. It needs
+// no API key, so it works in air-gapped deployments.
+// BaseURL defaults to http://127.0.0.1:11434.
+type OllamaProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func (p *OllamaProvider) Name() string { return "ollama" }
+
+// request builds the /api/chat URL and body for req
+func (p *OllamaProvider) request(req AIRequest, stream bool) (string, ollamaRequest) {
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:11434"
+	}
+
+	body := ollamaRequest{Model: req.Model, Messages: openAIMessages(req), Stream: stream}
+	if req.MaxTokens > 0 {
+		body.Options = &struct {
+			NumPredict int `json:"num_predict,omitempty"`
+		}{NumPredict: req.MaxTokens}
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/api/chat", body
+}
+
+func (p *OllamaProvider) Complete(ctx context.Context, req AIRequest) (*AIResponse, error) {
+	url, body := p.request(req, false)
+
+	var result ollamaResponse
+	if err := postJSON(ctx, p.Client, p.Name(), url, nil, body, &result); err != nil {
+		return nil, err
+	}
+	if result.Message == nil {
+		return nil, fmt.Errorf("invalid response from AI provider: missing message")
+	}
+
+	model := result.Model
+	if model == "" {
+		model = req.Model
+	}
+	return &AIResponse{
+		Content:  result.Message.Content,
+		Model:    model,
+		Provider: p.Name(),
+		Usage: AIUsage{
+			PromptTokens:     result.PromptEvalCount,
+			CompletionTokens: result.EvalCount,
+			TotalTokens:      result.PromptEvalCount + result.EvalCount,
+		},
+	}, nil
+}
+
+// Stream reads Ollama's newline-delimited JSON stream
+func (p *OllamaProvider) Stream(ctx context.Context, req AIRequest, onDelta func(string) error) (*AIResponse, error) {
+	url, body := p.request(req, true)
+	resp, err := openPost(ctx, p.Client, p.Name(), url, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &AIResponse{Model: req.Model, Provider: p.Name()}
+	var content strings.Builder
+	finished := false
+	err = readStreamLines(ctx, resp.Body, false, func(line []byte) error {
+		var chunk ollamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return fmt.Errorf("invalid stream chunk from AI provider: %w", err)
+		}
+		if chunk.Error != "" {
+			return fmt.Errorf("ollama stream error: %s", chunk.Error)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Done {
+			finished = true
+			result.Usage = AIUsage{
+				PromptTokens:     chunk.PromptEvalCount,
+				CompletionTokens: chunk.EvalCount,
+				TotalTokens:      chunk.PromptEvalCount + chunk.EvalCount,
+			}
+		}
+		if chunk.Message == nil || chunk.Message.Content == "" {
+			return nil
+		}
+		content.WriteString(chunk.Message.Content)
+		return onDelta(chunk.Message.Content)
+	})
+	if errors.Is(err, ErrStreamTruncated) && finished {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Content = content.String()
+	return result, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// openAIChatRequest is the OpenAI chat completions request body
+type openAIChatRequest struct {
+	Model     string      `json:"model"`
+	Messages  []AIMessage `json:"messages"`
+	MaxTokens int         `json:"max_tokens,omitempty"`
+	Stream    bool        `json:"stream,omitempty"`
+}
+
+// openAIChatResponse is the subset of the chat completions response we use
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message *struct {
+			Content *string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage AIUsage `json:"usage"`
+}
+
+// openAIStreamChunk is one "data:" payload of a streamed chat completion
+type openAIStreamChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *AIUsage `json:"usage"`
+}
+
+// openAIMessages prepends the system prompt as a system message
+func openAIMessages(req AIRequest) []AIMessage {
+	if req.System == "" {
+		return req.Messages
+	}
+	return append([]AIMessage{{Role: "system", Content: req.System}}, req.Messages...)
+}
+
+// completeOpenAIChat calls an OpenAI-compatible chat completions endpoint
+func completeOpenAIChat(ctx context.Context, client *http.Client, provider, url string, headers map[string]string, req AIRequest) (*AIResponse, error) {
+	var result openAIChatResponse
+	body := openAIChatRequest{Model: req.Model, Messages: openAIMessages(req), MaxTokens: req.MaxTokens}
+	if err := postJSON(ctx, client, provider, url, headers, body, &result); err != nil {
+		return nil, err
+	}
+
+	if len(result.Choices) == 0 {
+		log.Printf("%s response had no choices (model %s)", provider, req.Model)
+		return nil, ErrEmptyCompletion
+	}
+	message := result.Choices[0].Message
+	if message == nil {
+		return nil, fmt.Errorf("invalid response from AI provider: malformed message")
+	}
+	if message.Content == nil {
+		return nil, fmt.Errorf("invalid response from AI provider: missing content")
+	}
+
+	model := result.Model
+	if model == "" {
+		model = req.Model
+	}
+	return &AIResponse{Content: *message.Content, Model: model, Provider: provider, Usage: result.Usage}, nil
+}
+
+// streamOpenAIChat streams from an OpenAI-compatible chat completions endpoint
+func streamOpenAIChat(ctx context.Context, client *http.Client, provider, url string, headers map[string]string, req AIRequest, onDelta func(string) error) (*AIResponse, error) {
+	body := openAIChatRequest{Model: req.Model, Messages: openAIMessages(req), MaxTokens: req.MaxTokens, Stream: true}
+	resp, err := openPost(ctx, client, provider, url, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &AIResponse{Model: req.Model, Provider: provider}
+	var content strings.Builder
+	// Some compatible servers close the stream after the finish_reason
+	// chunk without sending [DONE]
+	finished := false
+	err = readStreamLines(ctx, resp.Body, true, func(data []byte) error {
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("invalid stream chunk from AI provider: %w", err)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+		if chunk.Choices[0].FinishReason != nil && *chunk.Choices[0].FinishReason != "" {
+			finished = true
+		}
+		if chunk.Choices[0].Delta.Content == "" {
+			return nil
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		return onDelta(chunk.Choices[0].Delta.Content)
+	})
+	if errors.Is(err, ErrStreamTruncated) && finished {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Content = content.String()
+	return result, nil
+}
+
+// OpenRouterProvider calls the OpenRouter chat completions API.
+// Empty fields are read from OPENROUTER_URL and OPENROUTER_API_KEY at call time.
+type OpenRouterProvider struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (p *OpenRouterProvider) Name() string { return "openrouter" }
+
+func (p *OpenRouterProvider) Complete(ctx context.Context, req AIRequest) (*AIResponse, error) {
+	url, headers := p.endpoint()
+	return completeOpenAIChat(ctx, p.Client, p.Name(), url, headers, req)
+}
+
+func (p *OpenRouterProvider) Stream(ctx context.Context, req AIRequest, onDelta func(string) error) (*AIResponse, error) {
+	url, headers := p.endpoint()
+	return streamOpenAIChat(ctx, p.Client, p.Name(), url, headers, req, onDelta)
+}
+
+// endpoint resolves the URL and auth header, falling back to the environment
+func (p *OpenRouterProvider) endpoint() (string, map[string]string) {
+	url := p.URL
+	if url == "" {
+		url = os.Getenv("OPENROUTER_URL")
+	}
+	if url == "" {
+		url = "https://openrouter.ai/api/v1/chat/completions"
+	}
+	apiKey := p.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENROUTER_API_KEY")
+	}
+
+	return url, map[string]string{"Authorization": "Bearer " + apiKey}
+}
+
+// OpenAICompatibleProvider calls any server implementing the OpenAI chat
+// completions API (OpenAI, vLLM, LM Studio, llama.cpp server, ...).
+// BaseURL is the API root, e.g. "http://vllm:8000/v1".
+type OpenAICompatibleProvider struct {
+	ProviderName string
+	BaseURL      string
+	APIKey       string
+	Headers      map[string]string
+	Client       *http.Client
+}
+
+func (p *OpenAICompatibleProvider) Name() string {
+	if p.ProviderName == "" {
+		return "openai"
+	}
+	return p.ProviderName
+}
+
+func (p *OpenAICompatibleProvider) Complete(ctx context.Context, req AIRequest) (*AIResponse, error) {
+	url, headers := p.endpoint()
+	return completeOpenAIChat(ctx, p.Client, p.Name(), url, headers, req)
+}
+
+func (p *OpenAICompatibleProvider) Stream(ctx context.Context, req AIRequest, onDelta func(string) error) (*AIResponse, error) {
+	url, headers := p.endpoint()
+	return streamOpenAIChat(ctx, p.Client, p.Name(), url, headers, req, onDelta)
+}
+
+// endpoint returns the chat completions URL and request headers
+func (p *OpenAICompatibleProvider) endpoint() (string, map[string]string) {
+	headers := make(map[string]string, len(p.Headers)+1)
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	if p.APIKey != "" {
+		headers["Authorization"] = "Bearer " + p.APIKey
+	}
+
+	return strings.TrimSuffix(p.BaseURL, "/") + "/chat/completions", headers
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Quote is a usage-based price for one specific request body. It is returned
+// in the 402 paymentContext and rebuilt from the submitted body at verification.
+type Quote struct {
+	Model           string `json:"model"`
+	EstimatedTokens int    `json:"estimatedTokens"`
+	RequestHash     string `json:"requestHash"`
+	Amount          string `json:"amount"`
+}
+
+// ModelPrice is the pricing formula for a model:
+// amount = base + perThousandTokens * tokens / 1000, clamped to [min, max]
+// and rounded up to the given number of decimals.
+type ModelPrice struct {
+	Base              string `json:"base"`
+	PerThousandTokens string `json:"perThousandTokens"`
+	Min               string `json:"min,omitempty"`
+	Max               string `json:"max,omitempty"`
+	Decimals          int    `json:"decimals,omitempty"`
+}
+
+// ModelPricingTable holds per-model formulas with an optional default
+type ModelPricingTable struct {
+	Default *ModelPrice           `json:"default,omitempty"`
+	Models  map[string]ModelPrice `json:"models"`
+}
+
+// defaultQuoteDecimals matches USDC's 6 decimals
+const defaultQuoteDecimals = 6
+
+// ErrQuoteMismatch is returned when a signed nonce was quoted for a different request body
+var ErrQuoteMismatch = fmt.Errorf("E013: request body does not match the quoted request")
+
+// modelPricing is nil unless MODEL_PRICING_CONFIG is set, which keeps flat pricing
+var modelPricing *ModelPricingTable
+
+// initModelPricing loads the usage pricing table from MODEL_PRICING_CONFIG if set
+func initModelPricing() error {
+	path := os.Getenv("MODEL_PRICING_CONFIG")
+	if path == "" {
+		return nil
+	}
+	table, err := LoadModelPricing(path)
+	if err != nil {
+		return err
+	}
+	modelPricing = table
+	log.Printf("Usage-based pricing enabled for %d models from %s", len(table.Models), path)
+	return nil
+}
+
+// LoadModelPricing reads and validates a JSON model pricing table
+func LoadModelPricing(path string) (*ModelPricingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read model pricing config: %w", err)
+	}
+
+	var table ModelPricingTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("parse model pricing config: %w", err)
+	}
+	if table.Default != nil {
+		if _, err := table.Default.amount(1); err != nil {
+			return nil, fmt.Errorf("default pricing: %w", err)
+		}
+	}
+	for model, price := range table.Models {
+		if _, err := price.amount(1); err != nil {
+			return nil, fmt.Errorf("pricing for model %s: %w", model, err)
+		}
+	}
+	return &table, nil
+}
+
+// priceFor returns the formula for model, falling back to the default
+func (t *ModelPricingTable) priceFor(model string) (*ModelPrice, bool) {
+	if price, ok := t.Models[model]; ok {
+		return &price, true
+	}
+	if t.Default != nil {
+		return t.Default, true
+	}
+	return nil, false
+}
+
+func parseDecimal(field, value string) (*big.Rat, error) {
+	if value == "" {
+		return nil, nil
+	}
+	r, ok := new(big.Rat).SetString(value)
+	if !ok || r.Sign() < 0 {
+		return nil, fmt.Errorf("invalid %s %q", field, value)
+	}
+	return r, nil
+}
+
+// amount evaluates the formula for the given token count
+func (p *ModelPrice) amount(tokens int) (string, error) {
+	base, err := parseDecimal("base", p.Base)
+	if err != nil {
+		return "", err
+	}
+	perThousand, err := parseDecimal("perThousandTokens", p.PerThousandTokens)
+	if err != nil {
+		return "", err
+	}
+	minAmount, err := parseDecimal("min", p.Min)
+	if err != nil {
+		return "", err
+	}
+	maxAmount, err := parseDecimal("max", p.Max)
+	if err != nil {
+		return "", err
+	}
+	decimals := p.Decimals
+	if decimals <= 0 {
+		decimals = defaultQuoteDecimals
+	}
+
+	total := new(big.Rat)
+	if base != nil {
+		total.Add(total, base)
+	}
+	if perThousand != nil {
+		usage := new(big.Rat).Mul(perThousand, big.NewRat(int64(tokens), 1000))
+		total.Add(total, usage)
+	}
+	if minAmount != nil && total.Cmp(minAmount) < 0 {
+		total.Set(minAmount)
+	}
+	if maxAmount != nil && total.Cmp(maxAmount) > 0 {
+		total.Set(maxAmount)
+	}
+	if total.Sign() <= 0 {
+		return "", fmt.Errorf("pricing formula yields a non-positive amount")
+	}
+	return formatAmountCeil(total, decimals), nil
+}
+
+// formatAmountCeil rounds r up to the given decimals and trims trailing zeros,
+// so quotes never undercharge and always serialize identically.
+func formatAmountCeil(r *big.Rat, decimals int) string {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	scaled := new(big.Int).Mul(r.Num(), scale)
+	units, rem := new(big.Int).QuoRem(scaled, r.Denom(), new(big.Int))
+	if rem.Sign() > 0 {
+		units.Add(units, big.NewInt(1))
+	}
+
+	s := new(big.Rat).SetFrac(units, scale).FloatString(decimals)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// estimateTokens approximates the token count of a request body at ~4
+// characters per token. JSON bodies with a "text" field are measured by
+// that field; anything else by the raw body.
+func estimateTokens(body []byte) int {
+	text := string(body)
+	var req SummarizeRequest
+	if err := json.Unmarshal(body, &req); err == nil && req.Text != "" {
+		text = req.Text
+	}
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// bodyDigest returns the hex SHA-256 of the request body
+func bodyDigest(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// quote computes the usage-based price of body for this route. It returns nil
+// (flat pricing) if the route is not usage-priced, no pricing table is loaded,
+// the model has no formula, or the body is empty.
+func (r *PaidRoute) quote(body []byte) (*Quote, error) {
+	if !r.Usage || modelPricing == nil || len(body) == 0 {
+		return nil, nil
+	}
+
+	model := getOpenRouterModel()
+	price, ok := modelPricing.priceFor(model)
+	if !ok {
+		return nil, nil
+	}
+
+	tokens := estimateTokens(body)
+	amount, err := price.amount(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("quote for model %s: %w", model, err)
+	}
+
+	return &Quote{
+		Model:           model,
+		EstimatedTokens: tokens,
+		RequestHash:     "sha256:" + bodyDigest(body),
+		Amount:          amount,
+	}, nil
+}
+
+// quotedNonce binds a nonce to a quote by appending the request body digest.
+// Because the nonce is part of the signed EIP-712 message, the signature then
+// covers the exact body that was quoted.
+func quotedNonce(nonce string, q *Quote) string {
+	return nonce + "." + strings.TrimPrefix(q.RequestHash, "sha256:")
+}
+
+// nonceMatchesQuote reports whether a signed nonce was issued for this quote
+func nonceMatchesQuote(nonce string, q *Quote) bool {
+	return strings.HasSuffix(nonce, "."+strings.TrimPrefix(q.RequestHash, "sha256:"))
+}
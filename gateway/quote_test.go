@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestModelPriceAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		price    ModelPrice
+		tokens   int
+		expected string
+	}{
+		{"Base only", ModelPrice{Base: "0.001"}, 500, "0.001"},
+		{"Base plus usage", ModelPrice{Base: "0.001", PerThousandTokens: "0.002"}, 500, "0.002"},
+		{"Rounds up to 6 decimals", ModelPrice{PerThousandTokens: "0.000001"}, 1, "0.000001"},
+		{"Clamped to min", ModelPrice{PerThousandTokens: "0.001", Min: "0.0005"}, 1, "0.0005"},
+		{"Clamped to max", ModelPrice{PerThousandTokens: "1", Max: "0.05"}, 1000000, "0.05"},
+		{"Custom decimals", ModelPrice{PerThousandTokens: "0.01", Decimals: 2}, 1, "0.01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.price.amount(tt.tokens)
+			if err != nil {
+				t.Fatalf("amount() failed: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("amount() = %s, want %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestModelPriceAmount_Invalid(t *testing.T) {
+	if _, err := (&ModelPrice{Base: "abc"}).amount(1); err == nil {
+		t.Error("expected error for non-numeric base")
+	}
+	if _, err := (&ModelPrice{}).amount(1); err == nil {
+		t.Error("expected error for zero price")
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	if got := estimateTokens([]byte(`{"text":"abcdefgh"}`)); got != 2 {
+		t.Errorf("expected 2 tokens for 8-char text field, got %d", got)
+	}
+	if got := estimateTokens([]byte("abcde")); got != 2 {
+		t.Errorf("expected raw body to be measured when not JSON, got %d", got)
+	}
+}
+
+func TestLoadModelPricing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.json")
+	os.WriteFile(path, []byte(`{
+		"default": {"base": "0.001"},
+		"models": {"test/model": {"base": "0.0001", "perThousandTokens": "0.001"}}
+	}`), 0o600)
+
+	table, err := LoadModelPricing(path)
+	if err != nil {
+		t.Fatalf("LoadModelPricing failed: %v", err)
+	}
+	if price, ok := table.priceFor("test/model"); !ok || price.Base != "0.0001" {
+		t.Errorf("expected model-specific price, got %+v", price)
+	}
+	if price, ok := table.priceFor("other/model"); !ok || price.Base != "0.001" {
+		t.Errorf("expected default price for unknown model, got %+v", price)
+	}
+
+	os.WriteFile(path, []byte(`{"models": {"bad": {"base": "-1"}}}`), 0o600)
+	if _, err := LoadModelPricing(path); err == nil {
+		t.Error("expected error for negative base")
+	}
+}
+
+func TestUsagePricing_QuoteBoundToBody(t *testing.T) {
+	var verifiedAmount string
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req VerifyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		verifiedAmount = req.Context.Amount
+		json.NewEncoder(w).Encode(VerifyResponse{IsValid: true, RecoveredAddress: "0xPayer"})
+	}))
+	defer verifier.Close()
+
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"summary"}}]}`))
+	}))
+	defer ai.Close()
+
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	t.Setenv("OPENROUTER_URL", ai.URL)
+	t.Setenv("OPENROUTER_MODEL", "test/model")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	origPricing := modelPricing
+	modelPricing = &ModelPricingTable{Models: map[string]ModelPrice{
+		"test/model": {Base: "0.001", PerThousandTokens: "0.01"},
+	}}
+	defer func() { modelPricing = origPricing }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	shortBody := `{"text":"` + strings.Repeat("a", 400) + `"}`
+	longBody := `{"text":"` + strings.Repeat("a", 40000) + `"}`
+
+	// 1. Request a quote by sending the body without payment headers
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/ai/summarize", bytes.NewBufferString(shortBody)))
+	if w.Code != 402 {
+		t.Fatalf("expected 402, got %d", w.Code)
+	}
+	var challenge struct {
+		PaymentContext PaymentContext `json:"paymentContext"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &challenge)
+	quote := challenge.PaymentContext.Quote
+	if quote == nil {
+		t.Fatal("expected paymentContext to carry a quote")
+	}
+	// 100 tokens: 0.001 + 0.01 * 100/1000
+	if quote.Amount != "0.002" || challenge.PaymentContext.Amount != "0.002" || quote.EstimatedTokens != 100 {
+		t.Errorf("unexpected quote: %+v (amount %s)", quote, challenge.PaymentContext.Amount)
+	}
+	if quote.Model != "test/model" || quote.RequestHash != "sha256:"+bodyDigest([]byte(shortBody)) {
+		t.Errorf("quote not bound to model and body: %+v", quote)
+	}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/ai/summarize", bytes.NewBufferString(body))
+		req.Header.Set("X-402-Signature", "0xsig")
+		req.Header.Set("X-402-Nonce", challenge.PaymentContext.Nonce)
+		req.Header.Set("X-402-Timestamp", strconv.FormatUint(challenge.PaymentContext.Timestamp, 10))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// 2. Paying for the short text and submitting the long one is rejected
+	w = send(longBody)
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "E013") {
+		t.Fatalf("expected 403 E013 for swapped body, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// 3. Submitting the quoted body verifies against the quoted amount
+	w = send(shortBody)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	if verifiedAmount != "0.002" {
+		t.Errorf("verifier should receive the reconstructed quote amount, got %s", verifiedAmount)
+	}
+}
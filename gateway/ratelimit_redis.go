@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript refills and optionally consumes a token bucket stored
+// as a hash {tokens, ts}. It uses the Redis server clock so replicas with
+// skewed clocks still share one refill rate.
+// ARGV: rate (tokens per ms), burst, n (0 = only read the bucket).
+// Returns {allowed (0/1), whole tokens left, ms until the bucket is full}.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+if n > 0 then
+	if tokens >= n then
+		tokens = tokens - n
+		allowed = 1
+	end
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+	-- A bucket left alone until full is the same as a missing one
+	redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+end
+return {allowed, math.floor(tokens), math.ceil((burst - tokens) / rate)}
+`)
+
+// RedisTokenBucket runs the token bucket algorithm atomically in Redis so
+// all gateway replicas share one limit per key. When Redis is unreachable
+// it falls back to a process-local TokenBucket with the same settings;
+// those decisions are counted in paygate_rate_limit_fallback_total.
+type RedisTokenBucket struct {
+	client   *redis.Client
+	tier     string
+	rate     float64 // Tokens added per millisecond
+	burst    int
+	timeout  time.Duration
+	fallback *TokenBucket
+	degraded atomic.Bool
+}
+
+// NewRedisTokenBucket creates a Redis-backed limiter for tier. A nil client
+// means Redis was unavailable at startup and every call uses the fallback.
+func NewRedisTokenBucket(client *redis.Client, tier string, rpm int, burst int, timeout time.Duration, fallback *TokenBucket) *RedisTokenBucket {
+	if rpm <= 0 {
+		rpm = 1
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RedisTokenBucket{
+		client:   client,
+		tier:     tier,
+		rate:     float64(rpm) / 60000.0,
+		burst:    burst,
+		timeout:  timeout,
+		fallback: fallback,
+	}
+}
+
+func rateLimitKey(tier, key string) string {
+	return "x402:ratelimit:" + tier + ":" + key
+}
+
+// run executes the bucket script, reporting false if Redis could not be used
+func (rb *RedisTokenBucket) run(key string, n int) (allowed bool, remaining int, msToFull int64, ok bool) {
+	if rb.client == nil {
+		rb.markDegraded(nil)
+		return false, 0, 0, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rb.timeout)
+	defer cancel()
+
+	res, err := tokenBucketScript.Run(ctx, rb.client, []string{rateLimitKey(rb.tier, key)}, rb.rate, rb.burst, n).Int64Slice()
+	if err != nil || len(res) != 3 {
+		rb.markDegraded(err)
+		return false, 0, 0, false
+	}
+	rb.markHealthy()
+	return res[0] == 1, int(res[1]), res[2], true
+}
+
+// markDegraded records a decision made by the local fallback, logging only
+// when the limiter switches over
+func (rb *RedisTokenBucket) markDegraded(err error) {
+	rateLimitFallbackTotal.WithLabelValues(rb.tier).Inc()
+	if !rb.degraded.Swap(true) {
+		rateLimitDegraded.WithLabelValues(rb.tier).Set(1)
+		log.Printf("WARNING: Redis rate limiter for tier %s unavailable, using local buckets: %v", rb.tier, err)
+	}
+}
+
+func (rb *RedisTokenBucket) markHealthy() {
+	if rb.degraded.Swap(false) {
+		rateLimitDegraded.WithLabelValues(rb.tier).Set(0)
+		log.Printf("Redis rate limiter for tier %s recovered", rb.tier)
+	}
+}
+
+// Allow checks if a single request is allowed and consumes a token if available
+func (rb *RedisTokenBucket) Allow(key string) bool {
+	return rb.AllowN(key, 1)
+}
+
+// AllowN checks if N requests are allowed and consumes N tokens if available
+func (rb *RedisTokenBucket) AllowN(key string, n int) bool {
+	allowed, _, _, ok := rb.run(key, n)
+	if !ok {
+		return rb.fallback.AllowN(key, n)
+	}
+	return allowed
+}
+
+// GetRemaining returns the number of remaining tokens for the given key
+func (rb *RedisTokenBucket) GetRemaining(key string) int {
+	_, remaining, _, ok := rb.run(key, 0)
+	if !ok {
+		return rb.fallback.GetRemaining(key)
+	}
+	return remaining
+}
+
+// GetResetTime returns the Unix timestamp when the bucket will be fully refilled
+func (rb *RedisTokenBucket) GetResetTime(key string) int64 {
+	_, _, msToFull, ok := rb.run(key, 0)
+	if !ok {
+		return rb.fallback.GetResetTime(key)
+	}
+	return time.Now().Add(time.Duration(msToFull) * time.Millisecond).Unix()
+}
+
+// getRateLimitRedisTimeout bounds each rate limiter call to Redis
+func getRateLimitRedisTimeout() time.Duration {
+	return time.Duration(getEnvAsInt("RATE_LIMIT_REDIS_TIMEOUT_MS", 100)) * time.Millisecond
+}
+
+// getRateLimitBackend returns RATE_LIMIT_BACKEND: "memory" (default) or "redis"
+func getRateLimitBackend() string {
+	return strings.ToLower(getEnv("RATE_LIMIT_BACKEND", "memory"))
+}
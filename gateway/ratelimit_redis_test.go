@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisClient connects to the local Redis, skipping the test if it is down
+func newTestRedisClient(t *testing.T) *redis.Client {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis unavailable, skipping: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRedisTokenBucket_SharedAcrossReplicas(t *testing.T) {
+	client := newTestRedisClient(t)
+	key := "shared-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	// Two limiters with separate fallbacks stand in for two gateway replicas
+	replicas := []*RedisTokenBucket{
+		NewRedisTokenBucket(client, "test", 60, 3, time.Second, NewTokenBucket(60, 3, time.Minute)),
+		NewRedisTokenBucket(client, "test", 60, 3, time.Second, NewTokenBucket(60, 3, time.Minute)),
+	}
+	for _, rb := range replicas {
+		defer stopCleanup(rb.fallback)
+	}
+
+	allowed := 0
+	for i := 0; i < 6; i++ {
+		if replicas[i%2].Allow(key) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("expected the burst of 3 to be shared across replicas, got %d allowed", allowed)
+	}
+	if remaining := replicas[0].GetRemaining(key); remaining != 0 {
+		t.Errorf("expected 0 remaining, got %d", remaining)
+	}
+	if reset := replicas[1].GetResetTime(key); reset < time.Now().Unix()+1 || reset > time.Now().Unix()+4 {
+		t.Errorf("expected reset within ~3s, got %d (now %d)", reset, time.Now().Unix())
+	}
+}
+
+func TestRedisTokenBucket_Refill(t *testing.T) {
+	client := newTestRedisClient(t)
+	key := "refill-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	rb := NewRedisTokenBucket(client, "test", 600, 2, time.Second, NewTokenBucket(600, 2, time.Minute))
+	defer stopCleanup(rb.fallback)
+
+	if !rb.AllowN(key, 2) || rb.Allow(key) {
+		t.Fatal("expected the burst to be consumed")
+	}
+	time.Sleep(150 * time.Millisecond) // 10 tokens per second
+	if !rb.Allow(key) {
+		t.Error("expected a token after refill")
+	}
+	if rb.fallback.GetRemaining(key) != 2 {
+		t.Error("the local fallback should not be touched while Redis is healthy")
+	}
+}
+
+func TestRedisTokenBucket_FallsBackWhenRedisUnreachable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	tier := "fallback-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	rb := NewRedisTokenBucket(client, tier, 60, 2, 100*time.Millisecond, NewTokenBucket(60, 2, time.Minute))
+	defer stopCleanup(rb.fallback)
+
+	if !rb.Allow("k") || !rb.Allow("k") || rb.Allow("k") {
+		t.Error("expected the local bucket to enforce the limit while Redis is down")
+	}
+	if got := testutil.ToFloat64(rateLimitFallbackTotal.WithLabelValues(tier)); got != 3 {
+		t.Errorf("expected 3 fallback decisions in metrics, got %v", got)
+	}
+	if got := testutil.ToFloat64(rateLimitDegraded.WithLabelValues(tier)); got != 1 {
+		t.Errorf("expected degraded gauge to be 1, got %v", got)
+	}
+}
+
+func TestRedisTokenBucket_NilClientUsesFallback(t *testing.T) {
+	rb := NewRedisTokenBucket(nil, "nil-client", 60, 1, time.Second, NewTokenBucket(60, 1, time.Minute))
+	defer stopCleanup(rb.fallback)
+
+	if !rb.Allow("k") || rb.Allow("k") {
+		t.Error("expected the local bucket to be used without a Redis client")
+	}
+	if rb.GetRemaining("k") != 0 {
+		t.Error("expected GetRemaining to come from the local bucket")
+	}
+}
+
+func TestInitRateLimiters_RedisBackend(t *testing.T) {
+	t.Setenv("RATE_LIMIT_BACKEND", "redis")
+	for tier, limiter := range initRateLimiters() {
+		rb, ok := limiter.(*RedisTokenBucket)
+		if !ok {
+			t.Fatalf("expected tier %s to use RedisTokenBucket, got %T", tier, limiter)
+		}
+		stopCleanup(rb.fallback)
+	}
+
+	t.Setenv("RATE_LIMIT_BACKEND", "memory")
+	for tier, limiter := range initRateLimiters() {
+		tb, ok := limiter.(*TokenBucket)
+		if !ok {
+			t.Fatalf("expected tier %s to use TokenBucket, got %T", tier, limiter)
+		}
+		stopCleanup(tb)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultWalletTier applies to payer wallets without a tier mapping
+const defaultWalletTier = "standard"
+
+// walletTiersKey is the Redis hash holding the wallet→tier mapping, with the
+// lowercase address as field
+const walletTiersKey = "x402:wallet-tiers"
+
+// WalletTierStore maps payer wallet addresses to rate limit tiers
+type WalletTierStore interface {
+	// TierFor returns the tier assigned to wallet, or "" if it has none
+	TierFor(ctx context.Context, wallet string) (string, error)
+}
+
+// walletTierNames are the tiers a wallet may be mapped to
+var walletTierNames = map[string]bool{"anonymous": true, "standard": true, "verified": true}
+
+// FileWalletTiers is a static wallet→tier mapping loaded from a JSON object
+// such as {"0xAbC...": "verified"}
+type FileWalletTiers map[string]string
+
+// LoadWalletTiers reads and validates a wallet tier file
+func LoadWalletTiers(path string) (FileWalletTiers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read wallet tiers: %w", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse wallet tiers: %w", err)
+	}
+
+	tiers := make(FileWalletTiers, len(raw))
+	for wallet, tier := range raw {
+		if !common.IsHexAddress(wallet) {
+			return nil, fmt.Errorf("wallet tiers: %q is not an address", wallet)
+		}
+		if !walletTierNames[tier] {
+			return nil, fmt.Errorf("wallet tiers: unknown tier %q for %s", tier, wallet)
+		}
+		tiers[strings.ToLower(wallet)] = tier
+	}
+	return tiers, nil
+}
+
+// TierFor returns the wallet's tier from the file
+func (t FileWalletTiers) TierFor(_ context.Context, wallet string) (string, error) {
+	return t[strings.ToLower(wallet)], nil
+}
+
+// RedisWalletTiers reads the mapping from the walletTiersKey hash, so tiers
+// can be changed (e.g. HSET x402:wallet-tiers 0xabc... verified) without a
+// restart
+type RedisWalletTiers struct {
+	client *redis.Client
+}
+
+// NewRedisWalletTiers creates a wallet tier store backed by the given Redis client
+func NewRedisWalletTiers(client *redis.Client) *RedisWalletTiers {
+	return &RedisWalletTiers{client: client}
+}
+
+// TierFor looks up the wallet's tier in Redis
+func (s *RedisWalletTiers) TierFor(ctx context.Context, wallet string) (string, error) {
+	tier, err := s.client.HGet(ctx, walletTiersKey, strings.ToLower(wallet)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return tier, err
+}
+
+// WalletRateLimit limits signed traffic per payer wallet once verifyPayment
+// has recovered it. Nonces change on every request, so only the wallet
+// identifies a paying client.
+type WalletRateLimit struct {
+	limiters map[string]RateLimiter
+	tiers    WalletTierStore // nil: every wallet gets defaultWalletTier
+}
+
+// walletRateLimit is nil when rate limiting is disabled
+var walletRateLimit *WalletRateLimit
+
+// getWalletTiersStore returns RATE_LIMIT_WALLET_TIERS_STORE: "" (no mapping,
+// the default), "file" or "redis"
+func getWalletTiersStore() string {
+	return strings.ToLower(getEnv("RATE_LIMIT_WALLET_TIERS_STORE", ""))
+}
+
+// initWalletRateLimit sets up per-wallet limits on top of limiters, loading
+// the wallet tier mapping selected by RATE_LIMIT_WALLET_TIERS_STORE.
+// Requesting Redis when it is unavailable is a startup error: silently
+// giving every wallet the default tier would make higher tiers unreachable.
+func initWalletRateLimit(limiters map[string]RateLimiter) error {
+	var tiers WalletTierStore
+	switch backend := getWalletTiersStore(); backend {
+	case "", "none":
+	case "file":
+		fileTiers, err := LoadWalletTiers(getEnv("RATE_LIMIT_WALLET_TIERS_FILE", "wallet-tiers.json"))
+		if err != nil {
+			return err
+		}
+		tiers = fileTiers
+		log.Printf("Loaded %d wallet rate limit tiers", len(fileTiers))
+	case "redis":
+		if redisClient == nil {
+			return fmt.Errorf("RATE_LIMIT_WALLET_TIERS_STORE=redis but Redis is unavailable")
+		}
+		tiers = NewRedisWalletTiers(redisClient)
+	default:
+		return fmt.Errorf("unknown RATE_LIMIT_WALLET_TIERS_STORE %q (want file or redis)", backend)
+	}
+
+	walletRateLimit = &WalletRateLimit{limiters: limiters, tiers: tiers}
+	return nil
+}
+
+// tierFor resolves the wallet's tier, using the default when the wallet has
+// no mapping or the lookup fails
+func (w *WalletRateLimit) tierFor(ctx context.Context, wallet string) string {
+	if w.tiers == nil {
+		return defaultWalletTier
+	}
+	ctx, cancel := context.WithTimeout(ctx, getRateLimitRedisTimeout())
+	defer cancel()
+
+	tier, err := w.tiers.TierFor(ctx, wallet)
+	if err != nil {
+		log.Printf("Wallet tier lookup failed for %s: %v", wallet, err)
+		return defaultWalletTier
+	}
+	if _, ok := w.limiters[tier]; !ok || !walletTierNames[tier] {
+		if tier != "" {
+			log.Printf("Ignoring unknown rate limit tier %q for wallet %s", tier, wallet)
+		}
+		return defaultWalletTier
+	}
+	return tier
+}
+
+// Check takes a token from the wallet's bucket. If none is left it sends
+// the 429, aborts the request and returns false.
+func (w *WalletRateLimit) Check(c *gin.Context, wallet string) bool {
+	tier := w.tierFor(c.Request.Context(), wallet)
+	return applyRateLimit(c, w.limiters[tier], "wallet:"+strings.ToLower(wallet), tier)
+}
+
+// checkWalletRateLimit applies the wallet limit when rate limiting is enabled
+func checkWalletRateLimit(c *gin.Context, wallet string) bool {
+	if walletRateLimit == nil {
+		return true
+	}
+	return walletRateLimit.Check(c, wallet)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testWallet      = "0xAbCdEf0123456789abcdef0123456789ABCDEF01"
+	otherTestWallet = "0x9999999999999999999999999999999999999999"
+)
+
+func writeWalletTiers(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wallet-tiers.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadWalletTiers(t *testing.T) {
+	tiers, err := LoadWalletTiers(writeWalletTiers(t, `{"`+testWallet+`": "verified"}`))
+	if err != nil {
+		t.Fatalf("LoadWalletTiers failed: %v", err)
+	}
+	if tier, _ := tiers.TierFor(context.Background(), strings.ToLower(testWallet)); tier != "verified" {
+		t.Errorf("expected case-insensitive lookup to find verified, got %q", tier)
+	}
+	if tier, _ := tiers.TierFor(context.Background(), otherTestWallet); tier != "" {
+		t.Errorf("expected no tier for an unmapped wallet, got %q", tier)
+	}
+
+	for name, content := range map[string]string{
+		"bad address":  `{"not-an-address": "verified"}`,
+		"unknown tier": `{"` + testWallet + `": "gold"}`,
+		"invalid json": `[`,
+	} {
+		if _, err := LoadWalletTiers(writeWalletTiers(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestInitWalletRateLimit_RedisRequired(t *testing.T) {
+	origClient := redisClient
+	redisClient = nil
+	t.Cleanup(func() { redisClient, walletRateLimit = origClient, nil })
+	t.Setenv("RATE_LIMIT_ENABLED", "true")
+	t.Setenv("RATE_LIMIT_WALLET_TIERS_STORE", "redis")
+
+	if !getRedisRequired() {
+		t.Error("expected RATE_LIMIT_WALLET_TIERS_STORE=redis to require Redis")
+	}
+	if err := initWalletRateLimit(initRateLimiters()); err == nil {
+		t.Error("expected a startup error when the Redis tier store is unavailable")
+	}
+}
+
+func TestWalletRateLimit_VerifiedTierReachable(t *testing.T) {
+	t.Setenv("RATE_LIMIT_STANDARD_RPM", "60")
+	t.Setenv("RATE_LIMIT_VERIFIED_RPM", "600")
+	t.Setenv("RATE_LIMIT_WALLET_TIERS_STORE", "file")
+	t.Setenv("RATE_LIMIT_WALLET_TIERS_FILE", writeWalletTiers(t, `{"`+testWallet+`": "verified"}`))
+	t.Cleanup(func() { walletRateLimit = nil })
+	if err := initWalletRateLimit(initRateLimiters()); err != nil {
+		t.Fatalf("initWalletRateLimit failed: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/test", func(c *gin.Context) {
+		if checkWalletRateLimit(c, c.GetHeader("X-Test-Wallet")) {
+			c.Status(200)
+		}
+	})
+
+	for wallet, want := range map[string]string{testWallet: "600", otherTestWallet: "60"} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Test-Wallet", wallet)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Header().Get("X-RateLimit-Limit"); got != want {
+			t.Errorf("wallet %s: expected limit %s, got %s", wallet, want, got)
+		}
+	}
+}
+
+func TestRedisWalletTiers(t *testing.T) {
+	client := newTestRedisClient(t)
+	wallet := "0x" + strconv.FormatInt(time.Now().UnixNano(), 16)
+	if err := client.HSet(context.Background(), walletTiersKey, wallet, "verified").Err(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.HDel(context.Background(), walletTiersKey, wallet)
+
+	store := NewRedisWalletTiers(client)
+	if tier, err := store.TierFor(context.Background(), "0x"+strings.ToUpper(wallet[2:])); err != nil || tier != "verified" {
+		t.Errorf("expected checksummed lookups to find verified, got %q, %v", tier, err)
+	}
+	if tier, err := store.TierFor(context.Background(), otherTestWallet); err != nil || tier != "" {
+		t.Errorf("expected no tier for an unmapped wallet, got %q, %v", tier, err)
+	}
+}
+
+func TestHandleSummarize_WalletLimitKeepsNonce(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": reply("summary")})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	t.Setenv("RATE_LIMIT_STANDARD_BURST", "1")
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	defer verifier.Close()
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	walletRateLimit = &WalletRateLimit{limiters: initRateLimiters()}
+	t.Cleanup(func() { walletRateLimit = nil })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	if w := paidRequest(t, r, `{"text":"hello"}`); w.Code != 200 {
+		t.Fatalf("expected first request to pass, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	nonce := "nonce-wallet-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := nonceStore.Issue(context.Background(), nonce, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"hello"}`))
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 429 {
+		t.Fatalf("expected the same wallet to be limited with a new nonce, got %d", w.Code)
+	}
+	if err := nonceStore.Consume(context.Background(), nonce); err != nil {
+		t.Errorf("a rate limited request must not spend its nonce: %v", err)
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
@@ -29,13 +28,25 @@ type PaymentDetails struct {
 	Token     string `json:"token"`
 	ChainID   int    `json:"chainId"`
 	Nonce     string `json:"nonce"`
+	// Funding is "signature" for a per-request signed payment, "prepaid"
+	// for a debit from the payer's balance or "refund" for a refund credit
+	Funding string `json:"funding,omitempty"`
 }
 
+const (
+	fundingSignature = "signature"
+	fundingPrepaid   = "prepaid"
+	fundingRefund    = "refund"
+)
+
 // ServiceDetails contains service-related information
 type ServiceDetails struct {
 	Endpoint     string `json:"endpoint"`
 	RequestHash  string `json:"request_hash"`
 	ResponseHash string `json:"response_hash"`
+	// Model is the AI model that actually produced the response, which may
+	// be a fallback rather than the configured primary model
+	Model string `json:"model,omitempty"`
 }
 
 // SignedReceipt contains the receipt and its cryptographic signature
@@ -43,19 +54,35 @@ type SignedReceipt struct {
 	Receipt         Receipt `json:"receipt"`
 	Signature       string  `json:"signature"`
 	ServerPublicKey string  `json:"server_public_key"`
+	// KeyID names the signing key in /.well-known/paygate-keys (empty for
+	// receipts signed before key IDs existed)
+	KeyID string `json:"kid,omitempty"`
 }
 
-// GenerateReceipt creates a new receipt for a successful payment
-func GenerateReceipt(payment PaymentContext, payer string, endpoint string, reqBody, respBody []byte) (*SignedReceipt, error) {
+// GenerateReceipt creates a new receipt for a successful payment.
+// model records which AI model served the request; it may be empty.
+// version is the receipt format, one of the receiptVersion constants.
+func GenerateReceipt(payment PaymentContext, payer string, endpoint string, model string, version string, reqBody, respBody []byte) (*SignedReceipt, error) {
 	receiptID, err := generateReceiptID()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate receipt ID: %w", err)
 	}
 
+	funding := payment.Funding
+	if funding == "" {
+		funding = fundingSignature
+	}
+
+	timestamp := time.Now().UTC()
+	if version == receiptVersionV2 {
+		// Typed receipts sign the timestamp in whole seconds
+		timestamp = timestamp.Truncate(time.Second)
+	}
+
 	receipt := Receipt{
 		ID:        receiptID,
-		Version:   "1.0",
-		Timestamp: time.Now().UTC(),
+		Version:   version,
+		Timestamp: timestamp,
 		Payment: PaymentDetails{
 			Payer:     payer,
 			Recipient: payment.Recipient,
@@ -63,11 +90,13 @@ func GenerateReceipt(payment PaymentContext, payer string, endpoint string, reqB
 			Token:     payment.Token,
 			ChainID:   payment.ChainID,
 			Nonce:     payment.Nonce,
+			Funding:   funding,
 		},
 		Service: ServiceDetails{
 			Endpoint:     endpoint,
 			RequestHash:  hashData(reqBody),
 			ResponseHash: hashData(respBody),
+			Model:        model,
 		},
 	}
 
@@ -94,42 +123,82 @@ func hashData(data []byte) string {
 	return "sha256:" + hex.EncodeToString(hash[:])
 }
 
-// signReceipt signs a receipt using the server's private key
-// NOTE: Go's json.Marshal is deterministic for structs - fields are always
-// serialized in the order they are defined in the struct, ensuring consistent output.
-// This guarantees consistent signatures across multiple marshaling operations.
+// signReceipt signs a receipt with the current receipt key. The signature
+// covers receiptDigest: for v1 the Keccak256 of the receipt JSON, relying on
+// json.Marshal emitting struct fields in declaration order; for v2 the
+// EIP-712 typed data hash; for v3 the Keccak256 of the canonical JSON.
 func signReceipt(receipt Receipt) (*SignedReceipt, error) {
-	// Get server's private key
-	privateKey, err := getServerPrivateKey()
+	digest, err := receiptDigest(receipt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load server private key: %w", err)
+		return nil, err
 	}
 
-	// Serialize receipt deterministically
-	// json.Marshal outputs struct fields in their declaration order
-	receiptBytes, err := json.Marshal(receipt)
+	signature, publicKey, kid, err := signDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.Version == receiptVersionV2 {
+		// ecrecover and wallets expect v as 27/28
+		signature, err = withEthereumRecoveryID(signature)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SignedReceipt{
+		Receipt:         receipt,
+		Signature:       signature,
+		ServerPublicKey: publicKey,
+		KeyID:           kid,
+	}, nil
+}
+
+// verifyReceipt checks a receipt's signature against the keyring
+func verifyReceipt(receipt *SignedReceipt) error {
+	ring, err := getReceiptKeyring()
+	if err != nil {
+		return err
+	}
+	digest, err := receiptDigest(receipt.Receipt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal receipt: %w", err)
+		return err
 	}
+	return ring.Verify(receipt.KeyID, receipt.ServerPublicKey, digest, receipt.Signature)
+}
 
-	// Hash the receipt using Keccak256 (Ethereum-compatible)
-	hash := crypto.Keccak256Hash(receiptBytes)
+// signPayload signs the Keccak256 hash of payload with the current receipt
+// key, returning the hex signature, the key's public key and its ID
+func signPayload(payload []byte) (signature, publicKey, kid string, err error) {
+	return signDigest(crypto.Keccak256(payload))
+}
+
+// signDigest signs a 32-byte digest with the current receipt key. The
+// signature's recovery ID is 0 or 1.
+func signDigest(digest []byte) (signature, publicKey, kid string, err error) {
+	ring, err := getReceiptKeyring()
+	if err != nil {
+		return "", "", "", err
+	}
+	key := ring.Current()
 
 	// Sign the hash using ECDSA
 	// SECURITY: crypto.Sign uses constant-time operations from go-ethereum's secp256k1 implementation
 	// This prevents timing attacks that could leak private key information
-	signature, err := crypto.Sign(hash.Bytes(), privateKey)
+	sig, err := crypto.Sign(digest, key.privateKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign receipt: %w", err)
+		return "", "", "", fmt.Errorf("failed to sign receipt: %w", err)
 	}
 
 	// Get server's public key for verification
-	publicKey := privateKey.Public().(*ecdsa.PublicKey)
-	publicKeyBytes := crypto.FromECDSAPub(publicKey)
+	publicKeyBytes := crypto.FromECDSAPub(key.PublicKey)
+	return "0x" + hex.EncodeToString(sig), "0x" + hex.EncodeToString(publicKeyBytes), key.ID, nil
+}
 
-	return &SignedReceipt{
-		Receipt:         receipt,
-		Signature:       "0x" + hex.EncodeToString(signature),
-		ServerPublicKey: "0x" + hex.EncodeToString(publicKeyBytes),
-	}, nil
+// withEthereumRecoveryID moves a signature's recovery ID from 0/1 to 27/28
+func withEthereumRecoveryID(signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return "", fmt.Errorf("invalid signature %q", signature)
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return "0x" + hex.EncodeToString(sig), nil
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUnknownReceiptKey means a signature names a key the keyring does not hold
+var ErrUnknownReceiptKey = errors.New("unknown receipt signing key")
+
+// Receipt key statuses published by /.well-known/paygate-keys
+const (
+	receiptKeyCurrent = "current" // signs new receipts
+	receiptKeyActive  = "active"  // could sign, e.g. staged for the next rotation
+	receiptKeyRetired = "retired" // public key only, verifies old receipts
+)
+
+// ReceiptKey is a receipt signing key. Retired keys have no private key.
+type ReceiptKey struct {
+	ID         string
+	PublicKey  *ecdsa.PublicKey
+	privateKey *ecdsa.PrivateKey
+}
+
+// ReceiptKeyring holds the keys receipts and failed-service records are
+// signed and verified with
+type ReceiptKeyring struct {
+	current *ReceiptKey
+	keys    []*ReceiptKey
+}
+
+// receiptKeyring is set by initReceiptKeyring. When nil the keyring holds
+// SERVER_WALLET_PRIVATE_KEY alone.
+var receiptKeyring *ReceiptKeyring
+
+// receiptKeysFile is the on-disk format of RECEIPT_KEYS_CONFIG
+type receiptKeysFile struct {
+	Current string `json:"current"`
+	Keys    []struct {
+		ID string `json:"kid"`
+		// PrivateKeyEnv names the environment variable holding the key
+		PrivateKeyEnv string `json:"privateKeyEnv"`
+		// PublicKey is a retired key kept to verify old receipts
+		PublicKey string `json:"publicKey"`
+	} `json:"keys"`
+}
+
+// defaultReceiptKeyID derives a stable key ID from a public key, so a
+// single configured key keeps its ID across restarts
+func defaultReceiptKeyID(pub *ecdsa.PublicKey) string {
+	hash := sha256.Sum256(crypto.FromECDSAPub(pub))
+	return "k_" + hex.EncodeToString(hash[:8])
+}
+
+// newSingleKeyring returns a keyring holding only key
+func newSingleKeyring(key *ecdsa.PrivateKey) *ReceiptKeyring {
+	pub := key.Public().(*ecdsa.PublicKey)
+	current := &ReceiptKey{ID: defaultReceiptKeyID(pub), PublicKey: pub, privateKey: key}
+	return &ReceiptKeyring{current: current, keys: []*ReceiptKey{current}}
+}
+
+// LoadReceiptKeyring reads a keyring config from path. Private keys come
+// from the environment variables the config names; retired keys are given
+// by public key.
+func LoadReceiptKeyring(path string) (*ReceiptKeyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read receipt keys config: %w", err)
+	}
+	var file receiptKeysFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse receipt keys config: %w", err)
+	}
+
+	ring := &ReceiptKeyring{}
+	seen := map[string]bool{}
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("receipt key without kid")
+		}
+		if seen[entry.ID] {
+			return nil, fmt.Errorf("duplicate receipt key %s", entry.ID)
+		}
+		seen[entry.ID] = true
+
+		key := &ReceiptKey{ID: entry.ID}
+		switch {
+		case entry.PrivateKeyEnv != "" && entry.PublicKey != "":
+			return nil, fmt.Errorf("receipt key %s: set either privateKeyEnv or publicKey", entry.ID)
+		case entry.PrivateKeyEnv != "":
+			keyHex := os.Getenv(entry.PrivateKeyEnv)
+			if keyHex == "" {
+				return nil, fmt.Errorf("receipt key %s: %s is not set", entry.ID, entry.PrivateKeyEnv)
+			}
+			if key.privateKey, err = parsePrivateKeyHex(keyHex); err != nil {
+				return nil, fmt.Errorf("receipt key %s: %w", entry.ID, err)
+			}
+			key.PublicKey = key.privateKey.Public().(*ecdsa.PublicKey)
+		case entry.PublicKey != "":
+			if key.PublicKey, err = parsePublicKeyHex(entry.PublicKey); err != nil {
+				return nil, fmt.Errorf("receipt key %s: %w", entry.ID, err)
+			}
+		default:
+			return nil, fmt.Errorf("receipt key %s: privateKeyEnv or publicKey is required", entry.ID)
+		}
+		ring.keys = append(ring.keys, key)
+		if entry.ID == file.Current {
+			ring.current = key
+		}
+	}
+	if ring.current == nil {
+		return nil, fmt.Errorf("current receipt key %q is not in keys", file.Current)
+	}
+	if ring.current.privateKey == nil {
+		return nil, fmt.Errorf("current receipt key %s has no private key", file.Current)
+	}
+	return ring, nil
+}
+
+// initReceiptKeyring loads RECEIPT_KEYS_CONFIG when set
+func initReceiptKeyring() error {
+	path := os.Getenv("RECEIPT_KEYS_CONFIG")
+	if path == "" {
+		return nil
+	}
+	ring, err := LoadReceiptKeyring(path)
+	if err != nil {
+		return err
+	}
+	receiptKeyring = ring
+	log.Printf("Loaded %d receipt keys from %s (current: %s)", len(ring.keys), path, ring.current.ID)
+	return nil
+}
+
+// getReceiptKeyring returns the configured keyring, or one holding
+// SERVER_WALLET_PRIVATE_KEY
+func getReceiptKeyring() (*ReceiptKeyring, error) {
+	if ring := receiptKeyring; ring != nil {
+		return ring, nil
+	}
+	key, err := getServerPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server private key: %w", err)
+	}
+	return newSingleKeyring(key), nil
+}
+
+// Current returns the key new signatures are made with
+func (r *ReceiptKeyring) Current() *ReceiptKey { return r.current }
+
+// Key returns the key named kid, or nil
+func (r *ReceiptKeyring) Key(kid string) *ReceiptKey {
+	for _, key := range r.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// status returns key's status in the published key set
+func (r *ReceiptKeyring) status(key *ReceiptKey) string {
+	switch {
+	case key == r.current:
+		return receiptKeyCurrent
+	case key.privateKey != nil:
+		return receiptKeyActive
+	}
+	return receiptKeyRetired
+}
+
+// Verify checks signature over digest against the key named kid. Records
+// signed before key IDs existed have no kid; they are matched by the
+// public key they embed, which must still be in the keyring.
+func (r *ReceiptKeyring) Verify(kid, publicKey string, digest []byte, signature string) error {
+	var key *ReceiptKey
+	if kid != "" {
+		key = r.Key(kid)
+	} else {
+		for _, candidate := range r.keys {
+			if strings.EqualFold(publicKey, "0x"+hex.EncodeToString(crypto.FromECDSAPub(candidate.PublicKey))) {
+				key = candidate
+				break
+			}
+		}
+	}
+	if key == nil {
+		return ErrUnknownReceiptKey
+	}
+
+	sig, err := decodeSignature(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	recovered, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !bytes.Equal(crypto.FromECDSAPub(recovered), crypto.FromECDSAPub(key.PublicKey)) {
+		return fmt.Errorf("signature does not match receipt key %s", key.ID)
+	}
+	return nil
+}
+
+// parsePublicKeyHex parses an uncompressed (65-byte) or compressed
+// (33-byte) secp256k1 public key
+func parsePublicKeyHex(keyHex string) (*ecdsa.PublicKey, error) {
+	keyBytes, err := hex.DecodeString(strings.TrimPrefix(keyHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key format: %w", err)
+	}
+	if len(keyBytes) == 33 {
+		return crypto.DecompressPubkey(keyBytes)
+	}
+	return crypto.UnmarshalPubkey(keyBytes)
+}
+
+// handleReceiptKeys handles GET /.well-known/paygate-keys, publishing the
+// keyring so verifiers can pin receipt keys instead of trusting the key
+// embedded in a receipt. Keys are JWKs with the public key also given in
+// hex and as an Ethereum address.
+func handleReceiptKeys(c *gin.Context) {
+	ring, err := getReceiptKeyring()
+	if err != nil {
+		log.Printf("Receipt keyring unavailable: %v", err)
+		c.JSON(500, gin.H{"error": "Receipt keys unavailable", "message": "An internal error occurred"})
+		return
+	}
+	keys := make([]gin.H, 0, len(ring.keys))
+	for _, key := range ring.keys {
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.PublicKey.X.FillBytes(x)
+		key.PublicKey.Y.FillBytes(y)
+		keys = append(keys, gin.H{
+			"kid":        key.ID,
+			"kty":        "EC",
+			"crv":        "secp256k1",
+			"use":        "sig",
+			"x":          base64.RawURLEncoding.EncodeToString(x),
+			"y":          base64.RawURLEncoding.EncodeToString(y),
+			"public_key": "0x" + hex.EncodeToString(crypto.FromECDSAPub(key.PublicKey)),
+			"address":    crypto.PubkeyToAddress(*key.PublicKey).Hex(),
+			"status":     ring.status(key),
+		})
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, gin.H{"current": ring.current.ID, "keys": keys, "receipt_domain": receiptDomain()})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+)
+
+// newTestKeyHex returns a fresh private key in hex
+func newTestKeyHex(t *testing.T) string {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(crypto.FromECDSA(key))
+}
+
+// useReceiptKeysConfig loads config as the receipt keyring
+func useReceiptKeysConfig(t *testing.T, config string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "receipt-keys.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RECEIPT_KEYS_CONFIG", path)
+	t.Cleanup(func() { receiptKeyring = nil })
+	if err := initReceiptKeyring(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testReceipt(t *testing.T) *SignedReceipt {
+	t.Helper()
+	receipt, err := GenerateReceipt(testPaymentContext(), testWallet, "/api/ai/summarize", "primary", receiptVersionV1, []byte("req"), []byte("resp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipt
+}
+
+func TestReceiptKeyring_DefaultKey(t *testing.T) {
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	receipt := testReceipt(t)
+	key, _ := getServerPrivateKey()
+	if want := defaultReceiptKeyID(&key.PublicKey); receipt.KeyID != want {
+		t.Errorf("expected kid %s derived from the server key, got %q", want, receipt.KeyID)
+	}
+	if err := verifyReceipt(receipt); err != nil {
+		t.Errorf("expected the receipt to verify, got %v", err)
+	}
+
+	receipt.Receipt.Payment.Amount = "1000"
+	if err := verifyReceipt(receipt); err == nil || errors.Is(err, ErrUnknownReceiptKey) {
+		t.Errorf("expected a tampered receipt to fail verification, got %v", err)
+	}
+}
+
+func TestReceiptKeyring_Rotation(t *testing.T) {
+	t.Setenv("RECEIPT_KEY_OLD", newTestKeyHex(t))
+	t.Setenv("RECEIPT_KEY_NEW", newTestKeyHex(t))
+
+	// Before the rotation the old key signs
+	useReceiptKeysConfig(t, `{"current":"old","keys":[{"kid":"old","privateKeyEnv":"RECEIPT_KEY_OLD"},{"kid":"new","privateKeyEnv":"RECEIPT_KEY_NEW"}]}`)
+	oldReceipt := testReceipt(t)
+	if oldReceipt.KeyID != "old" {
+		t.Fatalf("expected the current key to sign, got %q", oldReceipt.KeyID)
+	}
+	oldPublicKey := oldReceipt.ServerPublicKey
+
+	// After it the old key is retired: kept by public key only
+	useReceiptKeysConfig(t, `{"current":"new","keys":[{"kid":"new","privateKeyEnv":"RECEIPT_KEY_NEW"},{"kid":"old","publicKey":"`+oldPublicKey+`"}]}`)
+	newReceipt := testReceipt(t)
+	if newReceipt.KeyID != "new" || newReceipt.ServerPublicKey == oldPublicKey {
+		t.Errorf("expected new receipts to be signed with the new key, got %q", newReceipt.KeyID)
+	}
+	for _, receipt := range []*SignedReceipt{oldReceipt, newReceipt} {
+		if err := verifyReceipt(receipt); err != nil {
+			t.Errorf("%s: expected the receipt to verify, got %v", receipt.KeyID, err)
+		}
+	}
+
+	// Receipts from before key IDs are matched by their embedded key
+	legacy := *oldReceipt
+	legacy.KeyID = ""
+	if err := verifyReceipt(&legacy); err != nil {
+		t.Errorf("expected a receipt without kid to verify, got %v", err)
+	}
+
+	// A receipt claiming another key does not verify
+	forged := *oldReceipt
+	forged.KeyID = "new"
+	if err := verifyReceipt(&forged); err == nil {
+		t.Error("expected a receipt naming the wrong key to fail")
+	}
+
+	// Once dropped from the keyring, the old key vouches for nothing
+	useReceiptKeysConfig(t, `{"current":"new","keys":[{"kid":"new","privateKeyEnv":"RECEIPT_KEY_NEW"}]}`)
+	if err := verifyReceipt(oldReceipt); !errors.Is(err, ErrUnknownReceiptKey) {
+		t.Errorf("expected ErrUnknownReceiptKey, got %v", err)
+	}
+}
+
+func TestLoadReceiptKeyring_Errors(t *testing.T) {
+	t.Setenv("RECEIPT_KEY_A", newTestKeyHex(t))
+	key, _ := crypto.GenerateKey()
+	pub := "0x" + hex.EncodeToString(crypto.FromECDSAPub(&key.PublicKey))
+	tests := map[string]string{
+		"unknown current":     `{"current":"b","keys":[{"kid":"a","privateKeyEnv":"RECEIPT_KEY_A"}]}`,
+		"retired current":     `{"current":"a","keys":[{"kid":"a","publicKey":"` + pub + `"}]}`,
+		"duplicate kid":       `{"current":"a","keys":[{"kid":"a","privateKeyEnv":"RECEIPT_KEY_A"},{"kid":"a","publicKey":"` + pub + `"}]}`,
+		"unset variable":      `{"current":"a","keys":[{"kid":"a","privateKeyEnv":"RECEIPT_KEY_UNSET"}]}`,
+		"both key kinds":      `{"current":"a","keys":[{"kid":"a","privateKeyEnv":"RECEIPT_KEY_A","publicKey":"` + pub + `"}]}`,
+		"invalid public key":  `{"current":"a","keys":[{"kid":"a","privateKeyEnv":"RECEIPT_KEY_A"},{"kid":"b","publicKey":"0x1234"}]}`,
+		"missing kid":         `{"current":"a","keys":[{"privateKeyEnv":"RECEIPT_KEY_A"}]}`,
+		"no key material":     `{"current":"a","keys":[{"kid":"a"}]}`,
+		"malformed JSON file": `{"current":`,
+	}
+	for name, config := range tests {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		os.WriteFile(path, []byte(config), 0o600)
+		if _, err := LoadReceiptKeyring(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHandleReceiptKeys(t *testing.T) {
+	t.Setenv("RECEIPT_KEY_NEW", newTestKeyHex(t))
+	t.Setenv("RECEIPT_KEY_NEXT", newTestKeyHex(t))
+	retired, _ := crypto.GenerateKey()
+	compressed := "0x" + hex.EncodeToString(crypto.CompressPubkey(&retired.PublicKey))
+	useReceiptKeysConfig(t, `{"current":"new","keys":[
+		{"kid":"new","privateKeyEnv":"RECEIPT_KEY_NEW"},
+		{"kid":"next","privateKeyEnv":"RECEIPT_KEY_NEXT"},
+		{"kid":"old","publicKey":"`+compressed+`"}]}`)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/.well-known/paygate-keys", handleReceiptKeys)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/paygate-keys", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Current string
+		Keys    []struct{ Kid, Kty, Crv, X, Y, Address, Status string }
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Current != "new" || len(resp.Keys) != 3 {
+		t.Fatalf("unexpected key set %s", w.Body.String())
+	}
+	statuses := map[string]string{}
+	for _, key := range resp.Keys {
+		statuses[key.Kid] = key.Status
+	}
+	if statuses["new"] != "current" || statuses["next"] != "active" || statuses["old"] != "retired" {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+
+	// The JWK coordinates are those of the published key
+	old := resp.Keys[2]
+	x, _ := base64.RawURLEncoding.DecodeString(old.X)
+	y, _ := base64.RawURLEncoding.DecodeString(old.Y)
+	if old.Kty != "EC" || old.Crv != "secp256k1" || new(big.Int).SetBytes(x).Cmp(retired.PublicKey.X) != 0 || new(big.Int).SetBytes(y).Cmp(retired.PublicKey.Y) != 0 {
+		t.Errorf("JWK does not match the retired key: %+v", old)
+	}
+	if old.Address != crypto.PubkeyToAddress(retired.PublicKey).Hex() {
+		t.Errorf("expected address %s, got %s", crypto.PubkeyToAddress(retired.PublicKey).Hex(), old.Address)
+	}
+}
+
+func TestHandleGetReceipt_VerifiesAgainstKeyring(t *testing.T) {
+	t.Setenv("RECEIPT_KEY_A", newTestKeyHex(t))
+	useReceiptKeysConfig(t, `{"current":"a","keys":[{"kid":"a","privateKeyEnv":"RECEIPT_KEY_A"}]}`)
+	receipt := testReceipt(t)
+	if err := storeReceipt(context.Background(), receipt, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/receipts/:id", handleGetReceipt)
+	get := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/receipts/"+receipt.Receipt.ID, nil))
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+	if resp := get(); resp["status"] != "valid" || resp["kid"] != "a" {
+		t.Errorf("expected a valid receipt signed by a, got %v", resp)
+	}
+
+	// Rotated away entirely: the receipt can no longer be vouched for
+	t.Setenv("RECEIPT_KEY_B", newTestKeyHex(t))
+	useReceiptKeysConfig(t, `{"current":"b","keys":[{"kid":"b","privateKeyEnv":"RECEIPT_KEY_B"}]}`)
+	if resp := get(); resp["status"] != "unknown_key" {
+		t.Errorf("expected unknown_key, got %v", resp["status"])
+	}
+}
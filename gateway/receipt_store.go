@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ReceiptStore persists signed receipts so they can be looked up via
+// GET /api/receipts/:id for the duration of their TTL.
+type ReceiptStore interface {
+	// Put stores a receipt that expires after ttl
+	Put(ctx context.Context, receipt *SignedReceipt, ttl time.Duration) error
+	// Get returns the receipt with the given ID. The bool is false if the
+	// receipt does not exist or has expired.
+	Get(ctx context.Context, id string) (*SignedReceipt, bool, error)
+	// Cleanup removes expired receipts and returns how many were removed
+	Cleanup(ctx context.Context) (int, error)
+	// ExpiresNatively reports whether the backend expires entries on its own,
+	// in which case periodic cleanup is unnecessary.
+	ExpiresNatively() bool
+}
+
+// receiptStore is the process-wide store. It defaults to the in-memory
+// implementation and is replaced by initReceiptStore at startup.
+var receiptStore ReceiptStore = NewMemoryReceiptStore()
+
+// getReceiptStoreBackend returns the configured receipt backend: "memory" (default), "redis" or "file"
+func getReceiptStoreBackend() string {
+	return strings.ToLower(getEnv("RECEIPT_STORE", "memory"))
+}
+
+// initReceiptStore selects the receipt backend from RECEIPT_STORE. Redis
+// being unavailable is an error: a memory store would 404 receipts issued by
+// other replicas.
+func initReceiptStore() error {
+	switch backend := getReceiptStoreBackend(); backend {
+	case "memory", "":
+		receiptStore = NewMemoryReceiptStore()
+	case "redis":
+		if redisClient == nil {
+			return fmt.Errorf("RECEIPT_STORE=redis but Redis is unavailable")
+		}
+		receiptStore = NewRedisReceiptStore(redisClient)
+	case "file":
+		store, err := NewFileReceiptStore(getEnv("RECEIPT_STORE_PATH", "data/receipts"))
+		if err != nil {
+			return err
+		}
+		receiptStore = store
+	default:
+		return fmt.Errorf("unknown RECEIPT_STORE %q (expected memory, redis or file)", backend)
+	}
+	log.Printf("Receipt store: %s", getReceiptStoreBackend())
+	return nil
+}
+
+type receiptEntry struct {
+	receipt   *SignedReceipt
+	expiresAt time.Time
+}
+
+// MemoryReceiptStore keeps receipts in a process-local map.
+// Receipts are lost on restart and not shared across replicas.
+type MemoryReceiptStore struct {
+	mu       sync.RWMutex
+	receipts map[string]*receiptEntry
+}
+
+// NewMemoryReceiptStore creates an empty in-memory receipt store
+func NewMemoryReceiptStore() *MemoryReceiptStore {
+	return &MemoryReceiptStore{receipts: make(map[string]*receiptEntry)}
+}
+
+func (s *MemoryReceiptStore) Put(ctx context.Context, receipt *SignedReceipt, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.receipts[receipt.Receipt.ID] = &receiptEntry{
+		receipt:   receipt,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (s *MemoryReceiptStore) Get(ctx context.Context, id string) (*SignedReceipt, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists := s.receipts[id]
+	if !exists || time.Now().After(entry.expiresAt) {
+		return nil, false, nil
+	}
+	return entry.receipt, true, nil
+}
+
+func (s *MemoryReceiptStore) Cleanup(ctx context.Context) (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for id, entry := range s.receipts {
+		if now.After(entry.expiresAt) {
+			delete(s.receipts, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryReceiptStore) ExpiresNatively() bool { return false }
+
+// RedisReceiptStore keeps receipts in Redis using native key expiry,
+// so every replica can serve any receipt.
+type RedisReceiptStore struct {
+	client *redis.Client
+}
+
+// NewRedisReceiptStore creates a receipt store backed by the given Redis client
+func NewRedisReceiptStore(client *redis.Client) *RedisReceiptStore {
+	return &RedisReceiptStore{client: client}
+}
+
+func receiptKey(id string) string {
+	return "receipt:" + id
+}
+
+func (s *RedisReceiptStore) Put(ctx context.Context, receipt *SignedReceipt, ttl time.Duration) error {
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("marshal receipt: %w", err)
+	}
+	if err := s.client.Set(ctx, receiptKey(receipt.Receipt.ID), data, ttl).Err(); err != nil {
+		return fmt.Errorf("store receipt: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisReceiptStore) Get(ctx context.Context, id string) (*SignedReceipt, bool, error) {
+	data, err := s.client.Get(ctx, receiptKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("load receipt: %w", err)
+	}
+
+	var receipt SignedReceipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return nil, false, fmt.Errorf("decode receipt: %w", err)
+	}
+	return &receipt, true, nil
+}
+
+// Cleanup is a no-op: Redis expires receipt keys via their TTL
+func (s *RedisReceiptStore) Cleanup(ctx context.Context) (int, error) { return 0, nil }
+
+func (s *RedisReceiptStore) ExpiresNatively() bool { return true }
+
+// receiptIDPattern restricts IDs used as file names to prevent path traversal
+var receiptIDPattern = regexp.MustCompile(`^rcpt_[A-Za-z0-9]+$`)
+
+// fileReceiptRecord is the on-disk format of a receipt
+type fileReceiptRecord struct {
+	ExpiresAt time.Time      `json:"expires_at"`
+	Receipt   *SignedReceipt `json:"receipt"`
+}
+
+// FileReceiptStore keeps one JSON file per receipt in a local directory.
+// Receipts survive restarts without running an external service.
+type FileReceiptStore struct {
+	dir string
+}
+
+// NewFileReceiptStore creates a receipt store rooted at dir, creating it if needed
+func NewFileReceiptStore(dir string) (*FileReceiptStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create receipt directory: %w", err)
+	}
+	return &FileReceiptStore{dir: dir}, nil
+}
+
+func (s *FileReceiptStore) path(id string) (string, error) {
+	if !receiptIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid receipt ID")
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Put writes the receipt atomically via a temp file and rename
+func (s *FileReceiptStore) Put(ctx context.Context, receipt *SignedReceipt, ttl time.Duration) error {
+	path, err := s.path(receipt.Receipt.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(fileReceiptRecord{ExpiresAt: time.Now().Add(ttl), Receipt: receipt})
+	if err != nil {
+		return fmt.Errorf("marshal receipt: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".receipt-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write receipt: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close receipt file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("commit receipt file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileReceiptStore) Get(ctx context.Context, id string) (*SignedReceipt, bool, error) {
+	path, err := s.path(id)
+	if err != nil {
+		// Malformed IDs can never have been stored
+		return nil, false, nil
+	}
+
+	record, err := readFileReceipt(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return nil, false, nil
+	}
+	return record.Receipt, true, nil
+}
+
+func (s *FileReceiptStore) Cleanup(ctx context.Context) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "rcpt_*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	count := 0
+	for _, path := range matches {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		record, err := readFileReceipt(path)
+		if err != nil {
+			log.Printf("[WARNING] Skipping unreadable receipt file %s: %v", filepath.Base(path), err)
+			continue
+		}
+		if now.After(record.ExpiresAt) {
+			if err := os.Remove(path); err == nil {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (s *FileReceiptStore) ExpiresNatively() bool { return false }
+
+func readFileReceipt(path string) (*fileReceiptRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record fileReceiptRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("decode receipt file: %w", err)
+	}
+	return &record, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestSignedReceipt(t *testing.T) *SignedReceipt {
+	t.Helper()
+	receiptID, err := generateReceiptID()
+	if err != nil {
+		t.Fatalf("generateReceiptID() failed: %v", err)
+	}
+	return &SignedReceipt{
+		Receipt: Receipt{
+			ID:        receiptID,
+			Version:   "1.0",
+			Timestamp: time.Now().UTC(),
+			Payment: PaymentDetails{
+				Payer:     "0x742d35Cc6634C0532925a3b844Bc9e7595f8fE21",
+				Recipient: "0x2cAF48b4BA1C58721a85dFADa5aC01C2DFa62219",
+				Amount:    "0.001",
+				Token:     "USDC",
+				ChainID:   8453,
+				Nonce:     "store-test-nonce",
+			},
+			Service: ServiceDetails{
+				Endpoint:     "/api/ai/summarize",
+				RequestHash:  "sha256:request",
+				ResponseHash: "sha256:response",
+			},
+		},
+		Signature:       "0x1234567890abcdef",
+		ServerPublicKey: "0xabcdef1234567890",
+	}
+}
+
+// testReceiptStoreRoundTrip exercises the behavior every ReceiptStore must share
+func testReceiptStoreRoundTrip(t *testing.T, store ReceiptStore) {
+	t.Helper()
+	ctx := context.Background()
+	receipt := newTestSignedReceipt(t)
+
+	if err := store.Put(ctx, receipt, time.Hour); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	got, exists, err := store.Get(ctx, receipt.Receipt.ID)
+	if err != nil || !exists {
+		t.Fatalf("Get returned exists=%v err=%v", exists, err)
+	}
+	if got.Receipt.ID != receipt.Receipt.ID || got.Signature != receipt.Signature {
+		t.Errorf("Retrieved receipt does not match stored receipt")
+	}
+	if got.Receipt.Payment.Nonce != receipt.Receipt.Payment.Nonce {
+		t.Errorf("Nonce mismatch: got %s, want %s", got.Receipt.Payment.Nonce, receipt.Receipt.Payment.Nonce)
+	}
+
+	if _, exists, err := store.Get(ctx, "rcpt_doesnotexist"); err != nil || exists {
+		t.Errorf("Missing receipt should not be found (exists=%v err=%v)", exists, err)
+	}
+}
+
+func TestMemoryReceiptStore(t *testing.T) {
+	testReceiptStoreRoundTrip(t, NewMemoryReceiptStore())
+}
+
+func TestMemoryReceiptStore_Cleanup(t *testing.T) {
+	store := NewMemoryReceiptStore()
+	ctx := context.Background()
+	receipt := newTestSignedReceipt(t)
+
+	if err := store.Put(ctx, receipt, 10*time.Millisecond); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, exists, _ := store.Get(ctx, receipt.Receipt.ID); exists {
+		t.Error("Expired receipt should not be returned")
+	}
+	count, err := store.Cleanup(ctx)
+	if err != nil || count != 1 {
+		t.Errorf("Cleanup removed %d receipts (err=%v), want 1", count, err)
+	}
+}
+
+func TestFileReceiptStore(t *testing.T) {
+	store, err := NewFileReceiptStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileReceiptStore failed: %v", err)
+	}
+	testReceiptStoreRoundTrip(t, store)
+}
+
+func TestFileReceiptStore_SurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	receipt := newTestSignedReceipt(t)
+
+	first, err := NewFileReceiptStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileReceiptStore failed: %v", err)
+	}
+	if err := first.Put(ctx, receipt, time.Hour); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Simulate a restart by opening a new store on the same directory
+	second, err := NewFileReceiptStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileReceiptStore failed: %v", err)
+	}
+	if _, exists, err := second.Get(ctx, receipt.Receipt.ID); err != nil || !exists {
+		t.Errorf("Receipt should survive reopen (exists=%v err=%v)", exists, err)
+	}
+}
+
+func TestFileReceiptStore_CleanupAndTraversal(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileReceiptStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileReceiptStore failed: %v", err)
+	}
+	ctx := context.Background()
+	receipt := newTestSignedReceipt(t)
+
+	if err := store.Put(ctx, receipt, 10*time.Millisecond); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	count, err := store.Cleanup(ctx)
+	if err != nil || count != 1 {
+		t.Errorf("Cleanup removed %d receipts (err=%v), want 1", count, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, receipt.Receipt.ID+".json")); !os.IsNotExist(err) {
+		t.Error("Expired receipt file should be removed")
+	}
+
+	// IDs that are not valid receipt IDs must never touch the filesystem
+	if _, exists, err := store.Get(ctx, "../secret"); exists || err != nil {
+		t.Errorf("Malformed ID should not be found (exists=%v err=%v)", exists, err)
+	}
+}
+
+func TestRedisReceiptStore(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer rdb.Close()
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("Redis unavailable, skipping integration test: %v", err)
+	}
+
+	store := NewRedisReceiptStore(rdb)
+	testReceiptStoreRoundTrip(t, store)
+
+	if !store.ExpiresNatively() {
+		t.Error("Redis store should report native expiry")
+	}
+}
+
+func TestStartReceiptCleanup_NoopForNativeExpiry(t *testing.T) {
+	orig := receiptStore
+	receiptStore = &RedisReceiptStore{}
+	defer func() { receiptStore = orig }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		startReceiptCleanup(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("startReceiptCleanup should return immediately for natively expiring stores")
+	}
+}
+
+func TestInitReceiptStore_RedisRequired(t *testing.T) {
+	orig, origClient := receiptStore, redisClient
+	redisClient = nil
+	defer func() { receiptStore, redisClient = orig, origClient }()
+
+	t.Setenv("RECEIPT_STORE", "redis")
+	if !getRedisRequired() {
+		t.Error("expected RECEIPT_STORE=redis to require Redis")
+	}
+	if err := initReceiptStore(); err == nil {
+		t.Error("expected a startup error when the Redis receipt store is unavailable")
+	}
+}
+
+func TestInitReceiptStore_UnknownBackend(t *testing.T) {
+	orig := receiptStore
+	defer func() { receiptStore = orig }()
+
+	t.Setenv("RECEIPT_STORE", "postgres")
+	if err := initReceiptStore(); err == nil {
+		t.Error("Expected error for unknown receipt store backend")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -197,7 +198,7 @@ func TestStoreAndRetrieveReceipt(t *testing.T) {
 	}
 
 	// Store receipt
-	if err := storeReceipt(signedReceipt, 24*time.Hour); err != nil {
+	if err := storeReceipt(context.Background(), signedReceipt, 24*time.Hour); err != nil {
 		t.Fatalf("Failed to store receipt: %v", err)
 	}
 
@@ -331,7 +332,7 @@ func TestReceiptFullFlowIntegration(t *testing.T) {
 	responseBody := []byte(`This is a test AI response summary.`)
 
 	// Step 2: Generate receipt (simulates what happens in handleSummarize)
-	receipt, err := GenerateReceipt(paymentCtx, payer, endpoint, requestBody, responseBody)
+	receipt, err := GenerateReceipt(paymentCtx, payer, endpoint, "", receiptVersionV1, requestBody, responseBody)
 	if err != nil {
 		t.Fatalf("Failed to generate receipt: %v", err)
 	}
@@ -365,7 +366,7 @@ func TestReceiptFullFlowIntegration(t *testing.T) {
 	ttl := 1 * time.Hour
 	receiptID := receipt.Receipt.ID
 
-	if err := storeReceipt(receipt, ttl); err != nil {
+	if err := storeReceipt(context.Background(), receipt, ttl); err != nil {
 		t.Fatalf("Failed to store receipt: %v", err)
 	}
 
@@ -409,13 +410,13 @@ func TestReceiptFullFlowIntegration(t *testing.T) {
 
 	// Step 6: Verify expiration behavior
 	// Store a receipt with very short TTL
-	shortTTLReceipt, err := GenerateReceipt(paymentCtx, payer, endpoint, requestBody, responseBody)
+	shortTTLReceipt, err := GenerateReceipt(paymentCtx, payer, endpoint, "", receiptVersionV1, requestBody, responseBody)
 	if err != nil {
 		t.Fatalf("Failed to generate short TTL receipt: %v", err)
 	}
 
 	shortTTL := 100 * time.Millisecond
-	if err := storeReceipt(shortTTLReceipt, shortTTL); err != nil {
+	if err := storeReceipt(context.Background(), shortTTLReceipt, shortTTL); err != nil {
 		t.Fatalf("Failed to store short TTL receipt: %v", err)
 	}
 
@@ -446,7 +447,7 @@ func TestReceiptFullFlowIntegration(t *testing.T) {
 	}
 
 	// Should fail validation
-	if err := storeReceipt(invalidReceipt, ttl); err == nil {
+	if err := storeReceipt(context.Background(), invalidReceipt, ttl); err == nil {
 		t.Error("Expected error when storing invalid receipt, got nil")
 	}
 
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+)
+
+// Receipt format versions. 1.0 signs the Keccak256 of the receipt JSON as
+// json.Marshal writes it; 2.0 signs the receipt as EIP-712 typed data, which
+// Solidity and wallets' eth_signTypedData can reproduce; 3.0 signs the
+// Keccak256 of the receipt's RFC 8785 canonical JSON, which does not depend
+// on struct field order.
+const (
+	receiptVersionV1 = "1.0"
+	receiptVersionV2 = "2.0"
+	receiptVersionV3 = "3.0"
+)
+
+// acceptReceiptVersionHeader lists the receipt versions a client accepts,
+// most preferred first, e.g. "2.0, 1.0"
+const acceptReceiptVersionHeader = "Accept-Receipt-Version"
+
+// EIP-712 domain and type of v2 receipts. The domain's chainId is the
+// receipt's payment chain. The struct is flat so a contract can rebuild it
+// without nested type hashes.
+const (
+	receiptDomainName    = "MicroAI Paygate Receipt"
+	receiptDomainVersion = "2"
+	receiptType          = "Receipt(string id,uint256 timestamp,address payer,address recipient,string amount,string token,uint256 chainId,string nonce,string funding,string endpoint,bytes32 requestHash,bytes32 responseHash,string model)"
+)
+
+var receiptTypeHash = crypto.Keccak256([]byte(receiptType))
+
+// normalizeReceiptVersion maps "1", "1.0", "2", "2.0", "3" and "3.0" to a
+// supported version, or returns "" for anything else
+func normalizeReceiptVersion(version string) string {
+	switch strings.TrimSpace(version) {
+	case "1", receiptVersionV1:
+		return receiptVersionV1
+	case "2", receiptVersionV2:
+		return receiptVersionV2
+	case "3", receiptVersionV3:
+		return receiptVersionV3
+	}
+	return ""
+}
+
+// getDefaultReceiptVersion returns the version issued to clients that send
+// no Accept-Receipt-Version (RECEIPT_VERSION, default 1.0)
+func getDefaultReceiptVersion() string {
+	if version := normalizeReceiptVersion(getEnv("RECEIPT_VERSION", receiptVersionV1)); version != "" {
+		return version
+	}
+	return receiptVersionV1
+}
+
+// getReceiptVerifyingContract returns the verifyingContract of the v2
+// receipt domain (RECEIPT_VERIFYING_CONTRACT, default the zero address)
+func getReceiptVerifyingContract() common.Address {
+	return common.HexToAddress(os.Getenv("RECEIPT_VERIFYING_CONTRACT"))
+}
+
+// validateReceiptConfig checks RECEIPT_VERSION and RECEIPT_VERIFYING_CONTRACT
+func validateReceiptConfig() error {
+	if version := os.Getenv("RECEIPT_VERSION"); version != "" && normalizeReceiptVersion(version) == "" {
+		return fmt.Errorf("RECEIPT_VERSION %q is not supported (use %s, %s or %s)", version, receiptVersionV1, receiptVersionV2, receiptVersionV3)
+	}
+	if contract := os.Getenv("RECEIPT_VERIFYING_CONTRACT"); contract != "" && !common.IsHexAddress(contract) {
+		return fmt.Errorf("RECEIPT_VERIFYING_CONTRACT %q is not an address", contract)
+	}
+	return nil
+}
+
+// negotiateReceiptVersion picks the receipt version for a request: the
+// first supported entry of Accept-Receipt-Version, or the default
+func negotiateReceiptVersion(c *gin.Context) string {
+	for _, accepted := range strings.Split(c.GetHeader(acceptReceiptVersionHeader), ",") {
+		if version := normalizeReceiptVersion(accepted); version != "" {
+			return version
+		}
+	}
+	return getDefaultReceiptVersion()
+}
+
+// receiptDomain describes the v2 EIP-712 domain for /.well-known/paygate-keys.
+// chainId is omitted: it is each receipt's payment chain.
+func receiptDomain() gin.H {
+	return gin.H{
+		"name":              receiptDomainName,
+		"version":           receiptDomainVersion,
+		"verifyingContract": getReceiptVerifyingContract().Hex(),
+	}
+}
+
+// receiptDigest returns the hash a receipt's signature covers, according to
+// its version
+func receiptDigest(receipt Receipt) ([]byte, error) {
+	switch receipt.Version {
+	case receiptVersionV1:
+		// Go's json.Marshal outputs struct fields in their declaration order
+		receiptBytes, err := json.Marshal(receipt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal receipt: %w", err)
+		}
+		return crypto.Keccak256(receiptBytes), nil
+	case receiptVersionV2:
+		return receiptTypedDataHash(receipt)
+	case receiptVersionV3:
+		receiptBytes, err := marshalCanonical(receipt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to canonicalize receipt: %w", err)
+		}
+		return crypto.Keccak256(receiptBytes), nil
+	}
+	return nil, fmt.Errorf("unsupported receipt version %q", receipt.Version)
+}
+
+// receiptTypedDataHash returns the EIP-712 digest of a v2 receipt,
+// keccak256("\x19\x01" || domainSeparator || hashStruct(Receipt))
+func receiptTypedDataHash(receipt Receipt) ([]byte, error) {
+	if err := validateTypedReceipt(receipt); err != nil {
+		return nil, err
+	}
+	requestHash, _ := decodeReceiptHash(receipt.Service.RequestHash)
+	responseHash, _ := decodeReceiptHash(receipt.Service.ResponseHash)
+	chainID := big.NewInt(int64(receipt.Payment.ChainID))
+
+	domainSeparator := eip712DomainSeparator(receiptDomainName, receiptDomainVersion, chainID, getReceiptVerifyingContract())
+	structHash := crypto.Keccak256(
+		receiptTypeHash,
+		crypto.Keccak256([]byte(receipt.ID)),
+		encodeUint256(big.NewInt(receipt.Timestamp.Unix())),
+		common.LeftPadBytes(common.HexToAddress(receipt.Payment.Payer).Bytes(), 32),
+		common.LeftPadBytes(common.HexToAddress(receipt.Payment.Recipient).Bytes(), 32),
+		crypto.Keccak256([]byte(receipt.Payment.Amount)),
+		crypto.Keccak256([]byte(receipt.Payment.Token)),
+		encodeUint256(chainID),
+		crypto.Keccak256([]byte(receipt.Payment.Nonce)),
+		crypto.Keccak256([]byte(receipt.Payment.Funding)),
+		crypto.Keccak256([]byte(receipt.Service.Endpoint)),
+		requestHash,
+		responseHash,
+		crypto.Keccak256([]byte(receipt.Service.Model)),
+	)
+	return crypto.Keccak256([]byte("\x19\x01"), domainSeparator, structHash), nil
+}
+
+// validateTypedReceipt checks the fields a v2 receipt encodes as EIP-712
+// addresses, integers and bytes32
+func validateTypedReceipt(receipt Receipt) error {
+	if !common.IsHexAddress(receipt.Payment.Payer) {
+		return fmt.Errorf("payer %q is not an address", receipt.Payment.Payer)
+	}
+	if !common.IsHexAddress(receipt.Payment.Recipient) {
+		return fmt.Errorf("recipient %q is not an address", receipt.Payment.Recipient)
+	}
+	if receipt.Payment.ChainID < 0 {
+		return fmt.Errorf("invalid chain ID %d", receipt.Payment.ChainID)
+	}
+	// The signed timestamp is in whole seconds; a fraction in the JSON
+	// would not match it
+	if receipt.Timestamp.Nanosecond() != 0 || receipt.Timestamp.Unix() < 0 {
+		return fmt.Errorf("timestamp must be whole seconds since the epoch")
+	}
+	if _, err := decodeReceiptHash(receipt.Service.RequestHash); err != nil {
+		return fmt.Errorf("request hash: %w", err)
+	}
+	if _, err := decodeReceiptHash(receipt.Service.ResponseHash); err != nil {
+		return fmt.Errorf("response hash: %w", err)
+	}
+	return nil
+}
+
+// decodeReceiptHash parses a "sha256:<hex>" hash into its 32 bytes
+func decodeReceiptHash(hash string) ([]byte, error) {
+	digest, err := hex.DecodeString(strings.TrimPrefix(hash, "sha256:"))
+	if err != nil || !strings.HasPrefix(hash, "sha256:") || len(digest) != 32 {
+		return nil, fmt.Errorf("%q is not a sha256 hash", hash)
+	}
+	return digest, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+)
+
+func testTypedReceipt() Receipt {
+	return Receipt{
+		ID:        "rcpt_a1b2c3d4e5f6",
+		Version:   receiptVersionV2,
+		Timestamp: time.Unix(1767695400, 0).UTC(),
+		Payment: PaymentDetails{
+			Payer:     testWallet,
+			Recipient: "0x2cAF48b4BA1C58721a85dFADa5aC01C2DFa62219",
+			Amount:    "0.001",
+			Token:     "USDC",
+			ChainID:   8453,
+			Nonce:     "9c311e31-0000-4000-8000-000000000000",
+			Funding:   fundingSignature,
+		},
+		Service: ServiceDetails{
+			Endpoint:     "/api/ai/summarize",
+			RequestHash:  hashData([]byte("req")),
+			ResponseHash: hashData([]byte("resp")),
+			Model:        "primary",
+		},
+	}
+}
+
+// useTestReceiptKey signs receipts with a fresh key for the test
+func useTestReceiptKey(t *testing.T) {
+	t.Helper()
+	t.Setenv("RECEIPT_KEY_TEST", newTestKeyHex(t))
+	useReceiptKeysConfig(t, `{"current":"test","keys":[{"kid":"test","privateKeyEnv":"RECEIPT_KEY_TEST"}]}`)
+}
+
+func TestReceiptTypedDataHash_MatchesABIEncoding(t *testing.T) {
+	contract := common.HexToAddress("0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC")
+	t.Setenv("RECEIPT_VERIFYING_CONTRACT", contract.Hex())
+	receipt := testTypedReceipt()
+	var requestHash, responseHash [32]byte
+	r, _ := decodeReceiptHash(receipt.Service.RequestHash)
+	copy(requestHash[:], r)
+	r, _ = decodeReceiptHash(receipt.Service.ResponseHash)
+	copy(responseHash[:], r)
+
+	// hashStruct is keccak256(typeHash || abi.encode(fields)), with dynamic
+	// fields replaced by their keccak256, as a contract would compute it
+	newType := func(name string) abi.Type {
+		typ, err := abi.NewType(name, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return typ
+	}
+	var args abi.Arguments
+	for _, name := range []string{"bytes32", "bytes32", "uint256", "address", "address", "bytes32", "bytes32", "uint256", "bytes32", "bytes32", "bytes32", "bytes32", "bytes32", "bytes32"} {
+		args = append(args, abi.Argument{Type: newType(name)})
+	}
+	keccak := func(s string) [32]byte { return crypto.Keccak256Hash([]byte(s)) }
+	encoded, err := args.Pack(
+		crypto.Keccak256Hash([]byte(receiptType)),
+		keccak(receipt.ID),
+		big.NewInt(receipt.Timestamp.Unix()),
+		common.HexToAddress(receipt.Payment.Payer),
+		common.HexToAddress(receipt.Payment.Recipient),
+		keccak(receipt.Payment.Amount),
+		keccak(receipt.Payment.Token),
+		big.NewInt(int64(receipt.Payment.ChainID)),
+		keccak(receipt.Payment.Nonce),
+		keccak(receipt.Payment.Funding),
+		keccak(receipt.Service.Endpoint),
+		requestHash,
+		responseHash,
+		keccak(receipt.Service.Model),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := eip712DomainSeparator(receiptDomainName, receiptDomainVersion, big.NewInt(8453), contract)
+	want := crypto.Keccak256([]byte("\x19\x01"), domain, crypto.Keccak256(encoded))
+
+	got, err := receiptTypedDataHash(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("typed data hash %x does not match the ABI encoding's %x", got, want)
+	}
+}
+
+func TestSignReceipt_V2(t *testing.T) {
+	useTestReceiptKey(t)
+	signed, err := signReceipt(testTypedReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateReceipt(signed); err != nil {
+		t.Errorf("expected a valid v2 receipt, got %v", err)
+	}
+
+	// Recoverable the way ecrecover does it, from v = 27/28
+	sig, _ := hex.DecodeString(strings.TrimPrefix(signed.Signature, "0x"))
+	if v := sig[crypto.RecoveryIDOffset]; v != 27 && v != 28 {
+		t.Fatalf("expected v to be 27 or 28, got %d", v)
+	}
+	sig[crypto.RecoveryIDOffset] -= 27
+	digest, _ := receiptTypedDataHash(signed.Receipt)
+	pub, err := crypto.SigToPub(digest, sig)
+	if err != nil || "0x"+hex.EncodeToString(crypto.FromECDSAPub(pub)) != signed.ServerPublicKey {
+		t.Errorf("expected the signature to recover the server key, got %v", err)
+	}
+	if err := verifyReceipt(signed); err != nil {
+		t.Errorf("expected the receipt to verify, got %v", err)
+	}
+
+	tampered := *signed
+	tampered.Receipt.Service.Model = "other"
+	if err := verifyReceipt(&tampered); err == nil {
+		t.Error("expected a tampered receipt to fail verification")
+	}
+
+	// The domain binds the receipt to its verifying contract
+	t.Setenv("RECEIPT_VERIFYING_CONTRACT", "0x1234567890123456789012345678901234567890")
+	if err := verifyReceipt(signed); err == nil {
+		t.Error("expected a receipt for another verifying contract to fail verification")
+	}
+}
+
+func TestValidateReceipt_Versions(t *testing.T) {
+	useTestReceiptKey(t)
+	tests := map[string]func(*Receipt){
+		"unsupported version": func(r *Receipt) { r.Version = "4.0" },
+		"payer not address":   func(r *Receipt) { r.Payment.Payer = "alice" },
+		"short request hash":  func(r *Receipt) { r.Service.RequestHash = "sha256:abc123" },
+		"fractional seconds":  func(r *Receipt) { r.Timestamp = r.Timestamp.Add(time.Millisecond) },
+	}
+	for name, mutate := range tests {
+		signed, err := signReceipt(testTypedReceipt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutate(&signed.Receipt)
+		if err := validateReceipt(signed); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// v1 receipts keep their looser format
+	v1 := testTypedReceipt()
+	v1.Version = receiptVersionV1
+	v1.Service.RequestHash = "sha256:abc123"
+	signed, err := signReceipt(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateReceipt(signed); err != nil {
+		t.Errorf("expected a v1 receipt to be valid, got %v", err)
+	}
+	if err := verifyReceipt(signed); err != nil {
+		t.Errorf("expected the v1 receipt to verify, got %v", err)
+	}
+}
+
+func TestNegotiateReceiptVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	negotiate := func(header string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/api/ai/summarize", nil)
+		if header != "" {
+			c.Request.Header.Set(acceptReceiptVersionHeader, header)
+		}
+		return negotiateReceiptVersion(c)
+	}
+	for header, want := range map[string]string{
+		"":         receiptVersionV1,
+		"2":        receiptVersionV2,
+		"2.0, 1.0": receiptVersionV2,
+		"4.0, 1":   receiptVersionV1,
+		"4.0":      receiptVersionV1,
+	} {
+		if got := negotiate(header); got != want {
+			t.Errorf("%q: expected %s, got %s", header, want, got)
+		}
+	}
+
+	t.Setenv("RECEIPT_VERSION", "2")
+	if got := negotiate(""); got != receiptVersionV2 {
+		t.Errorf("expected RECEIPT_VERSION to set the default, got %s", got)
+	}
+	if got := negotiate("1.0"); got != receiptVersionV1 {
+		t.Errorf("expected the header to override the default, got %s", got)
+	}
+}
+
+func TestGenerateAndSendReceipt_AcceptReceiptVersion(t *testing.T) {
+	useTestReceiptKey(t)
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/api/ai/summarize", nil)
+	c.Request.Header.Set(acceptReceiptVersionHeader, "2.0")
+
+	ctx := testPaymentContext()
+	if err := generateAndSendReceipt(c, ctx, strings.ToLower(testWallet), []byte(`{"text":"hi"}`), "summary", "primary"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(w.Header().Get("X-402-Receipt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receipt SignedReceipt
+	if err := json.Unmarshal(raw, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Receipt.Version != receiptVersionV2 || receipt.Receipt.Timestamp.Nanosecond() != 0 {
+		t.Errorf("expected a v2 receipt in whole seconds, got %+v", receipt.Receipt)
+	}
+	if receipt.Receipt.Service.ResponseHash != hashData(w.Body.Bytes()) {
+		t.Error("expected the receipt to hash the response body")
+	}
+	if err := verifyReceipt(&receipt); err != nil {
+		t.Errorf("expected the sent receipt to verify, got %v", err)
+	}
+}
@@ -13,7 +13,7 @@ import (
 var redisClient *redis.Client
 
 func initRedis() {
-	if !getCacheEnabled() {
+	if !getRedisRequired() {
 		return
 	}
 
@@ -32,7 +32,7 @@ func initRedis() {
 		opts, err = redis.ParseURL(redisURL)
 		if err != nil {
 			log.Printf("WARNING: Invalid REDIS_URL format: %v", err)
-			log.Println("Continuing with caching disabled. Set CACHE_ENABLED=false to suppress this warning.")
+			log.Println("Continuing without Redis (caching disabled, stores fall back to memory).")
 			redisClient = nil
 			return
 		}
@@ -51,8 +51,8 @@ func initRedis() {
 	defer cancel()
 
 	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Printf("WARNING: Redis connection failed when CACHE_ENABLED=true: %v", err)
-		log.Println("Continuing with caching disabled. Set CACHE_ENABLED=false to suppress this warning.")
+		log.Printf("WARNING: Redis connection failed: %v", err)
+		log.Println("Continuing without Redis (caching disabled, stores fall back to memory).")
 		redisClient.Close()
 		redisClient = nil
 		return
@@ -65,6 +65,14 @@ func getCacheEnabled() bool {
 	return enabled == "true" || enabled == "1"
 }
 
+// getRedisRequired reports whether any component is configured to use Redis
+func getRedisRequired() bool {
+	return (getCacheEnabled() && getCacheBackend() != "memory") || getReceiptStoreBackend() == "redis" || getRefundStoreBackend() == "redis" ||
+		getNonceStoreBackend() == "redis" ||
+		(getRateLimitEnabled() && (getRateLimitBackend() == "redis" || getWalletTiersStore() == "redis")) ||
+		(getLedgerEnabled() && getLedgerBackend() == "redis")
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
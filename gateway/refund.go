@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrRefundTooSmall is returned when a refund credit is spent on a request
+// that costs more than the refunded amount
+var ErrRefundTooSmall = errors.New("E016: refund credit does not cover this request")
+
+// refundIDHeader spends a refund credit on a paid route instead of a signature
+const refundIDHeader = "X-402-Refund-ID"
+
+// refundRecordHeader carries the base64 signed failed-service record on
+// failed responses, like X-402-Receipt on successful ones
+const refundRecordHeader = "X-402-Refund"
+
+// FailedService records that a paid request was not served. It is signed
+// like a receipt so the client can prove the payment was refundable.
+type FailedService struct {
+	ID        string         `json:"id"`
+	Version   string         `json:"version"`
+	Timestamp time.Time      `json:"timestamp"`
+	Payment   PaymentDetails `json:"payment"`
+	Failure   FailureDetails `json:"failure"`
+	// Refund is "refundable" or, for prepaid requests, "reversed"
+	Refund string `json:"refund"`
+}
+
+// FailureDetails describes the failed service call
+type FailureDetails struct {
+	Endpoint    string `json:"endpoint"`
+	RequestHash string `json:"request_hash"`
+	Status      int    `json:"status"`
+	Reason      string `json:"reason"`
+}
+
+// SignedFailedService contains the record and its signature
+type SignedFailedService struct {
+	Record          FailedService `json:"record"`
+	Signature       string        `json:"signature"`
+	ServerPublicKey string        `json:"server_public_key"`
+	// KeyID names the signing key in /.well-known/paygate-keys
+	KeyID string `json:"kid,omitempty"`
+}
+
+// generateRefundID returns a random "rfnd_" ID. Knowing the ID is enough to
+// spend the credit, so it is longer than a receipt ID.
+func generateRefundID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random refund ID: %w", err)
+	}
+	return "rfnd_" + hex.EncodeToString(b), nil
+}
+
+// GenerateFailedService creates and signs a failed-service record
+func GenerateFailedService(payment PaymentContext, payer, endpoint string, reqBody []byte, status int, reason, refund string) (*SignedFailedService, error) {
+	id, err := generateRefundID()
+	if err != nil {
+		return nil, err
+	}
+	funding := payment.Funding
+	if funding == "" {
+		funding = fundingSignature
+	}
+
+	record := FailedService{
+		ID:        id,
+		Version:   "1.0",
+		Timestamp: time.Now().UTC(),
+		Payment: PaymentDetails{
+			Payer:     payer,
+			Recipient: payment.Recipient,
+			Amount:    payment.Amount,
+			Token:     payment.Token,
+			ChainID:   payment.ChainID,
+			Nonce:     payment.Nonce,
+			Funding:   funding,
+		},
+		Failure: FailureDetails{
+			Endpoint:    endpoint,
+			RequestHash: hashData(reqBody),
+			Status:      status,
+			Reason:      reason,
+		},
+		Refund: refund,
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal failed-service record: %w", err)
+	}
+	signature, publicKey, kid, err := signPayload(data)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedFailedService{Record: record, Signature: signature, ServerPublicKey: publicKey, KeyID: kid}, nil
+}
+
+// pendingServiceKey is the gin context key of the request's *pendingService
+const pendingServiceKey = "pending_service"
+
+// pendingService tracks a paid request until it is either served or recorded
+// as failed. The handler and the timeout middleware can both notice a
+// failure; the once makes sure only one of them records it.
+type pendingService struct {
+	once       sync.Once
+	paymentCtx PaymentContext
+	payer      string
+	endpoint   string
+	body       []byte
+	refund     *RefundEntry
+}
+
+// trackPaidService marks the request as paid from here on
+func trackPaidService(c *gin.Context, paymentCtx PaymentContext, payer string, body []byte) {
+	c.Set(pendingServiceKey, &pendingService{
+		paymentCtx: paymentCtx,
+		payer:      payer,
+		endpoint:   c.Request.URL.Path,
+		body:       body,
+	})
+}
+
+// markServiceDelivered records that the paid request was served, so a later
+// timeout no longer produces a refund
+func markServiceDelivered(c *gin.Context) {
+	if p, ok := c.Get(pendingServiceKey); ok {
+		p.(*pendingService).once.Do(func() {})
+	}
+}
+
+// failPaidService records that the paid request failed with status and
+// returns the resulting refund entry, or nil if the request was not paid,
+// was already served, or the record could not be stored. A prepaid debit is
+// credited back immediately; any other payment becomes a refund credit.
+func failPaidService(c *gin.Context, status int, reason string) *RefundEntry {
+	v, ok := c.Get(pendingServiceKey)
+	if !ok {
+		return nil
+	}
+	return v.(*pendingService).fail(c.Request.Context(), status, reason)
+}
+
+// fail is failPaidService for callers that hold the pendingService and the
+// request context, such as the timeout middleware, which must not read c
+// while the handler is still running
+func (p *pendingService) fail(ctx context.Context, status int, reason string) *RefundEntry {
+	p.once.Do(func() {
+		// The request context is usually what failed; recording must not
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), receiptStoreTimeout)
+		defer cancel()
+		p.refund = recordFailedService(ctx, p, status, reason)
+	})
+	return p.refund
+}
+
+func recordFailedService(ctx context.Context, p *pendingService, status int, reason string) *RefundEntry {
+	refund := refundStatusRefundable
+	if p.paymentCtx.Funding == fundingPrepaid && ledger != nil {
+		if units, err := parseLedgerAmount(p.paymentCtx.Amount); err == nil {
+			if _, err := ledger.Credit(ctx, p.payer, units); err == nil {
+				refund = refundStatusReversed
+			} else {
+				log.Printf("Failed to reverse prepaid debit of %s for %s, issuing a refund credit: %v", p.paymentCtx.Amount, p.payer, err)
+			}
+		}
+	}
+
+	record, err := GenerateFailedService(p.paymentCtx, p.payer, p.endpoint, p.body, status, reason, refund)
+	if err != nil {
+		log.Printf("CRITICAL: failed to sign failed-service record for nonce %s: %v", p.paymentCtx.Nonce, err)
+		return nil
+	}
+	entry := &RefundEntry{Record: record, Status: refund}
+	if err := refundStore.Put(ctx, entry, getRefundTTL()); err != nil {
+		log.Printf("CRITICAL: failed to store failed-service record %s for nonce %s: %v", record.Record.ID, p.paymentCtx.Nonce, err)
+		return nil
+	}
+	failedServicesTotal.WithLabelValues(refund).Inc()
+	log.Printf("Recorded failed service %s for nonce %s (%s)", record.Record.ID, p.paymentCtx.Nonce, refund)
+	return entry
+}
+
+// refundSummary is the "refund" field of failed responses
+func refundSummary(entry *RefundEntry) gin.H {
+	return gin.H{
+		"id":     entry.Record.Record.ID,
+		"status": entry.Status,
+		"amount": entry.Record.Record.Payment.Amount,
+	}
+}
+
+// setRefundHeader attaches the signed record to a failed response
+func setRefundHeader(header interface{ Set(string, string) }, entry *RefundEntry) {
+	data, err := json.Marshal(entry.Record)
+	if err != nil {
+		log.Printf("Failed to encode failed-service record: %v", err)
+		return
+	}
+	header.Set(refundRecordHeader, base64.StdEncoding.EncodeToString(data))
+}
+
+// respondServiceFailure sends a failed paid request's error response,
+// recording the failure and attaching the refund to the response
+func respondServiceFailure(c *gin.Context, status int, body gin.H, reason string) {
+	if entry := failPaidService(c, status, reason); entry != nil {
+		setRefundHeader(c.Writer.Header(), entry)
+		body["refund"] = refundSummary(entry)
+	}
+	c.JSON(status, body)
+}
+
+// refundRequested reports whether the request spends a refund credit
+func refundRequested(c *gin.Context) bool {
+	return c.GetHeader(refundIDHeader) != ""
+}
+
+// spendRefund pays for the request with the refund credit named in the
+// X-402-Refund-ID header. The credit is used up even if the request costs
+// less; claim it to a balance to keep the exact amount. On failure it has
+// already sent the response and returns false.
+func spendRefund(c *gin.Context, route *PaidRoute, requestBody []byte) (*PaymentContext, string, bool) {
+	id := c.GetHeader(refundIDHeader)
+	entry, ok, err := refundStore.Get(c.Request.Context(), id)
+	if err != nil {
+		log.Printf("Refund lookup failed for %s: %v", id, err)
+		c.JSON(500, gin.H{"error": "Refund store unavailable", "message": "An internal error occurred"})
+		return nil, "", false
+	}
+	if !ok || entry.Status != refundStatusRefundable {
+		c.JSON(403, gin.H{"error": "Invalid refund", "details": ErrRefundUnavailable.Error()})
+		return nil, "", false
+	}
+	payer := entry.Record.Record.Payment.Payer
+
+	paymentCtx, units, ok := priceUnsignedRequest(c, route, requestBody, "refund_"+id)
+	if !ok {
+		return nil, "", false
+	}
+	refunded, err := parseLedgerAmount(entry.Record.Record.Payment.Amount)
+	if err != nil || refunded < units {
+		c.JSON(402, gin.H{
+			"error":   "Payment Required",
+			"details": ErrRefundTooSmall.Error(),
+			"refund":  refundSummary(entry),
+			"amount":  paymentCtx.Amount,
+		})
+		return nil, "", false
+	}
+	paymentCtx.Funding = fundingRefund
+
+	if !checkWalletRateLimit(c, payer) {
+		return nil, "", false
+	}
+	if _, err := refundStore.Claim(c.Request.Context(), id); err != nil {
+		if errors.Is(err, ErrRefundUnavailable) {
+			c.JSON(403, gin.H{"error": "Invalid refund", "details": err.Error()})
+		} else {
+			log.Printf("Refund claim failed for %s: %v", id, err)
+			c.JSON(500, gin.H{"error": "Refund store unavailable", "message": "An internal error occurred"})
+		}
+		return nil, "", false
+	}
+	return paymentCtx, payer, true
+}
+
+// handleGetRefund handles GET /api/refunds/:id
+func handleGetRefund(c *gin.Context) {
+	entry, ok, err := refundStore.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		log.Printf("Refund lookup failed: %v", err)
+		c.JSON(500, gin.H{"error": "Refund store unavailable", "message": "An internal error occurred"})
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": "Refund not found"})
+		return
+	}
+	c.JSON(200, entry)
+}
+
+// handleListRefunds handles GET /api/refunds, listing the failed-service
+// records of the wallet owning the balance token
+func handleListRefunds(c *gin.Context) {
+	wallet, ok := authenticateBalanceToken(c)
+	if !ok {
+		return
+	}
+	entries, err := refundStore.List(c.Request.Context(), wallet)
+	if err != nil {
+		log.Printf("Refund listing failed for %s: %v", wallet, err)
+		c.JSON(500, gin.H{"error": "Refund store unavailable", "message": "An internal error occurred"})
+		return
+	}
+	if entries == nil {
+		entries = []*RefundEntry{}
+	}
+	c.JSON(200, gin.H{"wallet": wallet, "refunds": entries})
+}
+
+// handleClaimRefund handles POST /api/refunds/:id/claim, crediting the
+// refunded amount to the original payer's prepaid balance. The credit goes
+// to the payer whoever claims it, so the refund ID alone is enough.
+func handleClaimRefund(c *gin.Context) {
+	entry, err := refundStore.Claim(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, ErrRefundUnavailable) {
+		c.JSON(409, gin.H{"error": "Refund not claimable", "details": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Refund claim failed: %v", err)
+		c.JSON(500, gin.H{"error": "Refund store unavailable", "message": "An internal error occurred"})
+		return
+	}
+
+	payment := entry.Record.Record.Payment
+	wallet := strings.ToLower(payment.Payer)
+	units, err := parseLedgerAmount(payment.Amount)
+	if err == nil {
+		var balance int64
+		balance, err = ledger.Credit(context.WithoutCancel(c.Request.Context()), wallet, units)
+		if err == nil {
+			c.JSON(200, gin.H{"refund": refundSummary(entry), "wallet": wallet, "balance": formatLedgerAmount(balance)})
+			return
+		}
+	}
+	// Give the credit back so the payer can claim it again
+	if unclaimErr := refundStore.Unclaim(context.WithoutCancel(c.Request.Context()), entry.Record.Record.ID); unclaimErr != nil {
+		log.Printf("CRITICAL: refund %s claimed but %s was not credited to %s: %v (restoring it failed: %v)", entry.Record.Record.ID, payment.Amount, wallet, err, unclaimErr)
+		c.JSON(500, gin.H{"error": "Failed to credit balance", "message": "An internal error occurred"})
+		return
+	}
+	log.Printf("Refund %s not credited to %s, restored to refundable: %v", entry.Record.Record.ID, wallet, err)
+	if errors.Is(err, ErrBalanceOverflow) {
+		c.JSON(409, gin.H{"error": "Balance limit exceeded", "details": err.Error()})
+		return
+	}
+	c.JSON(500, gin.H{"error": "Failed to credit balance", "message": "The refund is still claimable"})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrRefundUnavailable is returned when a refund credit does not exist, has
+// expired or was already claimed
+var ErrRefundUnavailable = errors.New("E015: refund credit is unknown or already used")
+
+// Refund credit states
+const (
+	refundStatusRefundable = "refundable"
+	refundStatusClaimed    = "claimed"
+	refundStatusReversed   = "reversed" // Prepaid debit was credited back automatically
+)
+
+// RefundEntry is a signed failed-service record plus its claim state
+type RefundEntry struct {
+	Record    *SignedFailedService `json:"record"`
+	Status    string               `json:"status"`
+	ClaimedAt *time.Time           `json:"claimed_at,omitempty"`
+}
+
+// RefundStore is the refund ledger: failed-service records indexed by ID and
+// by payer wallet. Claim must be atomic so a credit is only ever used once.
+type RefundStore interface {
+	// Put stores an entry that expires after ttl
+	Put(ctx context.Context, entry *RefundEntry, ttl time.Duration) error
+	// Get returns the entry with the given ID. The bool is false if it does
+	// not exist or has expired.
+	Get(ctx context.Context, id string) (*RefundEntry, bool, error)
+	// List returns the wallet's unexpired entries, newest first
+	List(ctx context.Context, wallet string) ([]*RefundEntry, error)
+	// Claim moves a refundable entry to claimed and returns it, or returns
+	// ErrRefundUnavailable
+	Claim(ctx context.Context, id string) (*RefundEntry, error)
+	// Unclaim moves a claimed entry back to refundable, undoing a Claim
+	// whose credit could not be applied, or returns ErrRefundUnavailable
+	Unclaim(ctx context.Context, id string) error
+}
+
+// refundStore is the process-wide refund ledger, replaced by initRefundStore
+var refundStore RefundStore = NewMemoryRefundStore()
+
+// getRefundStoreBackend returns REFUND_STORE: "memory" (default) or "redis"
+func getRefundStoreBackend() string {
+	return strings.ToLower(getEnv("REFUND_STORE", "memory"))
+}
+
+// getRefundTTL returns how long a refund credit can be claimed (default 30 days)
+func getRefundTTL() time.Duration {
+	return time.Duration(getEnvAsInt("REFUND_TTL_SECONDS", 30*24*3600)) * time.Second
+}
+
+// initRefundStore selects the refund backend from REFUND_STORE. Redis being
+// unavailable is an error: a memory store would drop credits on restart.
+func initRefundStore() error {
+	switch backend := getRefundStoreBackend(); backend {
+	case "memory", "":
+		refundStore = NewMemoryRefundStore()
+	case "redis":
+		if redisClient == nil {
+			return fmt.Errorf("REFUND_STORE=redis but Redis is unavailable")
+		}
+		refundStore = NewRedisRefundStore(redisClient)
+	default:
+		return fmt.Errorf("unknown REFUND_STORE %q (expected memory or redis)", backend)
+	}
+	log.Printf("Refund store: %s", getRefundStoreBackend())
+	return nil
+}
+
+func sortRefundsNewestFirst(entries []*RefundEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Record.Record.Timestamp.After(entries[j].Record.Record.Timestamp)
+	})
+}
+
+type refundMemoryEntry struct {
+	entry     RefundEntry
+	expiresAt time.Time
+}
+
+// MemoryRefundStore keeps refund credits in a process-local map.
+// Credits are lost on restart and not shared across replicas.
+type MemoryRefundStore struct {
+	mu       sync.Mutex
+	entries  map[string]*refundMemoryEntry
+	byWallet map[string][]string
+}
+
+// NewMemoryRefundStore creates an empty in-memory refund store
+func NewMemoryRefundStore() *MemoryRefundStore {
+	return &MemoryRefundStore{
+		entries:  make(map[string]*refundMemoryEntry),
+		byWallet: make(map[string][]string),
+	}
+}
+
+func (s *MemoryRefundStore) Put(ctx context.Context, entry *RefundEntry, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweepLocked(time.Now())
+	id := entry.Record.Record.ID
+	wallet := strings.ToLower(entry.Record.Record.Payment.Payer)
+	if _, exists := s.entries[id]; !exists {
+		s.byWallet[wallet] = append(s.byWallet[wallet], id)
+	}
+	s.entries[id] = &refundMemoryEntry{entry: *entry, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryRefundStore) Get(ctx context.Context, id string) (*RefundEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || time.Now().After(e.expiresAt) {
+		return nil, false, nil
+	}
+	entry := e.entry
+	return &entry, true, nil
+}
+
+func (s *MemoryRefundStore) List(ctx context.Context, wallet string) ([]*RefundEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var entries []*RefundEntry
+	for _, id := range s.byWallet[strings.ToLower(wallet)] {
+		if e, ok := s.entries[id]; ok && !now.After(e.expiresAt) {
+			entry := e.entry
+			entries = append(entries, &entry)
+		}
+	}
+	sortRefundsNewestFirst(entries)
+	return entries, nil
+}
+
+func (s *MemoryRefundStore) Claim(ctx context.Context, id string) (*RefundEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.entries[id]
+	if !ok || now.After(e.expiresAt) || e.entry.Status != refundStatusRefundable {
+		return nil, ErrRefundUnavailable
+	}
+	e.entry.Status = refundStatusClaimed
+	e.entry.ClaimedAt = &now
+	entry := e.entry
+	return &entry, nil
+}
+
+func (s *MemoryRefundStore) Unclaim(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || time.Now().After(e.expiresAt) || e.entry.Status != refundStatusClaimed {
+		return ErrRefundUnavailable
+	}
+	e.entry.Status = refundStatusRefundable
+	e.entry.ClaimedAt = nil
+	return nil
+}
+
+// sweepLocked drops expired entries. Failures are rare, so sweeping on each
+// Put keeps the map bounded without a cleanup goroutine.
+func (s *MemoryRefundStore) sweepLocked(now time.Time) {
+	for id, e := range s.entries {
+		if now.After(e.expiresAt) {
+			delete(s.entries, id)
+		}
+	}
+	for wallet, ids := range s.byWallet {
+		kept := ids[:0]
+		for _, id := range ids {
+			if _, ok := s.entries[id]; ok {
+				kept = append(kept, id)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.byWallet, wallet)
+		} else {
+			s.byWallet[wallet] = kept
+		}
+	}
+}
+
+// claimRefundScript marks a refundable entry claimed and returns its record,
+// or returns false. ARGV[1] is the claim time in RFC 3339.
+var claimRefundScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'status') ~= 'refundable' then
+	return false
+end
+redis.call('HSET', KEYS[1], 'status', 'claimed', 'claimed_at', ARGV[1])
+return redis.call('HGET', KEYS[1], 'record')
+`)
+
+// unclaimRefundScript moves a claimed entry back to refundable and returns
+// 1, or returns 0 if the entry is not claimed
+var unclaimRefundScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'status') ~= 'claimed' then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', 'refundable')
+redis.call('HDEL', KEYS[1], 'claimed_at')
+return 1
+`)
+
+// RedisRefundStore keeps each credit in a hash {record, status, claimed_at}
+// with a per-wallet set of IDs, both expiring natively.
+type RedisRefundStore struct {
+	client *redis.Client
+}
+
+// NewRedisRefundStore creates a refund store backed by the given Redis client
+func NewRedisRefundStore(client *redis.Client) *RedisRefundStore {
+	return &RedisRefundStore{client: client}
+}
+
+func refundKey(id string) string {
+	return "x402:refund:" + id
+}
+
+func walletRefundsKey(wallet string) string {
+	return "x402:refunds:" + strings.ToLower(wallet)
+}
+
+func (s *RedisRefundStore) Put(ctx context.Context, entry *RefundEntry, ttl time.Duration) error {
+	record, err := json.Marshal(entry.Record)
+	if err != nil {
+		return fmt.Errorf("marshal refund record: %w", err)
+	}
+	id := entry.Record.Record.ID
+	walletKey := walletRefundsKey(entry.Record.Record.Payment.Payer)
+
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, refundKey(id), "record", record, "status", entry.Status)
+	pipe.Expire(ctx, refundKey(id), ttl)
+	pipe.SAdd(ctx, walletKey, id)
+	pipe.Expire(ctx, walletKey, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("store refund: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisRefundStore) Get(ctx context.Context, id string) (*RefundEntry, bool, error) {
+	fields, err := s.client.HGetAll(ctx, refundKey(id)).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("load refund: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, false, nil
+	}
+	entry, err := decodeRedisRefund(fields)
+	if err != nil {
+		return nil, false, err
+	}
+	return entry, true, nil
+}
+
+func (s *RedisRefundStore) List(ctx context.Context, wallet string) ([]*RefundEntry, error) {
+	ids, err := s.client.SMembers(ctx, walletRefundsKey(wallet)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+	var entries []*RefundEntry
+	for _, id := range ids {
+		entry, ok, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Expired: drop it from the wallet index
+			s.client.SRem(ctx, walletRefundsKey(wallet), id)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sortRefundsNewestFirst(entries)
+	return entries, nil
+}
+
+func (s *RedisRefundStore) Claim(ctx context.Context, id string) (*RefundEntry, error) {
+	claimedAt := time.Now().UTC()
+	record, err := claimRefundScript.Run(ctx, s.client, []string{refundKey(id)}, claimedAt.Format(time.RFC3339Nano)).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrRefundUnavailable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim refund: %w", err)
+	}
+	entry, err := decodeRedisRefund(map[string]string{"record": record, "status": refundStatusClaimed})
+	if err != nil {
+		return nil, err
+	}
+	entry.ClaimedAt = &claimedAt
+	return entry, nil
+}
+
+func (s *RedisRefundStore) Unclaim(ctx context.Context, id string) error {
+	restored, err := unclaimRefundScript.Run(ctx, s.client, []string{refundKey(id)}).Int()
+	if err != nil {
+		return fmt.Errorf("unclaim refund: %w", err)
+	}
+	if restored == 0 {
+		return ErrRefundUnavailable
+	}
+	return nil
+}
+
+func decodeRedisRefund(fields map[string]string) (*RefundEntry, error) {
+	var record SignedFailedService
+	if err := json.Unmarshal([]byte(fields["record"]), &record); err != nil {
+		return nil, fmt.Errorf("decode refund record: %w", err)
+	}
+	entry := &RefundEntry{Record: &record, Status: fields["status"]}
+	if ts, err := time.Parse(time.RFC3339Nano, fields["claimed_at"]); err == nil {
+		entry.ClaimedAt = &ts
+	}
+	return entry, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRefundEntry(id, payer string, at time.Time) *RefundEntry {
+	return &RefundEntry{
+		Record: &SignedFailedService{Record: FailedService{
+			ID:        id,
+			Timestamp: at,
+			Payment:   PaymentDetails{Payer: payer, Amount: "0.001"},
+		}},
+		Status: refundStatusRefundable,
+	}
+}
+
+// testRefundStore runs the behavior every RefundStore backend must share
+func testRefundStore(t *testing.T, store RefundStore, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	wallet := "0x" + prefix
+	older := newTestRefundEntry("rfnd_"+prefix+"a", wallet, time.Now().Add(-time.Minute))
+	newer := newTestRefundEntry("rfnd_"+prefix+"b", wallet, time.Now())
+	for _, entry := range []*RefundEntry{older, newer} {
+		if err := store.Put(ctx, entry, time.Minute); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	entries, err := store.List(ctx, wallet)
+	if err != nil || len(entries) != 2 || entries[0].Record.Record.ID != newer.Record.Record.ID {
+		t.Fatalf("expected both entries newest first, got %d entries, %v", len(entries), err)
+	}
+
+	// Concurrent claims: exactly one wins
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Claim(ctx, older.Record.Record.ID); err == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrRefundUnavailable) {
+				t.Errorf("unexpected claim error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("expected exactly one claim to succeed, got %d", won)
+	}
+
+	entry, ok, err := store.Get(ctx, older.Record.Record.ID)
+	if err != nil || !ok || entry.Status != refundStatusClaimed || entry.ClaimedAt == nil {
+		t.Errorf("expected the entry to be marked claimed, got %+v, %v, %v", entry, ok, err)
+	}
+	if _, err := store.Claim(ctx, "rfnd_missing"); !errors.Is(err, ErrRefundUnavailable) {
+		t.Errorf("expected ErrRefundUnavailable for an unknown ID, got %v", err)
+	}
+
+	// Unclaim makes a claimed entry refundable again, and only a claimed one
+	if err := store.Unclaim(ctx, older.Record.Record.ID); err != nil {
+		t.Fatalf("Unclaim failed: %v", err)
+	}
+	entry, _, _ = store.Get(ctx, older.Record.Record.ID)
+	if entry.Status != refundStatusRefundable || entry.ClaimedAt != nil {
+		t.Errorf("expected the entry to be refundable again, got %+v", entry)
+	}
+	if err := store.Unclaim(ctx, older.Record.Record.ID); !errors.Is(err, ErrRefundUnavailable) {
+		t.Errorf("expected ErrRefundUnavailable for an unclaimed entry, got %v", err)
+	}
+	if _, err := store.Claim(ctx, older.Record.Record.ID); err != nil {
+		t.Errorf("expected the restored entry to be claimable, got %v", err)
+	}
+}
+
+func TestMemoryRefundStore(t *testing.T) {
+	testRefundStore(t, NewMemoryRefundStore(), "mem")
+
+	store := NewMemoryRefundStore()
+	store.Put(context.Background(), newTestRefundEntry("rfnd_expired", "0xabc", time.Now()), -time.Second)
+	if _, ok, _ := store.Get(context.Background(), "rfnd_expired"); ok {
+		t.Error("expected an expired entry to be hidden")
+	}
+	if _, err := store.Claim(context.Background(), "rfnd_expired"); !errors.Is(err, ErrRefundUnavailable) {
+		t.Error("expected an expired entry not to be claimable")
+	}
+}
+
+func TestRedisRefundStore(t *testing.T) {
+	client := newTestRedisClient(t)
+	prefix := strconv.FormatInt(time.Now().UnixNano(), 16)
+	t.Cleanup(func() {
+		client.Del(context.Background(), refundKey("rfnd_"+prefix+"a"), refundKey("rfnd_"+prefix+"b"), walletRefundsKey("0x"+prefix))
+	})
+	testRefundStore(t, NewRedisRefundStore(client), prefix)
+}
+
+func TestInitRefundStore_RedisRequired(t *testing.T) {
+	orig, origClient := refundStore, redisClient
+	redisClient = nil
+	defer func() { refundStore, redisClient = orig, origClient }()
+
+	t.Setenv("REFUND_STORE", "redis")
+	if !getRedisRequired() {
+		t.Error("expected REFUND_STORE=redis to require Redis")
+	}
+	if err := initRefundStore(); err == nil {
+		t.Error("expected a startup error when the Redis refund store is unavailable")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failing answers with a non-retryable 400 on the first call and succeeds afterwards
+func failing(content string) func(http.ResponseWriter, int) {
+	return func(w http.ResponseWriter, call int) {
+		if call == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reply(content)(w, call)
+	}
+}
+
+func useRefundTestEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	refundStore = NewMemoryRefundStore()
+	t.Cleanup(func() { refundStore = NewMemoryRefundStore() })
+}
+
+type failureResponse struct {
+	Refund struct {
+		ID, Status, Amount string
+	}
+}
+
+func TestRefund_SignedPaymentFailureIsRefundable(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": failing("summary")})
+	useRefundTestEnv(t)
+	r := newBalanceRouter(t)
+	r.GET("/api/refunds/:id", handleGetRefund)
+
+	before := testutil.ToFloat64(failedServicesTotal.WithLabelValues(refundStatusRefundable))
+	w := paidRequest(t, r, `{"text":"hello"}`)
+	if w.Code != 500 {
+		t.Fatalf("expected 500 from the failed AI call, got %d body=%s", w.Code, w.Body.String())
+	}
+	var resp failureResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Refund.Status != refundStatusRefundable || resp.Refund.Amount != "0.001" {
+		t.Fatalf("expected a refundable credit for 0.001, got %+v", resp.Refund)
+	}
+	if got := testutil.ToFloat64(failedServicesTotal.WithLabelValues(refundStatusRefundable)); got != before+1 {
+		t.Errorf("expected the failure to be counted, got %v -> %v", before, got)
+	}
+
+	// The record in the header is signed like a receipt
+	recordJSON, _ := base64.StdEncoding.DecodeString(w.Header().Get(refundRecordHeader))
+	var signed SignedFailedService
+	if err := json.Unmarshal(recordJSON, &signed); err != nil || signed.Record.ID != resp.Refund.ID {
+		t.Fatalf("expected the signed record in %s, got %s (%v)", refundRecordHeader, recordJSON, err)
+	}
+	payload, _ := json.Marshal(signed.Record)
+	sig := hexutil.MustDecode(signed.Signature)
+	pub, err := crypto.Ecrecover(crypto.Keccak256(payload), sig)
+	if err != nil || hexutil.Encode(pub) != signed.ServerPublicKey {
+		t.Errorf("failed-service signature does not verify: %v", err)
+	}
+	if signed.Record.Payment.Payer != testWallet || signed.Record.Failure.Status != 500 {
+		t.Errorf("unexpected record contents: %+v", signed.Record)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/refunds/"+resp.Refund.ID, nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"status":"refundable"`) {
+		t.Errorf("expected the refund to be retrievable, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// The credit pays for the next request once
+	spend := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"hello"}`))
+		req.Header.Set(refundIDHeader, resp.Refund.ID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w = spend()
+	if w.Code != 200 {
+		t.Fatalf("expected the refund credit to pay for the retry, got %d body=%s", w.Code, w.Body.String())
+	}
+	receiptJSON, _ := base64.StdEncoding.DecodeString(w.Header().Get("X-402-Receipt"))
+	var receipt SignedReceipt
+	json.Unmarshal(receiptJSON, &receipt)
+	if p := receipt.Receipt.Payment; p.Funding != fundingRefund || p.Payer != testWallet {
+		t.Errorf("expected a refund-funded receipt for the original payer, got %+v", p)
+	}
+	if w := spend(); w.Code != 403 || !strings.Contains(w.Body.String(), "E015") {
+		t.Errorf("expected a spent credit to be rejected with E015, got %d body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestRefund_PrepaidFailureIsReversed(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": failing("summary")})
+	useRefundTestEnv(t)
+	r := newBalanceRouter(t)
+	token := topUp(t, r, "0.01")
+
+	w := prepaidRequest(r, token, `{"text":"hello"}`)
+	var resp failureResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 500 || resp.Refund.Status != refundStatusReversed {
+		t.Fatalf("expected 500 with a reversed debit, got %d body=%s", w.Code, w.Body.String())
+	}
+	if balance, _ := ledger.Balance(context.Background(), testWallet); balance != 10_000 {
+		t.Errorf("expected the debit to be credited back to 0.01, got %s", formatLedgerAmount(balance))
+	}
+	if _, err := refundStore.Claim(context.Background(), resp.Refund.ID); err == nil {
+		t.Error("a reversed debit must not also be claimable")
+	}
+}
+
+func TestRefund_TimeoutMiddlewareRecordsFailure(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){
+		"primary": func(w http.ResponseWriter, call int) {
+			time.Sleep(500 * time.Millisecond)
+			reply("late")(w, call)
+		},
+	})
+	useRefundTestEnv(t)
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	defer verifier.Close()
+	t.Setenv("VERIFIER_URL", verifier.URL)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", RequestTimeoutMiddleware(200*time.Millisecond), handleSummarize)
+
+	w := paidRequest(t, r, `{"text":"hello"}`)
+	if w.Code != 504 {
+		t.Fatalf("expected 504, got %d body=%s", w.Code, w.Body.String())
+	}
+	var resp failureResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Refund.Status != refundStatusRefundable || w.Header().Get(refundRecordHeader) == "" {
+		t.Fatalf("expected the timeout response to carry the refund, got body=%s", w.Body.String())
+	}
+
+	// The handler notices the failure too once the AI call returns; it must
+	// not record a second credit
+	time.Sleep(400 * time.Millisecond)
+	if entries, _ := refundStore.List(context.Background(), testWallet); len(entries) != 1 {
+		t.Errorf("expected exactly one failed-service record, got %d", len(entries))
+	}
+}
+
+func TestRefund_ClaimToBalance(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": failing("summary")})
+	useRefundTestEnv(t)
+	r := newBalanceRouter(t)
+	r.GET("/api/refunds", handleListRefunds)
+	r.POST("/api/refunds/:id/claim", handleClaimRefund)
+	token := topUp(t, r, "1")
+
+	w := paidRequest(t, r, `{"text":"hello"}`)
+	var resp failureResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	req := httptest.NewRequest("GET", "/api/refunds", nil)
+	req.Header.Set(balanceTokenHeader, token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), resp.Refund.ID) {
+		t.Fatalf("expected the wallet's refunds to be listed, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	for _, want := range []int{200, 409} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/refunds/"+resp.Refund.ID+"/claim", nil))
+		if w.Code != want {
+			t.Fatalf("expected claim to return %d, got %d body=%s", want, w.Code, w.Body.String())
+		}
+	}
+	if balance, _ := ledger.Balance(context.Background(), testWallet); balance != 1_001_000 {
+		t.Errorf("expected the refund to be credited once, got %s", formatLedgerAmount(balance))
+	}
+}
+
+// failingCreditLedger is a ledger whose credits fail, e.g. while its store
+// is down
+type failingCreditLedger struct{ Ledger }
+
+func (failingCreditLedger) Credit(ctx context.Context, wallet string, units int64) (int64, error) {
+	return 0, errors.New("ledger unavailable")
+}
+
+func TestRefund_ClaimRestoredWhenCreditFails(t *testing.T) {
+	newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": failing("summary")})
+	useRefundTestEnv(t)
+	r := newBalanceRouter(t)
+	r.POST("/api/refunds/:id/claim", handleClaimRefund)
+
+	w := paidRequest(t, r, `{"text":"hello"}`)
+	var resp failureResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	working := ledger
+	ledger = failingCreditLedger{working}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/refunds/"+resp.Refund.ID+"/claim", nil))
+	if w.Code != 500 {
+		t.Fatalf("expected the failed credit to return 500, got %d body=%s", w.Code, w.Body.String())
+	}
+	if entry, _, _ := refundStore.Get(context.Background(), resp.Refund.ID); entry == nil || entry.Status != refundStatusRefundable {
+		t.Fatalf("expected the refund to stay refundable, got %+v", entry)
+	}
+
+	// Once the ledger is back, the same refund can be claimed
+	ledger = working
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/refunds/"+resp.Refund.ID+"/claim", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected the retried claim to succeed, got %d body=%s", w.Code, w.Body.String())
+	}
+	if balance, _ := ledger.Balance(context.Background(), testWallet); balance != 1_000 {
+		t.Errorf("expected the refund to be credited once, got %s", formatLedgerAmount(balance))
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrCacheMiss is returned by ResponseCache.Get for a missing or expired key
+var ErrCacheMiss = errors.New("cache miss")
+
+// ResponseCache stores AI results by cache key
+type ResponseCache interface {
+	// Get returns the entry for key, or ErrCacheMiss
+	Get(ctx context.Context, key string) (*CachedResponse, error)
+	// Set stores value under key for ttl
+	Set(ctx context.Context, key string, value *CachedResponse, ttl time.Duration) error
+	// Shared reports whether other replicas see the entries, in which case
+	// concurrent misses are coalesced across replicas too
+	Shared() bool
+	// Delete removes key and reports whether it existed
+	Delete(ctx context.Context, key string) (bool, error)
+	// DeleteWhere removes every entry match accepts and returns how many
+	DeleteWhere(ctx context.Context, match func(key string, value *CachedResponse) bool) (int, error)
+	// Stats returns the number and approximate size of stored entries
+	Stats(ctx context.Context) (CacheStats, error)
+}
+
+// CacheStats describes the contents of a ResponseCache
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// cacheKeyPrefix starts every cache key (see AIRequestDescriptor.CacheKey)
+const cacheKeyPrefix = "ai:"
+
+// responseCache is the process-wide AI result cache, set by
+// initResponseCache. nil disables caching.
+var responseCache ResponseCache
+
+// getCacheBackend returns CACHE_BACKEND: "redis" (default), "memory" or
+// "tiered" (a local LRU in front of Redis)
+func getCacheBackend() string {
+	return strings.ToLower(getEnv("CACHE_BACKEND", "redis"))
+}
+
+// getCacheTTL returns how long results are cached (CACHE_TTL_SECONDS, default 3600)
+func getCacheTTL() time.Duration {
+	return time.Duration(getEnvAsInt("CACHE_TTL_SECONDS", 3600)) * time.Second
+}
+
+// getCacheLocalTTL bounds how long the local tier of the tiered cache keeps
+// an entry, and so how stale it can be against Redis
+// (CACHE_LOCAL_TTL_SECONDS, default 60)
+func getCacheLocalTTL() time.Duration {
+	return getPositiveTimeout("CACHE_LOCAL_TTL_SECONDS", 60)
+}
+
+// newMemoryResponseCacheFromEnv sizes an LRU from CACHE_MEMORY_MAX_ENTRIES
+// (default 10000) and CACHE_MEMORY_MAX_BYTES (default 64 MiB)
+func newMemoryResponseCacheFromEnv() *MemoryResponseCache {
+	return NewMemoryResponseCache(getEnvAsInt("CACHE_MEMORY_MAX_ENTRIES", 10000), int64(getEnvAsInt("CACHE_MEMORY_MAX_BYTES", 64<<20)))
+}
+
+// initResponseCache selects the cache backend from CACHE_BACKEND when
+// CACHE_ENABLED is set. If Redis is requested but unavailable it falls back
+// to memory.
+func initResponseCache() error {
+	if !getCacheEnabled() {
+		responseCache = nil
+		return nil
+	}
+	switch backend := getCacheBackend(); backend {
+	case "memory":
+		responseCache = newMemoryResponseCacheFromEnv()
+	case "redis", "tiered", "":
+		if redisClient == nil {
+			log.Printf("WARNING: CACHE_BACKEND=%s but Redis is unavailable, falling back to memory", backend)
+			responseCache = newMemoryResponseCacheFromEnv()
+			return nil
+		}
+		if backend == "tiered" {
+			responseCache = NewTieredResponseCache(newMemoryResponseCacheFromEnv(), NewRedisResponseCache(redisClient), redisClient, getCacheLocalTTL())
+		} else {
+			responseCache = NewRedisResponseCache(redisClient)
+		}
+	default:
+		return fmt.Errorf("unknown CACHE_BACKEND %q (expected redis, memory or tiered)", backend)
+	}
+	log.Printf("Response cache: %s", getCacheBackend())
+	return nil
+}
+
+// RedisResponseCache keeps entries as JSON strings in Redis, gzipped above
+// CACHE_COMPRESS_MIN_BYTES, shared by all replicas and expired by Redis TTL
+type RedisResponseCache struct {
+	client *redis.Client
+}
+
+func NewRedisResponseCache(client *redis.Client) *RedisResponseCache {
+	return &RedisResponseCache{client: client}
+}
+
+func (r *RedisResponseCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	val, err := r.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCacheEntry([]byte(val))
+}
+
+func (r *RedisResponseCache) Set(ctx context.Context, key string, value *CachedResponse, ttl time.Duration) error {
+	data, err := encodeCacheEntry(value)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, key, data, ttl).Err()
+}
+
+func (r *RedisResponseCache) Shared() bool { return true }
+
+func (r *RedisResponseCache) Delete(ctx context.Context, key string) (bool, error) {
+	n, err := r.client.Del(ctx, key).Result()
+	return n > 0, err
+}
+
+// redisScanBatch is the SCAN COUNT hint used when walking cache keys
+const redisScanBatch = 500
+
+// scan calls fn with each batch of cache keys and their raw values
+func (r *RedisResponseCache) scan(ctx context.Context, fn func(keys []string, values []interface{}) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, cacheKeyPrefix+"*", redisScanBatch).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			values, err := r.client.MGet(ctx, keys...).Result()
+			if err != nil {
+				return err
+			}
+			if err := fn(keys, values); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// DeleteWhere scans the cache keys, so it costs a pass over the keyspace
+func (r *RedisResponseCache) DeleteWhere(ctx context.Context, match func(key string, value *CachedResponse) bool) (int, error) {
+	deleted := 0
+	err := r.scan(ctx, func(keys []string, values []interface{}) error {
+		var matched []string
+		for i, key := range keys {
+			raw, ok := values[i].(string)
+			if !ok {
+				continue // Expired between SCAN and MGET
+			}
+			cached, err := decodeCacheEntry([]byte(raw))
+			if err != nil {
+				continue
+			}
+			if match(key, cached) {
+				matched = append(matched, key)
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+		n, err := r.client.Del(ctx, matched...).Result()
+		deleted += int(n)
+		return err
+	})
+	return deleted, err
+}
+
+// Stats scans the cache keys and asks Redis for the length of their values
+// rather than reading them; Bytes counts the stored (compressed) values only
+func (r *RedisResponseCache) Stats(ctx context.Context) (CacheStats, error) {
+	var stats CacheStats
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, cacheKeyPrefix+"*", redisScanBatch).Result()
+		if err != nil {
+			return stats, err
+		}
+		if len(keys) > 0 {
+			pipe := r.client.Pipeline()
+			lengths := make([]*redis.IntCmd, len(keys))
+			for i, key := range keys {
+				lengths[i] = pipe.StrLen(ctx, key)
+			}
+			// A reply error only means a key that is not a string value
+			var replyErr redis.Error
+			if _, err := pipe.Exec(ctx); err != nil && !errors.As(err, &replyErr) {
+				return stats, err
+			}
+			for _, length := range lengths {
+				// 0 means the key expired after SCAN
+				if n := length.Val(); length.Err() == nil && n > 0 {
+					stats.Entries++
+					stats.Bytes += n
+				}
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return stats, nil
+		}
+	}
+}
+
+// memoryCacheEntryOverhead approximates the bookkeeping bytes of an entry
+// beyond its key and strings
+const memoryCacheEntryOverhead = 128
+
+type memoryCacheEntry struct {
+	key       string
+	value     CachedResponse
+	size      int64
+	expiresAt time.Time
+}
+
+// MemoryResponseCache is a process-local LRU bounded by entry count and by
+// approximate memory use. Expired entries are dropped when read or when
+// they reach the LRU tail.
+type MemoryResponseCache struct {
+	maxEntries int
+	maxBytes   int64
+	now        func() time.Time
+
+	mu    sync.Mutex
+	bytes int64
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+// NewMemoryResponseCache creates an LRU holding at most maxEntries entries
+// and maxBytes bytes. A limit <= 0 is not enforced.
+func NewMemoryResponseCache(maxEntries int, maxBytes int64) *MemoryResponseCache {
+	return &MemoryResponseCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		now:        time.Now,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryResponseCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if !m.now().Before(entry.expiresAt) {
+		m.removeLocked(elem, "expired")
+		return nil, ErrCacheMiss
+	}
+	m.order.MoveToFront(elem)
+	value := entry.value
+	return &value, nil
+}
+
+func (m *MemoryResponseCache) Set(ctx context.Context, key string, value *CachedResponse, ttl time.Duration) error {
+	size := int64(len(key)+len(value.Result)+len(value.Model)) + memoryCacheEntryOverhead
+	if value.Error != nil {
+		size += int64(len(value.Error.Message))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.items[key]; ok {
+		m.removeLocked(elem, "")
+	}
+	if m.maxBytes > 0 && size > m.maxBytes {
+		// Storing it would flush everything else
+		return nil
+	}
+	entry := &memoryCacheEntry{key: key, value: *value, size: size, expiresAt: m.now().Add(ttl)}
+	m.items[key] = m.order.PushFront(entry)
+	m.bytes += size
+	cacheMemoryBytes.Add(float64(size))
+
+	for (m.maxEntries > 0 && m.order.Len() > m.maxEntries) || (m.maxBytes > 0 && m.bytes > m.maxBytes) {
+		m.removeLocked(m.order.Back(), "capacity")
+	}
+	return nil
+}
+
+func (m *MemoryResponseCache) Shared() bool { return false }
+
+func (m *MemoryResponseCache) Delete(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.items[key]
+	if ok {
+		m.removeLocked(elem, "")
+	}
+	return ok, nil
+}
+
+func (m *MemoryResponseCache) DeleteWhere(ctx context.Context, match func(key string, value *CachedResponse) bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for elem := m.order.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*memoryCacheEntry)
+		value := entry.value
+		if match(entry.key, &value) {
+			m.removeLocked(elem, "")
+			deleted++
+		}
+		elem = next
+	}
+	return deleted, nil
+}
+
+func (m *MemoryResponseCache) Stats(ctx context.Context) (CacheStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return CacheStats{Entries: m.order.Len(), Bytes: m.bytes}, nil
+}
+
+// Len returns the number of stored entries, including expired ones not yet
+// dropped
+func (m *MemoryResponseCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// removeLocked drops elem, counting it as an eviction unless reason is empty
+func (m *MemoryResponseCache) removeLocked(elem *list.Element, reason string) {
+	entry := m.order.Remove(elem).(*memoryCacheEntry)
+	delete(m.items, entry.key)
+	m.bytes -= entry.size
+	cacheMemoryBytes.Sub(float64(entry.size))
+	if reason != "" {
+		cacheEvictionsTotal.WithLabelValues(reason).Inc()
+	}
+}
+
+// cacheInvalidationChannel carries the keys deleted from a tiered cache to
+// every replica, which drop their local copies; "*" drops the whole local tier
+const cacheInvalidationChannel = "x402:cache:invalidate"
+
+// TieredResponseCache serves hits from a local LRU and falls back to a
+// shared cache, copying its hits into the local tier for at most localTTL
+// and never past the entry's own expiry
+type TieredResponseCache struct {
+	local    *MemoryResponseCache
+	remote   ResponseCache
+	localTTL time.Duration
+	// client publishes deletions to the other replicas; nil keeps them local
+	client *redis.Client
+}
+
+// NewTieredResponseCache puts local in front of remote. With a Redis client,
+// deletions are published on cacheInvalidationChannel and those of other
+// replicas are applied to local. Pub/sub delivers at most once, so a replica
+// that misses a message still drops its copy after localTTL.
+func NewTieredResponseCache(local *MemoryResponseCache, remote ResponseCache, client *redis.Client, localTTL time.Duration) *TieredResponseCache {
+	t := &TieredResponseCache{local: local, remote: remote, localTTL: localTTL, client: client}
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		sub := client.Subscribe(ctx, cacheInvalidationChannel)
+		if _, err := sub.Receive(ctx); err != nil {
+			log.Printf("[WARNING] Failed to subscribe to cache invalidations, local copies expire after %s: %v", localTTL, err)
+		}
+		go t.applyInvalidations(sub)
+	}
+	return t
+}
+
+// applyInvalidations drops the local copies of deleted keys until the Redis
+// client is closed
+func (t *TieredResponseCache) applyInvalidations(sub *redis.PubSub) {
+	defer sub.Close()
+	ctx := context.Background()
+	for msg := range sub.Channel() {
+		if msg.Payload == "*" {
+			t.local.DeleteWhere(ctx, func(string, *CachedResponse) bool { return true })
+		} else {
+			t.local.Delete(ctx, msg.Payload)
+		}
+	}
+}
+
+// publishInvalidation tells every replica to drop key, or "*" for all keys,
+// from its local tier
+func (t *TieredResponseCache) publishInvalidation(ctx context.Context, key string) {
+	if t.client == nil {
+		return
+	}
+	if err := t.client.Publish(ctx, cacheInvalidationChannel, key).Err(); err != nil {
+		log.Printf("[WARNING] Failed to publish cache invalidation, other replicas keep their local copy for up to %s: %v", t.localTTL, err)
+	}
+}
+
+func (t *TieredResponseCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	if cached, err := t.local.Get(ctx, key); err == nil {
+		return cached, nil
+	}
+	cached, err := t.remote.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ttl := t.localTTL
+	if cached.ExpiresAt != 0 {
+		ttl = min(ttl, time.Unix(cached.ExpiresAt, 0).Sub(t.local.now()))
+	}
+	if ttl > 0 {
+		t.local.Set(ctx, key, cached, ttl)
+	}
+	return cached, nil
+}
+
+func (t *TieredResponseCache) Set(ctx context.Context, key string, value *CachedResponse, ttl time.Duration) error {
+	t.local.Set(ctx, key, value, min(ttl, t.localTTL))
+	return t.remote.Set(ctx, key, value, ttl)
+}
+
+func (t *TieredResponseCache) Shared() bool { return t.remote.Shared() }
+
+// Delete and DeleteWhere clear both tiers here and, once the shared tier is
+// cleared, the local tiers of the other replicas
+func (t *TieredResponseCache) Delete(ctx context.Context, key string) (bool, error) {
+	t.local.Delete(ctx, key)
+	deleted, err := t.remote.Delete(ctx, key)
+	if err == nil {
+		t.publishInvalidation(ctx, key)
+	}
+	return deleted, err
+}
+
+func (t *TieredResponseCache) DeleteWhere(ctx context.Context, match func(key string, value *CachedResponse) bool) (int, error) {
+	t.local.DeleteWhere(ctx, match)
+	n, err := t.remote.DeleteWhere(ctx, match)
+	if err == nil && n > 0 {
+		// Other replicas cannot evaluate match against entries they no
+		// longer find in the shared tier, so they drop everything and
+		// refill from it
+		t.publishInvalidation(ctx, "*")
+	}
+	return n, err
+}
+
+// Stats reports the shared tier, which holds every entry
+func (t *TieredResponseCache) Stats(ctx context.Context) (CacheStats, error) {
+	return t.remote.Stats(ctx)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func cachedResult(result string) *CachedResponse {
+	return &CachedResponse{Result: result, Model: "primary", CachedAt: time.Now().Unix()}
+}
+
+func TestMemoryResponseCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryResponseCache(2, 0)
+	cache.Set(ctx, "a", cachedResult("A"), time.Minute)
+	cache.Set(ctx, "b", cachedResult("B"), time.Minute)
+	cache.Get(ctx, "a") // a is now more recent than b
+	cache.Set(ctx, "c", cachedResult("C"), time.Minute)
+
+	if _, err := cache.Get(ctx, "b"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected the least recently used entry to be evicted, got %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := cache.Get(ctx, key); err != nil {
+			t.Errorf("expected %s to be kept, got %v", key, err)
+		}
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", cache.Len())
+	}
+}
+
+func TestMemoryResponseCache_MemoryCap(t *testing.T) {
+	ctx := context.Background()
+	// Room for two entries with 100-byte results
+	entrySize := int64(len("k1")+100+len("primary")) + memoryCacheEntryOverhead
+	cache := NewMemoryResponseCache(0, 2*entrySize)
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		cache.Set(ctx, key, cachedResult(strings.Repeat("x", 100)), time.Minute)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected the byte cap to keep 2 entries, got %d", cache.Len())
+	}
+	if _, err := cache.Get(ctx, "k1"); !errors.Is(err, ErrCacheMiss) {
+		t.Error("expected the oldest entry to be evicted")
+	}
+
+	// An entry larger than the whole cache is not stored and evicts nothing
+	cache.Set(ctx, "huge", cachedResult(strings.Repeat("x", int(3*entrySize))), time.Minute)
+	if _, err := cache.Get(ctx, "huge"); !errors.Is(err, ErrCacheMiss) || cache.Len() != 2 {
+		t.Errorf("expected an oversized entry to be skipped, got %v with %d entries", err, cache.Len())
+	}
+}
+
+func TestMemoryResponseCache_TTL(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	cache := NewMemoryResponseCache(10, 0)
+	cache.now = func() time.Time { return now }
+
+	cache.Set(ctx, "k", cachedResult("v"), 10*time.Second)
+	now = now.Add(9 * time.Second)
+	if got, err := cache.Get(ctx, "k"); err != nil || got.Result != "v" {
+		t.Fatalf("expected a hit before expiry, got %v %v", got, err)
+	}
+	now = now.Add(time.Second)
+	if _, err := cache.Get(ctx, "k"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected a miss at expiry, got %v", err)
+	}
+	if cache.Len() != 0 {
+		t.Error("expected the expired entry to be dropped")
+	}
+}
+
+func TestTieredResponseCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	local, remote := NewMemoryResponseCache(10, 0), NewMemoryResponseCache(10, 0)
+	local.now = func() time.Time { return now }
+	tiered := NewTieredResponseCache(local, remote, nil, 5*time.Second)
+
+	// A remote hit is copied into the local tier
+	remote.Set(ctx, "k", cachedResult("from remote"), time.Hour)
+	if got, err := tiered.Get(ctx, "k"); err != nil || got.Result != "from remote" {
+		t.Fatalf("expected the remote entry, got %v %v", got, err)
+	}
+	if _, err := local.Get(ctx, "k"); err != nil {
+		t.Error("expected the remote hit to populate the local tier")
+	}
+
+	// Writes go to both tiers; the local copy lives at most localTTL
+	tiered.Set(ctx, "k", cachedResult("updated"), time.Hour)
+	if got, _ := remote.Get(ctx, "k"); got == nil || got.Result != "updated" {
+		t.Error("expected Set to write through to the remote tier")
+	}
+	remote.Set(ctx, "k", cachedResult("changed elsewhere"), time.Hour)
+	if got, _ := tiered.Get(ctx, "k"); got.Result != "updated" {
+		t.Errorf("expected the local tier to answer first, got %q", got.Result)
+	}
+	now = now.Add(5 * time.Second)
+	if got, _ := tiered.Get(ctx, "k"); got.Result != "changed elsewhere" {
+		t.Errorf("expected the remote entry once the local copy expired, got %q", got.Result)
+	}
+}
+
+func TestTieredResponseCache_LocalCopyEndsWithEntry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	local, remote := NewMemoryResponseCache(10, 0), NewMemoryResponseCache(10, 0)
+	local.now = func() time.Time { return now }
+	tiered := NewTieredResponseCache(local, remote, nil, time.Minute)
+
+	expiring := cachedResult("expiring")
+	expiring.ExpiresAt = now.Add(2 * time.Second).Unix()
+	remote.Set(ctx, "k", expiring, time.Hour)
+	tiered.Get(ctx, "k")
+	now = now.Add(2 * time.Second)
+	if _, err := local.Get(ctx, "k"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected the local copy to expire with the entry, got %v", err)
+	}
+
+	// An entry already past its expiry is served but not copied
+	if got, err := tiered.Get(ctx, "k"); err != nil || got.Result != "expiring" {
+		t.Fatalf("expected the remote entry, got %v %v", got, err)
+	}
+	if local.Len() != 0 {
+		t.Error("expected no local copy of an expired entry")
+	}
+}
+
+func TestTieredResponseCache_InvalidatesOtherReplicas(t *testing.T) {
+	client := newTestRedisClient(t)
+	ctx := context.Background()
+	prefix := "ai:test:" + strconv.FormatInt(time.Now().UnixNano(), 16) + ":"
+	t.Cleanup(func() { client.Del(ctx, prefix+"a", prefix+"b") })
+
+	// Two replicas sharing Redis, each with its own local tier
+	remote := NewRedisResponseCache(client)
+	a := NewTieredResponseCache(NewMemoryResponseCache(10, 0), remote, client, time.Hour)
+	b := NewTieredResponseCache(NewMemoryResponseCache(10, 0), remote, client, time.Hour)
+	for _, key := range []string{prefix + "a", prefix + "b"} {
+		a.Set(ctx, key, cachedResult("old"), time.Hour)
+		if _, err := b.Get(ctx, key); err != nil {
+			t.Fatalf("expected replica b to copy %s into its local tier, got %v", key, err)
+		}
+	}
+	waitForLocalMiss := func(key string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if _, err := b.local.Get(ctx, key); errors.Is(err, ErrCacheMiss) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("replica b still has its local copy of %s", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if deleted, err := a.Delete(ctx, prefix+"a"); err != nil || !deleted {
+		t.Fatalf("expected the entry to be deleted, got %v %v", deleted, err)
+	}
+	waitForLocalMiss(prefix + "a")
+	if _, err := b.local.Get(ctx, prefix+"b"); err != nil {
+		t.Error("expected deleting one key to leave replica b's other entries")
+	}
+
+	n, err := a.DeleteWhere(ctx, func(key string, _ *CachedResponse) bool { return strings.HasPrefix(key, prefix) })
+	if err != nil || n != 1 {
+		t.Fatalf("expected one entry to be invalidated, got %d %v", n, err)
+	}
+	waitForLocalMiss(prefix + "b")
+	if _, err := b.Get(ctx, prefix+"b"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected replica b to miss after the invalidation, got %v", err)
+	}
+}
+
+func TestInitResponseCache(t *testing.T) {
+	origClient := redisClient
+	defer func() { redisClient, responseCache = origClient, nil }()
+
+	t.Setenv("CACHE_ENABLED", "false")
+	if err := initResponseCache(); err != nil || responseCache != nil {
+		t.Fatalf("expected caching to be disabled, got %T %v", responseCache, err)
+	}
+
+	t.Setenv("CACHE_ENABLED", "true")
+	redisClient = nil
+	for _, backend := range []string{"memory", "redis", "tiered"} {
+		t.Setenv("CACHE_BACKEND", backend)
+		if err := initResponseCache(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := responseCache.(*MemoryResponseCache); !ok {
+			t.Errorf("%s without Redis: expected the memory cache, got %T", backend, responseCache)
+		}
+	}
+
+	// Clients connect lazily, so no server is needed to pick a backend
+	redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer redisClient.Close()
+	t.Setenv("CACHE_BACKEND", "tiered")
+	if err := initResponseCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := responseCache.(*TieredResponseCache); !ok || !responseCache.Shared() {
+		t.Errorf("expected a shared tiered cache, got %T", responseCache)
+	}
+
+	t.Setenv("CACHE_BACKEND", "memcached")
+	if err := initResponseCache(); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
+
+func TestCacheMiddleware_MemoryBackendWithoutRedis(t *testing.T) {
+	origClient := redisClient
+	redisClient = nil
+	responseCache = NewMemoryResponseCache(100, 1<<20)
+	defer func() {
+		closeResponseCache()
+		redisClient = origClient
+	}()
+
+	ai, _ := newFakeAIServer(t, map[string]func(http.ResponseWriter, int){"primary": reply("summary")})
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"` + testWallet + `","error":""}`))
+	}))
+	defer verifier.Close()
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	origStore := nonceStore
+	nonceStore = NewMemoryNonceStore()
+	defer func() { nonceStore = origStore }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", CacheMiddleware(), handleSummarize)
+
+	if w := summarizeWithNonce(t, r, "cache me", 0); w.Code != 200 {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	waitForCacheEntry(t, describeSummary("primary", "cache me").CacheKey())
+	w := summarizeWithNonce(t, r, "cache me", 1)
+	if w.Code != 200 || w.Header().Get("X-402-Receipt") == "" {
+		t.Fatalf("expected a paid cache hit, got %d body=%s", w.Code, w.Body.String())
+	}
+	if ai.count("primary") != 1 {
+		t.Errorf("expected the second request to be served from memory, got %d AI calls", ai.count("primary"))
+	}
+}
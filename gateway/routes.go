@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PaidRoute describes the price of a single paid endpoint. Empty fields fall
+// back to the global environment defaults (PAYMENT_AMOUNT, RECIPIENT_ADDRESS,
+// CHAIN_ID and the "USDC" token) when a payment context is built.
+type PaidRoute struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Amount    string `json:"amount,omitempty"`
+	Token     string `json:"token,omitempty"` // Token contract address (or symbol)
+	ChainID   int    `json:"chainId,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	// Usage prices each request from its body and model via MODEL_PRICING_CONFIG
+	// instead of the flat Amount.
+	Usage bool `json:"usage,omitempty"`
+}
+
+// RouteRegistry maps (method, path) pairs to their pricing
+type RouteRegistry struct {
+	routes map[string]*PaidRoute
+}
+
+// routeRegistryFile is the on-disk format of PRICING_CONFIG
+type routeRegistryFile struct {
+	Routes []PaidRoute `json:"routes"`
+}
+
+// paidRoutes is the process-wide registry, replaced by initPaidRoutes at startup
+var paidRoutes = defaultRouteRegistry()
+
+// defaultPaidRoute is used for paid endpoints without a registry entry.
+// All fields resolve from the environment.
+var defaultPaidRoute = &PaidRoute{}
+
+func routeKey(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+// defaultRouteRegistry prices the built-in AI endpoints from the environment
+func defaultRouteRegistry() *RouteRegistry {
+	registry := &RouteRegistry{routes: make(map[string]*PaidRoute)}
+	registry.routes[routeKey("POST", "/api/ai/summarize")] = &PaidRoute{Method: "POST", Path: "/api/ai/summarize", Usage: true}
+	return registry
+}
+
+// LoadRouteRegistry reads a JSON pricing table from path
+func LoadRouteRegistry(path string) (*RouteRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pricing config: %w", err)
+	}
+
+	var file routeRegistryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse pricing config: %w", err)
+	}
+
+	registry := &RouteRegistry{routes: make(map[string]*PaidRoute)}
+	for i := range file.Routes {
+		route := file.Routes[i]
+		if route.Method == "" || route.Path == "" {
+			return nil, fmt.Errorf("route %d: method and path are required", i)
+		}
+		if route.Amount != "" {
+			if amount, ok := new(big.Rat).SetString(route.Amount); !ok || amount.Sign() <= 0 {
+				return nil, fmt.Errorf("route %s %s: invalid amount %q", route.Method, route.Path, route.Amount)
+			}
+		}
+		if route.ChainID < 0 {
+			return nil, fmt.Errorf("route %s %s: invalid chainId %d", route.Method, route.Path, route.ChainID)
+		}
+		key := routeKey(route.Method, route.Path)
+		if _, exists := registry.routes[key]; exists {
+			return nil, fmt.Errorf("duplicate route %s", key)
+		}
+		route.Method = strings.ToUpper(route.Method)
+		registry.routes[key] = &route
+	}
+	return registry, nil
+}
+
+// initPaidRoutes loads the pricing table from PRICING_CONFIG if set
+func initPaidRoutes() error {
+	path := os.Getenv("PRICING_CONFIG")
+	if path == "" {
+		return nil
+	}
+	registry, err := LoadRouteRegistry(path)
+	if err != nil {
+		return err
+	}
+	paidRoutes = registry
+	log.Printf("Loaded %d paid routes from %s", len(registry.routes), path)
+	return nil
+}
+
+// Match returns the pricing for the given method and route path
+func (r *RouteRegistry) Match(method, path string) (*PaidRoute, bool) {
+	route, ok := r.routes[routeKey(method, path)]
+	return route, ok
+}
+
+// lookupPaidRoute finds the pricing for the current request. It matches on the
+// registered route template first (so parameterized routes work) and falls back
+// to the environment defaults when the route has no entry.
+func lookupPaidRoute(c *gin.Context) *PaidRoute {
+	if route, ok := paidRoutes.Match(c.Request.Method, c.FullPath()); ok {
+		return route
+	}
+	if route, ok := paidRoutes.Match(c.Request.Method, c.Request.URL.Path); ok {
+		return route
+	}
+	return defaultPaidRoute
+}
+
+// paymentContext builds the payment context for this route, filling unset
+// fields from the environment defaults.
+func (r *PaidRoute) paymentContext(nonce string, timestamp uint64) PaymentContext {
+	paymentCtx := PaymentContext{
+		Recipient: r.Recipient,
+		Token:     r.Token,
+		Amount:    r.Amount,
+		Nonce:     nonce,
+		ChainID:   r.ChainID,
+		Timestamp: timestamp,
+	}
+	if paymentCtx.Recipient == "" {
+		paymentCtx.Recipient = getRecipientAddress()
+	}
+	if paymentCtx.Token == "" {
+		paymentCtx.Token = "USDC"
+	}
+	if paymentCtx.Amount == "" {
+		paymentCtx.Amount = getPaymentAmount()
+	}
+	if paymentCtx.ChainID == 0 {
+		paymentCtx.ChainID = getChainID()
+	}
+	return paymentCtx
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func writePricingConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pricing.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write pricing config: %v", err)
+	}
+	return path
+}
+
+func TestLoadRouteRegistry(t *testing.T) {
+	path := writePricingConfig(t, `{
+		"routes": [
+			{"method": "post", "path": "/api/ai/summarize", "amount": "0.002", "token": "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913", "chainId": 84532, "recipient": "0xRouteRecipient"},
+			{"method": "POST", "path": "/api/ai/translate"}
+		]
+	}`)
+
+	registry, err := LoadRouteRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadRouteRegistry failed: %v", err)
+	}
+
+	route, ok := registry.Match("POST", "/api/ai/summarize")
+	if !ok {
+		t.Fatal("expected summarize route to match")
+	}
+	paymentCtx := route.paymentContext("n", 1)
+	if paymentCtx.Amount != "0.002" || paymentCtx.ChainID != 84532 || paymentCtx.Recipient != "0xRouteRecipient" {
+		t.Errorf("unexpected payment context: %+v", paymentCtx)
+	}
+	if paymentCtx.Token != "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913" {
+		t.Errorf("expected route token address, got %s", paymentCtx.Token)
+	}
+
+	if _, ok := registry.Match("GET", "/api/ai/summarize"); ok {
+		t.Error("method should be part of the route key")
+	}
+}
+
+func TestLoadRouteRegistry_DefaultsFromEnv(t *testing.T) {
+	t.Setenv("PAYMENT_AMOUNT", "0.005")
+	t.Setenv("CHAIN_ID", "1")
+	t.Setenv("RECIPIENT_ADDRESS", "0xEnvRecipient")
+
+	path := writePricingConfig(t, `{"routes": [{"method": "POST", "path": "/api/ai/translate"}]}`)
+	registry, err := LoadRouteRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadRouteRegistry failed: %v", err)
+	}
+
+	route, _ := registry.Match("POST", "/api/ai/translate")
+	paymentCtx := route.paymentContext("n", 1)
+	if paymentCtx.Amount != "0.005" || paymentCtx.ChainID != 1 || paymentCtx.Recipient != "0xEnvRecipient" || paymentCtx.Token != "USDC" {
+		t.Errorf("unset fields should fall back to env defaults, got %+v", paymentCtx)
+	}
+}
+
+func TestLoadRouteRegistry_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"Malformed JSON", `{"routes": [`},
+		{"Missing path", `{"routes": [{"method": "POST"}]}`},
+		{"Negative amount", `{"routes": [{"method": "POST", "path": "/a", "amount": "-1"}]}`},
+		{"Non-numeric amount", `{"routes": [{"method": "POST", "path": "/a", "amount": "free"}]}`},
+		{"Duplicate route", `{"routes": [{"method": "POST", "path": "/a"}, {"method": "post", "path": "/a"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadRouteRegistry(writePricingConfig(t, tt.content)); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestPaidRoute_PricingAppliedToChallengeAndVerification(t *testing.T) {
+	var verified PaymentContext
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req VerifyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		verified = req.Context
+		json.NewEncoder(w).Encode(VerifyResponse{IsValid: true, RecoveredAddress: "0xPayer"})
+	}))
+	defer verifier.Close()
+
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"summary"}}]}`))
+	}))
+	defer ai.Close()
+
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	t.Setenv("OPENROUTER_URL", ai.URL)
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	registry, err := LoadRouteRegistry(writePricingConfig(t, `{"routes": [
+		{"method": "POST", "path": "/api/ai/summarize", "amount": "0.010", "token": "0xToken", "chainId": 10, "recipient": "0xRouteRecipient"}
+	]}`))
+	if err != nil {
+		t.Fatalf("LoadRouteRegistry failed: %v", err)
+	}
+	origRoutes := paidRoutes
+	paidRoutes = registry
+	defer func() { paidRoutes = origRoutes }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/ai/summarize", nil))
+	var challenge struct {
+		PaymentContext PaymentContext `json:"paymentContext"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &challenge)
+	if challenge.PaymentContext.Amount != "0.010" || challenge.PaymentContext.Token != "0xToken" || challenge.PaymentContext.ChainID != 10 {
+		t.Fatalf("402 context not built from route entry: %+v", challenge.PaymentContext)
+	}
+
+	req := httptest.NewRequest("POST", "/api/ai/summarize", bytes.NewBufferString(`{"text":"hello"}`))
+	req.Header.Set("X-402-Signature", "0xsig")
+	req.Header.Set("X-402-Nonce", challenge.PaymentContext.Nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatUint(challenge.PaymentContext.Timestamp, 10))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	if verified.Amount != "0.010" || verified.Token != "0xToken" || verified.ChainID != 10 || verified.Recipient != "0xRouteRecipient" {
+		t.Errorf("verification context not built from route entry: %+v", verified)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Streaming responses (Accept: text/event-stream) send these SSE events:
+//   - "delta":   {"content": "..."} for each chunk of the summary
+//   - "receipt": the SignedReceipt, always the last event on success.
+//     Its response_hash covers the concatenation of all delta contents and
+//     service.model names the model that produced them.
+//   - "error":   {"error": "...", "message": "..."} if the stream fails
+//     after it has started; no receipt follows.
+
+// wantsEventStream reports whether the client asked for a streamed response
+func wantsEventStream(c *gin.Context) bool {
+	for _, accept := range c.Request.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeSSEEvent writes one SSE event with a JSON payload and flushes it
+func writeSSEEvent(w http.ResponseWriter, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// startEventStream commits a 200 text/event-stream response, switching any
+// buffering timeout middleware to pass-through first
+func startEventStream(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	if s, ok := c.Writer.(streamingWriter); ok {
+		s.StartStreaming()
+	}
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+}
+
+// finishEventStream signs and stores the receipt for the streamed content and
+// sends it as the final event
+func finishEventStream(c *gin.Context, paymentCtx PaymentContext, recoveredAddr string, requestBody []byte, content string, model string) error {
+	_, span := startSpan(c.Request.Context(), "generateReceipt")
+	receipt, err := GenerateReceipt(paymentCtx, recoveredAddr, c.Request.URL.Path, model, negotiateReceiptVersion(c), requestBody, []byte(content))
+	endSpan(span, err)
+	if err != nil {
+		_ = writeSSEEvent(c.Writer, "error", gin.H{"error": "Failed to generate receipt", "message": err.Error()})
+		return err
+	}
+	if err := storeReceipt(c.Request.Context(), receipt, getReceiptTTL()); err != nil {
+		_ = writeSSEEvent(c.Writer, "error", gin.H{"error": "Failed to store receipt"})
+		return err
+	}
+	return writeSSEEvent(c.Writer, "receipt", receipt)
+}
+
+// streamFailure records a failure after the stream started and adds the
+// refund, including its signed record, to the error event
+func streamFailure(c *gin.Context, event gin.H, reason string) gin.H {
+	return withStreamRefund(event, failPaidService(c, 200, reason))
+}
+
+// withStreamRefund adds the refund of a failed stream, if any, to its error
+// event
+func withStreamRefund(event gin.H, entry *RefundEntry) gin.H {
+	if entry != nil {
+		refund := refundSummary(entry)
+		refund["record"] = entry.Record
+		event["refund"] = refund
+	}
+	return event
+}
+
+// streamCompletion streams the AI completion of desc to the client as SSE
+// and ends with the receipt. Failures before the first chunk are reported as regular
+// JSON errors, since nothing has been sent yet.
+func streamCompletion(c *gin.Context, paymentCtx PaymentContext, recoveredAddr string, requestBody []byte, desc *AIRequestDescriptor) {
+	started := false
+	aiResp, err := callAIStream(c.Request.Context(), desc, func(delta string) error {
+		if !started {
+			startEventStream(c)
+			started = true
+		}
+		return writeSSEEvent(c.Writer, "delta", gin.H{"content": delta})
+	})
+	if err != nil {
+		timedOut := errors.Is(err, context.DeadlineExceeded) || c.Request.Context().Err() == context.DeadlineExceeded
+		var unavailable *DependencyUnavailableError
+		switch {
+		case !started && errors.As(err, &unavailable):
+			respondPaidUnavailable(c, unavailable)
+		case !started && timedOut:
+			respondServiceFailure(c, 504, gin.H{"error": "Gateway Timeout", "message": "AI request timed out"}, "AI request timed out")
+		case !started:
+			noteAIFailure(c, err)
+			respondServiceFailure(c, 500, gin.H{"error": "AI Service Failed", "details": err.Error()}, "AI service failed")
+		case c.Request.Context().Err() != nil:
+			// The request deadline belongs to RequestTimeoutMiddleware, which
+			// records the failure and ends the stream with its own error event
+		case timedOut:
+			_ = writeSSEEvent(c.Writer, "error", streamFailure(c, gin.H{"error": "Gateway Timeout", "message": "AI request timed out"}, "AI request timed out"))
+		default:
+			_ = writeSSEEvent(c.Writer, "error", streamFailure(c, gin.H{"error": "AI Service Failed", "message": err.Error()}, "AI service failed"))
+		}
+		return
+	}
+	markServiceDelivered(c)
+	if !started {
+		startEventStream(c)
+	}
+
+	if err := finishEventStream(c, paymentCtx, recoveredAddr, requestBody, aiResp.Content, aiResp.Model); err != nil {
+		log.Printf("Failed to send streamed receipt: %v", err)
+		return
+	}
+	c.Set("streamed_result", aiResp.Content)
+	c.Set("streamed_model", aiResp.Model)
+}
+
+// streamCachedResult sends a cached summary as a single-delta stream
+func streamCachedResult(c *gin.Context, paymentCtx PaymentContext, recoveredAddr string, requestBody []byte, result string, model string) {
+	startEventStream(c)
+	if err := writeSSEEvent(c.Writer, "delta", gin.H{"content": result}); err != nil {
+		log.Printf("Failed to stream cached result: %v", err)
+		return
+	}
+	if err := finishEventStream(c, paymentCtx, recoveredAddr, requestBody, result, model); err != nil {
+		log.Printf("Failed to send streamed receipt: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent is one parsed server-sent event
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var ev sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				ev.Event = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				ev.Data = v
+			}
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// streamingAIServer streams chunks as OpenAI-style SSE, pausing between them
+func streamingAIServer(t *testing.T, chunks []string, pause time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body openAIChatRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		if !body.Stream {
+			t.Errorf("expected stream=true in provider request")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			data, _ := json.Marshal(map[string]interface{}{
+				"model":   "test/model",
+				"choices": []map[string]interface{}{{"delta": map[string]string{"content": chunk}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			time.Sleep(pause)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+}
+
+func setupStreamingTest(t *testing.T, aiURL string) *gin.Engine {
+	t.Helper()
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"0xabc","error":""}`))
+	}))
+	t.Cleanup(verifier.Close)
+
+	t.Setenv("OPENROUTER_URL", aiURL)
+	t.Setenv("OPENROUTER_API_KEY", "test")
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// Nested timeouts, as in main(): global then AI-specific
+	r.Use(RequestTimeoutMiddleware(getRequestTimeout()))
+	r.POST("/api/ai/summarize", RequestTimeoutMiddleware(getAITimeout()), handleSummarize)
+	return r
+}
+
+func newStreamingRequest(t *testing.T, nonce string) *http.Request {
+	t.Helper()
+	nonce = fmt.Sprintf("%s-%d", nonce, time.Now().UnixNano())
+	if err := nonceStore.Issue(context.Background(), nonce, time.Minute); err != nil {
+		t.Fatalf("failed to issue nonce: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/api/ai/summarize", strings.NewReader(`{"text":"hello"}`))
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("X-402-Signature", "sig")
+	req.Header.Set("X-402-Nonce", nonce)
+	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	return req
+}
+
+func TestHandleSummarize_StreamsSSEWithReceipt(t *testing.T) {
+	ai := streamingAIServer(t, []string{"Hello", ", ", "world."}, 0)
+	defer ai.Close()
+	r := setupStreamingTest(t, ai.URL)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newStreamingRequest(t, "nonce-stream-ok"))
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", ct)
+	}
+
+	events := parseSSE(t, w.Body.String())
+	if len(events) != 4 {
+		t.Fatalf("expected 3 deltas and a receipt, got %+v", events)
+	}
+	var content strings.Builder
+	for _, ev := range events[:3] {
+		if ev.Event != "delta" {
+			t.Fatalf("expected delta event, got %+v", ev)
+		}
+		var delta struct{ Content string }
+		json.Unmarshal([]byte(ev.Data), &delta)
+		content.WriteString(delta.Content)
+	}
+	if content.String() != "Hello, world." {
+		t.Errorf("unexpected streamed content %q", content.String())
+	}
+
+	last := events[3]
+	if last.Event != "receipt" {
+		t.Fatalf("expected final receipt event, got %+v", last)
+	}
+	var receipt SignedReceipt
+	if err := json.Unmarshal([]byte(last.Data), &receipt); err != nil {
+		t.Fatalf("failed to decode receipt: %v", err)
+	}
+	if receipt.Receipt.Service.ResponseHash != hashData([]byte("Hello, world.")) {
+		t.Errorf("response_hash should cover the concatenated content, got %s", receipt.Receipt.Service.ResponseHash)
+	}
+	if _, ok := getReceipt(receipt.Receipt.ID); !ok {
+		t.Error("streamed receipt should be stored")
+	}
+}
+
+func TestHandleSummarize_StreamWritesPassThroughTimeoutMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":"first"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":" second"}}]}`+"\n\ndata: [DONE]\n\n")
+	}))
+	defer ai.Close()
+
+	server := httptest.NewServer(setupStreamingTest(t, ai.URL))
+	defer server.Close()
+
+	req := newStreamingRequest(t, "nonce-stream-passthrough")
+	outReq, _ := http.NewRequest("POST", server.URL+"/api/ai/summarize", req.Body)
+	outReq.Header = req.Header
+	resp, err := http.DefaultClient.Do(outReq)
+	if err != nil {
+		close(release)
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	// The first delta must arrive while the provider is still blocked, i.e.
+	// before the handler returns and the middleware would flush its buffer.
+	select {
+	case line := <-lines:
+		if line != "event: delta" {
+			close(release)
+			t.Fatalf("expected delta event first, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("first delta was buffered instead of streamed")
+	}
+	close(release)
+
+	var last string
+	for line := range lines {
+		if strings.HasPrefix(line, "event: ") {
+			last = line
+		}
+	}
+	if last != "event: receipt" {
+		t.Errorf("expected the stream to end with a receipt, last event %q", last)
+	}
+}
+
+func TestHandleSummarize_StreamTimeoutSendsErrorEvent(t *testing.T) {
+	ai := streamingAIServer(t, []string{"slow", "er"}, 2*time.Second)
+	defer ai.Close()
+	t.Setenv("AI_REQUEST_TIMEOUT_SECONDS", "1")
+	r := setupStreamingTest(t, ai.URL)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newStreamingRequest(t, "nonce-stream-timeout"))
+
+	events := parseSSE(t, w.Body.String())
+	if len(events) != 2 || events[0].Event != "delta" || events[1].Event != "error" {
+		t.Fatalf("expected a delta then an error event, got %+v", events)
+	}
+	if !strings.Contains(events[1].Data, "Gateway Timeout") {
+		t.Errorf("expected timeout error event, got %s", events[1].Data)
+	}
+}
+
+func TestHandleSummarize_StreamClosedMidwayIsFailure(t *testing.T) {
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection drops after the first chunk: no finish_reason, no [DONE]
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":"partial"}}]}`+"\n\n")
+	}))
+	defer ai.Close()
+	r := setupStreamingTest(t, ai.URL)
+	useRefundTestEnv(t)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newStreamingRequest(t, "nonce-stream-closed"))
+
+	events := parseSSE(t, w.Body.String())
+	if len(events) != 2 || events[0].Event != "delta" || events[1].Event != "error" {
+		t.Fatalf("expected a delta then an error event, got %+v", events)
+	}
+	var failure failureResponse
+	if err := json.Unmarshal([]byte(events[1].Data), &failure); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(events[1].Data, "AI Service Failed") || failure.Refund.Status != refundStatusRefundable {
+		t.Errorf("expected a refundable service failure, got %s", events[1].Data)
+	}
+}
+
+func TestHandleSummarize_StreamFailureBeforeFirstChunkIsJSON(t *testing.T) {
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ai.Close()
+	r := setupStreamingTest(t, ai.URL)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newStreamingRequest(t, "nonce-stream-fail"))
+
+	if w.Code != 500 || !strings.Contains(w.Body.String(), "AI Service Failed") {
+		t.Fatalf("expected 500 JSON error, got %d body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestWantsEventStream(t *testing.T) {
+	tests := map[string]bool{
+		"":                  false,
+		"application/json":  false,
+		"text/event-stream": true,
+		"application/json, text/event-stream;q=0.9": true,
+	}
+	for accept, want := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/", nil)
+		c.Request.Header.Set("Accept", accept)
+		if got := wantsEventStream(c); got != want {
+			t.Errorf("wantsEventStream(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -56,9 +57,9 @@ func TestCallOpenRouter_RespectsContextTimeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	_, err := callOpenRouter(ctx, "hello")
+	_, err := callAI(ctx, describeSummary(getOpenRouterModel(), "hello"))
 	if err == nil {
-		t.Fatalf("Expected timeout error from callOpenRouter, got nil")
+		t.Fatalf("Expected timeout error from callAI, got nil")
 	}
 
 	if !errors.Is(err, context.DeadlineExceeded) {
@@ -93,11 +94,14 @@ func TestHandleSummarize_AIRequestTimeoutReturns504(t *testing.T) {
 	// Apply AI-specific timeout to this route
 	r.POST("/api/ai/summarize", RequestTimeoutMiddleware(getAITimeout()), handleSummarize)
 
-	// Build a valid request with signature/nonce
+	// Build a valid request with signature and a gateway-issued nonce
+	if err := nonceStore.Issue(context.Background(), "nonce-timeout-504", time.Minute); err != nil {
+		t.Fatalf("failed to issue nonce: %v", err)
+	}
 	reqBody := strings.NewReader(`{"text":"hello"}`)
 	req, _ := http.NewRequest("POST", "/api/ai/summarize", reqBody)
 	req.Header.Set("X-402-Signature", "sig")
-	req.Header.Set("X-402-Nonce", "nonce")
+	req.Header.Set("X-402-Nonce", "nonce-timeout-504")
 	req.Header.Set("X-402-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
 	req.Header.Set("Content-Type", "application/json")
 
@@ -122,3 +126,44 @@ func TestHandleSummarize_AIRequestTimeoutReturns504(t *testing.T) {
 		t.Fatalf("Handler response leaked after timeout: %s", w.Body.String())
 	}
 }
+
+func TestRequestTimeoutMiddleware_AnswersBeforeHandlerReturns(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	r := gin.New()
+	// Nested like the AI routes: the inner, shorter timeout answers
+	r.Use(RequestTimeoutMiddleware(5 * time.Second))
+	r.GET("/stuck", RequestTimeoutMiddleware(100*time.Millisecond), func(c *gin.Context) {
+		// Blocks on something that ignores the request context
+		defer close(returned)
+		<-release
+		c.JSON(200, gin.H{"ok": true})
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	defer close(release)
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	start := time.Now()
+	resp, err := client.Get(srv.URL + "/stuck")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if dur := time.Since(start); dur > time.Second {
+		t.Errorf("expected the 504 right after the deadline, got it after %v", dur)
+	}
+	if resp.StatusCode != 504 || !strings.Contains(string(body), "Gateway Timeout") {
+		t.Errorf("expected 504 Gateway Timeout, got %d body=%s", resp.StatusCode, body)
+	}
+	select {
+	case <-returned:
+		t.Error("expected the handler to still be blocked")
+	default:
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// useInMemoryTracing installs a tracer provider that records spans in memory
+// for the duration of the test
+func useInMemoryTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return exporter
+}
+
+// headerRecorder records one header from each request it sees
+type headerRecorder struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (h *headerRecorder) record(r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.values = append(h.values, r.Header.Get("traceparent"))
+}
+
+func (h *headerRecorder) all() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.values...)
+}
+
+func TestTracing_SpansPaidRequest(t *testing.T) {
+	exporter := useInMemoryTracing(t)
+
+	var aiHeaders, verifierHeaders headerRecorder
+	ai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aiHeaders.record(r)
+		w.Write([]byte(`{"choices":[{"message":{"content":"summary"}}]}`))
+	}))
+	defer ai.Close()
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifierHeaders.record(r)
+		w.Write([]byte(`{"is_valid":true,"recovered_address":"0xabc","error":""}`))
+	}))
+	defer verifier.Close()
+	t.Setenv("OPENROUTER_URL", ai.URL)
+	t.Setenv("OPENROUTER_API_KEY", "test")
+	t.Setenv("OPENROUTER_MODEL", "primary")
+	t.Setenv("VERIFIER_URL", verifier.URL)
+	t.Setenv("SERVER_WALLET_PRIVATE_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CorrelationIDMiddleware())
+	r.Use(TracingMiddleware())
+	r.Use(RateLimitMiddleware(initRateLimiters()))
+	r.POST("/api/ai/summarize", handleSummarize)
+
+	w := paidRequest(t, r, `{"text":"hello"}`, [2]string{"traceparent", testTraceparent}, [2]string{"X-Correlation-ID", "corr-123"})
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() != testTraceID {
+			t.Errorf("span %s is not part of the incoming trace", span.Name)
+		}
+		spans[span.Name] = span
+	}
+	for _, name := range []string{"POST /api/ai/summarize", "rateLimit", "verifyPayment", "callAI", "aiAttempt", "generateReceipt", "storeReceipt"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("missing span %s (got %v)", name, spanNames(exporter))
+		}
+	}
+
+	server := spans["POST /api/ai/summarize"]
+	var correlationID string
+	for _, attr := range server.Attributes {
+		if attr.Key == "correlation_id" {
+			correlationID = attr.Value.AsString()
+		}
+	}
+	if correlationID != "corr-123" {
+		t.Errorf("expected correlation_id attribute corr-123, got %q", correlationID)
+	}
+	if attempt := spans["aiAttempt"]; attempt.Parent.SpanID() != spans["callAI"].SpanContext.SpanID() {
+		t.Error("aiAttempt should be a child of callAI")
+	}
+
+	for name, headers := range map[string][]string{"verifier": verifierHeaders.all(), "AI provider": aiHeaders.all()} {
+		if len(headers) == 0 || !strings.Contains(headers[0], testTraceID) {
+			t.Errorf("expected %s to receive the trace in traceparent, got %v", name, headers)
+		}
+	}
+}
+
+func TestTracing_PropagatesWithoutExporter(t *testing.T) {
+	for _, key := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+		t.Setenv(key, "")
+	}
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(noop.NewTracerProvider())
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	shutdown, err := initTracing(context.Background())
+	if err != nil {
+		t.Fatalf("initTracing failed: %v", err)
+	}
+	defer shutdown(context.Background())
+
+	var upstream headerRecorder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.record(r)
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(TracingMiddleware())
+	r.GET("/call", func(c *gin.Context) {
+		var out openAIChatResponse
+		if err := postJSON(c.Request.Context(), nil, "test", server.URL, nil, gin.H{}, &out); err != nil {
+			t.Errorf("postJSON failed: %v", err)
+		}
+	})
+	req := httptest.NewRequest("GET", "/call", nil)
+	req.Header.Set("traceparent", testTraceparent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if headers := upstream.all(); len(headers) != 1 || !strings.Contains(headers[0], testTraceID) {
+		t.Errorf("expected the incoming trace to be forwarded, got %v", headers)
+	}
+}
+
+func TestTracingEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if tracingEnabled() {
+		t.Error("tracing should be off without an endpoint")
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	if !tracingEnabled() {
+		t.Error("tracing should be on with OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	if tracingEnabled() {
+		t.Error("OTEL_SDK_DISABLED should turn tracing off")
+	}
+}
+
+func spanNames(exporter *tracetest.InMemoryExporter) []string {
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+	}
+	return names
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Verifier modes selected by VERIFIER_MODE
+const (
+	verifierModeRemote = "remote" // Rust verifier service at VERIFIER_URL
+	verifierModeLocal  = "local"  // In-process EIP-712 recovery
+	verifierModeDual   = "dual"   // Remote decides, local runs alongside and mismatches are logged
+)
+
+// PaymentVerifier checks a signed payment context. An invalid signature or
+// timestamp is reported in the response (IsValid false, Error starting with
+// its E0xx code when it has one); errors are reserved for failures to verify.
+type PaymentVerifier interface {
+	// Mode is the VERIFIER_MODE that selects this verifier
+	Mode() string
+	Verify(ctx context.Context, req VerifyRequest) (*VerifyResponse, error)
+}
+
+// paymentVerifier is the process-wide verifier, replaced by initPaymentVerifier
+var paymentVerifier PaymentVerifier = RemoteVerifier{}
+
+// getVerifierMode returns VERIFIER_MODE: "remote" (default), "local" or "dual"
+func getVerifierMode() string {
+	return strings.ToLower(getEnv("VERIFIER_MODE", verifierModeRemote))
+}
+
+// initPaymentVerifier selects the verifier from VERIFIER_MODE
+func initPaymentVerifier() error {
+	switch mode := getVerifierMode(); mode {
+	case verifierModeRemote, "":
+		paymentVerifier = RemoteVerifier{}
+	case verifierModeLocal:
+		paymentVerifier = LocalVerifier{}
+	case verifierModeDual:
+		paymentVerifier = DualVerifier{Primary: RemoteVerifier{}, Shadow: LocalVerifier{}}
+	default:
+		return fmt.Errorf("unknown VERIFIER_MODE %q (expected remote, local or dual)", mode)
+	}
+	log.Printf("Payment verifier: %s", paymentVerifier.Mode())
+	return nil
+}
+
+// getVerifierURL returns VERIFIER_URL, defaulting to the local Rust service
+func getVerifierURL() string {
+	return getEnv("VERIFIER_URL", "http://127.0.0.1:3002")
+}
+
+// RemoteVerifier calls the Rust verifier service's /verify endpoint, bounded
+// by VERIFIER_TIMEOUT_SECONDS and guarded by the "verifier" circuit breaker
+// and bulkhead
+type RemoteVerifier struct{}
+
+func (RemoteVerifier) Mode() string { return verifierModeRemote }
+
+func (RemoteVerifier) Verify(ctx context.Context, req VerifyRequest) (*VerifyResponse, error) {
+	verifyBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal verification request: %w", err)
+	}
+
+	// Use a separate context for verifier timeout to avoid hanging
+	verifierCtx, verifierCancel := context.WithTimeout(ctx, getVerifierTimeout())
+	defer verifierCancel()
+
+	vreq, err := http.NewRequestWithContext(verifierCtx, "POST", getVerifierURL()+"/verify", bytes.NewBuffer(verifyBody))
+	if err != nil {
+		return nil, fmt.Errorf("create verifier request: %w", err)
+	}
+	vreq.Header.Set("Content-Type", "application/json")
+
+	// Pass the correlation ID to the verifier service
+	if cid, ok := ctx.Value(correlationIDKey).(string); ok {
+		vreq.Header.Set("X-Correlation-ID", cid)
+	}
+	injectTraceContext(verifierCtx, vreq.Header)
+
+	var verifyResp *VerifyResponse
+	err = verifierGuard().run(func() error {
+		start := time.Now()
+		var err error
+		verifyResp, err = doVerifierRequest(vreq)
+		verifierRequestDuration.WithLabelValues(upstreamOutcome(err)).Observe(time.Since(start).Seconds())
+		return err
+	}, func(error) callOutcome {
+		if ctx.Err() != nil {
+			// The caller's deadline or cancellation, not the verifier's fault
+			return callIgnored
+		}
+		return callFailed
+	})
+	return verifyResp, err
+}
+
+// doVerifierRequest sends vreq to the verifier and decodes its response
+func doVerifierRequest(vreq *http.Request) (*VerifyResponse, error) {
+	// Rely on the request context for timeouts/cancellation
+	resp, err := verifierHTTPClient.Do(vreq)
+	if err != nil {
+		return nil, fmt.Errorf("verifier request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("verifier returned status %d", resp.StatusCode)
+	}
+
+	var verifyResp VerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&verifyResp); err != nil {
+		return nil, fmt.Errorf("decode verification response: %w", err)
+	}
+	return &verifyResp, nil
+}
+
+// EIP-712 type strings of the payment context, as signed by clients and
+// checked by the Rust verifier
+const (
+	eip712DomainType = "EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"
+	paymentType      = "Payment(address recipient,string token,string amount,string nonce,uint256 timestamp)"
+)
+
+// EIP-712 domain of the payment context
+const (
+	paymentDomainName    = "MicroAI Paygate"
+	paymentDomainVersion = "1"
+)
+
+var (
+	eip712DomainTypeHash = crypto.Keccak256([]byte(eip712DomainType))
+	paymentTypeHash      = crypto.Keccak256([]byte(paymentType))
+)
+
+// LocalVerifier recovers the signer in-process with the same EIP-712 typed
+// data and timestamp rules as the Rust verifier, without a network hop
+type LocalVerifier struct{}
+
+func (LocalVerifier) Mode() string { return verifierModeLocal }
+
+func (LocalVerifier) Verify(ctx context.Context, req VerifyRequest) (*VerifyResponse, error) {
+	if msg := validateSignatureTimestamp(req.Context.Timestamp, uint64(time.Now().Unix())); msg != "" {
+		return &VerifyResponse{IsValid: false, Error: msg}, nil
+	}
+
+	digest, err := paymentTypedDataHash(req.Context)
+	if err != nil {
+		return nil, fmt.Errorf("typed data error: %w", err)
+	}
+	sig, err := decodeSignature(req.Signature)
+	if err != nil {
+		return &VerifyResponse{IsValid: false, Error: "bad signature: " + err.Error()}, nil
+	}
+	pub, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return &VerifyResponse{IsValid: false, Error: err.Error()}, nil
+	}
+	// Lowercase like the Rust verifier, so payers match across modes
+	return &VerifyResponse{IsValid: true, RecoveredAddress: strings.ToLower(crypto.PubkeyToAddress(*pub).Hex())}, nil
+}
+
+// validateSignatureTimestamp applies the verifier's timestamp rules: a
+// signature is valid for SIGNATURE_EXPIRY_SECONDS (default 300) and may be
+// up to SIGNATURE_CLOCK_SKEW_SECONDS (default 60) in the future. It returns
+// the E007/E008/E009 error, or "" if the timestamp is acceptable.
+func validateSignatureTimestamp(timestamp, now uint64) string {
+	window := uint64(getEnvAsInt("SIGNATURE_EXPIRY_SECONDS", 300))
+	skew := uint64(getEnvAsInt("SIGNATURE_CLOCK_SKEW_SECONDS", 60))
+
+	if timestamp == 0 {
+		return "E009: missing timestamp"
+	}
+	if timestamp > now+skew {
+		return fmt.Sprintf("E008: future ts=%d now=%d", timestamp, now)
+	}
+	if now > timestamp && now-timestamp > window {
+		return fmt.Sprintf("E007: expired (age=%d max=%d)", now-timestamp, window)
+	}
+	return ""
+}
+
+// paymentTypedDataHash returns the EIP-712 digest
+// keccak256("\x19\x01" || domainSeparator || hashStruct(Payment))
+func paymentTypedDataHash(ctx PaymentContext) ([]byte, error) {
+	if !common.IsHexAddress(ctx.Recipient) {
+		return nil, fmt.Errorf("invalid recipient address %q", ctx.Recipient)
+	}
+	if ctx.ChainID < 0 {
+		return nil, fmt.Errorf("invalid chain ID %d", ctx.ChainID)
+	}
+
+	domainSeparator := eip712DomainSeparator(paymentDomainName, paymentDomainVersion, big.NewInt(int64(ctx.ChainID)), common.Address{})
+	structHash := crypto.Keccak256(
+		paymentTypeHash,
+		common.LeftPadBytes(common.HexToAddress(ctx.Recipient).Bytes(), 32),
+		crypto.Keccak256([]byte(ctx.Token)),
+		crypto.Keccak256([]byte(ctx.Amount)),
+		crypto.Keccak256([]byte(ctx.Nonce)),
+		encodeUint256(new(big.Int).SetUint64(ctx.Timestamp)),
+	)
+	return crypto.Keccak256([]byte("\x19\x01"), domainSeparator, structHash), nil
+}
+
+// eip712DomainSeparator returns hashStruct(EIP712Domain) for the given domain
+func eip712DomainSeparator(name, version string, chainID *big.Int, verifyingContract common.Address) []byte {
+	return crypto.Keccak256(
+		eip712DomainTypeHash,
+		crypto.Keccak256([]byte(name)),
+		crypto.Keccak256([]byte(version)),
+		encodeUint256(chainID),
+		common.LeftPadBytes(verifyingContract.Bytes(), 32),
+	)
+}
+
+func encodeUint256(n *big.Int) []byte {
+	return common.LeftPadBytes(n.Bytes(), 32)
+}
+
+// decodeSignature parses a 65-byte r||s||v hex signature, with or without
+// 0x, into the [R || S || V] form with V in {0, 1} expected by SigToPub
+func decodeSignature(signature string) ([]byte, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(signature, "0x"), "0X"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return nil, fmt.Errorf("expected %d bytes, got %d", crypto.SignatureLength, len(sig))
+	}
+	switch v := sig[crypto.RecoveryIDOffset]; v {
+	case 0, 1:
+	case 27, 28:
+		sig[crypto.RecoveryIDOffset] = v - 27
+	default:
+		return nil, fmt.Errorf("invalid recovery id %d", v)
+	}
+	return sig, nil
+}
+
+// DualVerifier returns the primary verifier's result and checks the same
+// request with the shadow verifier, logging any disagreement. It is meant
+// for comparing the local verifier against the remote one before switching.
+type DualVerifier struct {
+	Primary PaymentVerifier
+	Shadow  PaymentVerifier
+}
+
+func (DualVerifier) Mode() string { return verifierModeDual }
+
+func (d DualVerifier) Verify(ctx context.Context, req VerifyRequest) (*VerifyResponse, error) {
+	primary, err := d.Primary.Verify(ctx, req)
+	if err != nil {
+		// Nothing to compare against; the caller reports the failure
+		return nil, err
+	}
+	shadow, shadowErr := d.Shadow.Verify(ctx, req)
+	if shadowErr != nil {
+		verifierMismatchesTotal.Inc()
+		log.Printf("Verifier mismatch for nonce %s: %s returned %s, %s failed: %v",
+			req.Context.Nonce, d.Primary.Mode(), describeVerification(primary), d.Shadow.Mode(), shadowErr)
+	} else if !sameVerification(primary, shadow) {
+		verifierMismatchesTotal.Inc()
+		log.Printf("Verifier mismatch for nonce %s: %s returned %s, %s returned %s",
+			req.Context.Nonce, d.Primary.Mode(), describeVerification(primary), d.Shadow.Mode(), describeVerification(shadow))
+	}
+	return primary, nil
+}
+
+// sameVerification compares two results by validity, recovered address and
+// error code. Error messages are not compared: they carry the check time and
+// recovery errors are worded differently by each implementation.
+func sameVerification(a, b *VerifyResponse) bool {
+	if a.IsValid != b.IsValid {
+		return false
+	}
+	if a.IsValid {
+		return strings.EqualFold(a.RecoveredAddress, b.RecoveredAddress)
+	}
+	return verificationOutcome(a, nil) == verificationOutcome(b, nil)
+}
+
+func describeVerification(resp *VerifyResponse) string {
+	if resp.IsValid {
+		return "valid " + resp.RecoveredAddress
+	}
+	return fmt.Sprintf("invalid (%s)", resp.Error)
+}
@@ -460,6 +460,66 @@ mod tests {
         assert!(resp.is_valid);
     }
 
+    #[test]
+    fn test_recover_fixed_vectors() {
+        // Shared with the gateway's LocalVerifier tests, so both verifiers
+        // recover the same signer from the same payment context
+        let vectors = [
+            (
+                8453u64,
+                "0x2cAF48b4BA1C58721a85dFADa5aC01C2DFa62219",
+                "0.001",
+                "9c311e31-0000-4000-8000-000000000000",
+                1767695400u64,
+                "0xd885d964374a8a39c21498a56984ecda64fb4496305c30b0626a03e023ff698d521d6b300d0fbd3452a5194b1598059f46b490ebe0a466684d762a337c10bf631b",
+            ),
+            (
+                1u64,
+                "0x1234567890123456789012345678901234567890",
+                "100",
+                "nonce-1",
+                1700000000u64,
+                "0xad11be19821402c4771df619ff150ddb52f0600ea97b943932a8c1683e5c4d4f74b2e200d51199a24d23ec8f40de285be3842c372fa88613273574534abe51da1c",
+            ),
+        ];
+
+        for (chain_id, recipient, amount, nonce, timestamp, signature) in vectors {
+            let typed = serde_json::json!({
+                "domain": {
+                    "name": "MicroAI Paygate",
+                    "version": "1",
+                    "chainId": chain_id,
+                    "verifyingContract": "0x0000000000000000000000000000000000000000"
+                },
+                "types": {
+                    "Payment": [
+                        { "name": "recipient", "type": "address" },
+                        { "name": "token", "type": "string" },
+                        { "name": "amount", "type": "string" },
+                        { "name": "nonce", "type": "string" },
+                        { "name": "timestamp", "type": "uint256" }
+                    ]
+                },
+                "primaryType": "Payment",
+                "message": {
+                    "recipient": recipient,
+                    "token": "USDC",
+                    "amount": amount,
+                    "nonce": nonce,
+                    "timestamp": timestamp
+                }
+            });
+
+            let typed: TypedData = serde_json::from_value(typed).unwrap();
+            let sig = Signature::from_str(signature).unwrap();
+            let addr = sig.recover_typed_data(&typed).unwrap();
+            assert_eq!(
+                format!("{:?}", addr),
+                "0x3cdb3d9e1b74692bb1e3bb5fc81938151ca64b02"
+            );
+        }
+    }
+
     #[tokio::test]
     async fn test_health_endpoint() {
         let (_headers, Json(response)) = health(HeaderMap::new()).await;
@@ -2,7 +2,9 @@
  * Receipt Verification Library for MicroAI-Paygate
  * 
  * Verifies cryptographic receipts using ECDSA signatures and Keccak256 hashing.
- * Compatible with Ethereum wallet signatures.
+ * Compatible with Ethereum wallet signatures. Version 1.0 receipts sign the
+ * Keccak256 of the receipt JSON; version 2.0 receipts sign EIP-712 typed data;
+ * version 3.0 receipts sign the Keccak256 of the RFC 8785 canonical JSON.
  * 
  * @module verify-receipt
  */
@@ -18,12 +20,16 @@ export interface PaymentDetails {
   token: string;
   chainId: number;
   nonce: string;
+  /** "signature", "prepaid" or "refund" (omitted by older gateways) */
+  funding?: string;
 }
 
 export interface ServiceDetails {
   endpoint: string;
   request_hash: string;
   response_hash: string;
+  /** Model that produced the response (omitted by older gateways) */
+  model?: string;
 }
 
 export interface Receipt {
@@ -38,12 +44,92 @@ export interface SignedReceipt {
   receipt: Receipt;
   signature: string;
   server_public_key: string;
+  kid?: string;
+}
+
+/** EIP-712 domain and type of version 2.0 receipts (see gateway/receipt_typed.go) */
+export const RECEIPT_DOMAIN_NAME = 'MicroAI Paygate Receipt';
+export const RECEIPT_DOMAIN_VERSION = '2';
+
+export const RECEIPT_TYPES = {
+  Receipt: [
+    { name: 'id', type: 'string' },
+    { name: 'timestamp', type: 'uint256' },
+    { name: 'payer', type: 'address' },
+    { name: 'recipient', type: 'address' },
+    { name: 'amount', type: 'string' },
+    { name: 'token', type: 'string' },
+    { name: 'chainId', type: 'uint256' },
+    { name: 'nonce', type: 'string' },
+    { name: 'funding', type: 'string' },
+    { name: 'endpoint', type: 'string' },
+    { name: 'requestHash', type: 'bytes32' },
+    { name: 'responseHash', type: 'bytes32' },
+    { name: 'model', type: 'string' },
+  ],
+};
+
+/**
+ * Serializes a JSON value in RFC 8785 (JCS) canonical form: JSON.stringify
+ * already formats numbers and escapes strings as JCS requires, so only
+ * object members need sorting (by UTF-16 code units, JavaScript's default).
+ * Test vectors: gateway/testdata/jcs.
+ */
+export function canonicalize(value: unknown): string {
+  if (Array.isArray(value)) {
+    return '[' + value.map((item) => canonicalize(item)).join(',') + ']';
+  }
+  if (value !== null && typeof value === 'object') {
+    const entries = Object.entries(value as Record<string, unknown>)
+      .filter(([, v]) => v !== undefined)
+      .sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0));
+    return '{' + entries.map(([k, v]) => JSON.stringify(k) + ':' + canonicalize(v)).join(',') + '}';
+  }
+  return JSON.stringify(value);
+}
+
+/**
+ * Returns the hash a receipt's signature covers, according to its version
+ *
+ * @param receipt - The receipt
+ * @param verifyingContract - The gateway's RECEIPT_VERIFYING_CONTRACT (v2 only)
+ */
+export function receiptDigest(receipt: Receipt, verifyingContract: string = ethers.ZeroAddress): string {
+  if (receipt.version === '3.0') {
+    return ethers.keccak256(ethers.toUtf8Bytes(canonicalize(receipt)));
+  }
+  if (receipt.version !== '2.0') {
+    // Serialize receipt deterministically (same as Go's json.Marshal)
+    return ethers.keccak256(ethers.toUtf8Bytes(JSON.stringify(receipt)));
+  }
+  const domain = {
+    name: RECEIPT_DOMAIN_NAME,
+    version: RECEIPT_DOMAIN_VERSION,
+    chainId: receipt.payment.chainId,
+    verifyingContract,
+  };
+  return ethers.TypedDataEncoder.hash(domain, RECEIPT_TYPES, {
+    id: receipt.id,
+    timestamp: Math.floor(Date.parse(receipt.timestamp) / 1000),
+    payer: receipt.payment.payer,
+    recipient: receipt.payment.recipient,
+    amount: receipt.payment.amount,
+    token: receipt.payment.token,
+    chainId: receipt.payment.chainId,
+    nonce: receipt.payment.nonce,
+    funding: receipt.payment.funding ?? '',
+    endpoint: receipt.service.endpoint,
+    requestHash: '0x' + receipt.service.request_hash.replace(/^sha256:/, ''),
+    responseHash: '0x' + receipt.service.response_hash.replace(/^sha256:/, ''),
+    model: receipt.service.model ?? '',
+  });
 }
 
 /**
  * Verifies a cryptographic receipt signature
  * 
  * @param signedReceipt - The signed receipt from the API response
+ * @param verifyingContract - The gateway's RECEIPT_VERIFYING_CONTRACT, for version 2.0 receipts
  * @returns Promise<boolean> - true if signature is valid
  * 
  * @example
@@ -54,7 +140,10 @@ export interface SignedReceipt {
  * console.log(`Receipt valid: ${isValid}`);
  * ```
  */
-export async function verifyReceipt(signedReceipt: SignedReceipt): Promise<boolean> {
+export async function verifyReceipt(
+  signedReceipt: SignedReceipt,
+  verifyingContract: string = ethers.ZeroAddress
+): Promise<boolean> {
   try {
     // Validate structure
     if (!signedReceipt?.receipt || !signedReceipt.signature || !signedReceipt.server_public_key) {
@@ -62,11 +151,8 @@ export async function verifyReceipt(signedReceipt: SignedReceipt): Promise<boole
       return false;
     }
 
-    // Serialize receipt deterministically (same as Go's json.Marshal)
-    const receiptJSON = JSON.stringify(signedReceipt.receipt);
-    
-    // Hash using Keccak256 (Ethereum-compatible) - same as Go's crypto.Keccak256Hash
-    const messageHash = ethers.keccak256(ethers.toUtf8Bytes(receiptJSON));
+    // Hash using Keccak256 (Ethereum-compatible) - same as the gateway's receiptDigest
+    const messageHash = receiptDigest(signedReceipt.receipt, verifyingContract);
 
     // Convert signature from hex string to bytes
     const sigBytes = ethers.getBytes(signedReceipt.signature);
@@ -79,11 +165,11 @@ export async function verifyReceipt(signedReceipt: SignedReceipt): Promise<boole
     }
 
     // Recover the public key from the signature
-    // Go uses v=0/1, but ethers expects v=27/28, so we add 27
+    // v1 receipts use v=0/1, but ethers expects v=27/28, so we add 27
     const signature = ethers.Signature.from({
       r: ethers.hexlify(sigBytes.slice(0, 32)),
       s: ethers.hexlify(sigBytes.slice(32, 64)),
-      v: sigBytes[64] + 27
+      v: sigBytes[64] < 27 ? sigBytes[64] + 27 : sigBytes[64]
     });
 
     const recoveredPubKey = ethers.SigningKey.recoverPublicKey(messageHash, signature);
@@ -153,6 +239,7 @@ export async function fetchReceipt(
       receipt: data.receipt,
       signature: data.signature,
       server_public_key: data.server_public_key,
+      kid: data.kid,
     };
   } catch (error) {
     console.error('Error fetching receipt:', error);